@@ -2,44 +2,252 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/flipb/sftp-server/internal/srv"
 )
 
 var (
-	userName string
+	auditLog *srv.AuditLogger // also records events, if set
+	logger   *srv.Logger
+)
+
+// options are the flags which aren't settings of the server.
+type options struct {
+	config   string
+	hash     bool
+	generate bool
+	user     srv.UserConfig // given by -user, -plaintextPassword and -passwordHash
+}
 
-	userPassPlaintext         string
-	userNameAndPasswordSha256 string
+// stringsFlag is a flag which may be given several times.
+type stringsFlag []string
 
-	endpoint    string
-	rootPath    string
-	hostKeyPath string
-)
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// listFlag is a comma separated list.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	*f = splitList(value)
+	return nil
+}
+
+// bindFlags defines the flags of fs setting c, with its settings as defaults, and opts.
+func bindFlags(fs *flag.FlagSet, c *srv.Config, opts *options) {
+	fs.StringVar(&opts.config, "config", "", "YAML configuration file (see README), overridden by the flags given")
+	fs.StringVar(&c.Root, "root", c.Root, "root directory or .tar/.zip archive (read-only) to serve over SFTP, mem:[size limit] to serve from memory or s3://bucket/prefix?endpoint=URL&region=REGION for S3-compatible storage")
+	fs.StringVar(&c.Listen, "endpoint", c.Listen, "endpoint to serve SFTP on (mutually exclusive with socket arg)")
+	fs.StringVar(&c.HostKey, "hostkey", c.HostKey, "PEM encoded privte and public keys to use for SFTP server (written to if not existing). If - PEM key is read from stdin.")
+	fs.StringVar(&c.Storage.EncryptionKey, "encryption-key", c.Storage.EncryptionKey, "file holding a 256 bit master key (raw or hex) to encrypt stored files with")
+	fs.BoolVar(&c.Storage.Compress, "compress", c.Storage.Compress, "store file contents compressed (existing uncompressed files are still served)")
+	fs.BoolVar(&c.Storage.Dedup, "dedup", c.Storage.Dedup, "store identical file contents only once")
+	fs.StringVar(&c.Storage.Quota, "quota", c.Storage.Quota, "limit the total size of the files stored by each user, counting every copy, eg. 10G (requires -dedup)")
+	fs.DurationVar(&c.Storage.TrashRetention, "trash-retention", c.Storage.TrashRetention, "keep deleted and replaced files in a hidden trash for this long (eg. 720h), restorable with the trash command")
+	fs.IntVar(&c.Storage.Versions, "versions", c.Storage.Versions, "keep this many previous versions of overwritten files, readable in .versions directories (0 for unlimited if -versions-max-age is set)")
+	fs.DurationVar(&c.Storage.VersionsMaxAge, "versions-max-age", c.Storage.VersionsMaxAge, "keep previous versions of overwritten files for this long (eg. 168h)")
+	fs.Var((*stringsFlag)(&c.Storage.Retention), "retention", "expire files by a rule such as path=/incoming,age=30d[,archive=/archive] or path=/outgoing,after=download (may be repeated)")
+	fs.BoolVar(&c.Storage.RetentionDryRun, "retention-dry-run", c.Storage.RetentionDryRun, "only log files which would expire by the -retention rules")
+	fs.DurationVar(&c.Storage.RetentionInterval, "retention-interval", c.Storage.RetentionInterval, "how often to look for files to expire by the -retention rules")
+	fs.BoolVar(&c.Policy.Enabled, "file-policy", c.Policy.Enabled, "refuse file names with control characters, reserved on Windows or ending with a dot or space (implied by the other policy flags)")
+	fs.Var((*listFlag)(&c.Policy.AllowExtensions), "allow-ext", "comma separated extensions (eg. .csv,.txt) of the only files users may upload")
+	fs.Var((*listFlag)(&c.Policy.DenyExtensions), "deny-ext", "comma separated extensions (eg. .exe,.bat) of files users may not upload")
+	fs.Var((*listFlag)(&c.Policy.AllowTypes), "allow-type", "comma separated types of the only contents users may upload: text, binary, exe, elf, macho, script, zip, gzip, bzip2, xz, 7z, rar, pdf, png, jpeg or gif")
+	fs.Var((*listFlag)(&c.Policy.DenyTypes), "deny-type", "comma separated types of contents users may not upload (see -allow-type)")
+	fs.IntVar(&c.Policy.MaxNameLength, "max-name-length", c.Policy.MaxNameLength, "maximum length of file names in bytes (default 255 with a file policy)")
+	fs.StringVar(&c.Limits.MaxFileSize, "max-file-size", c.Limits.MaxFileSize, "maximum size of uploaded files, eg. 100M")
+	fs.StringVar(&c.Limits.MaxSessionBytes, "max-session-bytes", c.Limits.MaxSessionBytes, "maximum bytes uploaded and downloaded in a session, eg. 1G")
+	fs.StringVar(&c.Limits.MaxDailyBytes, "max-daily-bytes", c.Limits.MaxDailyBytes, "maximum bytes uploaded and downloaded by the user in a day, eg. 10G")
+	fs.DurationVar(&c.Timeouts.MaxDuration, "max-session-duration", c.Timeouts.MaxDuration, "time after which sessions are closed, eg. 8h")
+	fs.DurationVar(&c.Timeouts.Idle, "session-idle-timeout", c.Timeouts.Idle, "time without SFTP packets from the client after which sessions are closed, eg. 15m")
+	fs.DurationVar(&c.HandshakeTimeout, "handshake-timeout", c.HandshakeTimeout, "time clients may take to log in")
+	fs.IntVar(&c.Connections.Max, "max-connections", c.Connections.Max, "maximum connections open")
+	fs.IntVar(&c.Connections.MaxPerIP, "max-connections-per-ip", c.Connections.MaxPerIP, "maximum connections open from a remote IP")
+	fs.IntVar(&c.Connections.MaxSessionsPerUser, "max-sessions-per-user", c.Connections.MaxSessionsPerUser, "maximum sessions open by a user")
+	fs.IntVar(&c.Connections.RatePerIP, "connection-rate-per-ip", c.Connections.RatePerIP, "maximum new connections a minute from a remote IP")
+	fs.StringVar(&c.Storage.Clamd, "clamd", c.Storage.Clamd, "scan uploads with clamd at unix:/path/to/clamd.ctl or tcp:host:port before they appear")
+	fs.DurationVar(&c.Storage.ClamdTimeout, "clamd-timeout", c.Storage.ClamdTimeout, "maximum time to scan an upload with clamd")
+	fs.StringVar(&c.Storage.Quarantine, "quarantine", c.Storage.Quarantine, "local directory to move infected uploads to (with -clamd)")
+	fs.BoolVar(&c.Storage.VerifyChecksums, "verify-checksums", c.Storage.VerifyChecksums, "verify uploads against sidecar files (eg. file.csv.sha256, .sha512 or .md5 in the format of sha256sum)")
+	fs.StringVar(&c.Storage.VerifiedDir, "verified-dir", c.Storage.VerifiedDir, "directory to move verified files and their sidecar files to, relative to their directory unless absolute")
+	fs.StringVar(&c.Storage.FailedDir, "failed-dir", c.Storage.FailedDir, "directory to move files failing verification and their sidecar files to, relative to their directory unless absolute")
+	fs.StringVar(&c.Storage.Inbox, "inbox", c.Storage.Inbox, "directory users upload files to be processed to, marked processed with the inbox command")
+	fs.StringVar(&c.Logging.AuditLog, "audit-log", c.Logging.AuditLog, "write an audit log of sessions and operations as JSON lines to a file, - for stdout or syslog[:tag]")
+	fs.StringVar(&c.Logging.Level, "log-level", c.Logging.Level, "level of messages logged: debug, info, warn or error")
+	fs.StringVar(&c.Logging.Format, "log-format", c.Logging.Format, "format of messages logged: text or json")
+	fs.StringVar(&c.Metrics.Listen, "metrics-listen", c.Metrics.Listen, "address (eg. 127.0.0.1:9100) to serve Prometheus metrics on at /metrics")
+	fs.StringVar(&c.Admin.Listen, "admin-listen", c.Admin.Listen, "unix:/path/to/socket or loopback address (eg. 127.0.0.1:9101, requires -admin-token) to serve the admin API on")
+	fs.StringVar(&c.Admin.TokenFile, "admin-token", c.Admin.TokenFile, "file holding the bearer token required by the admin API")
+	fs.StringVar(&opts.user.Name, "user", "root", "name of SFTP user (unless users are configured by -config)")
+	fs.StringVar(&opts.user.Password, "plaintextPassword", "", "plaintext password of SFTP user (discouraged)")
+	fs.StringVar(&opts.user.PasswordHash, "passwordHash", "", "user name and password hashed with sha256 encoded as hex")
+	fs.BoolVar(&opts.hash, "hash", false, "return hashed username and password (for use with -passwordHash) and exit.")
+	fs.BoolVar(&opts.generate, "generate", false, "generate SSH host key and write to stdout and exit.")
+	fs.BoolVar(&c.ExitWhenIdle, "exit", c.ExitWhenIdle, "exit when idle")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "time without connections, including since started, to exit after with -exit")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "time transfers in progress may take to finish on SIGTERM or SIGINT")
+	fs.BoolVar(&c.SystemdSocket, "socket", c.SystemdSocket, "serve systemd socket (mutually exclusive with endpoint arg)")
+}
+
+// parseFlags returns the configuration of the -config file overridden by the
+// flags given in args, and the other options. The flags are parsed twice: to
+// find the file, and then over its settings.
+func parseFlags(name string, args []string) (*srv.Config, *options, error) {
+	var opts options
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	bindFlags(fs, srv.DefaultConfig(), &opts)
+	_ = fs.Parse(args)
+	if opts.hash || opts.generate {
+		return nil, &opts, nil
+	}
+
+	c := srv.DefaultConfig()
+	if opts.config != "" {
+		var err error
+		if c, err = srv.LoadConfig(opts.config); err != nil {
+			return nil, nil, err
+		}
+	}
+	opts = options{}
+	fs = flag.NewFlagSet(name, flag.ExitOnError)
+	bindFlags(fs, c, &opts)
+	_ = fs.Parse(args)
+
+	userFlags := false
+	fs.Visit(func(f *flag.Flag) {
+		userFlags = userFlags || f.Name == "user" || f.Name == "plaintextPassword" || f.Name == "passwordHash"
+	})
+	switch {
+	case opts.config == "":
+		c.Users = []srv.UserConfig{opts.user}
+	case userFlags:
+		return nil, nil, fmt.Errorf("-user, -plaintextPassword and -passwordHash can't be combined with -config")
+	}
+	if err := c.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return c, &opts, nil
+}
+
+// reloader reloads the users, policy, limits and timeouts of the -config file
+// (as overridden by the flags in args) into s.
+type reloader struct {
+	s       *srv.Server
+	storage *storage
+	args    []string
+
+	started *srv.Config // settings other than the users are kept from start
+
+	mu sync.Mutex // serializes reloading
+}
+
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, _, err := parseFlags(os.Args[0], r.args)
+	if err != nil {
+		return err
+	}
+	users, err := c.ServerUsers()
+	if err != nil {
+		return err
+	}
+	if c.NeedsRestart(r.started) {
+		logger.Warn("settings other than users, policy, limits and timeouts take effect when restarted")
+	}
+	r.s.SetUsers(users)
+	r.storage.prune(users)
+	closed := 0
+	if c.DisconnectRemovedUsers {
+		closed = r.s.CloseRemovedSessions()
+	}
+	logger.Info("reloaded users", "users", len(users), "closed_sessions", closed)
+	return nil
+}
+
+// reloadOnHangup reloads with r when receiving SIGHUP.
+func reloadOnHangup(r *reloader) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := r.reload(); err != nil {
+			logger.Error("error reloading configuration", "err", err)
+		}
+	}
+}
+
+// shutdownOnSignal shuts s down on SIGTERM or SIGINT, letting transfers in
+// progress finish until timeout or another signal. It closes stopping when
+// signaled and done when shut down.
+func shutdownOnSignal(s *srv.Server, timeout time.Duration, stopping, done chan<- struct{}) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	logger.Info("shutting down", "signal", <-sig, "timeout", timeout)
+	close(stopping)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		<-sig
+		cancel()
+	}()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Warn("closed connections with transfers in progress", "err", err)
+	}
+	close(done)
+}
 
 func main() {
-	flag.StringVar(&rootPath, "root", "./sftproot", "root directory to serve over SFTP")
-	flag.StringVar(&endpoint, "endpoint", "", "endpoint to serve SFTP on (mutually exclusive with socket arg)")
-	flag.StringVar(&hostKeyPath, "hostkey", "./cert.pem", "PEM encoded privte and public keys to use for SFTP server (written to if not existing). If - PEM key is read from stdin.")
-	flag.StringVar(&userName, "user", "root", "name of SFTP user")
-	flag.StringVar(&userPassPlaintext, "plaintextPassword", "", "plaintext password of SFTP user (discouraged)")
-	flag.StringVar(&userNameAndPasswordSha256, "passwordHash", "", "user name and password hashed with sha256 encoded as hex")
-	justHash := flag.Bool("hash", false, "return hashed username and password (for use with -passwordHash) and exit.")
-	justGenerate := flag.Bool("generate", false, "generate SSH host key and write to stdout and exit.")
-	idleExit := flag.Bool("exit", false, "exit when idle")
-	systemdSocket := flag.Bool("socket", false, "serve systemd socket (mutually exclusive with endpoint arg)")
-
-	flag.Parse()
-
-	if *justGenerate {
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		decryptMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "trash" {
+		trashMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "inbox" {
+		inboxMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		checkConfigMain(os.Args[2:])
+		return
+	}
+
+	c, opts, err := parseFlags(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if opts.generate {
 		priv, pub, err := srv.GenerateSSHKeysAsPEM()
 		if err != nil {
 			log.Fatalf("error generating SSH keys: %v", err)
@@ -48,64 +256,559 @@ func main() {
 		_, _ = io.Copy(os.Stdout, bytes.NewReader(pub))
 		os.Exit(0)
 	}
-
-	if len(userName) < 4 || len(userName) > 32 {
-		log.Fatalf("user name %q too long or short", userName)
+	if opts.hash {
+		hash := plaintextToHash(opts.user.Name, opts.user.Password)
+		if opts.user.PasswordHash != "" {
+			hashBytes, err := hex.DecodeString(opts.user.PasswordHash)
+			if err != nil {
+				log.Fatalf("error decoding hash as hexa decimal string: %v", err)
+			}
+			hash = string(hashBytes)
+		}
+		fmt.Printf("%0x\n", hash)
+		os.Exit(0)
 	}
-	if userPassPlaintext == "" && userNameAndPasswordSha256 == "" {
-		log.Fatalf("user password required")
+
+	level, _ := srv.ParseLevel(c.Logging.Level)
+	logger = srv.NewLogger(os.Stderr, level, c.Logging.Format == "json")
+
+	users, err := c.ServerUsers()
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
-	if userNameAndPasswordSha256 != "" {
-		hashBytes, err := hex.DecodeString(userNameAndPasswordSha256)
+	if c.Logging.AuditLog != "" {
+		// real paths are recorded when serving a directory
+		root := ""
+		if info, err := os.Stat(c.Root); err == nil && info.IsDir() {
+			root = c.Root
+		}
+		var err error
+		auditLog, err = srv.OpenAuditLog(c.Logging.AuditLog, root)
 		if err != nil {
-			log.Fatalf("error decoding hash as hexa decimal string: %v", err)
+			log.Fatalf("%v", err)
 		}
-		userNameAndPasswordSha256 = string(hashBytes)
 	}
-	if userNameAndPasswordSha256 == "" && len(userPassPlaintext) > 0 {
-		userNameAndPasswordSha256 = plaintextToHash(userName, userPassPlaintext)
+
+	s := c.Storage
+	backend, err := srv.OpenBackend(c.Root)
+	if err != nil {
+		log.Fatalf("unable to open root %q: %v", c.Root, err)
 	}
-	if *justHash {
-		fmt.Printf("%0x\n", userNameAndPasswordSha256)
-		os.Exit(0)
+	if s.EncryptionKey != "" {
+		key, err := srv.LoadKeyFile(s.EncryptionKey)
+		if err != nil {
+			log.Fatalf("error loading encryption key: %v", err)
+		}
+		backend, err = srv.NewCryptBackend(backend, key)
+		if err != nil {
+			log.Fatalf("error enabling encryption: %v", err)
+		}
 	}
-
-	var idleCb func(*srv.Server)
-	if *idleExit {
-		idleCb = stopIfIdle
+	if s.Compress {
+		// compressed before encrypted, as ciphertext doesn't compress
+		backend = srv.NewCompressBackend(backend)
 	}
-
-	if len(endpoint) == 0 && !*systemdSocket {
-		log.Fatalf("no socket or endpoint specified")
-		os.Exit(1)
+	var dedup *srv.Dedup
+	if s.Dedup {
+		var quotaBytes int64
+		if s.Quota != "" {
+			quotaBytes, _ = srv.ParseSize(s.Quota)
+		}
+		dedup, err = srv.NewDedup(backend, quotaBytes)
+		if err != nil {
+			log.Fatalf("error enabling deduplication: %v", err)
+		}
 	}
-	if len(endpoint) > 0 && *systemdSocket {
-		log.Fatalf("both socket or endpoint specified")
-		os.Exit(1)
+	st := &storage{conf: s, base: backend, dedup: dedup}
+	for _, u := range users {
+		// built before serving to report errors and start the upkeep of each user
+		if _, err := st.user(u); err != nil {
+			log.Fatalf("%v", err)
+		}
 	}
 
-	sftpSrv, err := srv.NewServer(rootPath, hostKeyPath, userName, userNameAndPasswordSha256, idleCb)
+	sftpSrv, err := srv.NewServerWithBackend(backend, c.HostKey, c.Users[0].Name, "", nil)
 	if err != nil {
 		log.Fatalf("unable to initalize server: %v", err)
 	}
+	sftpSrv.SetUsers(users)
+	sftpSrv.SetUserStorage(st.user)
+	sftpSrv.SetHandshakeTimeout(c.HandshakeTimeout)
+	sftpSrv.SetConnectionLimits(c.Connections.ConnectionLimits())
+	if c.ExitWhenIdle {
+		sftpSrv.SetIdleTimeout(c.IdleTimeout)
+	}
+	var reload func() error
+	if opts.config != "" {
+		r := &reloader{s: sftpSrv, storage: st, args: os.Args[1:], started: c}
+		reload = r.reload
+		go reloadOnHangup(r)
+	}
+	sftpSrv.SetEventHandler(logEvent)
+	sftpSrv.SetAuditLog(auditLog)
+	sftpSrv.SetLogger(logger)
+	if dedup != nil {
+		sftpSrv.SetQuota(dedup)
+	}
+	if c.Metrics.Listen != "" {
+		metrics := srv.NewMetrics()
+		sftpSrv.SetMetrics(metrics)
+		go serveMetrics(c.Metrics.Listen, metrics)
+	}
+	if c.Admin.Listen != "" {
+		var token string
+		if c.Admin.TokenFile != "" {
+			data, err := ioutil.ReadFile(c.Admin.TokenFile)
+			if err != nil {
+				log.Fatalf("error reading admin token: %v", err)
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		api := srv.NewAdminAPI(sftpSrv, token, reload)
+		go func() {
+			logger.Info("serving admin API", "addr", c.Admin.Listen)
+			if err := api.ListenAndServe(c.Admin.Listen); err != nil {
+				log.Fatalf("error serving admin API: %v", err)
+			}
+		}()
+	}
+
+	stopping, stopped := make(chan struct{}), make(chan struct{})
+	go shutdownOnSignal(sftpSrv, c.ShutdownTimeout, stopping, stopped)
 
-	if *systemdSocket {
-		if err := sftpSrv.ServeSystemdSocket(); err != nil {
+	if c.SystemdSocket {
+		if err := sftpSrv.ServeSystemdSocket(); err != nil && err != srv.ErrServerClosed {
 			log.Fatalf("error serving systemd socket: %v", err)
 		}
 	} else {
-		if err := sftpSrv.Serve(endpoint); err != nil {
-			log.Fatalf("error serving endpoint %q: %v", endpoint, err)
+		if err := sftpSrv.Serve(c.Listen); err != nil && err != srv.ErrServerClosed {
+			log.Fatalf("error serving endpoint %q: %v", c.Listen, err)
+		}
+	}
+
+	select {
+	case <-stopping:
+		<-stopped
+	default: // stopped when idle
+	}
+	st.close()
+	logger.Info("stopped")
+}
+
+// storage builds the backends serving each user over the backend the users share.
+type storage struct {
+	conf  srv.StorageConfig
+	base  srv.Backend // encrypting and compressing, if enabled
+	dedup *srv.Dedup  // nil if disabled
+
+	mu    sync.Mutex
+	users map[string]*userStorage // by storageKey
+}
+
+// userStorage is the storage of a user, kept up until stop is called.
+type userStorage struct {
+	*srv.UserStorage
+	stop context.CancelFunc
+}
+
+func storageKey(u srv.User) string {
+	return u.Name + "\x00" + u.Home
+}
+
+// user returns the storage of u, built when first needed.
+func (s *storage) user(u srv.User) (*srv.UserStorage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := storageKey(u)
+	if us, ok := s.users[key]; ok {
+		return us.UserStorage, nil
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	us, err := s.build(ctx, u)
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("error opening storage of %s: %w", u.Name, err)
+	}
+	if s.users == nil {
+		s.users = map[string]*userStorage{}
+	}
+	s.users[key] = &userStorage{UserStorage: us, stop: stop}
+	return us, nil
+}
+
+// prune stops the upkeep of the storage of users no longer in users, or with
+// another home, dropping it.
+func (s *storage) prune(users []srv.User) {
+	keep := map[string]bool{}
+	for _, u := range users {
+		keep[storageKey(u)] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, us := range s.users {
+		if !keep[key] {
+			us.stop()
+			delete(s.users, key)
+		}
+	}
+}
+
+// close stops the upkeep of the storage of every user.
+func (s *storage) close() {
+	s.prune(nil)
+}
+
+// build returns the backends serving the home of u, starting their upkeep
+// until ctx is done.
+func (s *storage) build(ctx context.Context, u srv.User) (*srv.UserStorage, error) {
+	c := s.conf
+	onEvent := func(e srv.Event) {
+		e.Home = u.Home
+		logEvent(e)
+	}
+	us := &srv.UserStorage{}
+	backend := s.base
+	if s.dedup != nil {
+		backend = s.dedup.Backend(u.Name)
+	}
+	backend, err := srv.NewSubBackend(backend, u.Home)
+	if err != nil {
+		return nil, err
+	}
+	home := backend
+	if c.Clamd != "" {
+		// scanned below the trash and versions, which keep only scanned files
+		scanner, _ := srv.ParseClamdAddress(c.Clamd)
+		scanner.Timeout = c.ClamdTimeout
+		backend, err = srv.NewScanBackend(backend, scanner, c.Quarantine, u.Name, onEvent)
+		if err != nil {
+			return nil, fmt.Errorf("error enabling scanning: %w", err)
+		}
+	}
+	if c.TrashRetention > 0 {
+		us.Trash = srv.NewTrash(backend, c.TrashRetention)
+		backend = us.Trash.Backend(u.Name)
+		go purgeTrash(ctx, us.Trash, c.TrashRetention)
+	}
+	if c.Versions > 0 || c.VersionsMaxAge > 0 {
+		backend = srv.NewVersionBackend(backend, c.Versions, c.VersionsMaxAge)
+	}
+	if c.Inbox != "" {
+		us.Inbox = srv.NewInbox(backend, c.Inbox)
+		backend, err = us.Inbox.Backend(u.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error enabling inbox: %w", err)
+		}
+	}
+	if len(c.Retention) > 0 {
+		rules := []srv.RetentionRule{}
+		for _, spec := range c.Retention {
+			rule, _ := srv.ParseRetentionRule(spec)
+			rules = append(rules, rule)
+		}
+		sweeper := srv.NewRetentionSweeper(backend, u.Name, rules, c.RetentionDryRun, onEvent)
+		// downloads kept below the trash and versions, which would keep every change
+		if err := sweeper.SetStore(home); err != nil {
+			return nil, err
+		}
+		backend = sweeper.Backend()
+		go sweep(ctx, sweeper, c.RetentionInterval)
+	}
+	if c.VerifyChecksums {
+		backend = srv.NewChecksumBackend(backend, c.VerifiedDir, c.FailedDir, u.Name, onEvent)
+	}
+	us.Backend = backend
+	return us, nil
+}
+
+// checkConfigMain validates the configuration given by -config and the flags,
+// printing it with the passwords redacted.
+func checkConfigMain(args []string) {
+	c, _, err := parseFlags("check-config", args)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	data, err := c.Redacted().YAML()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	os.Stdout.Write(data)
+}
+
+// decryptMain decrypts files stored with -encryption-key, for offline processing.
+func decryptMain(args []string) {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyPath := flags.String("key", "", "file holding the master key used to encrypt the file")
+	outPath := flags.String("out", "-", "file to write the decrypted contents to, - for stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s decrypt -key master.key [-out file] encrypted-file\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if *keyPath == "" || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	key, err := srv.LoadKeyFile(*keyPath)
+	if err != nil {
+		log.Fatalf("error loading key: %v", err)
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("error opening file: %v", err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		log.Fatalf("error opening file: %v", err)
+	}
+
+	out := os.Stdout
+	if *outPath != "-" {
+		out, err = os.OpenFile(*outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			log.Fatalf("error creating output file: %v", err)
+		}
+	}
+	err = srv.DecryptFile(out, in, info.Size(), key)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		if *outPath != "-" {
+			os.Remove(*outPath)
 		}
+		log.Fatalf("error decrypting %q: %v", flags.Arg(0), err)
 	}
+}
 
-	return
+// purgeTrash periodically removes files kept in trash for longer than retention,
+// until ctx is done.
+func purgeTrash(ctx context.Context, trash *srv.Trash, retention time.Duration) {
+	interval := time.Hour
+	if retention < interval {
+		interval = retention
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := trash.Purge(time.Now())
+		if err != nil {
+			logger.Error("error purging trash", "err", err)
+		}
+		if n > 0 {
+			logger.Info("purged trash", "items", n)
+		}
+	}
 }
 
-func stopIfIdle(s *srv.Server) {
-	<-time.After(10 * time.Second)
-	if s.NumConns() == 0 {
-		s.Close()
+// splitList returns the elements of a comma separated list.
+func splitList(s string) []string {
+	list := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// sweep periodically expires files by the retention rules of sweeper, until
+// ctx is done.
+func sweep(ctx context.Context, sweeper *srv.RetentionSweeper, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := sweeper.Sweep(time.Now()); err != nil {
+			logger.Error("error expiring files", "err", err)
+		}
+	}
+}
+
+// serveMetrics serves metrics over HTTP on addr.
+func serveMetrics(addr string, metrics *srv.Metrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	logger.Info("serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("error serving metrics", "addr", addr, "err", err)
+	}
+}
+
+func logEvent(e srv.Event) {
+	auditLog.LogEvent(e)
+	kv := []interface{}{"type", e.Type, "user", e.User, "path", e.Path}
+	if e.Detail != "" {
+		kv = append(kv, "detail", e.Detail)
+	}
+	if e.Target != "" {
+		kv = append(kv, "target", e.Target)
+	}
+	if e.DryRun {
+		kv = append(kv, "dry_run", true)
+	}
+	if e.Err != nil {
+		logger.Warn("event failed", append(kv, "err", e.Err)...)
+		return
+	}
+	logger.Info("event", kv...)
+}
+
+// adminClient sends requests to the admin API of a running server.
+type adminClient struct {
+	url    string // of the API, without trailing slash
+	token  string
+	client *http.Client
+}
+
+// newAdminClient returns a client of the admin API served on addr, as given
+// by admin.listen, sending the token read from tokenFile unless empty.
+func newAdminClient(addr, tokenFile string) (*adminClient, error) {
+	c := &adminClient{url: "http://" + addr, client: &http.Client{Timeout: time.Minute}}
+	if strings.HasPrefix(addr, "unix:") {
+		socket := strings.TrimPrefix(addr, "unix:")
+		c.url = "http://admin"
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+	}
+	if tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading admin token: %w", err)
+		}
+		c.token = strings.TrimSpace(string(data))
+	}
+	return c, nil
+}
+
+// do sends a request of method to the path p, decoding the JSON reply into v unless nil.
+func (c *adminClient) do(method, p string, v interface{}) error {
+	req, err := http.NewRequest(method, c.url+p, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling admin API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// trashMain lists and restores, through the admin API of the running server,
+// files deleted while serving with -trash-retention.
+func trashMain(args []string) {
+	flags := flag.NewFlagSet("trash", flag.ExitOnError)
+	admin := flags.String("admin", "unix:/run/sftp-server/admin.sock", "address the admin API is served on")
+	tokenFile := flags.String("token-file", "", "file holding the admin API token")
+	user := flags.String("user", "root", "name of user who deleted the files")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s trash [-admin addr] [-token-file file] [-user name] list | restore ID...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, err := newAdminClient(*admin, *tokenFile)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	userPath := "/trash/" + url.PathEscape(*user)
+
+	switch flags.Arg(0) {
+	case "list":
+		var items []srv.TrashItem
+		if err := client.do(http.MethodGet, userPath, &items); err != nil {
+			log.Fatalf("error listing trash: %v", err)
+		}
+		for _, item := range items {
+			kind := "file"
+			if item.IsDir {
+				kind = "dir"
+			}
+			fmt.Printf("%s\t%s\t%s\t%d\t%s\n", item.ID, item.Deleted.Local().Format(time.RFC3339), kind, item.Size, item.Path)
+		}
+	case "restore":
+		for _, id := range flags.Args()[1:] {
+			if err := client.do(http.MethodPost, userPath+"/"+url.PathEscape(id), nil); err != nil {
+				log.Fatalf("error restoring %q: %v", id, err)
+			}
+		}
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// inboxMain lists and marks processed, through the admin API of the running
+// server, the files uploaded to the -inbox directory.
+func inboxMain(args []string) {
+	flags := flag.NewFlagSet("inbox", flag.ExitOnError)
+	admin := flags.String("admin", "unix:/run/sftp-server/admin.sock", "address the admin API is served on")
+	tokenFile := flags.String("token-file", "", "file holding the admin API token")
+	user := flags.String("user", "root", "name of user who uploaded the files")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s inbox [-admin addr] [-token-file file] [-user name] list | process PATH...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, err := newAdminClient(*admin, *tokenFile)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	userPath := "/inbox/" + url.PathEscape(*user)
+
+	switch flags.Arg(0) {
+	case "list":
+		var items []srv.InboxItem
+		if err := client.do(http.MethodGet, userPath, &items); err != nil {
+			log.Fatalf("error listing inbox: %v", err)
+		}
+		for _, item := range items {
+			fmt.Printf("%s\t%s\t%d\t%s\n", item.State(), item.Time.Local().Format(time.RFC3339), item.Size, item.Path)
+		}
+	case "process":
+		for _, p := range flags.Args()[1:] {
+			if err := client.do(http.MethodPost, userPath+"/"+(&url.URL{Path: p}).EscapedPath(), nil); err != nil {
+				log.Fatalf("error processing %q: %v", p, err)
+			}
+		}
+	default:
+		flags.Usage()
+		os.Exit(2)
 	}
 }
 
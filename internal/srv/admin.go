@@ -0,0 +1,199 @@
+package srv
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AdminAPI serves the admin API of a Server over HTTP:
+//
+//	GET    /sessions             active sessions
+//	DELETE /sessions/<id>        terminates a session
+//	GET    /quota                storage used by the users
+//	GET    /trash/<user>         files deleted by a user
+//	POST   /trash/<user>/<id>    restores a deleted file
+//	GET    /inbox/<user>         files of the inbox of a user
+//	POST   /inbox/<user>/<path>  marks a file of the inbox processed
+//	POST   /reload               reloads the users
+type AdminAPI struct {
+	server *Server
+	token  string
+	reload func() error
+}
+
+// NewAdminAPI returns the admin API of server, requiring requests to carry
+// the bearer token unless empty. Reloading calls reload, unsupported if nil.
+func NewAdminAPI(server *Server, token string, reload func() error) *AdminAPI {
+	return &AdminAPI{server: server, token: token, reload: reload}
+}
+
+// ListenAndServe serves the API on addr, a unix socket given as unix:/path or
+// a loopback host:port, which requires a token.
+func (a *AdminAPI) ListenAndServe(addr string) error {
+	var listener net.Listener
+	if strings.HasPrefix(addr, "unix:") {
+		p := strings.TrimPrefix(addr, "unix:")
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing stale admin socket: %w", err)
+		}
+		var err error
+		if listener, err = net.Listen("unix", p); err != nil {
+			return fmt.Errorf("error listening for admin API: %w", err)
+		}
+		if err := os.Chmod(p, 0600); err != nil {
+			listener.Close()
+			return fmt.Errorf("error restricting admin socket: %w", err)
+		}
+	} else {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid admin address %q: %w", addr, err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("admin address %q is not a loopback address", addr)
+		}
+		if a.token == "" {
+			return errors.New("admin API over TCP requires a token")
+		}
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			return fmt.Errorf("error listening for admin API: %w", err)
+		}
+	}
+	return http.Serve(listener, a)
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	switch {
+	case r.URL.Path == "/sessions":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, a.server.Sessions())
+	case strings.HasPrefix(r.URL.Path, "/sessions/"):
+		if !allowMethod(w, r, http.MethodDelete) {
+			return
+		}
+		if err := a.server.CloseSession(strings.TrimPrefix(r.URL.Path, "/sessions/")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/quota":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, a.server.QuotaUsage())
+	case strings.HasPrefix(r.URL.Path, "/trash/"):
+		user, id := splitAdminPath(strings.TrimPrefix(r.URL.Path, "/trash/"))
+		if id == "" {
+			if !allowMethod(w, r, http.MethodGet) {
+				return
+			}
+			items, err := a.server.TrashItems(user)
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			writeJSON(w, items)
+			return
+		}
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		if err := a.server.RestoreTrash(user, id); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(r.URL.Path, "/inbox/"):
+		user, p := splitAdminPath(strings.TrimPrefix(r.URL.Path, "/inbox/"))
+		if p == "" {
+			if !allowMethod(w, r, http.MethodGet) {
+				return
+			}
+			items, err := a.server.InboxItems(user)
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			writeJSON(w, items)
+			return
+		}
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		if err := a.server.ProcessInbox(user, p); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/reload":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		if a.reload == nil {
+			http.Error(w, "reloading is not supported", http.StatusNotImplemented)
+			return
+		}
+		if err := a.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// splitAdminPath splits p into the user and the item it names, if any.
+func splitAdminPath(p string) (user, item string) {
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// errorStatus returns the HTTP status reporting err.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, os.ErrExist):
+		return http.StatusConflict
+	case errors.Is(err, os.ErrInvalid):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// allowMethod replies with an error unless r is a request of method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,157 @@
+package srv
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSSHConn is the ssh.Conn of a session, recording if closed.
+type fakeSSHConn struct {
+	ssh.Conn
+	user   string
+	id     []byte
+	closed bool
+}
+
+func (c *fakeSSHConn) User() string      { return c.user }
+func (c *fakeSSHConn) SessionID() []byte { return c.id }
+func (c *fakeSSHConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50312}
+}
+func (c *fakeSSHConn) Close() error { c.closed = true; return nil }
+
+func TestAdminAPI(t *testing.T) {
+	dedup, err := NewDedup(NewMemBackend(0), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := dedup.Backend("u")
+	writeMemFile(t, backend, "/a", "hello")
+	s := &Server{conf: config{Owner: "u", Users: map[string]User{"u": {Name: "u"}}}}
+	s.SetQuota(dedup)
+	trash := NewTrash(NewMemBackend(0), time.Hour)
+	trashed := trash.Backend("u")
+	writeMemFile(t, trashed, "/old", "deleted")
+	if err := trashed.Remove("/old"); err != nil {
+		t.Fatal(err)
+	}
+	items, err := trash.List("u")
+	if err != nil || len(items) != 1 {
+		t.Fatalf("List() = %v, %v, want 1 item", items, err)
+	}
+	inbox := NewInbox(NewMemBackend(0), "/incoming")
+	inboxed, err := inbox.Backend("u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inboxed.Mkdir("/incoming/2020", 0770); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, inboxed, "/incoming/2020/orders.csv", "1")
+	s.SetUserStorage(func(u User) (*UserStorage, error) {
+		return &UserStorage{Backend: trashed, Trash: trash, Inbox: inbox}, nil
+	})
+	conn := &fakeSSHConn{user: "u", id: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}}
+	sess, err := s.openSession(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.add(42)
+	reloaded := 0
+	api := NewAdminAPI(s, "secret", func() error { reloaded++; return nil })
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"no token", "GET", "/sessions", "", http.StatusUnauthorized},
+		{"wrong token", "GET", "/sessions", "guess", http.StatusUnauthorized},
+		{"sessions", "GET", "/sessions", "secret", http.StatusOK},
+		{"quota", "GET", "/quota", "secret", http.StatusOK},
+		{"reload", "POST", "/reload", "secret", http.StatusNoContent},
+		{"reload by GET", "GET", "/reload", "secret", http.StatusMethodNotAllowed},
+		{"unknown session", "DELETE", "/sessions/0000000000000000", "secret", http.StatusNotFound},
+		{"close session", "DELETE", "/sessions/0102030405060708", "secret", http.StatusNoContent},
+		{"trash", "GET", "/trash/u", "secret", http.StatusOK},
+		{"trash of unknown user", "GET", "/trash/nobody", "secret", http.StatusNotFound},
+		{"restore unknown item", "POST", "/trash/u/20000101T000000.000000000Z", "secret", http.StatusNotFound},
+		{"restore", "POST", "/trash/u/" + items[0].ID, "secret", http.StatusNoContent},
+		{"restore again", "POST", "/trash/u/" + items[0].ID, "secret", http.StatusNotFound},
+		{"inbox", "GET", "/inbox/u", "secret", http.StatusOK},
+		{"process outside inbox", "POST", "/inbox/u//outgoing/orders.csv", "secret", http.StatusBadRequest},
+		{"process", "POST", "/inbox/u/2020/orders.csv", "secret", http.StatusNoContent},
+		{"process again", "POST", "/inbox/u/2020/orders.csv", "secret", http.StatusNotFound},
+		{"unknown path", "GET", "/users", "secret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s = %d %s, want %d", tt.method, tt.path, rec.Code, rec.Body, tt.want)
+			}
+
+			switch tt.name {
+			case "sessions":
+				var sessions []SessionInfo
+				if err := json.Unmarshal(rec.Body.Bytes(), &sessions); err != nil {
+					t.Fatal(err)
+				}
+				if len(sessions) != 1 || sessions[0].ID != "0102030405060708" || sessions[0].User != "u" ||
+					sessions[0].RemoteAddr != "10.0.0.2:50312" || sessions[0].Bytes != 42 || sessions[0].Start.IsZero() {
+					t.Errorf("sessions = %s", rec.Body)
+				}
+			case "close session":
+				if err := sess.cutBy(); !conn.closed || err == nil || err.Error() != "closed by admin" {
+					t.Errorf("session closed = %v, reason %v, want closed by admin", conn.closed, err)
+				}
+			case "trash":
+				var got []TrashItem
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != 1 || got[0].ID != items[0].ID || got[0].Path != "/old" {
+					t.Errorf("trash = %s, want /old", rec.Body)
+				}
+			case "inbox":
+				var got []InboxItem
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != 1 || got[0].Path != "2020/orders.csv" || got[0].Processed {
+					t.Errorf("inbox = %s, want 2020/orders.csv pending", rec.Body)
+				}
+			case "quota":
+				var quotas []UserQuota
+				if err := json.Unmarshal(rec.Body.Bytes(), &quotas); err != nil {
+					t.Fatal(err)
+				}
+				if want := (UserQuota{User: "u", Used: 5, Limit: 1000}); len(quotas) != 1 || quotas[0] != want {
+					t.Errorf("quota = %s, want %+v", rec.Body, want)
+				}
+			}
+		})
+	}
+	if reloaded != 1 {
+		t.Errorf("reloaded %d times, want 1", reloaded)
+	}
+	if got := readMemFile(t, trashed, "/old"); got != "deleted" {
+		t.Errorf("restored %q, want deleted", got)
+	}
+	if !conn.closed {
+		t.Error("session not closed")
+	}
+}
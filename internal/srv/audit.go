@@ -0,0 +1,254 @@
+package srv
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Audit record types
+const (
+	AuditSessionOpen  = "session_open"
+	AuditSessionClose = "session_close"
+	AuditAuth         = "auth"
+	AuditOpen         = "open"
+	AuditRead         = "read"  // the reads of an open file, recorded when closed
+	AuditWrite        = "write" // the writes to an open file, recorded when closed
+	AuditClose        = "close"
+	AuditList         = "list"
+)
+
+// AuditRecord is a line of the audit log.
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"` // one of the Audit constants, or the lower case SFTP command
+	User       string    `json:"user"`
+	Session    string    `json:"session"`
+	RemoteAddr string    `json:"remote_addr"`
+	Path       string    `json:"path,omitempty"`
+	Home       string    `json:"-"` // directory of the root Path is in, for RealPath
+	RealPath   string    `json:"real_path,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// AuditLogger writes AuditRecords as lines of JSON.
+type AuditLogger struct {
+	realPath func(string) (string, error)
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAuditLogger returns an AuditLogger writing to w. Paths are recorded
+// with their real path below root, unless root is empty.
+func NewAuditLogger(w io.Writer, root string) *AuditLogger {
+	a := &AuditLogger{w: w}
+	if root != "" {
+		a.realPath = rootSanitizer(root)
+	}
+	return a
+}
+
+// OpenAuditLog returns an AuditLogger writing to dest: "-" for stdout,
+// "syslog" or "syslog:tag" for the local syslog, otherwise a file appended to.
+func OpenAuditLog(dest, root string) (*AuditLogger, error) {
+	switch {
+	case dest == "-":
+		return NewAuditLogger(os.Stdout, root), nil
+	case dest == "syslog" || strings.HasPrefix(dest, "syslog:"):
+		tag := strings.TrimPrefix(strings.TrimPrefix(dest, "syslog"), ":")
+		if tag == "" {
+			tag = "sftp-server"
+		}
+		w, err := openSyslog(tag)
+		if err != nil {
+			return nil, fmt.Errorf("error opening syslog: %w", err)
+		}
+		return NewAuditLogger(w, root), nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %w", err)
+	}
+	return NewAuditLogger(f, root), nil
+}
+
+// Log writes rec, filling in its time and real path.
+func (a *AuditLogger) Log(rec AuditRecord) {
+	if a == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	if rec.Path != "" && a.realPath != nil {
+		if real, err := a.realPath(path.Join("/", rec.Home, rec.Path)); err == nil {
+			rec.RealPath = real
+		}
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, _ = a.w.Write(append(line, '\n'))
+}
+
+// LogEvent writes the record of e.
+func (a *AuditLogger) LogEvent(e Event) {
+	a.Log(AuditRecord{Time: e.Time, Type: e.Type, User: e.User, Path: e.Path, Home: e.Home, Target: e.Target, Result: auditResult(e.Err), Error: errorString(e.Err)})
+}
+
+func errorString(err error) string {
+	if err == nil || err == io.EOF {
+		return ""
+	}
+	return err.Error()
+}
+
+// auditResult returns the result code of err, named after the SFTP status codes.
+func auditResult(err error) string {
+	var errno syscall.Errno
+	var timeout interface{ Timeout() bool }
+	switch {
+	case err == nil || err == io.EOF:
+		return "ok"
+	case errors.As(err, &timeout) && timeout.Timeout():
+		return "timeout"
+	case os.IsNotExist(err):
+		return "no_such_file"
+	case os.IsPermission(err):
+		return "permission_denied"
+	case errors.As(err, &errno) && errno == syscall.ENOSPC:
+		return "no_space"
+	case errors.Is(err, os.ErrInvalid):
+		return "bad_message"
+	}
+	return "failure"
+}
+
+// sessionAudit records the operations of an SSH session.
+type sessionAudit struct {
+	log        *AuditLogger
+	user       string
+	home       string
+	session    string
+	remoteAddr string
+	start      time.Time
+}
+
+// sessionID returns the ID of the SSH session with the id given by the ssh package.
+func sessionID(id []byte) string {
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return hex.EncodeToString(id)
+}
+
+// record logs an operation which took since start.
+func (s *sessionAudit) record(typ, p, target string, bytes int64, start time.Time, err error) {
+	if s == nil {
+		return
+	}
+	rec := AuditRecord{
+		Type:       typ,
+		User:       s.user,
+		Session:    s.session,
+		RemoteAddr: s.remoteAddr,
+		Path:       p,
+		Home:       s.home,
+		Target:     target,
+		Bytes:      bytes,
+		Result:     auditResult(err),
+		Error:      errorString(err),
+	}
+	if !start.IsZero() {
+		rec.DurationMs = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	}
+	s.log.Log(rec)
+}
+
+// auditFile is an open file counting its reads and writes in the session and metrics,
+// and recording them in the audit log when closed.
+type auditFile struct {
+	read    int64 // first for alignment of atomic operations
+	written int64
+	File
+	audit       *sessionAudit
+	metrics     *Metrics
+	transferred *userMetrics
+	session     *session
+	name        string
+	opened      time.Time
+
+	mu       sync.Mutex // guards the errors
+	readErr  error
+	writeErr error
+}
+
+func (f *auditFile) TransferError(err error) {
+	transferError(f.File, err)
+}
+
+func (f *auditFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	atomic.AddInt64(&f.read, int64(n))
+	f.transferred.add(int64(n), 0)
+	f.session.add(int64(n))
+	if err != nil && err != io.EOF {
+		f.mu.Lock()
+		f.readErr = err
+		f.mu.Unlock()
+	}
+	return n, err
+}
+
+func (f *auditFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	atomic.AddInt64(&f.written, int64(n))
+	f.transferred.add(0, int64(n))
+	f.session.add(int64(n))
+	if err != nil {
+		f.mu.Lock()
+		f.writeErr = err
+		f.mu.Unlock()
+	}
+	return n, err
+}
+
+func (f *auditFile) Close() error {
+	err := f.File.Close()
+	f.session.closed()
+	read, written := atomic.LoadInt64(&f.read), atomic.LoadInt64(&f.written)
+	f.mu.Lock()
+	readErr, writeErr := f.readErr, f.writeErr
+	f.mu.Unlock()
+	f.metrics.transferFailed(readErr)
+	f.metrics.transferFailed(writeErr)
+	f.metrics.transferFailed(err)
+	if f.audit == nil {
+		return err
+	}
+	if read > 0 || readErr != nil {
+		f.audit.record(AuditRead, f.name, "", read, f.opened, readErr)
+	}
+	if written > 0 || writeErr != nil {
+		f.audit.record(AuditWrite, f.name, "", written, f.opened, writeErr)
+	}
+	f.audit.record(AuditClose, f.name, "", 0, f.opened, err)
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package srv
+
+import (
+	"errors"
+	"io"
+)
+
+func openSyslog(tag string) (io.Writer, error) {
+	return nil, errors.New("syslog not supported on this platform")
+}
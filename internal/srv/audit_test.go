@@ -0,0 +1,77 @@
+package srv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestUserRootHandler_Audit(t *testing.T) {
+	var buf bytes.Buffer
+	ur := newUserHandler(NewMemBackend(0), nil)
+	ur.logger = nil
+	ur.audit = &sessionAudit{log: NewAuditLogger(&buf, "/srv/sftp"), user: "u", session: "0123", remoteAddr: "127.0.0.1:5000"}
+
+	put := sftp.NewRequest("Put", "/report.csv")
+	put.Flags = fxfWrite | fxfCreat | fxfTrunc
+	w, err := ur.Filewrite(put)
+	if err != nil {
+		t.Fatalf("Filewrite() error = %v", err)
+	}
+	if _, err := w.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	w.(io.Closer).Close()
+	ur.Filecmd(&sftp.Request{Method: "Rename", Filepath: "/report.csv", Target: "/done.csv"})
+	ur.Filecmd(sftp.NewRequest("Remove", "/missing"))
+
+	want := []AuditRecord{
+		{Type: AuditOpen, Path: "/report.csv", RealPath: "/srv/sftp/report.csv", Result: "ok"},
+		{Type: AuditWrite, Path: "/report.csv", Bytes: 5, Result: "ok"},
+		{Type: AuditClose, Path: "/report.csv", Result: "ok"},
+		{Type: "rename", Path: "/report.csv", Target: "/done.csv", Result: "ok"},
+		{Type: "remove", Path: "/missing", Result: "no_such_file"},
+	}
+	scanner := bufio.NewScanner(&buf)
+	i := 0
+	for ; scanner.Scan(); i++ {
+		var got AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if i >= len(want) {
+			t.Fatalf("unexpected record %s", scanner.Text())
+		}
+		if got.Type != want[i].Type || got.Path != want[i].Path || got.Target != want[i].Target ||
+			got.Bytes != want[i].Bytes || got.Result != want[i].Result ||
+			(want[i].RealPath != "" && got.RealPath != want[i].RealPath) {
+			t.Errorf("record %d = %s, want %+v", i, scanner.Text(), want[i])
+		}
+		if got.User != "u" || got.Session != "0123" || got.RemoteAddr != "127.0.0.1:5000" || got.Time.IsZero() {
+			t.Errorf("record %d = %s, want user, session, address and time", i, scanner.Text())
+		}
+	}
+	if i != len(want) {
+		t.Errorf("got %d records, want %d", i, len(want))
+	}
+}
+
+func TestAuditFile_TransferError(t *testing.T) {
+	inner := &transferErrorBackend{Backend: NewMemBackend(0)}
+	ur := newUserHandler(inner, nil)
+	ur.logger = nil
+	ur.audit = &sessionAudit{log: NewAuditLogger(ioutil.Discard, ""), user: "u", session: "0123", remoteAddr: "127.0.0.1:5000"}
+	put := sftp.NewRequest("Put", "/report.csv")
+	put.Flags = fxfWrite | fxfCreat | fxfTrunc
+	w, err := ur.Filewrite(put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.(io.Closer).Close()
+	checkTransferError(t, w, inner)
+}
@@ -0,0 +1,277 @@
+package srv
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// checksumAlgorithms are the extensions of sidecar files, and their digests.
+var checksumAlgorithms = []struct {
+	ext     string
+	newHash func() hash.Hash
+}{
+	{".sha256", sha256.New},
+	{".sha512", sha512.New},
+	{".md5", md5.New},
+}
+
+// checksumBackend verifies files against the digest in a sidecar file (eg.
+// file.csv.sha256 for file.csv) once both are written, and moves the pair to
+// the verified or failed directory, otherwise delegating to the wrapped Backend.
+type checksumBackend struct {
+	Backend
+	verifiedDir string
+	failedDir   string
+	user        string
+	onEvent     func(Event)
+
+	mu      sync.Mutex
+	writing map[string]int // number of times files are open for writing or being verified
+}
+
+// NewChecksumBackend returns a Backend verifying the files written to backend by user
+// against sidecar files. Verified pairs are moved to verifiedDir and others to failedDir,
+// which are relative to the directory of the pair unless absolute, and every result is
+// reported to onEvent.
+func NewChecksumBackend(backend Backend, verifiedDir, failedDir, user string, onEvent func(Event)) Backend {
+	return &checksumBackend{
+		Backend:     backend,
+		verifiedDir: verifiedDir,
+		failedDir:   failedDir,
+		user:        user,
+		onEvent:     onEvent,
+		writing:     map[string]int{},
+	}
+}
+
+// pair returns the payload and sidecar files of p, and the digest of the sidecar.
+func pair(p string) (payload, sidecar string, newHash func() hash.Hash) {
+	for _, alg := range checksumAlgorithms {
+		if strings.HasSuffix(p, alg.ext) && len(path.Base(p)) > len(alg.ext) {
+			return strings.TrimSuffix(p, alg.ext), p, alg.newHash
+		}
+	}
+	return p, "", nil
+}
+
+// dir returns the directory d is for the pair in the directory of payload.
+func (b *checksumBackend) dir(payload, d string) string {
+	if path.IsAbs(d) {
+		return cleanPath(d)
+	}
+	return path.Join(path.Dir(payload), d)
+}
+
+// verify verifies the pair p is part of, if complete and neither is being written.
+// The pair is claimed as being written while verified, so that verifying it again
+// waits for the next write and the lock isn't held while hashing.
+func (b *checksumBackend) verify(p string) {
+	p = cleanPath(p)
+	payload, sidecar, newHash := pair(p)
+	if payload == p {
+		for _, alg := range checksumAlgorithms {
+			if info, err := b.Backend.Stat(p + alg.ext); err == nil && info.Mode().IsRegular() {
+				sidecar, newHash = p+alg.ext, alg.newHash
+				break
+			}
+		}
+		if sidecar == "" {
+			return
+		}
+	}
+	if path.Dir(payload) == b.dir(payload, b.verifiedDir) || path.Dir(payload) == b.dir(payload, b.failedDir) {
+		return
+	}
+
+	b.mu.Lock()
+	if b.writing[payload] > 0 || b.writing[sidecar] > 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.writing[payload]++
+	b.writing[sidecar]++
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.release(payload)
+		b.release(sidecar)
+		b.mu.Unlock()
+	}()
+
+	if info, err := b.Backend.Stat(payload); err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	event := Event{Type: EventVerified, User: b.user, Path: payload}
+	dir := b.dir(payload, b.verifiedDir)
+	if err := b.check(payload, sidecar, newHash); err != nil {
+		event.Type, event.Err = EventMismatch, err
+		dir = b.dir(payload, b.failedDir)
+	}
+	event.Target = path.Join(dir, path.Base(payload))
+	if err := b.move(dir, payload, sidecar); err != nil {
+		event.Err = fmt.Errorf("error moving to %s: %w", dir, err)
+		event.Target = ""
+	}
+	event.Time = time.Now()
+	if b.onEvent != nil {
+		b.onEvent(event)
+	}
+}
+
+// release releases a claim on p taken for writing, with b.mu held.
+func (b *checksumBackend) release(p string) {
+	if b.writing[p]--; b.writing[p] == 0 {
+		delete(b.writing, p)
+	}
+}
+
+// check returns an error unless the digest of payload matches the one in sidecar.
+func (b *checksumBackend) check(payload, sidecar string, newHash func() hash.Hash) error {
+	want, err := b.readDigest(sidecar, path.Base(payload))
+	if err != nil {
+		return err
+	}
+	h := newHash()
+	if len(want) != hex.EncodedLen(h.Size()) {
+		return fmt.Errorf("invalid digest %q in %s", want, path.Base(sidecar))
+	}
+
+	info, err := b.Backend.Stat(payload)
+	if err != nil {
+		return err
+	}
+	f, err := b.Backend.OpenFile(payload, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, info.Size())); err != nil {
+		return fmt.Errorf("error reading %s: %w", path.Base(payload), err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("digest %s doesn't match %s", got, want)
+	}
+	return nil
+}
+
+// readDigest returns the digest of name in the sidecar p, in the format of
+// sha256sum: lines of a hex digest, a space, a space or * and a file name.
+// A single digest applies whatever the name.
+func (b *checksumBackend) readDigest(p, name string) (string, error) {
+	info, err := b.Backend.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	f, err := b.Backend.OpenFile(p, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	digests := map[string]string{}
+	var last string
+	scanner := bufio.NewScanner(io.NewSectionReader(f, 0, info.Size()))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		digest := strings.ToLower(fields[0])
+		if _, err := hex.DecodeString(digest); err != nil {
+			return "", fmt.Errorf("invalid line in %s: %q", path.Base(p), line)
+		}
+		if len(fields) == 2 {
+			file := strings.TrimPrefix(strings.TrimPrefix(fields[1], " "), "*")
+			digests[path.Base(file)] = digest
+		}
+		last = digest
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("error reading %s: %w", path.Base(p), err)
+	}
+	if digest, ok := digests[name]; ok {
+		return digest, nil
+	}
+	if len(digests) <= 1 && last != "" {
+		return last, nil
+	}
+	return "", fmt.Errorf("no digest of %s in %s", name, path.Base(p))
+}
+
+// move moves the payload and sidecar files to dir, or neither.
+func (b *checksumBackend) move(dir, payload, sidecar string) error {
+	if err := mkdirAll(b.Backend, dir); err != nil {
+		return err
+	}
+	moved := path.Join(dir, path.Base(payload))
+	if err := b.Backend.Rename(payload, moved); err != nil {
+		return err
+	}
+	if err := b.Backend.Rename(sidecar, path.Join(dir, path.Base(sidecar))); err != nil {
+		if rerr := b.Backend.Rename(moved, payload); rerr != nil {
+			return fmt.Errorf("%v, and error moving %s back: %w", err, path.Base(payload), rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *checksumBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	f, err := b.Backend.OpenFile(p, flags, perm)
+	if err != nil || flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	b.mu.Lock()
+	b.writing[cleanPath(p)]++
+	b.mu.Unlock()
+	return &checksumFile{File: f, b: b, name: cleanPath(p)}, nil
+}
+
+// Rename verifies the pair of to, as clients may upload to a temporary name.
+func (b *checksumBackend) Rename(from, to string) error {
+	if err := b.Backend.Rename(from, to); err != nil {
+		return err
+	}
+	b.verify(to)
+	return nil
+}
+
+// checksumFile is a file open for writing, verifying its pair when closed.
+type checksumFile struct {
+	File
+	b      *checksumBackend
+	name   string
+	closed int32
+}
+
+func (f *checksumFile) TransferError(err error) {
+	transferError(f.File, err)
+}
+
+func (f *checksumFile) Close() error {
+	if !atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		return os.ErrClosed
+	}
+	err := f.File.Close()
+	f.b.mu.Lock()
+	f.b.release(f.name)
+	f.b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	f.b.verify(f.name)
+	return nil
+}
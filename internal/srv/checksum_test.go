@@ -0,0 +1,93 @@
+package srv
+
+import (
+	"os"
+	"testing"
+)
+
+func TestChecksumBackend(t *testing.T) {
+	const (
+		content = "id,amount\n1,42\n"
+		sha256  = "0f7573cb5487f607c74e1f891a1ded6a94a24d81b4c46f6ab92e1c65dd6f36d8"
+	)
+	tests := []struct {
+		name       string
+		dirs       []string
+		files      [][2]string // written in order
+		wantEvent  string
+		wantTarget string // "" if the pair isn't moved
+	}{
+		{
+			name:       "payload last",
+			files:      [][2]string{{"/in/file.csv.sha256", sha256 + "  file.csv\n"}, {"/in/file.csv", content}},
+			wantEvent:  EventVerified,
+			wantTarget: "/in/verified/file.csv",
+		},
+		{
+			name:       "sidecar last",
+			files:      [][2]string{{"/in/file.csv", content}, {"/in/file.csv.sha256", sha256 + " *other.csv\n"}},
+			wantEvent:  EventVerified,
+			wantTarget: "/in/verified/file.csv",
+		},
+		{
+			name:       "mismatch",
+			files:      [][2]string{{"/in/file.csv", content + "2,0\n"}, {"/in/file.csv.sha256", sha256 + "  file.csv\n"}},
+			wantEvent:  EventMismatch,
+			wantTarget: "/failed/file.csv",
+		},
+		{
+			name:       "wrong algorithm",
+			files:      [][2]string{{"/in/file.csv", content}, {"/in/file.csv.md5", sha256 + "  file.csv\n"}},
+			wantEvent:  EventMismatch,
+			wantTarget: "/failed/file.csv",
+		},
+		{
+			name:      "sidecar not moved",
+			dirs:      []string{"/in/verified", "/in/verified/file.csv.sha256"},
+			files:     [][2]string{{"/in/file.csv", content}, {"/in/file.csv.sha256", sha256 + "  file.csv\n"}},
+			wantEvent: EventVerified,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []Event
+			b := NewChecksumBackend(NewMemBackend(0), "verified", "/failed", "u", func(e Event) { events = append(events, e) })
+			for _, dir := range append([]string{"/in"}, tt.dirs...) {
+				if err := b.Mkdir(dir, 0770); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, file := range tt.files {
+				writeMemFile(t, b, file[0], file[1])
+			}
+			if len(events) != 1 || events[0].Type != tt.wantEvent || events[0].Target != tt.wantTarget {
+				t.Fatalf("events = %+v, want one %s event with target %s", events, tt.wantEvent, tt.wantTarget)
+			}
+			if tt.wantTarget == "" {
+				for _, file := range tt.files {
+					if got := readMemFile(t, b, file[0]); got != file[1] {
+						t.Errorf("read %s = %q, want %q left in place", file[0], got, file[1])
+					}
+				}
+				return
+			}
+			if _, err := b.Stat(tt.wantTarget); err != nil {
+				t.Errorf("Stat() of moved file error = %v", err)
+			}
+			if _, err := b.Stat(tt.files[0][0]); !os.IsNotExist(err) {
+				t.Errorf("Stat() of %s error = %v, want moved", tt.files[0][0], err)
+			}
+		})
+	}
+}
+
+func TestChecksumBackend_TransferError(t *testing.T) {
+	inner := &transferErrorBackend{Backend: NewMemBackend(0)}
+	b := NewChecksumBackend(inner, "verified", "failed", "u", nil)
+	f, err := b.OpenFile("/file.csv", os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	checkTransferError(t, f, inner)
+}
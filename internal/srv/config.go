@@ -0,0 +1,630 @@
+package srv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the server, read from a YAML file by LoadConfig.
+type Config struct {
+	Listen        string `yaml:"listen,omitempty"` // host:port to serve SFTP on
+	SystemdSocket bool   `yaml:"systemd_socket,omitempty"`
+	ExitWhenIdle  bool   `yaml:"exit_when_idle,omitempty"`
+
+	// IdleTimeout is how long the server runs without connections when ExitWhenIdle.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// ShutdownTimeout is how long transfers may take to finish when stopped.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// HandshakeTimeout is how long clients may take to log in.
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+
+	Connections ConnectionsConfig `yaml:"connections"`
+
+	// DisconnectRemovedUsers closes the sessions of users removed or disabled when reloaded.
+	DisconnectRemovedUsers bool `yaml:"disconnect_removed_users,omitempty"`
+
+	HostKey  string         `yaml:"host_key"` // PEM file, written to if missing, or - for stdin
+	Root     string         `yaml:"root"`     // see OpenBackend
+	Storage  StorageConfig  `yaml:"storage"`
+	Users    []UserConfig   `yaml:"users"`
+	Policy   PolicyConfig   `yaml:"policy"`   // of users without their own
+	Limits   LimitsConfig   `yaml:"limits"`   // of users without their own
+	Timeouts TimeoutsConfig `yaml:"timeouts"` // of users without their own
+	Logging  LoggingConfig  `yaml:"logging"`
+	Metrics  MetricsConfig  `yaml:"metrics"`
+	Admin    AdminConfig    `yaml:"admin"`
+}
+
+// StorageConfig configures the backends storing files.
+type StorageConfig struct {
+	EncryptionKey     string        `yaml:"encryption_key,omitempty"` // file holding the master key
+	Compress          bool          `yaml:"compress,omitempty"`
+	Dedup             bool          `yaml:"dedup,omitempty"`
+	Quota             string        `yaml:"quota,omitempty"` // size, eg. 10G
+	TrashRetention    time.Duration `yaml:"trash_retention,omitempty"`
+	Versions          int           `yaml:"versions,omitempty"`
+	VersionsMaxAge    time.Duration `yaml:"versions_max_age,omitempty"`
+	Retention         []string      `yaml:"retention,omitempty"` // see ParseRetentionRule
+	RetentionDryRun   bool          `yaml:"retention_dry_run,omitempty"`
+	RetentionInterval time.Duration `yaml:"retention_interval"`
+	Clamd             string        `yaml:"clamd,omitempty"` // see ParseClamdAddress
+	ClamdTimeout      time.Duration `yaml:"clamd_timeout"`
+	Quarantine        string        `yaml:"quarantine"`
+	VerifyChecksums   bool          `yaml:"verify_checksums,omitempty"`
+	VerifiedDir       string        `yaml:"verified_dir"`
+	FailedDir         string        `yaml:"failed_dir"`
+	Inbox             string        `yaml:"inbox,omitempty"`
+}
+
+// UserConfig configures a user, who logs in with a password or the hex encoded
+// sha256 hash of the user name followed by the password.
+type UserConfig struct {
+	Name         string          `yaml:"name"`
+	Password     string          `yaml:"password,omitempty"`
+	PasswordHash string          `yaml:"password_hash,omitempty"`
+	Disabled     bool            `yaml:"disabled,omitempty"`
+	ReadOnly     bool            `yaml:"read_only,omitempty"`
+	Home         string          `yaml:"home,omitempty"` // directory the user is confined to
+	Policy       *PolicyConfig   `yaml:"policy,omitempty"`
+	Limits       *LimitsConfig   `yaml:"limits,omitempty"`
+	Timeouts     *TimeoutsConfig `yaml:"timeouts,omitempty"`
+}
+
+// PolicyConfig configures the FilePolicy of users.
+type PolicyConfig struct {
+	Enabled         bool     `yaml:"enabled,omitempty"` // implied by the other settings
+	AllowExtensions []string `yaml:"allow_ext,omitempty"`
+	DenyExtensions  []string `yaml:"deny_ext,omitempty"`
+	AllowTypes      []string `yaml:"allow_type,omitempty"`
+	DenyTypes       []string `yaml:"deny_type,omitempty"`
+	MaxNameLength   int      `yaml:"max_name_length,omitempty"`
+}
+
+// LimitsConfig configures the TransferLimits of users, as sizes (eg. 100M).
+type LimitsConfig struct {
+	MaxFileSize     string `yaml:"max_file_size,omitempty"`
+	MaxSessionBytes string `yaml:"max_session_bytes,omitempty"`
+	MaxDailyBytes   string `yaml:"max_daily_bytes,omitempty"`
+}
+
+// ConnectionsConfig configures the ConnectionLimits of the server.
+type ConnectionsConfig struct {
+	Max                int `yaml:"max,omitempty"`
+	MaxPerIP           int `yaml:"max_per_ip,omitempty"`
+	MaxSessionsPerUser int `yaml:"max_sessions_per_user,omitempty"`
+	RatePerIP          int `yaml:"rate_per_ip,omitempty"` // new connections a minute
+}
+
+// TimeoutsConfig configures the SessionTimeouts of users.
+type TimeoutsConfig struct {
+	MaxDuration time.Duration `yaml:"max_duration,omitempty"`
+	Idle        time.Duration `yaml:"idle,omitempty"` // without SFTP packets
+}
+
+// LoggingConfig configures logging.
+type LoggingConfig struct {
+	Level    string `yaml:"level"`               // debug, info, warn or error
+	Format   string `yaml:"format"`              // text or json
+	AuditLog string `yaml:"audit_log,omitempty"` // see OpenAuditLog
+}
+
+// MetricsConfig configures serving metrics.
+type MetricsConfig struct {
+	Listen string `yaml:"listen,omitempty"`
+}
+
+// AdminConfig configures serving the admin API.
+type AdminConfig struct {
+	Listen    string `yaml:"listen,omitempty"`     // unix:/path or a loopback host:port
+	TokenFile string `yaml:"token_file,omitempty"` // file holding the bearer token
+}
+
+// DefaultConfig returns the settings not given in a configuration file.
+func DefaultConfig() *Config {
+	return &Config{
+		IdleTimeout:      10 * time.Second,
+		ShutdownTimeout:  30 * time.Second,
+		HandshakeTimeout: time.Minute,
+		HostKey:          "./cert.pem",
+		Root:             "./sftproot",
+		Storage: StorageConfig{
+			RetentionInterval: time.Hour,
+			ClamdTimeout:      time.Minute,
+			Quarantine:        "./quarantine",
+			VerifiedDir:       "verified",
+			FailedDir:         "failed",
+		},
+		Logging: LoggingConfig{Level: "info", Format: "text"},
+	}
+}
+
+// ConfigError is an invalid setting.
+type ConfigError struct {
+	Path string // of the setting, eg. users[0].name, if known
+	Line int    // of the setting in the file, 0 if unknown
+	Msg  string
+}
+
+func (e ConfigError) Error() string {
+	msg := e.Msg
+	if e.Path != "" {
+		msg = e.Path + ": " + msg
+	}
+	if e.Line > 0 {
+		msg = fmt.Sprintf("line %d: %s", e.Line, msg)
+	}
+	return msg
+}
+
+// ConfigErrors are the invalid settings of a Config.
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// LoadConfig reads and validates the configuration file p, returning a
+// ConfigErrors locating the invalid settings in the file if invalid.
+func LoadConfig(p string) (*Config, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %w", err)
+	}
+	c, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s:\n%w", p, err)
+	}
+	return c, nil
+}
+
+// ParseConfig parses and validates a configuration in YAML.
+func ParseConfig(data []byte) (*Config, error) {
+	c := DefaultConfig()
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			return nil, yamlErrors(typeErr.Errors)
+		}
+		return nil, yamlErrors([]string{strings.TrimPrefix(err.Error(), "yaml: ")})
+	}
+
+	err := c.Validate()
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		return c, err
+	}
+	var root yaml.Node
+	if yaml.Unmarshal(data, &root) == nil {
+		for i := range errs {
+			errs[i].Line = settingLine(&root, errs[i].Path)
+		}
+	}
+	return nil, errs
+}
+
+var yamlLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// yamlErrors returns the errors of the yaml package, eg. "line 3: field x not found in type srv.Config".
+func yamlErrors(msgs []string) ConfigErrors {
+	errs := make(ConfigErrors, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = ConfigError{Msg: msg}
+		if m := yamlLine.FindStringSubmatch(msg); m != nil {
+			errs[i].Line, _ = strconv.Atoi(m[1])
+			errs[i].Msg = strings.Replace(m[2], "srv.", "", -1)
+		}
+	}
+	return errs
+}
+
+// settingLine returns the line of the setting at path in the document root,
+// or of its closest parent present.
+func settingLine(root *yaml.Node, path string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+	for _, part := range strings.Split(path, ".") {
+		name, index := part, -1
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			name = part[:i]
+			index, _ = strconv.Atoi(strings.TrimSuffix(part[i+1:], "]"))
+		}
+		next := (*yaml.Node)(nil)
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == name {
+					next = node.Content[i+1]
+					line = node.Content[i].Line
+				}
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+		if index >= 0 {
+			if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+				return line
+			}
+			node = node.Content[index]
+			line = node.Line
+		}
+	}
+	return line
+}
+
+// validUserName reports whether name is safe to use as a path element and in
+// the URLs of the admin API.
+func validUserName(name string) bool {
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+		case (r == '.' || r == '-') && i > 0:
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Validate returns a ConfigErrors of the invalid settings, if any.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	fail := func(path, format string, a ...interface{}) {
+		errs = append(errs, ConfigError{Path: path, Msg: fmt.Sprintf(format, a...)})
+	}
+
+	switch {
+	case c.Listen == "" && !c.SystemdSocket:
+		fail("listen", "either listen or systemd_socket is required")
+	case c.Listen != "" && c.SystemdSocket:
+		fail("listen", "listen and systemd_socket are mutually exclusive")
+	case c.Listen != "":
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			fail("listen", "invalid address %q: %v", c.Listen, err)
+		}
+	}
+	if c.ExitWhenIdle && c.IdleTimeout <= 0 {
+		fail("idle_timeout", "must be positive to exit when idle")
+	}
+	if c.ShutdownTimeout < 0 {
+		fail("shutdown_timeout", "must not be negative")
+	}
+	if c.HandshakeTimeout < 0 {
+		fail("handshake_timeout", "must not be negative")
+	}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"max", c.Connections.Max},
+		{"max_per_ip", c.Connections.MaxPerIP},
+		{"max_sessions_per_user", c.Connections.MaxSessionsPerUser},
+		{"rate_per_ip", c.Connections.RatePerIP},
+	} {
+		if limit.value < 0 {
+			fail("connections."+limit.name, "must not be negative")
+		}
+	}
+	if c.HostKey == "" {
+		fail("host_key", "required")
+	}
+	if c.Root == "" {
+		fail("root", "required")
+	}
+
+	s := c.Storage
+	if s.Quota != "" {
+		if !s.Dedup {
+			fail("storage.quota", "requires storage.dedup")
+		}
+		if _, err := ParseSize(s.Quota); err != nil {
+			fail("storage.quota", "%v", err)
+		}
+	}
+	if s.Versions < 0 {
+		fail("storage.versions", "must not be negative")
+	}
+	for i, rule := range s.Retention {
+		if _, err := ParseRetentionRule(rule); err != nil {
+			fail(fmt.Sprintf("storage.retention[%d]", i), "%v", err)
+		}
+	}
+	if len(s.Retention) > 0 && s.RetentionInterval <= 0 {
+		fail("storage.retention_interval", "must be positive")
+	}
+	if s.Clamd != "" {
+		if _, err := ParseClamdAddress(s.Clamd); err != nil {
+			fail("storage.clamd", "%v", err)
+		}
+		if s.Quarantine == "" {
+			fail("storage.quarantine", "required with storage.clamd")
+		}
+	}
+	if s.VerifyChecksums && (s.VerifiedDir == "" || s.FailedDir == "") {
+		fail("storage", "verified_dir and failed_dir are required with verify_checksums")
+	}
+
+	if len(c.Users) == 0 {
+		fail("users", "at least one user is required")
+	}
+	names := map[string]bool{}
+	for i, u := range c.Users {
+		path := fmt.Sprintf("users[%d]", i)
+		switch {
+		case len(u.Name) < 4 || len(u.Name) > 32:
+			fail(path+".name", "%q must be 4 to 32 bytes long", u.Name)
+		case !validUserName(u.Name):
+			fail(path+".name", "%q must be letters, digits, '.', '_' or '-', not starting with '.' or '-'", u.Name)
+		case names[u.Name]:
+			fail(path+".name", "duplicate user %q", u.Name)
+		}
+		names[u.Name] = true
+		switch {
+		case u.Password == "" && u.PasswordHash == "":
+			fail(path, "password or password_hash is required")
+		case u.Password != "" && u.PasswordHash != "":
+			fail(path, "password and password_hash are mutually exclusive")
+		case u.PasswordHash != "":
+			if h, err := hex.DecodeString(u.PasswordHash); err != nil || len(h) != sha256.Size {
+				fail(path+".password_hash", "must be a hex encoded sha256 hash")
+			}
+		}
+		if u.Home != "" && cleanPath(u.Home) != u.Home {
+			fail(path+".home", "%q must be a clean absolute path", u.Home)
+		}
+		if u.Policy != nil {
+			u.Policy.validate(path+".policy", fail)
+		}
+		if u.Limits != nil {
+			u.Limits.validate(path+".limits", fail)
+		}
+		if u.Timeouts != nil {
+			u.Timeouts.validate(path+".timeouts", fail)
+		}
+	}
+	c.Policy.validate("policy", fail)
+	c.Limits.validate("limits", fail)
+	c.Timeouts.validate("timeouts", fail)
+
+	if _, err := ParseLevel(c.Logging.Level); err != nil {
+		fail("logging.level", "%q must be debug, info, warn or error", c.Logging.Level)
+	}
+	if c.Logging.Format != "text" && c.Logging.Format != "json" {
+		fail("logging.format", "%q must be text or json", c.Logging.Format)
+	}
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			fail("metrics.listen", "invalid address %q: %v", c.Metrics.Listen, err)
+		}
+	}
+	if c.Admin.Listen != "" && !strings.HasPrefix(c.Admin.Listen, "unix:") && c.Admin.TokenFile == "" {
+		fail("admin.token_file", "required to serve the admin API over TCP")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *PolicyConfig) validate(path string, fail func(path, format string, a ...interface{})) {
+	if p.MaxNameLength < 0 {
+		fail(path+".max_name_length", "must not be negative")
+	}
+	for _, types := range []struct {
+		name  string
+		types []string
+	}{{"allow_type", p.AllowTypes}, {"deny_type", p.DenyTypes}} {
+		for _, t := range types.types {
+			if !knownType(t) {
+				fail(path+"."+types.name, "unknown type %q", t)
+			}
+		}
+	}
+}
+
+// knownType reports whether t is a type of contents returned by sniffType.
+func knownType(t string) bool {
+	if t == "text" || t == "binary" {
+		return true
+	}
+	for _, magic := range magicTypes {
+		if magic.typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *LimitsConfig) validate(path string, fail func(path, format string, a ...interface{})) {
+	for _, size := range []struct{ name, value string }{
+		{"max_file_size", l.MaxFileSize},
+		{"max_session_bytes", l.MaxSessionBytes},
+		{"max_daily_bytes", l.MaxDailyBytes},
+	} {
+		if size.value == "" {
+			continue
+		}
+		if _, err := ParseSize(size.value); err != nil {
+			fail(path+"."+size.name, "%v", err)
+		}
+	}
+}
+
+func (t *TimeoutsConfig) validate(path string, fail func(path, format string, a ...interface{})) {
+	if t.MaxDuration < 0 {
+		fail(path+".max_duration", "must not be negative")
+	}
+	if t.Idle < 0 {
+		fail(path+".idle", "must not be negative")
+	}
+}
+
+// ConnectionLimits returns the limits configured.
+func (c *ConnectionsConfig) ConnectionLimits() ConnectionLimits {
+	return ConnectionLimits{
+		MaxConnections:      c.Max,
+		MaxConnectionsPerIP: c.MaxPerIP,
+		MaxSessionsPerUser:  c.MaxSessionsPerUser,
+		RatePerIP:           c.RatePerIP,
+	}
+}
+
+// SessionTimeouts returns the timeouts configured.
+func (t *TimeoutsConfig) SessionTimeouts() SessionTimeouts {
+	return SessionTimeouts{MaxDuration: t.MaxDuration, Idle: t.Idle}
+}
+
+// FilePolicy returns the policy configured, or nil if none.
+func (p *PolicyConfig) FilePolicy() *FilePolicy {
+	if !p.Enabled && len(p.AllowExtensions) == 0 && len(p.DenyExtensions) == 0 &&
+		len(p.AllowTypes) == 0 && len(p.DenyTypes) == 0 && p.MaxNameLength == 0 {
+		return nil
+	}
+	return &FilePolicy{
+		MaxNameLength:   p.MaxNameLength,
+		AllowExtensions: p.AllowExtensions,
+		DenyExtensions:  p.DenyExtensions,
+		AllowTypes:      p.AllowTypes,
+		DenyTypes:       p.DenyTypes,
+	}
+}
+
+// TransferLimits returns the limits configured.
+func (l *LimitsConfig) TransferLimits() (TransferLimits, error) {
+	var limits TransferLimits
+	for _, size := range []struct {
+		value string
+		bytes *int64
+	}{
+		{l.MaxFileSize, &limits.MaxFileSize},
+		{l.MaxSessionBytes, &limits.MaxSessionBytes},
+		{l.MaxDailyBytes, &limits.MaxDailyBytes},
+	} {
+		if size.value == "" {
+			continue
+		}
+		n, err := ParseSize(size.value)
+		if err != nil {
+			return limits, err
+		}
+		*size.bytes = n
+	}
+	return limits, nil
+}
+
+// ServerUsers returns the users allowed to log in, with the default policy, limits and timeouts unless their own.
+func (c *Config) ServerUsers() ([]User, error) {
+	users := make([]User, 0, len(c.Users))
+	for _, u := range c.Users {
+		if u.Disabled {
+			continue
+		}
+		policy, limits, timeouts := &c.Policy, &c.Limits, &c.Timeouts
+		if u.Policy != nil {
+			policy = u.Policy
+		}
+		if u.Limits != nil {
+			limits = u.Limits
+		}
+		if u.Timeouts != nil {
+			timeouts = u.Timeouts
+		}
+		transferLimits, err := limits.TransferLimits()
+		if err != nil {
+			return nil, fmt.Errorf("invalid limits of %s: %w", u.Name, err)
+		}
+		hash, err := u.hash()
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, User{
+			Name:     u.Name,
+			Password: hash,
+			ReadOnly: u.ReadOnly,
+			Home:     u.Home,
+			Policy:   policy.FilePolicy(),
+			Limits:   transferLimits,
+			Timeouts: timeouts.SessionTimeouts(),
+		})
+	}
+	return users, nil
+}
+
+// hash returns the sha256 hash of the user name followed by the password.
+func (u UserConfig) hash() (string, error) {
+	if u.PasswordHash != "" {
+		h, err := hex.DecodeString(u.PasswordHash)
+		if err != nil {
+			return "", fmt.Errorf("invalid password hash of %s: %w", u.Name, err)
+		}
+		return string(h), nil
+	}
+	h := sha256.New()
+	h.Write([]byte(u.Name))
+	h.Write([]byte(u.Password))
+	return string(h.Sum(nil)), nil
+}
+
+// NeedsRestart reports whether settings other than the users, policy, limits
+// and timeouts, which are reloaded while serving, differ from old.
+func (c *Config) NeedsRestart(old *Config) bool {
+	a, b := *c, *old
+	for _, c := range []*Config{&a, &b} {
+		c.Users, c.Policy, c.Limits, c.Timeouts, c.DisconnectRemovedUsers = nil, PolicyConfig{}, LimitsConfig{}, TimeoutsConfig{}, false
+	}
+	return !reflect.DeepEqual(a, b)
+}
+
+// Redacted returns the configuration with the passwords and hashes replaced.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Users = make([]UserConfig, len(c.Users))
+	for i, u := range c.Users {
+		if u.Password != "" {
+			u.Password = "REDACTED"
+		}
+		if u.PasswordHash != "" {
+			u.PasswordHash = "REDACTED"
+		}
+		r.Users[i] = u
+	}
+	return &r
+}
+
+// YAML returns the configuration in YAML.
+func (c *Config) YAML() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return nil, fmt.Errorf("error encoding config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("error encoding config: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,158 @@
+package srv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+listen: 127.0.0.1:2222
+root: /srv/sftp
+storage:
+  dedup: true
+  quota: 10G
+  trash_retention: 720h
+users:
+  - name: partner
+    home: /partners/partner
+    password_hash: d6aa6f8195f195aba1442934e28f20dd7c7ea342dd37cbb1ff422a15962f21e9
+  - name: auditor
+    password: secret
+    read_only: true
+    limits:
+      max_file_size: 1M
+    timeouts:
+      idle: 5m
+policy:
+  deny_ext: [.exe]
+limits:
+  max_daily_bytes: 10G
+timeouts:
+  max_duration: 8h
+logging:
+  level: debug
+`
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig([]byte(testConfig))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v", err)
+	}
+	if c.Storage.TrashRetention != 720*time.Hour || c.Storage.RetentionInterval != time.Hour || c.Logging.Format != "text" {
+		t.Errorf("ParseConfig() = %+v, want settings and defaults", c)
+	}
+
+	users, err := c.ServerUsers()
+	if err != nil {
+		t.Fatalf("ServerUsers() error = %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("ServerUsers() = %+v, want 2 users", users)
+	}
+	if users[0].Policy == nil || users[0].Limits.MaxDailyBytes != 10<<30 || users[0].ReadOnly || users[0].Home != "/partners/partner" ||
+		users[0].Timeouts != (SessionTimeouts{MaxDuration: 8 * time.Hour}) {
+		t.Errorf("partner = %+v, want default policy, limits and timeouts", users[0])
+	}
+	if !users[1].credentialMatch("auditor", []byte("secret")) || !users[1].ReadOnly ||
+		users[1].Limits != (TransferLimits{MaxFileSize: 1 << 20}) || users[1].Timeouts != (SessionTimeouts{Idle: 5 * time.Minute}) ||
+		users[1].Policy == nil {
+		t.Errorf("auditor = %+v, want own limits", users[1])
+	}
+
+	c.Users[0].Disabled = true
+	if users, _ := c.ServerUsers(); len(users) != 1 || users[0].Name != "auditor" {
+		t.Errorf("ServerUsers() with partner disabled = %+v, want auditor", users)
+	}
+	c.Users[0].Disabled = false
+
+	old := *c
+	c.Limits.MaxDailyBytes = "1G"
+	if c.NeedsRestart(&old) {
+		t.Error("NeedsRestart() after changing limits = true")
+	}
+	c.Storage.Versions = 3
+	if !c.NeedsRestart(&old) {
+		t.Error("NeedsRestart() after changing storage = false")
+	}
+
+	redacted, err := c.Redacted().YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(redacted), "secret") || strings.Contains(string(redacted), "d6aa6f") {
+		t.Errorf("Redacted() contains secrets:\n%s", redacted)
+	}
+	if c.Users[1].Password != "secret" {
+		t.Error("Redacted() modified the config")
+	}
+	if _, err := ParseConfig(redacted); err == nil || !strings.Contains(err.Error(), "password_hash: must be a hex encoded sha256 hash") {
+		t.Errorf("ParseConfig(redacted) error = %v, want invalid hash", err)
+	}
+}
+
+func TestParseConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{"empty", "", []string{
+			"listen: either listen or systemd_socket is required",
+			"users: at least one user is required",
+		}},
+		{"unknown field", "listen: :22\nport: 22\n", []string{"line 2: field port not found in type Config"}},
+		{"wrong type", "listen: :22\nstorage:\n  versions: many\n", []string{"line 3: cannot unmarshal !!str `many` into int"}},
+		{"syntax", "listen: [\n", []string{"line 1: did not find expected node content"}},
+		{"home", "listen: :22\nusers:\n  - name: partner\n    password: x\n    home: partners/\n", []string{
+			`line 5: users[0].home: "partners/" must be a clean absolute path`,
+		}},
+		{"user names", "listen: :22\nusers:\n  - name: ../alice\n    password: x\n  - name: .bobby\n    password: x\n  - name: carol.d-e_f\n    password: x\n", []string{
+			`line 3: users[0].name: "../alice" must be letters, digits, '.', '_' or '-', not starting with '.' or '-'`,
+			`line 5: users[1].name: ".bobby" must be letters, digits, '.', '_' or '-', not starting with '.' or '-'`,
+		}},
+		{"invalid settings", `
+listen: :22
+storage:
+  quota: 10G
+users:
+  - name: bob
+    password: x
+  - name: partner
+    password_hash: abc
+    limits:
+      max_file_size: lots
+policy:
+  allow_type: [text, word]
+logging:
+  format: xml
+admin:
+  listen: 127.0.0.1:9101
+`, []string{
+			"line 4: storage.quota: requires storage.dedup",
+			`line 6: users[0].name: "bob" must be 4 to 32 bytes long`,
+			"line 9: users[1].password_hash: must be a hex encoded sha256 hash",
+			"line 11: users[1].limits.max_file_size: invalid size",
+			`line 13: policy.allow_type: unknown type "word"`,
+			`line 15: logging.format: "xml" must be text or json`,
+			"line 16: admin.token_file: required to serve the admin API over TCP",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(tt.config))
+			if err == nil {
+				t.Fatal("ParseConfig() error = nil")
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("ParseConfig() error =\n%v\nwant %d errors", err, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("error %d = %q, want %q", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package srv
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ConnectionLimits cap the connections of a server. Limits of 0 don't apply.
+type ConnectionLimits struct {
+	MaxConnections      int // open
+	MaxConnectionsPerIP int // open from a remote IP
+	MaxSessionsPerUser  int // open by a user
+	RatePerIP           int // new connections from a remote IP per minute, in bursts up to as many
+}
+
+// Reasons connections are rejected for, reported in metrics.
+const (
+	rejectMaxConnections      = "max_connections"
+	rejectMaxConnectionsPerIP = "max_connections_per_ip"
+	rejectMaxSessionsPerUser  = "max_sessions_per_user"
+	rejectRatePerIP           = "rate_per_ip"
+)
+
+// connRejected is the error of a connection rejected by the ConnectionLimits.
+type connRejected struct {
+	reason string
+	limit  int
+}
+
+func (e connRejected) Error() string {
+	return fmt.Sprintf("connection rejected (%s %d)", e.reason, e.limit)
+}
+
+// rateBucket holds tokens, each allowing a new connection from ip.
+type rateBucket struct {
+	ip     string
+	tokens float64
+	last   time.Time // refilled
+}
+
+// take takes a token unless empty, refilled with perMinute tokens a minute up to perMinute.
+func (b *rateBucket) take(perMinute int, now time.Time) bool {
+	b.refill(perMinute, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket is refilled by now, as good as new.
+func (b *rateBucket) full(perMinute int, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Minutes()*float64(perMinute) >= float64(perMinute)
+}
+
+func (b *rateBucket) refill(perMinute int, now time.Time) {
+	b.tokens += now.Sub(b.last).Minutes() * float64(perMinute)
+	if max := float64(perMinute); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// remoteIP returns the IP of addr, or addr itself if not host:port.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// SetConnectionLimits caps the connections of the server.
+// It must be called before serving.
+func (s *Server) SetConnectionLimits(limits ConnectionLimits) {
+	s.connLimits = limits
+}
+
+// admit returns the error rejecting a new connection from ip by the
+// ConnectionLimits, if any, counting it otherwise. s.mu must be held.
+func (s *Server) admit(ip string, now time.Time) error {
+	l := s.connLimits
+	if l.MaxConnections > 0 && len(s.conns) >= l.MaxConnections {
+		return connRejected{rejectMaxConnections, l.MaxConnections}
+	}
+	if l.MaxConnectionsPerIP > 0 && s.ipConns[ip] >= l.MaxConnectionsPerIP {
+		return connRejected{rejectMaxConnectionsPerIP, l.MaxConnectionsPerIP}
+	}
+	if l.RatePerIP > 0 {
+		if s.ipRates == nil {
+			s.ipRates = map[string]*list.Element{}
+			s.ipRateOrder = list.New()
+		}
+		s.pruneRateBuckets(now)
+		e := s.ipRates[ip]
+		if e == nil {
+			e = s.ipRateOrder.PushFront(&rateBucket{ip: ip, tokens: float64(l.RatePerIP), last: now})
+			s.ipRates[ip] = e
+		} else {
+			s.ipRateOrder.MoveToFront(e)
+		}
+		if !e.Value.(*rateBucket).take(l.RatePerIP, now) {
+			return connRejected{rejectRatePerIP, l.RatePerIP}
+		}
+	}
+	if s.ipConns == nil {
+		s.ipConns = map[string]int{}
+	}
+	s.ipConns[ip]++
+	return nil
+}
+
+// pruneRateBuckets removes the buckets refilled, as good as new, starting
+// with the least recently refilled until one isn't. s.mu must be held.
+func (s *Server) pruneRateBuckets(now time.Time) {
+	for e := s.ipRateOrder.Back(); e != nil; e = s.ipRateOrder.Back() {
+		b := e.Value.(*rateBucket)
+		if !b.full(s.connLimits.RatePerIP, now) {
+			return
+		}
+		s.ipRateOrder.Remove(e)
+		delete(s.ipRates, b.ip)
+	}
+}
+
+// release uncounts a connection from ip admitted. s.mu must be held.
+func (s *Server) release(ip string) {
+	if s.ipConns[ip]--; s.ipConns[ip] <= 0 {
+		delete(s.ipConns, ip)
+	}
+}
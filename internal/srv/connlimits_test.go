@@ -0,0 +1,136 @@
+package srv
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addrConn is a connection from addr.
+type addrConn struct {
+	net.Conn
+	addr string
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+func TestServer_track_ConnectionLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits ConnectionLimits
+		addrs  []string // connecting in turn
+		want   []string // reason rejected, empty if admitted
+	}{
+		{
+			name:   "unlimited",
+			limits: ConnectionLimits{},
+			addrs:  []string{"10.0.0.1:1", "10.0.0.1:2", "10.0.0.1:3"},
+			want:   []string{"", "", ""},
+		},
+		{
+			name:   "max connections",
+			limits: ConnectionLimits{MaxConnections: 2},
+			addrs:  []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"},
+			want:   []string{"", "", rejectMaxConnections},
+		},
+		{
+			name:   "max connections per ip",
+			limits: ConnectionLimits{MaxConnectionsPerIP: 1},
+			addrs:  []string{"10.0.0.1:1", "10.0.0.1:2", "10.0.0.2:1"},
+			want:   []string{"", rejectMaxConnectionsPerIP, ""},
+		},
+		{
+			name:   "rate per ip",
+			limits: ConnectionLimits{RatePerIP: 2},
+			addrs:  []string{"10.0.0.1:1", "10.0.0.1:2", "10.0.0.1:3", "10.0.0.2:1"},
+			want:   []string{"", "", rejectRatePerIP, ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			s.SetConnectionLimits(tt.limits)
+			metrics := NewMetrics()
+			s.SetMetrics(metrics)
+			for i, addr := range tt.addrs {
+				err := s.track(addrConn{addr: addr})
+				got := ""
+				if rejected, ok := err.(connRejected); ok {
+					got = rejected.reason
+					s.metrics.rejected(err)
+				} else if err != nil {
+					t.Fatalf("track(%s) error = %v", addr, err)
+				}
+				if got != tt.want[i] {
+					t.Errorf("track(%s) %d rejected for %q, want %q", addr, i, got, tt.want[i])
+				}
+			}
+
+			var buf bytes.Buffer
+			metrics.WriteTo(&buf)
+			for _, reason := range tt.want {
+				if reason != "" && !strings.Contains(buf.String(), `sftp_connections_rejected_total{reason="`+reason+`"} 1`) {
+					t.Errorf("metrics missing rejection %s:\n%s", reason, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestServer_untrack_ReleasesIP(t *testing.T) {
+	s := &Server{}
+	s.SetConnectionLimits(ConnectionLimits{MaxConnectionsPerIP: 1})
+	conn := addrConn{addr: "10.0.0.1:1"}
+	if err := s.track(conn); err != nil {
+		t.Fatal(err)
+	}
+	s.untrack(conn)
+	if err := s.track(addrConn{addr: "10.0.0.1:2"}); err != nil {
+		t.Errorf("track() after untrack error = %v", err)
+	}
+	if len(s.ipConns) != 1 {
+		t.Errorf("ipConns = %v, want 1 address", s.ipConns)
+	}
+}
+
+func TestServer_admit_PrunesRateBuckets(t *testing.T) {
+	s := &Server{}
+	s.SetConnectionLimits(ConnectionLimits{RatePerIP: 1})
+	now := time.Now()
+	for _, c := range []struct {
+		ip    string
+		after time.Duration
+	}{{"10.0.0.1", 0}, {"10.0.0.2", 30 * time.Second}, {"10.0.0.3", 61 * time.Second}} {
+		if err := s.admit(c.ip, now.Add(c.after)); err != nil {
+			t.Fatalf("admit(%s) error = %v", c.ip, err)
+		}
+	}
+	// the bucket of 10.0.0.1 is refilled, that of 10.0.0.2 isn't yet
+	if _, ok := s.ipRates["10.0.0.1"]; ok || len(s.ipRates) != 2 || s.ipRateOrder.Len() != 2 {
+		t.Errorf("ipRates = %v, want the buckets of 10.0.0.2 and 10.0.0.3", s.ipRates)
+	}
+	if err := s.admit("10.0.0.2", now.Add(61*time.Second)); err == nil {
+		t.Error("admit() of an IP whose bucket is empty succeeded")
+	}
+}
+
+func TestRateBucket_take(t *testing.T) {
+	now := time.Now()
+	b := &rateBucket{tokens: 2, last: now}
+	for i, want := range []bool{true, true, false} {
+		if got := b.take(2, now); got != want {
+			t.Errorf("take() %d = %v, want %v", i, got, want)
+		}
+	}
+	if !b.take(2, now.Add(30*time.Second)) {
+		t.Error("take() after refilling a token = false")
+	}
+	if b.take(2, now.Add(30*time.Second)) {
+		t.Error("take() after taking the refilled token = true")
+	}
+}
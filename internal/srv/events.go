@@ -0,0 +1,27 @@
+package srv
+
+import "time"
+
+// Event types
+const (
+	EventExpired  = "expired"
+	EventLimit    = "limit"
+	EventScanned  = "scanned"  // a file was scanned clean, or couldn't be scanned
+	EventInfected = "infected" // malware was found in a file
+	EventVerified = "verified" // a file matched the digest of its sidecar file
+	EventMismatch = "mismatch" // a file didn't match the digest of its sidecar file, or it couldn't be verified
+)
+
+// Event is something the server did or refused on its own account rather than
+// as requested by a client, eg. expiring a file, enforcing a limit or scanning a file.
+type Event struct {
+	Time   time.Time
+	Type   string
+	User   string
+	Path   string
+	Home   string // directory of the root Path and Target are in
+	Target string // where the file was moved to, if it was
+	Detail string // eg. the malware found
+	DryRun bool   // the change was only reported, not made
+	Err    error
+}
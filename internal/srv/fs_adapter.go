@@ -3,12 +3,14 @@ package srv
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/pkg/sftp"
 )
 
+// fsAdapter maps SFTP semantics onto a Backend.
 type fsAdapter struct {
-	impl fsImpl
+	impl Backend
 }
 
 func osOpenFlags(pflags sftp.FileOpenFlags) int {
@@ -99,20 +101,40 @@ func (fs *fsAdapter) Stat(file string) (os.FileInfo, error) {
 	return fs.impl.Stat(file)
 }
 
+func (fs *fsAdapter) Lstat(file string) (os.FileInfo, error) {
+	return fs.impl.Lstat(file)
+}
+
+func (fs *fsAdapter) Truncate(path string, size int64) error {
+	file, err := fs.impl.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(size)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (fs *fsAdapter) Chmod(path string, mode os.FileMode) error {
+	return fs.impl.Chmod(path, mode)
+}
+
+func (fs *fsAdapter) Chtimes(path string, atime, mtime time.Time) error {
+	return fs.impl.Chtimes(path, atime, mtime)
+}
+
 func (fs *fsAdapter) Link(file, target string) error {
 	return fs.impl.Link(file, target)
 }
 
 func (fs *fsAdapter) Symlink(target, file string) error {
-	return fs.impl.Symlink(file, target)
+	return fs.impl.Symlink(target, file)
 }
 
 func (fs *fsAdapter) Readdir(dirPath string) ([]os.FileInfo, error) {
-	file, err := fs.impl.OpenFile(dirPath, os.O_RDONLY, 0400)
-	if err != nil {
-		return nil, err
-	}
-	return file.Readdir(0)
+	return fs.impl.Readdir(dirPath)
 }
 
 func (fs *fsAdapter) Readlink(path string) (string, error) {
@@ -0,0 +1,479 @@
+package srv
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// archiveBackend is a read-only Backend serving the entries of a tar or zip archive.
+// The archive is indexed once when opened, file contents are read on demand.
+type archiveBackend struct {
+	file    *os.File
+	size    int64
+	entries map[string]*archiveEntry
+}
+
+var _ Backend = &archiveBackend{}
+
+type archiveEntry struct {
+	name     string
+	mode     os.FileMode
+	modTime  time.Time
+	size     int64
+	target   string   // symlinks
+	children []string // directories, sorted
+
+	// exactly one of these provides the contents of regular files
+	offset int64     // uncompressed data at offset in the archive
+	zip    *zip.File // compressed zip data
+}
+
+// isArchive reports whether path names an archive file NewArchiveBackend can serve.
+func isArchive(path string) bool {
+	lower := strings.ToLower(path)
+	if !strings.HasSuffix(lower, ".tar") && !strings.HasSuffix(lower, ".zip") {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// NewArchiveBackend returns a read-only Backend serving the contents of a .tar or .zip file.
+func NewArchiveBackend(archivePath string) (Backend, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error opening archive: %w", err)
+	}
+
+	b := &archiveBackend{
+		file: file,
+		size: info.Size(),
+		entries: map[string]*archiveEntry{
+			"/": {name: "/", mode: os.ModeDir | 0550, modTime: info.ModTime()},
+		},
+	}
+	if strings.HasSuffix(strings.ToLower(archivePath), ".zip") {
+		err = b.indexZip()
+	} else {
+		err = b.indexTar()
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error indexing archive %q: %w", archivePath, err)
+	}
+
+	for _, entry := range b.entries {
+		sort.Strings(entry.children)
+	}
+	return b, nil
+}
+
+// countingReader counts the bytes read, which tar.Reader reads exactly.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (b *archiveBackend) indexTar() error {
+	counter := &countingReader{r: b.file}
+	tr := tar.NewReader(counter)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry := &archiveEntry{
+			mode:    hdr.FileInfo().Mode(),
+			modTime: hdr.ModTime,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			entry.size = hdr.Size
+			entry.offset = counter.n
+		case tar.TypeDir:
+		case tar.TypeSymlink:
+			entry.target = hdr.Linkname
+		case tar.TypeLink:
+			target, ok := b.entries[cleanPath(hdr.Linkname)]
+			if !ok {
+				continue
+			}
+			entry.size = target.size
+			entry.offset = target.offset
+			entry.mode = target.mode
+		default:
+			continue // devices, fifos and sparse files are not served
+		}
+		b.add(hdr.Name, entry)
+	}
+}
+
+func (b *archiveBackend) indexZip() error {
+	zr, err := zip.NewReader(b.file, b.size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		entry := &archiveEntry{
+			mode:    f.Mode(),
+			modTime: f.Modified,
+		}
+		switch {
+		case f.Mode().IsDir():
+		case f.Mode()&os.ModeSymlink != 0:
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			target, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			entry.target = string(target)
+		case f.Mode().IsRegular():
+			entry.size = int64(f.UncompressedSize64)
+			if f.Method == zip.Store {
+				offset, err := f.DataOffset()
+				if err != nil {
+					return err
+				}
+				entry.offset = offset
+			} else {
+				entry.zip = f
+			}
+		default:
+			continue
+		}
+		b.add(f.Name, entry)
+	}
+	return nil
+}
+
+// add inserts entry at name, creating any missing parent directories.
+func (b *archiveBackend) add(name string, entry *archiveEntry) {
+	p := cleanPath(name)
+	if p == "/" {
+		return
+	}
+	entry.name = path.Base(p)
+	if existing, ok := b.entries[p]; ok {
+		if existing.mode.IsDir() && entry.mode.IsDir() {
+			existing.mode = entry.mode
+			existing.modTime = entry.modTime
+			return
+		}
+		b.remove(p)
+	}
+	b.entries[p] = entry
+
+	for child := p; child != "/"; child = path.Dir(child) {
+		dir := path.Dir(child)
+		parent, ok := b.entries[dir]
+		if !ok {
+			parent = &archiveEntry{name: path.Base(dir), mode: os.ModeDir | 0550, modTime: entry.modTime}
+			b.entries[dir] = parent
+		}
+		parent.children = append(parent.children, path.Base(child))
+		if ok {
+			break
+		}
+	}
+}
+
+// remove drops a duplicate entry and anything below it so a later one in the archive wins.
+func (b *archiveBackend) remove(p string) {
+	b.drop(p)
+	parent := b.entries[path.Dir(p)]
+	for i, name := range parent.children {
+		if name == path.Base(p) {
+			parent.children = append(parent.children[:i], parent.children[i+1:]...)
+			break
+		}
+	}
+}
+
+// drop deletes the entry at p and the subtree of directories.
+func (b *archiveBackend) drop(p string) {
+	entry, ok := b.entries[p]
+	if !ok {
+		return
+	}
+	delete(b.entries, p)
+	for _, child := range entry.children {
+		b.drop(path.Join(p, child))
+	}
+}
+
+func archiveErr(op, p string, errno syscall.Errno) error {
+	return &os.PathError{Op: op, Path: p, Err: errno}
+}
+
+// lookup resolves p, following symlinks in all but (unless follow is set) the last element.
+func (b *archiveBackend) lookup(op, p string, follow bool) (*archiveEntry, string, error) {
+	resolved := "/"
+	p = cleanPath(p)
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for depth, i := 0, 0; i < len(parts); i++ {
+		if parts[i] == "" {
+			continue
+		}
+		next := path.Join(resolved, parts[i])
+		entry, ok := b.entries[next]
+		if !ok {
+			return nil, "", archiveErr(op, p, syscall.ENOENT)
+		}
+		last := i == len(parts)-1
+		if entry.mode&os.ModeSymlink != 0 && (!last || follow) {
+			if depth++; depth > maxSymlinkDepth {
+				return nil, "", archiveErr(op, p, syscall.ELOOP)
+			}
+			target := entry.target
+			if !path.IsAbs(target) {
+				target = path.Join(resolved, target)
+			}
+			// continue resolving the link target followed by the remaining elements
+			rest := append(strings.Split(strings.TrimPrefix(cleanPath(target), "/"), "/"), parts[i+1:]...)
+			parts, i, resolved = rest, -1, "/"
+			continue
+		}
+		if !last && !entry.mode.IsDir() {
+			return nil, "", archiveErr(op, p, syscall.ENOTDIR)
+		}
+		resolved = next
+	}
+	return b.entries[resolved], resolved, nil
+}
+
+func (e *archiveEntry) info() os.FileInfo {
+	return &memFileInfo{name: e.name, size: e.size, mode: e.mode, modTime: e.modTime}
+}
+
+func (b *archiveBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	if flags&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, archiveErr("open", p, syscall.EPERM)
+	}
+	entry, _, err := b.lookup("open", p, true)
+	if err != nil {
+		return nil, err
+	}
+	f := &archiveFile{name: p, entry: entry}
+	if entry.zip == nil {
+		f.section = io.NewSectionReader(b.file, entry.offset, entry.size)
+	}
+	return f, nil
+}
+
+func (b *archiveBackend) Stat(p string) (os.FileInfo, error) {
+	entry, _, err := b.lookup("stat", p, true)
+	if err != nil {
+		return nil, err
+	}
+	info := entry.info()
+	if cleanPath(p) != "/" {
+		info.(*memFileInfo).name = path.Base(cleanPath(p))
+	}
+	return info, nil
+}
+
+func (b *archiveBackend) Lstat(p string) (os.FileInfo, error) {
+	entry, _, err := b.lookup("lstat", p, false)
+	if err != nil {
+		return nil, err
+	}
+	return entry.info(), nil
+}
+
+func (b *archiveBackend) Readdir(p string) ([]os.FileInfo, error) {
+	entry, resolved, err := b.lookup("readdir", p, true)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.mode.IsDir() {
+		return nil, archiveErr("readdir", p, syscall.ENOTDIR)
+	}
+	infos := make([]os.FileInfo, 0, len(entry.children))
+	for _, name := range entry.children {
+		infos = append(infos, b.entries[path.Join(resolved, name)].info())
+	}
+	return infos, nil
+}
+
+func (b *archiveBackend) Readlink(p string) (string, error) {
+	entry, _, err := b.lookup("readlink", p, false)
+	if err != nil {
+		return "", err
+	}
+	if entry.mode&os.ModeSymlink == 0 {
+		return "", archiveErr("readlink", p, syscall.EINVAL)
+	}
+	return entry.target, nil
+}
+
+func (b *archiveBackend) Rename(from, to string) error {
+	return archiveErr("rename", from, syscall.EPERM)
+}
+
+func (b *archiveBackend) Remove(p string) error {
+	return archiveErr("remove", p, syscall.EPERM)
+}
+
+func (b *archiveBackend) Mkdir(p string, perm os.FileMode) error {
+	return archiveErr("mkdir", p, syscall.EPERM)
+}
+
+func (b *archiveBackend) Link(oldname, newname string) error {
+	return archiveErr("link", newname, syscall.EPERM)
+}
+
+func (b *archiveBackend) Symlink(oldname, newname string) error {
+	return archiveErr("symlink", newname, syscall.EPERM)
+}
+
+func (b *archiveBackend) Chmod(p string, mode os.FileMode) error {
+	return archiveErr("chmod", p, syscall.EPERM)
+}
+
+func (b *archiveBackend) Chtimes(p string, atime, mtime time.Time) error {
+	return archiveErr("chtimes", p, syscall.EPERM)
+}
+
+func (b *archiveBackend) StatFS(p string) (*sftp.StatVFS, error) {
+	const blockSize = 4096
+	const readOnly = 0x1 // ST_RDONLY
+	return &sftp.StatVFS{
+		Bsize:   blockSize,
+		Frsize:  blockSize,
+		Blocks:  uint64(b.size) / blockSize,
+		Files:   uint64(len(b.entries)),
+		Flag:    readOnly,
+		Namemax: 255,
+	}, nil
+}
+
+// archiveWindow is the number of bytes of a compressed entry last inflated
+// kept for reading backwards, covering the reads a client has in flight.
+const archiveWindow = 2 << 20
+
+// archiveFile is an open entry. Compressed zip entries are decompressed
+// sequentially, keeping the last archiveWindow bytes inflated: reads before
+// them start over from the beginning of the entry.
+type archiveFile struct {
+	name    string
+	entry   *archiveEntry
+	section *io.SectionReader
+
+	mu     sync.Mutex
+	rc     io.ReadCloser
+	pos    int64
+	window []byte // inflated bytes ending at pos
+}
+
+func (f *archiveFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.entry.mode.IsDir() {
+		return 0, archiveErr("read", f.name, syscall.EISDIR)
+	}
+	if f.section != nil {
+		return f.section.ReadAt(p, off)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= f.entry.size {
+		return 0, io.EOF
+	}
+	if f.rc == nil || off < f.pos-int64(len(f.window)) {
+		if f.rc != nil {
+			f.rc.Close()
+		}
+		rc, err := f.entry.zip.Open()
+		if err != nil {
+			return 0, err
+		}
+		f.rc, f.pos, f.window = rc, 0, f.window[:0]
+	}
+	err := f.inflate(off, off+int64(len(p)))
+	if off >= f.pos {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	n := copy(p, f.window[int64(len(f.window))-(f.pos-off):])
+	if n < len(p) && err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// inflate decompresses the entry up to end, or its end, keeping in the window
+// at least the bytes from off.
+func (f *archiveFile) inflate(off, end int64) error {
+	keep := int64(archiveWindow)
+	if end-off > keep {
+		keep = end - off
+	}
+	buf := make([]byte, 32<<10)
+	for f.pos < end {
+		if int64(len(buf)) > end-f.pos {
+			buf = buf[:end-f.pos]
+		}
+		n, err := f.rc.Read(buf)
+		f.window = append(f.window, buf[:n]...)
+		f.pos += int64(n)
+		if int64(len(f.window)) > keep+keep/4 {
+			f.window = append(f.window[:0], f.window[int64(len(f.window))-keep:]...)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *archiveFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, archiveErr("write", f.name, syscall.EPERM)
+}
+
+func (f *archiveFile) Truncate(size int64) error {
+	return archiveErr("truncate", f.name, syscall.EPERM)
+}
+
+func (f *archiveFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rc != nil {
+		f.rc.Close()
+		f.rc, f.window = nil, nil
+	}
+	return nil
+}
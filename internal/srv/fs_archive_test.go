@@ -0,0 +1,251 @@
+package srv
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type archiveTestEntry struct {
+	name    string
+	content string
+	link    string // symlink target
+}
+
+var archiveTestEntries = []archiveTestEntry{
+	{name: "README", content: "bundle of data"},
+	{name: "2020/01/data.csv", content: strings.Repeat("a,b,c\n", 1000)},
+	{name: "2020/02/"},
+	{name: "latest", link: "2020/01"},
+}
+
+func writeTestTar(t *testing.T, path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range archiveTestEntries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, ModTime: time.Now(), Size: int64(len(e.content))}
+		switch {
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		default:
+			hdr.Typeflag = tar.TypeReg
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestZip(t *testing.T, path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for i, e := range archiveTestEntries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		if i == 0 {
+			hdr.Method = zip.Store
+		}
+		hdr.SetMode(0644)
+		if e.link != "" {
+			hdr.SetMode(os.ModeSymlink | 0777)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := e.content
+		if e.link != "" {
+			content = e.link
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveBackend(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		write func(t *testing.T, path string)
+	}{
+		{name: "tar", file: "bundle.tar", write: writeTestTar},
+		{name: "zip", file: "bundle.zip", write: writeTestZip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sftp-archive-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			archivePath := filepath.Join(dir, tt.file)
+			tt.write(t, archivePath)
+
+			b, err := OpenBackend(archivePath)
+			if err != nil {
+				t.Fatalf("OpenBackend() error = %v", err)
+			}
+
+			infos, err := b.Readdir("/")
+			if err != nil {
+				t.Fatalf("Readdir(/) error = %v", err)
+			}
+			names := []string{}
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+			if got := strings.Join(names, ","); got != "2020,README,latest" {
+				t.Errorf("Readdir(/) = %s", got)
+			}
+
+			if got := readMemFile(t, b, "/README"); got != "bundle of data" {
+				t.Errorf("read README = %q", got)
+			}
+			f, err := b.OpenFile("/latest/data.csv", os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatalf("OpenFile() through symlink error = %v", err)
+			}
+			buf := make([]byte, 6)
+			for _, off := range []int64{600, 6, 5994} {
+				if n, err := f.ReadAt(buf, off); n != 6 || string(buf) != "a,b,c\n" {
+					t.Errorf("ReadAt(%d) = %d, %q, %v", off, n, buf, err)
+				}
+			}
+			f.Close()
+
+			if target, err := b.Readlink("/latest"); err != nil || target != "2020/01" {
+				t.Errorf("Readlink() = %q, %v", target, err)
+			}
+			if info, err := b.Stat("/2020/02"); err != nil || !info.IsDir() {
+				t.Errorf("Stat(empty dir) = %v, %v", info, err)
+			}
+
+			if _, err := b.OpenFile("/README", os.O_WRONLY, 0); !os.IsPermission(err) {
+				t.Errorf("OpenFile(O_WRONLY) error = %v, want permission error", err)
+			}
+			if err := b.Remove("/README"); !os.IsPermission(err) {
+				t.Errorf("Remove() error = %v, want permission error", err)
+			}
+			if err := b.Mkdir("/new", 0770); !os.IsPermission(err) {
+				t.Errorf("Mkdir() error = %v, want permission error", err)
+			}
+		})
+	}
+}
+
+func TestArchiveBackend_ReplaceDirectory(t *testing.T) {
+	b := &archiveBackend{entries: map[string]*archiveEntry{}}
+	b.add("dir/", &archiveEntry{mode: os.ModeDir | 0755})
+	b.add("dir/sub/file", &archiveEntry{mode: 0644, size: 1})
+	b.add("dir", &archiveEntry{mode: 0644, size: 2})
+
+	for _, p := range []string{"/dir/sub", "/dir/sub/file"} {
+		if _, ok := b.entries[p]; ok {
+			t.Errorf("entry %s left after its directory was replaced", p)
+		}
+	}
+	info, err := b.Stat("/dir")
+	if err != nil || !info.Mode().IsRegular() || info.Size() != 2 {
+		t.Errorf("Stat(/dir) = %v, %v, want the replacing file", info, err)
+	}
+	if infos, err := b.Readdir("/"); err != nil || len(infos) != 1 {
+		t.Errorf("Readdir(/) = %d entries, %v, want 1", len(infos), err)
+	}
+}
+
+func TestArchiveBackend_ReadBackwards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp-archive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var content bytes.Buffer
+	for i := 0; content.Len() < 3*archiveWindow; i++ {
+		fmt.Fprintf(&content, "line %d\n", i)
+	}
+	archivePath := filepath.Join(dir, "big.zip")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("big.txt")
+	if err == nil {
+		_, err = w.Write(content.Bytes())
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := OpenBackend(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	af, err := b.OpenFile("/big.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer af.Close()
+	const chunk = 32 << 10
+	size := int64(content.Len())
+	read := func(off int64) {
+		buf := make([]byte, chunk)
+		n, err := af.ReadAt(buf, off)
+		want := content.Bytes()[off:]
+		if len(want) > chunk {
+			want = want[:chunk]
+		}
+		if n != len(want) || !bytes.Equal(buf[:n], want) || (n == chunk && err != nil) {
+			t.Fatalf("ReadAt(%d) = %d, %v, want %d bytes", off, n, err, len(want))
+		}
+	}
+
+	// reads in flight arrive out of order, within the window
+	for off := int64(0); off < size; off += 4 * chunk {
+		for _, o := range []int64{3, 1, 0, 2} {
+			if off+o*chunk < size {
+				read(off + o*chunk)
+			}
+		}
+	}
+	rc := af.(*archiveFile).rc
+	read(size - archiveWindow)
+	if af.(*archiveFile).rc != rc {
+		t.Error("ReadAt() within the window started over")
+	}
+	read(0)
+	if af.(*archiveFile).rc == rc {
+		t.Error("ReadAt() before the window did not start over")
+	}
+	read(size / 2)
+}
@@ -0,0 +1,98 @@
+package srv
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Backend is the storage served to SFTP clients.
+//
+// All paths passed to a Backend are virtual: slash separated, absolute and
+// rooted at "/", as seen by the SFTP client. Mapping them onto real storage
+// (and refusing to escape it) is the job of the Backend.
+// Errors should preferably be (or wrap) the errors of the `os` package, eg.
+// os.ErrNotExist and os.ErrPermission, so they can be reported accordingly.
+type Backend interface {
+	OpenFile(path string, flags int, perm os.FileMode) (File, error)
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	Readdir(path string) ([]os.FileInfo, error)
+	Rename(from, to string) error
+	Remove(path string) error
+	Mkdir(path string, perm os.FileMode) error
+	// Link creates newname as a hard link to oldname.
+	Link(oldname, newname string) error
+	// Symlink creates newname as a symbolic link to oldname.
+	Symlink(oldname, newname string) error
+	Readlink(path string) (string, error)
+	Chmod(path string, mode os.FileMode) error
+	Chtimes(path string, atime, mtime time.Time) error
+	StatFS(path string) (*sftp.StatVFS, error)
+}
+
+// File is an open file of a Backend - implemented by *os.File
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+
+	Truncate(size int64) error
+}
+
+// transferError reports err to f if it implements sftp.TransferError, as File
+// wrappers do for the File they wrap.
+func transferError(f File, err error) {
+	if t, ok := f.(sftp.TransferError); ok {
+		t.TransferError(err)
+	}
+}
+
+// OpenBackend returns the Backend described by spec, which is either a local
+// directory, a .tar or .zip archive served read-only, "mem:" optionally followed
+// by a size limit (eg. "mem:64M") or an S3 bucket as
+// "s3://bucket/prefix?endpoint=https://host&region=region".
+func OpenBackend(spec string) (Backend, error) {
+	switch {
+	case strings.HasPrefix(spec, "s3://"):
+		conf, err := parseS3Spec(spec)
+		if err != nil {
+			return nil, err
+		}
+		return NewS3Backend(conf)
+	case strings.HasPrefix(spec, "mem:"):
+		var maxBytes int64
+		if limit := strings.TrimPrefix(spec, "mem:"); limit != "" {
+			var err error
+			maxBytes, err = ParseSize(limit)
+			if err != nil {
+				return nil, fmt.Errorf("invalid memory backend limit: %w", err)
+			}
+		}
+		return NewMemBackend(maxBytes), nil
+	case isArchive(spec):
+		return NewArchiveBackend(spec)
+	default:
+		return NewOSBackend(spec)
+	}
+}
+
+// cleanPath returns the canonical virtual form of p.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// hasPathComponent reports whether any element of the path p is name.
+func hasPathComponent(p, name string) bool {
+	for _, elem := range strings.Split(p, "/") {
+		if elem == name {
+			return true
+		}
+	}
+	return false
+}
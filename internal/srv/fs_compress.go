@@ -0,0 +1,494 @@
+package srv
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Compressed files start with a header, marking them as such and holding their
+// plain size, followed by a sequence of independently deflated frames and an
+// index of the frame sizes, so any range can be read by inflating only the
+// frames it covers:
+//
+//	header | frame... | index: (compressed size, plain size) per frame | frame count (uint32)
+//	header: magic | version (uint8) | plain size (uint64)
+//
+// Files without the header are served as is, uncompressed. Files being
+// written are spooled plain to a temporary sibling through the wrapped Backend,
+// so they are stored as it stores files (eg. encrypted), and compressed to
+// another one when closed, replacing the file only once complete.
+const (
+	compressMagic      = "SFTPDFL"
+	compressVersion    = 1
+	compressHeaderSize = len(compressMagic) + 1 + 8
+	compressTempPrefix = ".sftp-compress-"
+	compressFrameSize  = 256 << 10
+)
+
+// compressSizesCached is the number of plain sizes cached, above which the cache is emptied.
+const compressSizesCached = 4096
+
+// compressSize is the plain size of a file, as long as stored with size and modTime.
+type compressSize struct {
+	stored  int64
+	modTime time.Time
+	plain   int64
+}
+
+// compressBackend stores file contents compressed, otherwise delegating to the wrapped Backend.
+type compressBackend struct {
+	Backend
+	level int
+	seq   uint64 // of temporary files
+
+	mu    sync.Mutex
+	sizes map[string]compressSize // by path, so listings don't read every file
+}
+
+// NewCompressBackend returns a Backend storing file contents in backend compressed
+// in independently seekable frames.
+func NewCompressBackend(backend Backend) Backend {
+	return &compressBackend{Backend: backend, level: flate.DefaultCompression, sizes: map[string]compressSize{}}
+}
+
+type compressFrame struct {
+	offset     int64 // in the stored file
+	size       int64 // compressed
+	plainStart int64
+	plainSize  int64
+}
+
+// readCompressHeader returns the plain size of the file r of size bytes.
+// ok is false if r isn't compressed.
+func readCompressHeader(r io.ReaderAt, size int64) (plainSize int64, ok bool, err error) {
+	if size < int64(compressHeaderSize) {
+		return size, false, nil
+	}
+	header := make([]byte, compressHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	if string(header[:len(compressMagic)]) != compressMagic {
+		return size, false, nil
+	}
+	if v := header[len(compressMagic)]; v != compressVersion {
+		return 0, false, fmt.Errorf("unsupported compressed file version %d", v)
+	}
+	return int64(binary.BigEndian.Uint64(header[len(compressMagic)+1:])), true, nil
+}
+
+// readCompressIndex returns the frames and plain size of the compressed file r.
+// ok is false if r isn't compressed.
+func readCompressIndex(r io.ReaderAt, size int64) (frames []compressFrame, plainSize int64, ok bool, err error) {
+	plainSize, ok, err = readCompressHeader(r, size)
+	if err != nil || !ok {
+		return nil, plainSize, false, err
+	}
+	if size < int64(compressHeaderSize)+4 {
+		return nil, 0, false, fmt.Errorf("corrupt compressed file: no index")
+	}
+	countBuf := make([]byte, 4)
+	if _, err := r.ReadAt(countBuf, size-4); err != nil && err != io.EOF {
+		return nil, 0, false, err
+	}
+	count := int64(binary.BigEndian.Uint32(countBuf))
+
+	indexStart := size - 4 - count*8
+	if indexStart < int64(compressHeaderSize) {
+		return nil, 0, false, fmt.Errorf("corrupt compressed file: index out of bounds")
+	}
+	index := make([]byte, count*8)
+	if _, err := r.ReadAt(index, indexStart); err != nil && err != io.EOF {
+		return nil, 0, false, err
+	}
+	frames = make([]compressFrame, count)
+	offset, plainStart := int64(compressHeaderSize), int64(0)
+	for i := range frames {
+		frames[i] = compressFrame{
+			offset:     offset,
+			size:       int64(binary.BigEndian.Uint32(index[i*8:])),
+			plainStart: plainStart,
+			plainSize:  int64(binary.BigEndian.Uint32(index[i*8+4:])),
+		}
+		offset += frames[i].size
+		plainStart += frames[i].plainSize
+	}
+	if offset != indexStart || plainStart != plainSize {
+		return nil, 0, false, fmt.Errorf("corrupt compressed file: index does not match contents")
+	}
+	return frames, plainSize, true, nil
+}
+
+// plainSize returns the logical size of the file at path stored as info,
+// cached as long as the stored file doesn't change.
+func (b *compressBackend) plainSize(path string, info os.FileInfo) int64 {
+	size := info.Size()
+	if size < int64(compressHeaderSize) {
+		return size
+	}
+	path = cleanPath(path)
+	b.mu.Lock()
+	cached, ok := b.sizes[path]
+	b.mu.Unlock()
+	if ok && cached.stored == size && cached.modTime.Equal(info.ModTime()) {
+		return cached.plain
+	}
+
+	f, err := b.Backend.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return size
+	}
+	defer f.Close()
+	plainSize, ok, err := readCompressHeader(f, size)
+	if err != nil {
+		return size
+	}
+	if !ok {
+		plainSize = size
+	}
+	b.mu.Lock()
+	if len(b.sizes) >= compressSizesCached {
+		b.sizes = map[string]compressSize{}
+	}
+	b.sizes[path] = compressSize{stored: size, modTime: info.ModTime(), plain: plainSize}
+	b.mu.Unlock()
+	return plainSize
+}
+
+// forget removes the plain size of the file at p from the cache.
+func (b *compressBackend) forget(p string) {
+	b.mu.Lock()
+	delete(b.sizes, cleanPath(p))
+	b.mu.Unlock()
+}
+
+type compressFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi compressFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (b *compressBackend) info(path string, info os.FileInfo) os.FileInfo {
+	if info == nil || !info.Mode().IsRegular() {
+		return info
+	}
+	return compressFileInfo{FileInfo: info, size: b.plainSize(path, info)}
+}
+
+func (b *compressBackend) Stat(path string) (os.FileInfo, error) {
+	info, err := b.Backend.Stat(path)
+	return b.info(path, info), err
+}
+
+func (b *compressBackend) Lstat(path string) (os.FileInfo, error) {
+	info, err := b.Backend.Lstat(path)
+	return b.info(path, info), err
+}
+
+func (b *compressBackend) Readdir(dirPath string) ([]os.FileInfo, error) {
+	infos, err := b.Backend.Readdir(dirPath)
+	shown := infos[:0]
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), compressTempPrefix) {
+			continue
+		}
+		shown = append(shown, b.info(cleanPath(dirPath+"/"+info.Name()), info))
+	}
+	return shown, err
+}
+
+func (b *compressBackend) Rename(from, to string) error {
+	b.forget(from)
+	b.forget(to)
+	return b.Backend.Rename(from, to)
+}
+
+func (b *compressBackend) Remove(p string) error {
+	b.forget(p)
+	return b.Backend.Remove(p)
+}
+
+func (b *compressBackend) OpenFile(path string, flags int, perm os.FileMode) (File, error) {
+	writable := flags&(os.O_WRONLY|os.O_RDWR) != 0
+	info, err := b.Backend.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if info != nil && info.IsDir() {
+		return b.Backend.OpenFile(path, flags, perm)
+	}
+
+	// the file is only replaced once compressed on close
+	innerFlags := flags &^ (os.O_APPEND | os.O_TRUNC)
+	if writable && flags&os.O_TRUNC == 0 && info != nil && info.Size() > 0 {
+		// existing contents are read back before being rewritten on close
+		innerFlags = innerFlags&^os.O_WRONLY | os.O_RDWR
+	}
+	inner, err := b.Backend.OpenFile(path, innerFlags, perm)
+	if err != nil {
+		return nil, err
+	}
+	f := &compressFile{b: b, inner: inner, name: path, perm: perm, frameIdx: -1}
+	if info != nil {
+		f.perm = info.Mode().Perm()
+	}
+
+	if info != nil && flags&os.O_TRUNC == 0 {
+		f.frames, f.size, f.compressed, err = readCompressIndex(inner, info.Size())
+		if err != nil {
+			inner.Close()
+			return nil, &os.PathError{Op: "open", Path: path, Err: err}
+		}
+	}
+	if !writable {
+		if !f.compressed {
+			return inner, nil
+		}
+		return f, nil
+	}
+
+	// writes go to a plain spool file, compressed when closed
+	f.spoolPath = b.tempPath(path)
+	spool, err := b.Backend.OpenFile(f.spoolPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil && f.size > 0 {
+		_, err = io.Copy(&offsetWriter{w: spool}, io.NewSectionReader(f, 0, f.size))
+	}
+	f.spool, f.spoolSize = spool, f.size
+	if err != nil {
+		f.discardSpool()
+		inner.Close()
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	f.dirty = flags&os.O_TRUNC != 0 || info == nil
+	return f, nil
+}
+
+// tempPath returns the path of a new temporary sibling of the file at p.
+func (b *compressBackend) tempPath(p string) string {
+	return path.Join(path.Dir(cleanPath(p)), fmt.Sprintf("%s%d", compressTempPrefix, atomic.AddUint64(&b.seq, 1)))
+}
+
+// offsetWriter adapts an io.WriterAt to an io.Writer.
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// compressFile is an open compressed file. Readers inflate frames on demand,
+// writers keep the contents in a plain spool file until closed.
+type compressFile struct {
+	b     *compressBackend
+	inner File
+	name  string
+	perm  os.FileMode
+
+	mu         sync.Mutex
+	compressed bool
+	frames     []compressFrame
+	size       int64
+	frameIdx   int // frame held in frame
+	frame      []byte
+
+	spool     File // nil unless writable
+	spoolPath string
+	spoolSize int64
+	dirty     bool
+}
+
+func (f *compressFile) TransferError(err error) {
+	transferError(f.inner, err)
+}
+
+func (f *compressFile) readFrame(idx int) ([]byte, error) {
+	if idx == f.frameIdx {
+		return f.frame, nil
+	}
+	frame := f.frames[idx]
+	data := make([]byte, frame.size)
+	if _, err := f.inner.ReadAt(data, frame.offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	plain, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("frame %d: %w", idx, err)
+	}
+	if int64(len(plain)) != frame.plainSize {
+		return nil, fmt.Errorf("frame %d: corrupt", idx)
+	}
+	f.frame, f.frameIdx = plain, idx
+	return plain, nil
+}
+
+func (f *compressFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.spool != nil {
+		return f.spool.ReadAt(p, off)
+	}
+	if !f.compressed {
+		return f.inner.ReadAt(p, off)
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	idx := sort.Search(len(f.frames), func(i int) bool {
+		return f.frames[i].plainStart+f.frames[i].plainSize > off
+	})
+	for ; n < len(p) && idx < len(f.frames); idx++ {
+		plain, err := f.readFrame(idx)
+		if err != nil {
+			return n, &os.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		pos := off + int64(n) - f.frames[idx].plainStart
+		n += copy(p[n:], plain[pos:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *compressFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.spool == nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	f.dirty = true
+	n, err := f.spool.WriteAt(p, off)
+	if end := off + int64(n); end > f.spoolSize {
+		f.spoolSize = end
+	}
+	return n, err
+}
+
+func (f *compressFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.spool == nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrPermission}
+	}
+	f.dirty = true
+	if err := f.spool.Truncate(size); err != nil {
+		return err
+	}
+	f.spoolSize = size
+	return nil
+}
+
+// compress replaces the file with the spooled contents, as frames followed by the index.
+// The spool is read back once closed, as files being written may not be readable (eg. on S3).
+func (f *compressFile) compress() error {
+	spool, err := f.b.Backend.OpenFile(f.spoolPath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+	tmp := f.b.tempPath(f.name)
+	out, err := f.b.Backend.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, f.perm)
+	if err != nil {
+		return err
+	}
+	err = f.writeFrames(out, spool)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		f.b.forget(f.name)
+		err = f.b.Backend.Rename(tmp, f.name)
+	}
+	if err != nil {
+		f.b.Backend.Remove(tmp)
+	}
+	return err
+}
+
+// writeFrames writes the spooled contents read from spool to w as frames followed by the index.
+func (f *compressFile) writeFrames(w io.WriterAt, spool io.ReaderAt) error {
+	out := &offsetWriter{w: w}
+	header := make([]byte, compressHeaderSize)
+	copy(header, compressMagic)
+	header[len(compressMagic)] = compressVersion
+	binary.BigEndian.PutUint64(header[len(compressMagic)+1:], uint64(f.spoolSize))
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	index := &bytes.Buffer{}
+	buf := &bytes.Buffer{}
+	zw, err := flate.NewWriter(buf, f.b.level)
+	if err != nil {
+		return err
+	}
+	plain := make([]byte, compressFrameSize)
+	var count uint32
+	for off := int64(0); off < f.spoolSize; off += compressFrameSize {
+		n, err := spool.ReadAt(plain, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		buf.Reset()
+		zw.Reset(buf)
+		if _, err := zw.Write(plain[:n]); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		_ = binary.Write(index, binary.BigEndian, uint32(buf.Len()))
+		_ = binary.Write(index, binary.BigEndian, uint32(n))
+		if _, err := out.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		count++
+	}
+	_ = binary.Write(index, binary.BigEndian, count)
+	_, err = out.Write(index.Bytes())
+	return err
+}
+
+func (f *compressFile) discardSpool() {
+	if f.spool != nil {
+		f.spool.Close()
+		f.b.Backend.Remove(f.spoolPath)
+	}
+}
+
+func (f *compressFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	if f.spool != nil {
+		err = f.spool.Close()
+		if err == nil && f.dirty {
+			err = f.compress()
+		}
+		f.b.Backend.Remove(f.spoolPath)
+		f.spool = nil
+	}
+	if cerr := f.inner.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
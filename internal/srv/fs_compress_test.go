@@ -0,0 +1,216 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompressBackend(t *testing.T) {
+	key := make([]byte, cryptKeySize)
+	tests := []struct {
+		name  string
+		inner func() Backend
+	}{
+		{name: "plain", inner: func() Backend { return NewMemBackend(0) }},
+		{name: "encrypted", inner: func() Backend {
+			b, _ := NewCryptBackend(NewMemBackend(0), key)
+			return b
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := tt.inner()
+			b := NewCompressBackend(inner)
+
+			content := &bytes.Buffer{}
+			for i := 0; content.Len() < 3*compressFrameSize; i++ {
+				fmt.Fprintf(content, "%d,partner,some value,%d\n", i, i%7)
+			}
+			writeMemFile(t, b, "/data.csv", content.String())
+
+			stored, err := inner.Stat("/data.csv")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Size() > int64(content.Len()/3) {
+				t.Errorf("stored %d bytes of %d, expected compression", stored.Size(), content.Len())
+			}
+			infos, err := b.Readdir("/")
+			if err != nil || len(infos) != 1 || infos[0].Size() != int64(content.Len()) {
+				t.Errorf("Readdir() = %v, %v, want size %d", infos, err, content.Len())
+			}
+
+			f, err := b.OpenFile("/data.csv", os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			want := content.Bytes()
+			for _, off := range []int64{int64(len(want)) - 10, compressFrameSize - 5, 0} {
+				buf := make([]byte, 100)
+				n, _ := f.ReadAt(buf, off)
+				end := off + 100
+				if end > int64(len(want)) {
+					end = int64(len(want))
+				}
+				if !bytes.Equal(buf[:n], want[off:end]) {
+					t.Errorf("ReadAt(%d) = %q, want %q", off, buf[:n], want[off:end])
+				}
+			}
+
+			// append to the existing file
+			w, err := b.OpenFile("/data.csv", os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.WriteAt([]byte("last\n"), int64(len(want))); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readMemFile(t, b, "/data.csv"); got != content.String()+"last\n" {
+				t.Errorf("read after append differs, got %d bytes", len(got))
+			}
+		})
+	}
+}
+
+func TestCompressBackend_Rewrite(t *testing.T) {
+	inner := NewMemBackend(3000)
+	b := NewCompressBackend(inner)
+	original := make([]byte, 1000)
+	rand.Read(original)
+	writeMemFile(t, b, "/file", string(original))
+	stored := readMemFile(t, inner, "/file")
+	if !strings.HasPrefix(stored, compressMagic) {
+		t.Fatalf("stored file does not start with %q", compressMagic)
+	}
+
+	f, err := b.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, inner, "/file"); got != stored {
+		t.Error("opening an existing file with O_CREATE rewrote it")
+	}
+
+	// compressing the replacement fails over the limit of the inner backend
+	f, err = b.OpenFile("/file", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement := make([]byte, 1500)
+	rand.Read(replacement)
+	if _, err := f.WriteAt(replacement, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, b, "/file"); got != string(original) {
+		t.Error("file truncated before the replacement was compressed")
+	}
+	if err := f.Close(); err == nil {
+		t.Fatal("Close() over the limit succeeded")
+	}
+	if got := readMemFile(t, b, "/file"); got != string(original) {
+		t.Error("failed rewrite lost the original contents")
+	}
+	if infos, err := inner.Readdir("/"); err != nil || len(infos) != 1 {
+		t.Errorf("inner Readdir() = %d entries, %v, want only the file", len(infos), err)
+	}
+
+	writeMemFile(t, b, "/file", string(replacement[:500]))
+	if got := readMemFile(t, b, "/file"); got != string(replacement[:500]) {
+		t.Error("rewritten contents differ")
+	}
+}
+
+func TestCompressBackend_Spool(t *testing.T) {
+	inner := NewMemBackend(0)
+	b := NewCompressBackend(inner)
+	f, err := b.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("id,name\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	// the contents are spooled through the wrapped backend, not to a local file
+	infos, err := inner.Readdir("/")
+	if err != nil || len(infos) != 2 || !strings.HasPrefix(infos[0].Name(), compressTempPrefix) {
+		t.Errorf("inner Readdir() = %v, %v, want the file and its spool", infos, err)
+	}
+	if infos, _ := b.Readdir("/"); len(infos) != 1 {
+		t.Errorf("Readdir() = %v, want the spool hidden", infos)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := inner.Readdir("/"); len(infos) != 1 {
+		t.Errorf("inner Readdir() after Close() = %v, want the file only", infos)
+	}
+}
+
+// openCountingBackend counts the files opened.
+type openCountingBackend struct {
+	Backend
+	opened int
+}
+
+func (b *openCountingBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	b.opened++
+	return b.Backend.OpenFile(p, flags, perm)
+}
+
+func TestCompressBackend_Sizes(t *testing.T) {
+	inner := &openCountingBackend{Backend: NewMemBackend(0)}
+	b := NewCompressBackend(inner)
+	content := strings.Repeat("id,amount\n", 100)
+	writeMemFile(t, b, "/data.csv", content)
+	// written before compression was enabled, ending as the footer of a former format did
+	plain := "0123456789SFTPDFL1"
+	writeMemFile(t, inner, "/plain.txt", plain)
+
+	want := map[string]int64{"data.csv": int64(len(content)), "plain.txt": int64(len(plain))}
+	for i := 0; i < 2; i++ {
+		inner.opened = 0
+		infos, err := b.Readdir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range infos {
+			if info.Size() != want[info.Name()] {
+				t.Errorf("Readdir() size of %s = %d, want %d", info.Name(), info.Size(), want[info.Name()])
+			}
+		}
+		if i > 0 && inner.opened != 0 {
+			t.Errorf("Readdir() again opened %d files, want sizes cached", inner.opened)
+		}
+	}
+	if got := readMemFile(t, b, "/plain.txt"); got != plain {
+		t.Errorf("read %q, want %q", got, plain)
+	}
+
+	// the cache follows changes
+	writeMemFile(t, b, "/data.csv", "short")
+	if info, err := b.Stat("/data.csv"); err != nil || info.Size() != 5 {
+		t.Errorf("Stat() after rewrite = %v, %v, want size 5", info, err)
+	}
+}
+
+func TestCompressBackend_TransferError(t *testing.T) {
+	inner := &transferErrorBackend{Backend: NewMemBackend(0)}
+	b := NewCompressBackend(inner)
+	f, err := b.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	checkTransferError(t, f, inner)
+}
@@ -0,0 +1,520 @@
+package srv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Encrypted files start with a header holding the per-file data key, wrapped with
+// the master key, followed by the contents as independently sealed chunks:
+//
+//	header: magic | nonce | sealed data key
+//	chunk:  nonce | sealed plaintext (up to cryptChunkSize bytes)
+//
+// Each chunk is sealed with a fresh nonce whenever written and authenticated
+// with its index, so chunks cannot be reordered, and whether it is the last one,
+// so the file cannot be cut short at a chunk boundary. Empty files hold a single
+// empty last chunk.
+const (
+	cryptMagic      = "SFTPENC1"
+	cryptChunkSize  = 64 << 10
+	cryptNonceSize  = 12
+	cryptTagSize    = 16
+	cryptKeySize    = 32
+	cryptOverhead   = cryptNonceSize + cryptTagSize
+	cryptHeaderSize = len(cryptMagic) + cryptNonceSize + cryptKeySize + cryptTagSize
+	cryptSealedSize = cryptChunkSize + cryptOverhead
+)
+
+var errNotEncrypted = errors.New("file is not encrypted")
+
+// cryptBackend encrypts file contents at rest, otherwise delegating to the wrapped Backend.
+type cryptBackend struct {
+	Backend
+	master cipher.AEAD
+}
+
+// NewCryptBackend returns a Backend storing file contents in backend encrypted
+// with AES-GCM, using per-file data keys wrapped by masterKey.
+func NewCryptBackend(backend Backend, masterKey []byte) (Backend, error) {
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	return &cryptBackend{Backend: backend, master: master}, nil
+}
+
+// LoadKeyFile reads a 256 bit key, either raw or hex encoded, from path.
+func LoadKeyFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening key file %q: %w", path, err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("key at %q has too permissive permissions", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file %q: %w", path, err)
+	}
+	if len(data) == cryptKeySize {
+		return data, nil
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != cryptKeySize {
+		return nil, fmt.Errorf("key file %q should hold %d raw or hex encoded bytes", path, cryptKeySize)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// cryptPlainSize returns the size of the contents of an encrypted file of size bytes.
+func cryptPlainSize(size int64) int64 {
+	body := size - int64(cryptHeaderSize)
+	if body <= 0 {
+		return 0
+	}
+	plain := body / cryptSealedSize * cryptChunkSize
+	if rem := body % cryptSealedSize; rem > cryptOverhead {
+		plain += rem - cryptOverhead
+	}
+	return plain
+}
+
+// cryptLastChunk returns the index of the last chunk of size bytes of contents.
+func cryptLastChunk(size int64) int64 {
+	if size == 0 {
+		return 0
+	}
+	return (size - 1) / cryptChunkSize
+}
+
+// newHeader returns a new header and the data key it holds.
+func (b *cryptBackend) newHeader() ([]byte, []byte, error) {
+	key := make([]byte, cryptKeySize)
+	nonce := make([]byte, cryptNonceSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	header := append([]byte(cryptMagic), nonce...)
+	header = b.master.Seal(header, nonce, key, []byte(cryptMagic))
+	return header, key, nil
+}
+
+// openHeader returns the data key held by header.
+func openHeader(master cipher.AEAD, header []byte) ([]byte, error) {
+	if len(header) != cryptHeaderSize || string(header[:len(cryptMagic)]) != cryptMagic {
+		return nil, errNotEncrypted
+	}
+	nonce := header[len(cryptMagic) : len(cryptMagic)+cryptNonceSize]
+	key, err := master.Open(nil, nonce, header[len(cryptMagic)+cryptNonceSize:], []byte(cryptMagic))
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %w", err)
+	}
+	return key, nil
+}
+
+func (b *cryptBackend) OpenFile(path string, flags int, perm os.FileMode) (File, error) {
+	writable := flags&(os.O_WRONLY|os.O_RDWR) != 0
+	info, err := b.Backend.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if info != nil && info.IsDir() {
+		return b.Backend.OpenFile(path, flags, perm)
+	}
+	fresh := info == nil || info.Size() == 0 || flags&os.O_TRUNC != 0
+
+	innerFlags := flags &^ os.O_APPEND
+	if writable {
+		// chunks are read back when partially overwritten
+		innerFlags = innerFlags&^os.O_WRONLY | os.O_RDWR
+	}
+	inner, err := b.Backend.OpenFile(path, innerFlags, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	var size int64
+	if fresh && writable {
+		var header []byte
+		header, key, err = b.newHeader()
+		if err == nil {
+			_, err = inner.WriteAt(header, 0)
+		}
+	} else if info != nil && info.Size() > 0 {
+		header := make([]byte, cryptHeaderSize)
+		if _, err = inner.ReadAt(header, 0); err == nil || err == io.EOF {
+			key, err = openHeader(b.master, header)
+		}
+		size = cryptPlainSize(info.Size())
+	}
+	if err != nil {
+		inner.Close()
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	if key == nil {
+		// empty file opened for reading
+		return inner, nil
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		inner.Close()
+		return nil, err
+	}
+	f := &cryptFile{
+		inner:    inner,
+		aead:     aead,
+		name:     path,
+		size:     size,
+		stored:   size,
+		cacheIdx: -1,
+		final:    cryptLastChunk(size),
+	}
+	if fresh && writable {
+		err = f.writeChunk(0, nil)
+	} else if size == 0 {
+		// nothing else authenticates that the file is empty
+		_, err = f.readChunk(0)
+	}
+	if err != nil {
+		inner.Close()
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return f, nil
+}
+
+// cryptFileInfo reports the plaintext size of encrypted files.
+type cryptFileInfo struct {
+	os.FileInfo
+}
+
+func (fi cryptFileInfo) Size() int64 {
+	return cryptPlainSize(fi.FileInfo.Size())
+}
+
+func cryptInfo(info os.FileInfo) os.FileInfo {
+	if info == nil || !info.Mode().IsRegular() {
+		return info
+	}
+	return cryptFileInfo{info}
+}
+
+func (b *cryptBackend) Stat(path string) (os.FileInfo, error) {
+	info, err := b.Backend.Stat(path)
+	return cryptInfo(info), err
+}
+
+func (b *cryptBackend) Lstat(path string) (os.FileInfo, error) {
+	info, err := b.Backend.Lstat(path)
+	return cryptInfo(info), err
+}
+
+func (b *cryptBackend) Readdir(path string) ([]os.FileInfo, error) {
+	infos, err := b.Backend.Readdir(path)
+	for i := range infos {
+		infos[i] = cryptInfo(infos[i])
+	}
+	return infos, err
+}
+
+// cryptFile is an open encrypted file. The chunk last written to is kept in
+// memory until another chunk is touched, so sequential writes seal every chunk once.
+type cryptFile struct {
+	inner File
+	aead  cipher.AEAD
+	name  string
+
+	mu       sync.Mutex
+	size     int64  // plaintext size, including the cached chunk
+	stored   int64  // plaintext size written to inner
+	cache    []byte // plaintext of chunk cacheIdx
+	cacheIdx int64
+	dirty    bool
+	final    int64 // chunk stored sealed as the last one, -1 if none
+}
+
+func (f *cryptFile) TransferError(err error) {
+	transferError(f.inner, err)
+}
+
+func chunkAAD(idx int64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, uint64(idx))
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// readChunk returns the stored plaintext of chunk idx.
+func (f *cryptFile) readChunk(idx int64) ([]byte, error) {
+	return readCryptChunk(f.inner, f.aead, idx, f.stored, idx == f.final)
+}
+
+func readCryptChunk(r io.ReaderAt, aead cipher.AEAD, idx, size int64, final bool) ([]byte, error) {
+	n := size - idx*cryptChunkSize
+	if n < 0 || n == 0 && idx > 0 {
+		return nil, nil
+	}
+	if n > cryptChunkSize {
+		n = cryptChunkSize
+	}
+	sealed := make([]byte, n+cryptOverhead)
+	if _, err := r.ReadAt(sealed, int64(cryptHeaderSize)+idx*cryptSealedSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, sealed[:cryptNonceSize], sealed[cryptNonceSize:], chunkAAD(idx, final))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d: %w", idx, err)
+	}
+	return plain, nil
+}
+
+// writeChunk seals and stores chunk idx, as the last one if it reaches the size of the file.
+func (f *cryptFile) writeChunk(idx int64, plain []byte) error {
+	if f.final >= 0 && f.final < idx {
+		// the file grows past the chunk sealed as the last one
+		chunk, err := f.readChunk(f.final)
+		if err != nil {
+			return err
+		}
+		if err := f.sealChunk(f.final, chunk, false); err != nil {
+			return err
+		}
+		f.final = -1
+	}
+	end := idx*cryptChunkSize + int64(len(plain))
+	final := end >= f.size
+	if err := f.sealChunk(idx, plain, final); err != nil {
+		return err
+	}
+	if final {
+		f.final = idx
+	} else if f.final == idx {
+		f.final = -1
+	}
+	if end > f.stored {
+		f.stored = end
+	}
+	return nil
+}
+
+func (f *cryptFile) sealChunk(idx int64, plain []byte, final bool) error {
+	sealed := make([]byte, cryptNonceSize, len(plain)+cryptOverhead)
+	if _, err := rand.Read(sealed); err != nil {
+		return err
+	}
+	sealed = f.aead.Seal(sealed, sealed, plain, chunkAAD(idx, final))
+	_, err := f.inner.WriteAt(sealed, int64(cryptHeaderSize)+idx*cryptSealedSize)
+	return err
+}
+
+// extendStored zero fills the stored contents up to size.
+func (f *cryptFile) extendStored(size int64) error {
+	for f.stored < size {
+		idx := f.stored / cryptChunkSize
+		chunk, err := f.readChunk(idx)
+		if err != nil {
+			return err
+		}
+		n := size - idx*cryptChunkSize
+		if n > cryptChunkSize {
+			n = cryptChunkSize
+		}
+		chunk = append(chunk, make([]byte, n-int64(len(chunk)))...)
+		if err := f.writeChunk(idx, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *cryptFile) flush() error {
+	if !f.dirty {
+		return nil
+	}
+	if err := f.extendStored(f.cacheIdx * cryptChunkSize); err != nil {
+		return err
+	}
+	if err := f.writeChunk(f.cacheIdx, f.cache); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+// loadChunk makes chunk idx the cached chunk.
+func (f *cryptFile) loadChunk(idx int64) error {
+	if f.cacheIdx == idx {
+		return nil
+	}
+	if err := f.flush(); err != nil {
+		return err
+	}
+	chunk, err := f.readChunk(idx)
+	if err != nil {
+		return err
+	}
+	f.cache = append(make([]byte, 0, cryptChunkSize), chunk...)
+	f.cacheIdx = idx
+	return nil
+}
+
+func (f *cryptFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.flush(); err != nil {
+		return 0, err
+	}
+	if off >= f.stored {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off+int64(n) < f.stored {
+		pos := off + int64(n)
+		idx := pos / cryptChunkSize
+		var chunk []byte
+		var err error
+		if idx == f.cacheIdx {
+			chunk = f.cache
+		} else if chunk, err = f.readChunk(idx); err != nil {
+			return n, &os.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		n += copy(p[n:], chunk[pos-idx*cryptChunkSize:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *cryptFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// grow first, so chunks flushed meanwhile are not sealed as the last one
+	if end := off + int64(len(p)); end > f.size {
+		f.size = end
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		idx := pos / cryptChunkSize
+		inChunk := pos - idx*cryptChunkSize
+		if err := f.loadChunk(idx); err != nil {
+			return n, &os.PathError{Op: "write", Path: f.name, Err: err}
+		}
+		if pad := inChunk - int64(len(f.cache)); pad > 0 {
+			f.cache = append(f.cache, make([]byte, pad)...)
+		}
+		end := inChunk + int64(len(p)-n)
+		if end > cryptChunkSize {
+			end = cryptChunkSize
+		}
+		if end > int64(len(f.cache)) {
+			f.cache = f.cache[:end]
+		}
+		n += copy(f.cache[inChunk:end], p[n:])
+		f.dirty = true
+	}
+	return n, nil
+}
+
+func (f *cryptFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.flush(); err != nil {
+		return err
+	}
+	f.cache, f.cacheIdx = nil, -1
+	if size >= f.stored {
+		f.size = size
+		return f.extendStored(size)
+	}
+
+	// rewrite the new last chunk sealed as such
+	idx := size / cryptChunkSize
+	rem := size - idx*cryptChunkSize
+	if rem == 0 && idx > 0 {
+		idx, rem = idx-1, cryptChunkSize
+	}
+	chunk, err := f.readChunk(idx)
+	if err != nil {
+		return err
+	}
+	f.size = size
+	if err := f.writeChunk(idx, chunk[:rem]); err != nil {
+		return err
+	}
+	innerSize := int64(cryptHeaderSize) + idx*cryptSealedSize + rem + cryptOverhead
+	if err := f.inner.Truncate(innerSize); err != nil {
+		return err
+	}
+	f.stored, f.size = size, size
+	return nil
+}
+
+func (f *cryptFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.flush()
+	if cerr := f.inner.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// DecryptFile writes the plaintext of the encrypted file r, of size bytes, to w.
+func DecryptFile(w io.Writer, r io.ReaderAt, size int64, masterKey []byte) error {
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return fmt.Errorf("invalid master key: %w", err)
+	}
+	header := make([]byte, cryptHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return errNotEncrypted
+	}
+	key, err := openHeader(master, header)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	plainSize := cryptPlainSize(size)
+	last := cryptLastChunk(plainSize)
+	for idx := int64(0); idx <= last; idx++ {
+		chunk, err := readCryptChunk(r, aead, idx, plainSize, idx == last)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
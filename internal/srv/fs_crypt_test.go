@@ -0,0 +1,183 @@
+package srv
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestCryptBackend(t *testing.T) {
+	type op struct {
+		off      int64
+		n        int
+		truncate bool // truncate to off instead of writing n bytes at off
+	}
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{
+			name: "sequential",
+			ops:  []op{{0, 32 << 10, false}, {32 << 10, 32 << 10, false}, {64 << 10, 100, false}},
+		},
+		{
+			name: "out of order",
+			ops:  []op{{200 << 10, 1000, false}, {0, 5, false}, {70 << 10, 10, false}},
+		},
+		{
+			name: "overwrite across chunks",
+			ops:  []op{{0, 200 << 10, false}, {60 << 10, 10 << 10, false}},
+		},
+		{
+			name: "truncate",
+			ops:  []op{{0, 200 << 10, false}, {100 << 10, 0, true}, {150 << 10, 0, true}, {10, 0, true}},
+		},
+		{
+			name: "truncate at chunk boundaries",
+			ops:  []op{{0, 200 << 10, false}, {128 << 10, 0, true}, {0, 0, true}, {64 << 10, 0, true}, {64 << 10, 5, false}},
+		},
+	}
+	key := make([]byte, cryptKeySize)
+	rand.Read(key)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := NewMemBackend(0)
+			b, err := NewCryptBackend(inner, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []byte{}
+
+			f, err := b.OpenFile("/file", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+			if err != nil {
+				t.Fatalf("OpenFile() error = %v", err)
+			}
+			for _, o := range tt.ops {
+				if o.truncate {
+					if err := f.Truncate(o.off); err != nil {
+						t.Fatalf("Truncate(%d) error = %v", o.off, err)
+					}
+					if int64(len(want)) > o.off {
+						want = want[:o.off]
+					} else {
+						want = append(want, make([]byte, o.off-int64(len(want)))...)
+					}
+					continue
+				}
+				data := make([]byte, o.n)
+				rand.Read(data)
+				if _, err := f.WriteAt(data, o.off); err != nil {
+					t.Fatalf("WriteAt(%d) error = %v", o.off, err)
+				}
+				if end := o.off + int64(o.n); end > int64(len(want)) {
+					want = append(want, make([]byte, end-int64(len(want)))...)
+				}
+				copy(want[o.off:], data)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			info, err := b.Stat("/file")
+			if err != nil || info.Size() != int64(len(want)) {
+				t.Fatalf("Stat() size = %v, %v, want %d", info.Size(), err, len(want))
+			}
+			raw := readMemFile(t, inner, "/file")
+			if bytes.Contains([]byte(raw), want[:len(want)/2]) {
+				t.Errorf("plaintext stored")
+			}
+
+			f, err = b.OpenFile("/file", os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 1<<30))
+			f.Close()
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("read %d bytes, %v, want %d bytes", len(got), err, len(want))
+			}
+
+			out := &bytes.Buffer{}
+			if err := DecryptFile(out, bytes.NewReader([]byte(raw)), int64(len(raw)), key); err != nil {
+				t.Fatalf("DecryptFile() error = %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Errorf("DecryptFile() returned %d bytes, want %d", out.Len(), len(want))
+			}
+		})
+	}
+}
+
+func TestCryptBackend_CutShort(t *testing.T) {
+	key := make([]byte, cryptKeySize)
+	rand.Read(key)
+	inner := NewMemBackend(0)
+	b, err := NewCryptBackend(inner, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 2*cryptChunkSize)
+	rand.Read(content)
+	writeMemFile(t, b, "/file", string(content[:cryptChunkSize]))
+
+	// appending past a full last chunk reseals it
+	f, err := b.OpenFile("/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(content[cryptChunkSize:], cryptChunkSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, b, "/file"); got != string(content) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(content))
+	}
+
+	tests := []struct {
+		name string
+		size int64
+	}{
+		{name: "chunk boundary", size: int64(cryptHeaderSize) + cryptSealedSize},
+		{name: "header only", size: int64(cryptHeaderSize)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := readMemFile(t, inner, "/file")
+			writeMemFile(t, inner, "/cut", raw[:tt.size])
+
+			f, err := b.OpenFile("/cut", os.O_RDONLY, 0)
+			if err == nil {
+				_, err = ioutil.ReadAll(io.NewSectionReader(f, 0, 1<<30))
+				f.Close()
+			}
+			if err == nil {
+				t.Error("reading a file cut short succeeded")
+			}
+			if err := DecryptFile(ioutil.Discard, bytes.NewReader([]byte(raw[:tt.size])), tt.size, key); err == nil {
+				t.Error("DecryptFile() of a file cut short succeeded")
+			}
+		})
+	}
+}
+
+func TestCryptBackend_TransferError(t *testing.T) {
+	key := make([]byte, cryptKeySize)
+	rand.Read(key)
+	inner := &transferErrorBackend{Backend: NewMemBackend(0)}
+	b, err := NewCryptBackend(inner, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := b.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	checkTransferError(t, f, inner)
+}
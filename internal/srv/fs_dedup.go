@@ -0,0 +1,718 @@
+package srv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Deduplicated file contents are stored once, as blobs named by their sha256, in
+// dedupDir. The files seen by clients only hold a reference to their blob and
+// the user who stored it (path escaped), whose usage the file counts against:
+//
+//	SFTPREF1 <hex sha256> <size> [<user>]\n
+//
+// Blobs are reference counted; the counts and usage are rebuilt from the references
+// when the backend is created, and blobs no longer referenced are removed.
+// Files without a reference (eg. stored before deduplication was enabled) are
+// served as is, counting against no user. Files being written are spooled to
+// the tmp directory of the store, through the wrapped Backend, and the spool
+// becomes the blob when closed if its contents aren't stored yet.
+const (
+	dedupDirName = ".dedup"
+	dedupDir     = "/" + dedupDirName
+	dedupMagic   = "SFTPREF1"
+	dedupMaxRef  = 128
+)
+
+// Dedup is the blob store of deduplicated files, shared by the backends of its users.
+type Dedup struct {
+	seq     uint64 // of temporary files
+	backend Backend
+	quota   int64
+
+	mu    sync.Mutex
+	refs  map[string]int   // blob hash -> number of references
+	usage map[string]int64 // logical bytes of the files of each user
+}
+
+// NewDedup returns the store of identical file contents of the users of backend,
+// keeping them only once. The logical size of the files of each user, counting
+// every copy, is limited to quotaBytes unless quotaBytes is 0.
+func NewDedup(backend Backend, quotaBytes int64) (*Dedup, error) {
+	d := &Dedup{backend: backend, quota: quotaBytes, refs: map[string]int{}, usage: map[string]int64{}}
+	b := &dedupBackend{Backend: backend, Dedup: d}
+	for _, dir := range []string{dedupDir, dedupDir + "/blobs", dedupDir + "/tmp"} {
+		if err := backend.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("error creating blob store: %w", err)
+		}
+	}
+	if err := b.scan("/"); err != nil {
+		return nil, fmt.Errorf("error counting blob references: %w", err)
+	}
+	if err := b.collect(); err != nil {
+		return nil, fmt.Errorf("error removing unreferenced blobs: %w", err)
+	}
+	return d, nil
+}
+
+// NewDedupBackend returns a Backend storing identical file contents in backend
+// only once, counting the files stored against no user (see NewDedup).
+func NewDedupBackend(backend Backend, quotaBytes int64) (Backend, error) {
+	d, err := NewDedup(backend, quotaBytes)
+	if err != nil {
+		return nil, err
+	}
+	return d.Backend(""), nil
+}
+
+// Backend returns the backend of the store with the files stored by user counted against their quota.
+func (d *Dedup) Backend(user string) Backend {
+	return &dedupBackend{Backend: d.backend, Dedup: d, user: user}
+}
+
+// Usage returns the logical size of the files of user and the quota, implementing Quota.
+func (d *Dedup) Usage(user string) (used, limit int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.usage[user], d.quota
+}
+
+// dedupBackend stores file contents deduplicated, otherwise delegating to the wrapped Backend.
+type dedupBackend struct {
+	Backend
+	*Dedup
+	user string // whose files are stored
+}
+
+type dedupRef struct {
+	hash  string
+	size  int64
+	owner string
+}
+
+func (r dedupRef) String() string {
+	if r.owner == "" {
+		return fmt.Sprintf("%s %s %d\n", dedupMagic, r.hash, r.size)
+	}
+	return fmt.Sprintf("%s %s %d %s\n", dedupMagic, r.hash, r.size, url.PathEscape(r.owner))
+}
+
+func (r dedupRef) blobPath() string {
+	return dedupDir + "/blobs/" + r.hash[:2] + "/" + r.hash
+}
+
+// parseDedupRef parses a reference, ok is false if data isn't one.
+func parseDedupRef(data []byte) (ref dedupRef, ok bool) {
+	fields := strings.Fields(string(data))
+	if len(fields) == 3 {
+		// stored by no user
+		fields = append(fields, "")
+	}
+	if len(fields) != 4 || fields[0] != dedupMagic {
+		return ref, false
+	}
+	owner, err := url.PathUnescape(fields[3])
+	if err != nil {
+		return ref, false
+	}
+	if h, err := hex.DecodeString(fields[1]); err != nil || len(h) != sha256.Size {
+		return ref, false
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || size < 0 {
+		return ref, false
+	}
+	ref = dedupRef{hash: fields[1], size: size, owner: owner}
+	return ref, ref.String() == string(data)
+}
+
+// readRef returns the reference held by r, ok is false if r isn't a reference.
+func readRef(r io.ReaderAt) (ref dedupRef, ok bool, err error) {
+	buf := make([]byte, dedupMaxRef+1)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return ref, false, err
+	}
+	if n > dedupMaxRef {
+		return ref, false, nil
+	}
+	ref, ok = parseDedupRef(buf[:n])
+	return ref, ok, nil
+}
+
+// ref returns the reference stored at p, a regular file of the given size.
+func (b *dedupBackend) ref(p string, size int64) (ref dedupRef, ok bool, err error) {
+	if size > dedupMaxRef {
+		return ref, false, nil
+	}
+	f, err := b.Backend.OpenFile(p, os.O_RDONLY, 0)
+	if err != nil {
+		return ref, false, err
+	}
+	defer f.Close()
+	return readRef(f)
+}
+
+// logicalSize returns the size of the regular file p as seen by clients.
+func (b *dedupBackend) logicalSize(p string, info os.FileInfo) (size int64, ref dedupRef, isRef bool) {
+	ref, isRef, err := b.ref(p, info.Size())
+	if err != nil || !isRef {
+		return info.Size(), ref, false
+	}
+	return ref.size, ref, true
+}
+
+// scan counts the references and logical size of all files in dir.
+func (b *dedupBackend) scan(dir string) error {
+	infos, err := b.Backend.Readdir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		p := path.Join(dir, info.Name())
+		switch {
+		case p == dedupDir:
+		case info.IsDir():
+			if err := b.scan(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			size, ref, isRef := b.logicalSize(p, info)
+			if isRef {
+				b.refs[ref.hash]++
+			}
+			b.usage[ref.owner] += size
+		}
+	}
+	return nil
+}
+
+// collect removes blobs without references and leftover temporary files.
+func (b *dedupBackend) collect() error {
+	tmps, err := b.Backend.Readdir(dedupDir + "/tmp")
+	if err != nil {
+		return err
+	}
+	for _, info := range tmps {
+		if err := b.Backend.Remove(dedupDir + "/tmp/" + info.Name()); err != nil {
+			return err
+		}
+	}
+	prefixes, err := b.Backend.Readdir(dedupDir + "/blobs")
+	if err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		dir := dedupDir + "/blobs/" + prefix.Name()
+		blobs, err := b.Backend.Readdir(dir)
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			if b.refs[blob.Name()] > 0 {
+				continue
+			}
+			if err := b.Backend.Remove(dir + "/" + blob.Name()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// release drops a reference to the blob of ref, removing the blob once unreferenced.
+// Must be called with b.mu held.
+func (b *dedupBackend) release(ref dedupRef) {
+	b.refs[ref.hash]--
+	if b.refs[ref.hash] > 0 {
+		return
+	}
+	delete(b.refs, ref.hash)
+	// if this fails the blob is removed when the backend is next created
+	_ = b.Backend.Remove(ref.blobPath())
+}
+
+// isDedupPath reports whether p refers to the blob store, hidden from clients.
+// Any path with a component named like it is refused, as it may lead there through a symlink.
+func isDedupPath(p string) bool {
+	return hasPathComponent(p, dedupDirName)
+}
+
+func dedupHidden(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: syscall.ENOENT}
+}
+
+type dedupFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi dedupFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (b *dedupBackend) info(p string, info os.FileInfo) os.FileInfo {
+	if info == nil || !info.Mode().IsRegular() {
+		return info
+	}
+	size, _, _ := b.logicalSize(p, info)
+	return dedupFileInfo{FileInfo: info, size: size}
+}
+
+// overQuota reports whether the files of b.user would exceed the quota, growing by size.
+// Must be called with b.mu held.
+func (b *dedupBackend) overQuota(size int64) bool {
+	return b.quota > 0 && size > 0 && b.usage[b.user]+size > b.quota
+}
+
+func (b *dedupBackend) Stat(p string) (os.FileInfo, error) {
+	if isDedupPath(p) {
+		return nil, dedupHidden("stat", p)
+	}
+	info, err := b.Backend.Stat(p)
+	return b.info(p, info), err
+}
+
+func (b *dedupBackend) Lstat(p string) (os.FileInfo, error) {
+	if isDedupPath(p) {
+		return nil, dedupHidden("lstat", p)
+	}
+	info, err := b.Backend.Lstat(p)
+	return b.info(p, info), err
+}
+
+func (b *dedupBackend) Readdir(dirPath string) ([]os.FileInfo, error) {
+	if isDedupPath(dirPath) {
+		return nil, dedupHidden("readdir", dirPath)
+	}
+	infos, err := b.Backend.Readdir(dirPath)
+	visible := infos[:0]
+	for _, info := range infos {
+		if info.Name() == dedupDirName {
+			continue
+		}
+		visible = append(visible, b.info(path.Join(dirPath, info.Name()), info))
+	}
+	return visible, err
+}
+
+func (b *dedupBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	if isDedupPath(p) {
+		return nil, dedupHidden("open", p)
+	}
+	info, err := b.Backend.Stat(p)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if info != nil && !info.Mode().IsRegular() {
+		return b.Backend.OpenFile(p, flags, perm)
+	}
+	var ref dedupRef
+	var isRef bool
+	var size int64
+	if info != nil {
+		size, ref, isRef = b.logicalSize(p, info)
+	}
+
+	if flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if !isRef {
+			return b.Backend.OpenFile(p, flags, perm)
+		}
+		blob, err := b.Backend.OpenFile(ref.blobPath(), os.O_RDONLY, 0)
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: p, Err: err}
+		}
+		return &dedupFile{b: b, name: p, blob: blob}, nil
+	}
+
+	// writes go to a spool file of the blob store, which becomes the blob when
+	// closed. The current reference is kept until then (and read back to release it)
+	var spool File
+	var spoolPath string
+	if flags&os.O_TRUNC == 0 && size > 0 {
+		spool, spoolPath, err = b.spoolCopy(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	inner, err := b.Backend.OpenFile(p, flags&^(os.O_APPEND|os.O_TRUNC|os.O_WRONLY)|os.O_RDWR, perm)
+	if err == nil && spool == nil {
+		spoolPath = b.tempPath()
+		spool, err = b.Backend.OpenFile(spoolPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			inner.Close()
+			err = &os.PathError{Op: "open", Path: p, Err: err}
+		}
+	}
+	if err != nil {
+		if spool != nil {
+			spool.Close()
+			b.Backend.Remove(spoolPath)
+		}
+		return nil, err
+	}
+	f := &dedupFile{b: b, name: p, inner: inner, spool: spool, spoolPath: spoolPath}
+	if ref.owner == b.user {
+		f.oldSize = size
+	}
+	f.dirty = flags&(os.O_TRUNC|os.O_CREATE) != 0
+	return f, nil
+}
+
+// tempPath returns the path of a new temporary file of the blob store.
+func (b *dedupBackend) tempPath() string {
+	return fmt.Sprintf("%s/tmp/%d", dedupDir, atomic.AddUint64(&b.seq, 1))
+}
+
+// spoolCopy returns a temporary file of the blob store holding the contents of p, and its path.
+func (b *dedupBackend) spoolCopy(p string) (File, string, error) {
+	src, err := b.OpenFile(p, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+	info, err := b.Stat(p)
+	if err != nil {
+		return nil, "", err
+	}
+	tmp := b.tempPath()
+	spool, err := b.Backend.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		_, err = io.Copy(&offsetWriter{w: spool}, io.NewSectionReader(src, 0, info.Size()))
+		if err != nil {
+			spool.Close()
+			b.Backend.Remove(tmp)
+		}
+	}
+	if err != nil {
+		return nil, "", &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return spool, tmp, nil
+}
+
+// store moves the closed spool file into the blob store, unless holding contents
+// stored already, and references it from inner.
+func (b *dedupBackend) store(name string, inner File, spoolPath string) error {
+	spool, err := b.Backend.OpenFile(spoolPath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, io.NewSectionReader(spool, 0, 1<<62))
+	spool.Close()
+	if err != nil {
+		return err
+	}
+	ref := dedupRef{hash: hex.EncodeToString(h.Sum(nil)), size: size, owner: b.user}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	oldRef, oldIsRef, err := readRef(inner)
+	if err != nil {
+		return err
+	}
+	info, err := b.Backend.Stat(name)
+	if err != nil {
+		return err
+	}
+	oldSize := oldRef.size
+	if !oldIsRef {
+		oldSize = info.Size()
+	}
+	growth := size
+	if oldRef.owner == b.user {
+		growth -= oldSize
+	}
+	if b.overQuota(growth) {
+		return &os.PathError{Op: "close", Path: name, Err: syscall.ENOSPC}
+	}
+
+	if b.refs[ref.hash] == 0 {
+		if err := b.Backend.Mkdir(path.Dir(ref.blobPath()), 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := b.Backend.Rename(spoolPath, ref.blobPath()); err != nil {
+			return err
+		}
+	}
+	b.refs[ref.hash]++
+	// the reference replaces the file as a whole, never leaving it half written
+	refTmp, err := b.writeTemp(strings.NewReader(ref.String()), info.Mode().Perm())
+	if err == nil {
+		if err = b.Backend.Rename(refTmp, name); err != nil {
+			b.Backend.Remove(refTmp)
+		}
+	}
+	if err != nil {
+		b.release(ref)
+		return err
+	}
+	b.usage[oldRef.owner] -= oldSize
+	b.usage[b.user] += size
+	if oldIsRef {
+		b.release(oldRef)
+	}
+	return nil
+}
+
+// writeTemp copies src to a new temporary file of the blob store with perm.
+func (b *dedupBackend) writeTemp(src io.ReaderAt, perm os.FileMode) (string, error) {
+	tmp := b.tempPath()
+	f, err := b.Backend.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(&offsetWriter{w: f}, io.NewSectionReader(src, 0, 1<<62))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		b.Backend.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+func (b *dedupBackend) Remove(p string) error {
+	if isDedupPath(p) {
+		return dedupHidden("remove", p)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	info, err := b.Backend.Lstat(p)
+	if err != nil {
+		return err
+	}
+	var size int64
+	var ref dedupRef
+	var isRef bool
+	if info.Mode().IsRegular() {
+		size, ref, isRef = b.logicalSize(p, info)
+	}
+	if err := b.Backend.Remove(p); err != nil {
+		return err
+	}
+	b.usage[ref.owner] -= size
+	if isRef {
+		b.release(ref)
+	}
+	return nil
+}
+
+func (b *dedupBackend) Rename(from, to string) error {
+	if isDedupPath(from) {
+		return dedupHidden("rename", from)
+	}
+	if isDedupPath(to) {
+		return dedupHidden("rename", to)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// a file replaced by the rename is released
+	var size int64
+	var ref dedupRef
+	var isRef bool
+	info, err := b.Backend.Lstat(to)
+	if err == nil && info.Mode().IsRegular() && cleanPath(from) != cleanPath(to) {
+		size, ref, isRef = b.logicalSize(to, info)
+	}
+	if err := b.Backend.Rename(from, to); err != nil {
+		return err
+	}
+	b.usage[ref.owner] -= size
+	if isRef {
+		b.release(ref)
+	}
+	return nil
+}
+
+// Link creates newname as another reference to the blob of oldname.
+// Unlike a hard link both are updated independently.
+func (b *dedupBackend) Link(oldname, newname string) error {
+	if isDedupPath(oldname) {
+		return dedupHidden("link", oldname)
+	}
+	if isDedupPath(newname) {
+		return dedupHidden("link", newname)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	info, err := b.Backend.Lstat(oldname)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return b.Backend.Link(oldname, newname)
+	}
+	size, ref, isRef := b.logicalSize(oldname, info)
+	if !isRef {
+		// like the file, the link counts against no user
+		if err := b.Backend.Link(oldname, newname); err != nil {
+			return err
+		}
+		b.usage[""] += size
+		return nil
+	}
+	if b.overQuota(size) {
+		return &os.PathError{Op: "link", Path: newname, Err: syscall.ENOSPC}
+	}
+	ref.owner = b.user
+
+	f, err := b.Backend.OpenFile(newname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt([]byte(ref.String()), 0)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		b.Backend.Remove(newname)
+		return err
+	}
+	b.refs[ref.hash]++
+	b.usage[b.user] += size
+	return nil
+}
+
+func (b *dedupBackend) Symlink(oldname, newname string) error {
+	if isDedupPath(oldname) {
+		return &os.PathError{Op: "symlink", Path: oldname, Err: syscall.EPERM}
+	}
+	if isDedupPath(newname) {
+		return dedupHidden("symlink", newname)
+	}
+	return b.Backend.Symlink(oldname, newname)
+}
+
+func (b *dedupBackend) Mkdir(p string, perm os.FileMode) error {
+	if isDedupPath(p) {
+		return &os.PathError{Op: "mkdir", Path: p, Err: syscall.EPERM}
+	}
+	return b.Backend.Mkdir(p, perm)
+}
+
+func (b *dedupBackend) Readlink(p string) (string, error) {
+	if isDedupPath(p) {
+		return "", dedupHidden("readlink", p)
+	}
+	return b.Backend.Readlink(p)
+}
+
+func (b *dedupBackend) Chmod(p string, mode os.FileMode) error {
+	if isDedupPath(p) {
+		return dedupHidden("chmod", p)
+	}
+	return b.Backend.Chmod(p, mode)
+}
+
+func (b *dedupBackend) Chtimes(p string, atime, mtime time.Time) error {
+	if isDedupPath(p) {
+		return dedupHidden("chtimes", p)
+	}
+	return b.Backend.Chtimes(p, atime, mtime)
+}
+
+// dedupFile is an open deduplicated file. Readers read the blob directly,
+// writers keep the contents in a spool file until closed.
+type dedupFile struct {
+	b    *dedupBackend
+	name string
+	blob File
+
+	mu        sync.Mutex
+	inner     File
+	spool     File
+	spoolPath string
+	oldSize   int64 // of the contents replaced, if counted against the user
+	dirty     bool
+}
+
+func (f *dedupFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.blob != nil {
+		return f.blob.ReadAt(p, off)
+	}
+	return f.spool.ReadAt(p, off)
+}
+
+// checkQuota returns an error if the file growing to size would exceed the quota.
+func (f *dedupFile) checkQuota(size int64) error {
+	if f.b.quota == 0 {
+		return nil
+	}
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if f.b.overQuota(size - f.oldSize) {
+		return &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+	}
+	return nil
+}
+
+func (f *dedupFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.spool == nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if err := f.checkQuota(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+	f.dirty = true
+	return f.spool.WriteAt(p, off)
+}
+
+func (f *dedupFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.spool == nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+	}
+	if err := f.checkQuota(size); err != nil {
+		return err
+	}
+	f.dirty = true
+	return f.spool.Truncate(size)
+}
+
+func (f *dedupFile) TransferError(err error) {
+	if f.blob != nil {
+		transferError(f.blob, err)
+		return
+	}
+	transferError(f.inner, err)
+}
+
+func (f *dedupFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.blob != nil {
+		return f.blob.Close()
+	}
+	if f.spool == nil {
+		return os.ErrClosed
+	}
+	err := f.spool.Close()
+	if err == nil && f.dirty {
+		err = f.b.store(f.name, f.inner, f.spoolPath)
+	}
+	// gone unless it became a blob
+	f.b.Backend.Remove(f.spoolPath)
+	f.spool = nil
+	if cerr := f.inner.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,240 @@
+package srv
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// countBlobs returns the number of blobs in the store of the dedup backend wrapping inner.
+func countBlobs(t *testing.T, inner Backend) int {
+	t.Helper()
+	prefixes, err := inner.Readdir(dedupDir + "/blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, prefix := range prefixes {
+		blobs, err := inner.Readdir(dedupDir + "/blobs/" + prefix.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		n += len(blobs)
+	}
+	return n
+}
+
+func TestDedupBackend(t *testing.T) {
+	inner := NewMemBackend(0)
+	backend, err := NewDedupBackend(inner, 0)
+	if err != nil {
+		t.Fatalf("NewDedupBackend() error = %v", err)
+	}
+	b := backend.(*dedupBackend)
+	daily := strings.Repeat("id,amount\n", 1000)
+
+	writeMemFile(t, b, "/monday.csv", daily)
+	if err := b.Mkdir("/archive", 0770); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, b, "/archive/tuesday.csv", daily)
+	if err := b.Link("/monday.csv", "/copy.csv"); err != nil {
+		t.Fatalf("Link() error = %v", err)
+	}
+	if n := countBlobs(t, inner); n != 1 {
+		t.Errorf("stored %d blobs of identical files, want 1", n)
+	}
+	if got := readMemFile(t, b, "/archive/tuesday.csv"); got != daily {
+		t.Errorf("read %d bytes, want %d", len(got), len(daily))
+	}
+	infos, err := b.Readdir("/")
+	if err != nil || len(infos) != 3 {
+		t.Fatalf("Readdir(/) = %v, %v, want 3 entries", infos, err)
+	}
+	for _, info := range infos {
+		if !info.IsDir() && info.Size() != int64(len(daily)) {
+			t.Errorf("Readdir() size of %s = %d, want %d", info.Name(), info.Size(), len(daily))
+		}
+	}
+	if used, _ := b.Usage(""); used != 3*int64(len(daily)) {
+		t.Errorf("usage = %d, want logical size %d", used, 3*len(daily))
+	}
+	if _, err := b.Stat("/archive/../.dedup/blobs"); !os.IsNotExist(err) {
+		t.Errorf("Stat() of blob store error = %v, want not exist", err)
+	}
+
+	// modifying one copy leaves the others as is
+	f, err := b.OpenFile("/copy.csv", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("ID"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, b, "/copy.csv"); got != "ID"+daily[2:] {
+		t.Errorf("read modified copy = %q...", got[:10])
+	}
+	if got := readMemFile(t, b, "/monday.csv"); got != daily {
+		t.Errorf("original modified by write to copy")
+	}
+	if n := countBlobs(t, inner); n != 2 {
+		t.Errorf("stored %d blobs, want 2", n)
+	}
+
+	// references are counted again when restarting
+	backend, err = NewDedupBackend(inner, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = backend.(*dedupBackend)
+	for _, p := range []string{"/copy.csv", "/monday.csv"} {
+		if err := b.Remove(p); err != nil {
+			t.Fatalf("Remove(%s) error = %v", p, err)
+		}
+	}
+	if n := countBlobs(t, inner); n != 1 {
+		t.Errorf("stored %d blobs after remove, want 1", n)
+	}
+	if err := b.Rename("/archive/tuesday.csv", "/archive/2020.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Remove("/archive/2020.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := b.Usage(""); countBlobs(t, inner) != 0 || used != 0 {
+		t.Errorf("%d blobs and usage %d left after removing all files", countBlobs(t, inner), used)
+	}
+}
+
+func TestDedupBackend_Spool(t *testing.T) {
+	inner := NewMemBackend(0)
+	b, err := NewDedupBackend(inner, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, b, "/a.csv", "id,name\n")
+	f, err := b.OpenFile("/a.csv", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("1,x\n"), 8); err != nil {
+		t.Fatal(err)
+	}
+	// the contents are spooled through the wrapped backend, not to a local file
+	if tmps, err := inner.Readdir(dedupDir + "/tmp"); err != nil || len(tmps) != 1 {
+		t.Errorf("Readdir() of the spool directory = %v, %v, want one spool", tmps, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tmps, _ := inner.Readdir(dedupDir + "/tmp"); len(tmps) != 0 {
+		t.Errorf("Readdir() of the spool directory after Close() = %v, want empty", tmps)
+	}
+	if got := readMemFile(t, b, "/a.csv"); got != "id,name\n1,x\n" {
+		t.Errorf("read %q after append", got)
+	}
+	if n := countBlobs(t, inner); n != 1 {
+		t.Errorf("stored %d blobs, want 1", n)
+	}
+}
+
+func TestDedupBackend_Quota(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		wantErr bool
+	}{
+		{name: "within quota", files: []string{"12345", "12345"}},
+		{name: "copies count", files: []string{"123456", "123456"}, wantErr: true},
+		{name: "over quota", files: []string{"12345678901"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewDedupBackend(NewMemBackend(0), 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var writeErr error
+			for i, content := range tt.files {
+				f, err := b.OpenFile(fmt.Sprintf("/file%d", i), os.O_WRONLY|os.O_CREATE, 0660)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, writeErr = f.WriteAt([]byte(content), 0)
+				f.Close()
+				if writeErr != nil {
+					break
+				}
+			}
+			if (writeErr != nil) != tt.wantErr {
+				t.Errorf("WriteAt() error = %v, wantErr %v", writeErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDedup_Users(t *testing.T) {
+	inner := NewMemBackend(0)
+	d, err := NewDedup(inner, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := d.Backend("alice"), d.Backend("bob")
+	writeMemFile(t, alice, "/a", "12345678")
+	writeMemFile(t, bob, "/b", "12345678")
+	if err := alice.Chmod("/a", 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := alice.OpenFile("/c", os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("12345"), 0); err == nil {
+		t.Error("WriteAt() over the quota of the user succeeded")
+	}
+	f.Close()
+	// replacing the file of the user only counts the difference
+	writeMemFile(t, alice, "/a", "1234567890")
+	if info, err := inner.Stat("/a"); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("Stat() after rewrite = %v, %v, want permissions kept", info, err)
+	}
+
+	d, err = NewDedup(inner, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []UserQuota{{"alice", 10, 10}, {"bob", 8, 10}, {"carol", 0, 10}} {
+		if used, limit := d.Usage(want.User); used != want.Used || limit != want.Limit {
+			t.Errorf("Usage(%s) = %d, %d, want %d, %d", want.User, used, limit, want.Used, want.Limit)
+		}
+	}
+	if err := d.Backend("bob").Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := d.Usage("alice"); used != 0 {
+		t.Errorf("Usage(alice) = %d after removing the file, want 0", used)
+	}
+}
+
+func TestDedupBackend_TransferError(t *testing.T) {
+	inner := &transferErrorBackend{Backend: NewMemBackend(0)}
+	b, err := NewDedupBackend(inner, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, b, "/file", "hello")
+	for _, flags := range []int{os.O_RDONLY, os.O_WRONLY} {
+		inner.files = nil
+		f, err := b.OpenFile("/file", flags, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTransferError(t, f, inner)
+		f.Close()
+	}
+}
@@ -1,36 +1,67 @@
 package srv
 
 import (
-	"io"
+	"fmt"
 	"os"
-)
-
-// File is a file abstraction - implemented by *os.File
-type File interface {
-	//io.Reader
-	//io.Writer
-	//io.Seeker
-	io.ReaderAt
-	io.WriterAt
-	io.Closer
+	"path/filepath"
+	"strings"
+	"time"
 
-	Readdir(n int) ([]os.FileInfo, error)
-	Truncate(size int64) error
-}
+	"github.com/pkg/sftp"
+)
 
 // fsImpl provides file system access. Thinnest possible Facade over `os` package.
 // Also allows for sanitizing filepaths.
 // All errors from underlying implementation are retuned as is.
 type fsImpl struct {
+	root      string
 	sanitizer func(string) (string, error)
-	logger    func(format string, args ...interface{})
 }
 
-func (fs fsImpl) log(f string, args ...interface{}) {
-	if fs.logger == nil {
-		return
+var _ Backend = &fsImpl{}
+
+// NewOSBackend returns a Backend serving the directory root of the local file system.
+func NewOSBackend(root string) (Backend, error) {
+	info, err := os.Stat(root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error opening root dir %q: %w", root, err)
+	}
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("root %q does not exist", root)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("root path %q is not a directory", root)
+	}
+
+	return &fsImpl{
+		root:      root,
+		sanitizer: rootSanitizer(root),
+	}, nil
+}
+
+// rootSanitizer returns a sanitizer mapping virtual paths to paths below root.
+func rootSanitizer(root string) func(string) (string, error) {
+	return func(path string) (string, error) {
+		orgPath := path
+		path = filepath.Join(root, path)
+		path = filepath.Clean(path)
+		if !withinRoot(path, root) {
+			return root, fmt.Errorf("invalid file path %q", orgPath)
+		}
+		return path, nil
+	}
+}
+
+// withinRoot reports whether the real path p is root or below it.
+func withinRoot(p, root string) bool {
+	root = filepath.Clean(root)
+	if p == root {
+		return true
 	}
-	fs.logger(f, args...)
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+	return strings.HasPrefix(p, root)
 }
 
 func (fs fsImpl) sanitize(prevErr error, path string) (string, error) {
@@ -40,9 +71,7 @@ func (fs fsImpl) sanitize(prevErr error, path string) (string, error) {
 	if fs.sanitizer == nil {
 		return path, nil
 	}
-	sanitizedPath, err := fs.sanitizer(path)
-	fs.log("sanitize error = %v, path = %s, sanitized = %s", err, path, sanitizedPath)
-	return sanitizedPath, err
+	return fs.sanitizer(path)
 }
 
 func (fs fsImpl) OpenFile(path string, flags int, perm os.FileMode) (File, error) {
@@ -51,8 +80,11 @@ func (fs fsImpl) OpenFile(path string, flags int, perm os.FileMode) (File, error
 		return nil, err
 	}
 	file, err := os.OpenFile(path, flags, perm)
-	fs.log("OpenFile path = %q, err = %v", path, err)
-	return file, err
+	if err != nil {
+		// avoid returning a non-nil File holding a nil *os.File
+		return nil, err
+	}
+	return file, nil
 }
 
 func (fs fsImpl) Stat(path string) (os.FileInfo, error) {
@@ -61,28 +93,56 @@ func (fs fsImpl) Stat(path string) (os.FileInfo, error) {
 		return nil, err
 	}
 	fileinfo, err := os.Stat(path)
-	fs.log("Stat path = %q, err = %v", path, err)
 	return fileinfo, err
 }
 
+func (fs fsImpl) Lstat(path string) (os.FileInfo, error) {
+	path, err := fs.sanitize(nil, path)
+	if err != nil {
+		return nil, err
+	}
+	fileinfo, err := os.Lstat(path)
+	return fileinfo, err
+}
+
+func (fs fsImpl) Readdir(dirPath string) ([]os.FileInfo, error) {
+	dirPath, err := fs.sanitize(nil, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	infos, err := dir.Readdir(0)
+	return infos, err
+}
+
 func (fs fsImpl) Readlink(path string) (string, error) {
 	path, err := fs.sanitize(nil, path)
 	if err != nil {
 		return "", err
 	}
 	linkPath, err := os.Readlink(path)
-	fs.log("Readlink path = %q, err = %v", path, err)
-	return linkPath, err
+	if err != nil {
+		return "", err
+	}
+	// links are created with sanitized targets, hand back the virtual path.
+	root := filepath.Clean(fs.root)
+	if fs.root != "" && withinRoot(linkPath, root) {
+		linkPath = cleanPath(filepath.ToSlash(strings.TrimPrefix(linkPath, root)))
+	}
+	return linkPath, nil
 }
 
 func (fs fsImpl) Rename(from, to string) error {
 	from, err := fs.sanitize(nil, from)
-	to, err = fs.sanitize(nil, to)
+	to, err = fs.sanitize(err, to)
 	if err != nil {
 		return err
 	}
 	err = os.Rename(from, to)
-	fs.log("Rename from = %q, to = %q, err = %v", from, to, err)
 	return err
 }
 
@@ -92,7 +152,6 @@ func (fs *fsImpl) Remove(dirPath string) error {
 		return err
 	}
 	err = os.Remove(dirPath)
-	fs.log("Remove path = %q, err = %v", dirPath, err)
 	return err
 }
 
@@ -102,28 +161,52 @@ func (fs fsImpl) Mkdir(path string, perm os.FileMode) error {
 		return err
 	}
 	err = os.Mkdir(path, perm)
-	fs.log("Mkdir path = %q, err = %v", path, err)
 	return err
 }
 
-func (fs fsImpl) Link(file, target string) error {
-	file, err := fs.sanitize(nil, file)
-	target, err = fs.sanitize(nil, target)
+func (fs fsImpl) Link(oldname, newname string) error {
+	oldname, err := fs.sanitize(nil, oldname)
+	newname, err = fs.sanitize(err, newname)
 	if err != nil {
 		return err
 	}
-	err = os.Link(file, target)
-	fs.log("Link file = %q, target = %q, err = %v", file, target, err)
+	err = os.Link(oldname, newname)
 	return err
 }
 
-func (fs fsImpl) Symlink(file, target string) error {
-	file, err := fs.sanitize(nil, file)
-	target, err = fs.sanitize(nil, target)
+func (fs fsImpl) Symlink(oldname, newname string) error {
+	oldname, err := fs.sanitize(nil, oldname)
+	newname, err = fs.sanitize(err, newname)
 	if err != nil {
 		return err
 	}
-	err = os.Symlink(file, target)
-	fs.log("Symlink file = %q, target = %q, err = %v", file, target, err)
+	err = os.Symlink(oldname, newname)
 	return err
 }
+
+func (fs fsImpl) Chmod(path string, mode os.FileMode) error {
+	path, err := fs.sanitize(nil, path)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(path, mode)
+	return err
+}
+
+func (fs fsImpl) Chtimes(path string, atime, mtime time.Time) error {
+	path, err := fs.sanitize(nil, path)
+	if err != nil {
+		return err
+	}
+	err = os.Chtimes(path, atime, mtime)
+	return err
+}
+
+func (fs fsImpl) StatFS(path string) (*sftp.StatVFS, error) {
+	path, err := fs.sanitize(nil, path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := statFS(path)
+	return stat, err
+}
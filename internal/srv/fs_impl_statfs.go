@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package srv
+
+import (
+	"syscall"
+
+	"github.com/pkg/sftp"
+)
+
+func statFS(path string) (*sftp.StatVFS, error) {
+	stat := &syscall.Statfs_t{}
+	if err := syscall.Statfs(path, stat); err != nil {
+		return nil, err
+	}
+	return &sftp.StatVFS{
+		Bsize:   uint64(stat.Bsize),
+		Frsize:  uint64(stat.Frsize),
+		Blocks:  stat.Blocks,
+		Bfree:   stat.Bfree,
+		Bavail:  stat.Bavail,
+		Files:   stat.Files,
+		Ffree:   stat.Ffree,
+		Favail:  stat.Ffree, // not sure how to calculate Favail
+		Flag:    uint64(stat.Flags),
+		Namemax: uint64(stat.Namelen),
+	}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package srv
+
+import (
+	"github.com/pkg/sftp"
+)
+
+func statFS(path string) (*sftp.StatVFS, error) {
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
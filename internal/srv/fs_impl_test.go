@@ -0,0 +1,78 @@
+package srv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRootSanitizer(t *testing.T) {
+	tests := []struct {
+		root    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"/srv", "/file", "/srv/file", false},
+		{"/srv", "/", "/srv", false},
+		{"/srv", "/../../etc/passwd", "/srv", true},
+		{"/srv", "/../srvother/file", "/srv", true},
+		{"/srv/", "dir/file", "/srv/dir/file", false},
+		{"/", "/file", "/file", false},
+	}
+	for _, tt := range tests {
+		got, err := rootSanitizer(tt.root)(tt.path)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("rootSanitizer(%q)(%q) = %q, %v, want %q", tt.root, tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestWithinRoot(t *testing.T) {
+	tests := []struct {
+		path, root string
+		want       bool
+	}{
+		{"/srv", "/srv", true},
+		{"/srv/file", "/srv", true},
+		{"/srv/file", "/srv/", true},
+		{"/srvother", "/srv", false},
+		{"/srvother/file", "/srv", false},
+		{"/file", "/", true},
+	}
+	for _, tt := range tests {
+		if got := withinRoot(tt.path, tt.root); got != tt.want {
+			t.Errorf("withinRoot(%q, %q) = %v, want %v", tt.path, tt.root, got, tt.want)
+		}
+	}
+}
+
+func TestOSBackend_Readlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "srv")
+	if err := os.Mkdir(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewOSBackend(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Symlink("/file", "/inside"); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(dir, "srvother", "file")
+	if err := os.Symlink(outside, filepath.Join(root, "outside")); err != nil {
+		t.Fatal(err)
+	}
+	for link, want := range map[string]string{"/inside": "/file", "/outside": outside} {
+		if got, err := b.Readlink(link); err != nil || got != want {
+			t.Errorf("Readlink(%q) = %q, %v, want %q", link, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package srv
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// logBackend logs the operations on the wrapped Backend, whichever it is, with
+// the fields of the logger of the session.
+type logBackend struct {
+	Backend
+	logger *Logger
+}
+
+var _ Backend = &logBackend{}
+
+// NewLogBackend returns a Backend logging the operations on backend to logger,
+// with the component "fs".
+func NewLogBackend(backend Backend, logger *Logger) Backend {
+	return &logBackend{Backend: backend, logger: logger.With("component", "fs")}
+}
+
+// log logs op at LevelDebug, or at LevelWarn if it failed with an error other
+// than a file system error, eg. a path outside of the root or a storage failure.
+func (b *logBackend) log(op string, err error, kv ...interface{}) {
+	kv = append(kv, "err", err)
+	var pathErr *os.PathError
+	var linkErr *os.LinkError
+	var syscallErr *os.SyscallError
+	if err != nil && !errors.As(err, &pathErr) && !errors.As(err, &linkErr) && !errors.As(err, &syscallErr) {
+		b.logger.Warn(op, kv...)
+		return
+	}
+	b.logger.Debug(op, kv...)
+}
+
+func (b *logBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	f, err := b.Backend.OpenFile(p, flags, perm)
+	b.log("openfile", err, "path", p, "flags", flags)
+	return f, err
+}
+
+func (b *logBackend) Stat(p string) (os.FileInfo, error) {
+	info, err := b.Backend.Stat(p)
+	b.log("stat", err, "path", p)
+	return info, err
+}
+
+func (b *logBackend) Lstat(p string) (os.FileInfo, error) {
+	info, err := b.Backend.Lstat(p)
+	b.log("lstat", err, "path", p)
+	return info, err
+}
+
+func (b *logBackend) Readdir(p string) ([]os.FileInfo, error) {
+	infos, err := b.Backend.Readdir(p)
+	b.log("readdir", err, "path", p, "entries", len(infos))
+	return infos, err
+}
+
+func (b *logBackend) Rename(from, to string) error {
+	err := b.Backend.Rename(from, to)
+	b.log("rename", err, "from", from, "to", to)
+	return err
+}
+
+func (b *logBackend) Remove(p string) error {
+	err := b.Backend.Remove(p)
+	b.log("remove", err, "path", p)
+	return err
+}
+
+func (b *logBackend) Mkdir(p string, perm os.FileMode) error {
+	err := b.Backend.Mkdir(p, perm)
+	b.log("mkdir", err, "path", p)
+	return err
+}
+
+func (b *logBackend) Link(oldname, newname string) error {
+	err := b.Backend.Link(oldname, newname)
+	b.log("link", err, "oldname", oldname, "newname", newname)
+	return err
+}
+
+func (b *logBackend) Symlink(oldname, newname string) error {
+	err := b.Backend.Symlink(oldname, newname)
+	b.log("symlink", err, "oldname", oldname, "newname", newname)
+	return err
+}
+
+func (b *logBackend) Readlink(p string) (string, error) {
+	target, err := b.Backend.Readlink(p)
+	b.log("readlink", err, "path", p)
+	return target, err
+}
+
+func (b *logBackend) Chmod(p string, mode os.FileMode) error {
+	err := b.Backend.Chmod(p, mode)
+	b.log("chmod", err, "path", p, "mode", mode)
+	return err
+}
+
+func (b *logBackend) Chtimes(p string, atime, mtime time.Time) error {
+	err := b.Backend.Chtimes(p, atime, mtime)
+	b.log("chtimes", err, "path", p)
+	return err
+}
+
+func (b *logBackend) StatFS(p string) (*sftp.StatVFS, error) {
+	stat, err := b.Backend.StatFS(p)
+	b.log("statfs", err, "path", p)
+	return stat, err
+}
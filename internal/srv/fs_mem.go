@@ -0,0 +1,575 @@
+package srv
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// maxSymlinkDepth is the number of symlinks followed before giving up with ELOOP.
+const maxSymlinkDepth = 40
+
+// memBackend is a Backend keeping everything in memory.
+// It's safe for concurrent use. All state is guarded by a single lock.
+type memBackend struct {
+	mu       sync.RWMutex
+	root     *memNode
+	used     int64
+	maxBytes int64
+}
+
+var _ Backend = &memBackend{}
+
+// memNode is an inode; a directory entry (or several if hard linked) refers to it.
+type memNode struct {
+	mode    os.FileMode
+	modTime time.Time
+	atime   time.Time
+	nlink   int
+	open    int // handles, keeping the data of an unlinked node counted
+
+	data    []byte              // regular files
+	entries map[string]*memNode // directories
+	target  string              // symlinks
+}
+
+// NewMemBackend returns an empty in-memory Backend.
+// File contents are limited to maxBytes in total, unless maxBytes is 0.
+func NewMemBackend(maxBytes int64) Backend {
+	now := time.Now()
+	return &memBackend{
+		maxBytes: maxBytes,
+		root: &memNode{
+			mode:    os.ModeDir | 0770,
+			modTime: now,
+			atime:   now,
+			nlink:   1,
+			entries: map[string]*memNode{},
+		},
+	}
+}
+
+func memErr(op, p string, errno syscall.Errno) error {
+	return &os.PathError{Op: op, Path: p, Err: errno}
+}
+
+func splitPath(p string) (dir, name string) {
+	p = cleanPath(p)
+	return path.Dir(p), path.Base(p)
+}
+
+// lookup resolves p, following symlinks in all but (unless follow is set) the last element.
+// Must be called with lock held.
+func (b *memBackend) lookup(op, p string, follow bool) (*memNode, error) {
+	return b.lookupDepth(op, p, follow, 0)
+}
+
+func (b *memBackend) lookupDepth(op, p string, follow bool, depth int) (*memNode, error) {
+	p = cleanPath(p)
+	node := b.root
+	cur := "/"
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		if !node.mode.IsDir() {
+			return nil, memErr(op, p, syscall.ENOTDIR)
+		}
+		child, ok := node.entries[part]
+		if !ok {
+			return nil, memErr(op, p, syscall.ENOENT)
+		}
+		last := i == len(parts)-1
+		if child.mode&os.ModeSymlink != 0 && (!last || follow) {
+			if depth >= maxSymlinkDepth {
+				return nil, memErr(op, p, syscall.ELOOP)
+			}
+			target := child.target
+			if !path.IsAbs(target) {
+				target = path.Join(cur, target)
+			}
+			resolved, err := b.lookupDepth(op, target, true, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			child = resolved
+		}
+		node = child
+		cur = path.Join(cur, part)
+	}
+	return node, nil
+}
+
+// parent returns the directory which should hold p and the name of p within it.
+// Must be called with lock held.
+func (b *memBackend) parent(op, p string) (*memNode, string, error) {
+	dirPath, name := splitPath(p)
+	if name == "/" {
+		return nil, "", memErr(op, p, syscall.EPERM)
+	}
+	dir, err := b.lookup(op, dirPath, true)
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.mode.IsDir() {
+		return nil, "", memErr(op, p, syscall.ENOTDIR)
+	}
+	return dir, name, nil
+}
+
+// createPath returns the path of the file to create for p, the target of the
+// symlinks p ends with, if any. Must be called with lock held.
+func (b *memBackend) createPath(p string) (string, error) {
+	p = cleanPath(p)
+	for depth := 0; ; depth++ {
+		dir, name, err := b.parent("open", p)
+		if err != nil {
+			return "", err
+		}
+		link, ok := dir.entries[name]
+		if !ok || link.mode&os.ModeSymlink == 0 {
+			return p, nil
+		}
+		if depth >= maxSymlinkDepth {
+			return "", memErr("open", p, syscall.ELOOP)
+		}
+		target := link.target
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(p), target)
+		}
+		p = cleanPath(target)
+	}
+}
+
+// grow accounts for n more bytes of file data, which count until the node is
+// both unlinked and closed. Must be called with write lock held.
+func (b *memBackend) grow(op, p string, node *memNode, n int64) error {
+	if n > 0 && b.maxBytes > 0 && b.used+n > b.maxBytes {
+		return memErr(op, p, syscall.ENOSPC)
+	}
+	b.used += n
+	return nil
+}
+
+// unlink drops a directory entry. Must be called with write lock held.
+func (b *memBackend) unlink(dir *memNode, name string) {
+	node := dir.entries[name]
+	delete(dir.entries, name)
+	dir.modTime = time.Now()
+	node.nlink--
+	b.release(node)
+}
+
+// release uncounts the data of node once unlinked and closed. Must be called
+// with write lock held.
+func (b *memBackend) release(node *memNode) {
+	if node.nlink == 0 && node.open == 0 {
+		b.used -= int64(len(node.data))
+		node.data = nil
+	}
+}
+
+func (b *memBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	node, err := b.lookup("open", p, true)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0 {
+		if _, err := b.lookup("open", p, false); err == nil {
+			return nil, memErr("open", p, syscall.EEXIST)
+		}
+	}
+	if node == nil {
+		if flags&os.O_CREATE == 0 {
+			return nil, err
+		}
+		target, err := b.createPath(p)
+		if err != nil {
+			return nil, err
+		}
+		dir, name, err := b.parent("open", target)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		node = &memNode{mode: perm.Perm(), modTime: now, atime: now, nlink: 1}
+		dir.entries[name] = node
+		dir.modTime = now
+	}
+
+	writable := flags&(os.O_WRONLY|os.O_RDWR) != 0
+	if node.mode.IsDir() && writable {
+		return nil, memErr("open", p, syscall.EISDIR)
+	}
+	if flags&os.O_TRUNC != 0 && writable && len(node.data) > 0 {
+		_ = b.grow("open", p, node, -int64(len(node.data)))
+		node.data = nil
+		node.modTime = time.Now()
+	}
+
+	node.open++
+	return &memFile{
+		b:        b,
+		node:     node,
+		name:     cleanPath(p),
+		readable: flags&os.O_WRONLY == 0,
+		writable: writable,
+	}, nil
+}
+
+func (b *memBackend) Stat(p string) (os.FileInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	node, err := b.lookup("stat", p, true)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(path.Base(cleanPath(p))), nil
+}
+
+func (b *memBackend) Lstat(p string) (os.FileInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	node, err := b.lookup("lstat", p, false)
+	if err != nil {
+		return nil, err
+	}
+	return node.info(path.Base(cleanPath(p))), nil
+}
+
+func (b *memBackend) Readdir(p string) ([]os.FileInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	node, err := b.lookup("readdir", p, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, memErr("readdir", p, syscall.ENOTDIR)
+	}
+	infos := make([]os.FileInfo, 0, len(node.entries))
+	for name, child := range node.entries {
+		infos = append(infos, child.info(name))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (b *memBackend) Rename(from, to string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fromDir, fromName, err := b.parent("rename", from)
+	if err != nil {
+		return err
+	}
+	node, ok := fromDir.entries[fromName]
+	if !ok {
+		return memErr("rename", from, syscall.ENOENT)
+	}
+	toDir, toName, err := b.parent("rename", to)
+	if err != nil {
+		return err
+	}
+	if cleanPath(from) == cleanPath(to) {
+		return nil
+	}
+	if node.mode.IsDir() && strings.HasPrefix(cleanPath(to), cleanPath(from)+"/") {
+		return memErr("rename", to, syscall.EINVAL)
+	}
+	if existing, ok := toDir.entries[toName]; ok {
+		switch {
+		case existing == node:
+			return nil
+		case node.mode.IsDir() && !existing.mode.IsDir():
+			return memErr("rename", to, syscall.ENOTDIR)
+		case !node.mode.IsDir() && existing.mode.IsDir():
+			return memErr("rename", to, syscall.EISDIR)
+		case existing.mode.IsDir() && len(existing.entries) > 0:
+			return memErr("rename", to, syscall.ENOTEMPTY)
+		}
+		b.unlink(toDir, toName)
+	}
+
+	delete(fromDir.entries, fromName)
+	toDir.entries[toName] = node
+	now := time.Now()
+	fromDir.modTime = now
+	toDir.modTime = now
+	return nil
+}
+
+func (b *memBackend) Remove(p string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dir, name, err := b.parent("remove", p)
+	if err != nil {
+		return err
+	}
+	node, ok := dir.entries[name]
+	if !ok {
+		return memErr("remove", p, syscall.ENOENT)
+	}
+	if node.mode.IsDir() && len(node.entries) > 0 {
+		return memErr("remove", p, syscall.ENOTEMPTY)
+	}
+	b.unlink(dir, name)
+	return nil
+}
+
+func (b *memBackend) Mkdir(p string, perm os.FileMode) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dir, name, err := b.parent("mkdir", p)
+	if err != nil {
+		return err
+	}
+	if _, exists := dir.entries[name]; exists {
+		return memErr("mkdir", p, syscall.EEXIST)
+	}
+	now := time.Now()
+	dir.entries[name] = &memNode{
+		mode:    os.ModeDir | perm.Perm(),
+		modTime: now,
+		atime:   now,
+		nlink:   1,
+		entries: map[string]*memNode{},
+	}
+	dir.modTime = now
+	return nil
+}
+
+func (b *memBackend) Link(oldname, newname string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	node, err := b.lookup("link", oldname, false)
+	if err != nil {
+		return err
+	}
+	if node.mode.IsDir() {
+		return memErr("link", oldname, syscall.EPERM)
+	}
+	dir, name, err := b.parent("link", newname)
+	if err != nil {
+		return err
+	}
+	if _, exists := dir.entries[name]; exists {
+		return memErr("link", newname, syscall.EEXIST)
+	}
+	dir.entries[name] = node
+	dir.modTime = time.Now()
+	node.nlink++
+	return nil
+}
+
+func (b *memBackend) Symlink(oldname, newname string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dir, name, err := b.parent("symlink", newname)
+	if err != nil {
+		return err
+	}
+	if _, exists := dir.entries[name]; exists {
+		return memErr("symlink", newname, syscall.EEXIST)
+	}
+	now := time.Now()
+	dir.entries[name] = &memNode{
+		mode:    os.ModeSymlink | 0777,
+		modTime: now,
+		atime:   now,
+		nlink:   1,
+		target:  oldname,
+	}
+	dir.modTime = now
+	return nil
+}
+
+func (b *memBackend) Readlink(p string) (string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	node, err := b.lookup("readlink", p, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return "", memErr("readlink", p, syscall.EINVAL)
+	}
+	return node.target, nil
+}
+
+func (b *memBackend) Chmod(p string, mode os.FileMode) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	node, err := b.lookup("chmod", p, true)
+	if err != nil {
+		return err
+	}
+	node.mode = node.mode&^os.ModePerm | mode.Perm()
+	return nil
+}
+
+func (b *memBackend) Chtimes(p string, atime, mtime time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	node, err := b.lookup("chtimes", p, true)
+	if err != nil {
+		return err
+	}
+	node.atime = atime
+	node.modTime = mtime
+	return nil
+}
+
+func (b *memBackend) StatFS(p string) (*sftp.StatVFS, error) {
+	const blockSize = 4096
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if _, err := b.lookup("statfs", p, true); err != nil {
+		return nil, err
+	}
+	total := b.maxBytes
+	if total <= 0 {
+		total = b.used + 1<<40
+	}
+	free := uint64(total-b.used) / blockSize
+	return &sftp.StatVFS{
+		Bsize:   blockSize,
+		Frsize:  blockSize,
+		Blocks:  uint64(total) / blockSize,
+		Bfree:   free,
+		Bavail:  free,
+		Namemax: 255,
+	}, nil
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return &memFileInfo{
+		name:    name,
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+// memFile is an open memNode.
+type memFile struct {
+	b        *memBackend
+	node     *memNode
+	name     string
+	readable bool
+	writable bool
+	closed   bool
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.readable || f.node.mode.IsDir() {
+		return 0, memErr("read", f.name, syscall.EBADF)
+	}
+	if off < 0 {
+		return 0, memErr("read", f.name, syscall.EINVAL)
+	}
+	f.node.atime = time.Now()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.writable {
+		return 0, memErr("write", f.name, syscall.EBADF)
+	}
+	if off < 0 {
+		return 0, memErr("write", f.name, syscall.EINVAL)
+	}
+	end := off + int64(len(p))
+	if grow := end - int64(len(f.node.data)); grow > 0 {
+		if err := f.b.grow("write", f.name, f.node, grow); err != nil {
+			return 0, err
+		}
+		f.node.data = append(f.node.data, make([]byte, grow)...)
+	}
+	n := copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return n, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if !f.writable {
+		return memErr("truncate", f.name, syscall.EBADF)
+	}
+	if size < 0 {
+		return memErr("truncate", f.name, syscall.EINVAL)
+	}
+	delta := size - int64(len(f.node.data))
+	if err := f.b.grow("truncate", f.name, f.node, delta); err != nil {
+		return err
+	}
+	if delta > 0 {
+		f.node.data = append(f.node.data, make([]byte, delta)...)
+	} else {
+		f.node.data = f.node.data[:size:size]
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	f.node.open--
+	f.b.release(f.node)
+	return nil
+}
@@ -0,0 +1,343 @@
+package srv
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// sftp open flags (SSH_FXF_*) as sent by clients
+const (
+	fxfRead  = 0x01
+	fxfWrite = 0x02
+	fxfCreat = 0x08
+	fxfTrunc = 0x10
+	fxfExcl  = 0x20
+)
+
+func writeMemFile(t *testing.T, b Backend, path, content string) {
+	t.Helper()
+	f, err := b.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		t.Fatalf("OpenFile(%q) error = %v", path, err)
+	}
+	if _, err := f.WriteAt([]byte(content), 0); err != nil {
+		t.Fatalf("WriteAt(%q) error = %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close(%q) error = %v", path, err)
+	}
+}
+
+func readMemFile(t *testing.T, b Backend, path string) string {
+	t.Helper()
+	f, err := b.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(%q) error = %v", path, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 1<<20))
+	if err != nil {
+		t.Fatalf("read %q error = %v", path, err)
+	}
+	return string(data)
+}
+
+func TestMemBackend_Links(t *testing.T) {
+	b := NewMemBackend(0)
+	if err := b.Mkdir("/dir", 0770); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, b, "/dir/file", "hello")
+
+	if err := b.Link("/dir/file", "/hard"); err != nil {
+		t.Fatalf("Link() error = %v", err)
+	}
+	if err := b.Symlink("dir/file", "/soft"); err != nil {
+		t.Fatalf("Symlink() error = %v", err)
+	}
+	writeMemFile(t, b, "/hard", "world")
+	if got := readMemFile(t, b, "/soft"); got != "world" {
+		t.Errorf("read through links = %q, want %q", got, "world")
+	}
+
+	info, err := b.Lstat("/soft")
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat(/soft) = %v, %v, want symlink", info, err)
+	}
+	target, err := b.Readlink("/soft")
+	if err != nil || target != "dir/file" {
+		t.Errorf("Readlink(/soft) = %q, %v", target, err)
+	}
+
+	if err := b.Remove("/dir/file"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := b.Stat("/soft"); !os.IsNotExist(err) {
+		t.Errorf("Stat(dangling link) error = %v, want not exist", err)
+	}
+	if got := readMemFile(t, b, "/hard"); got != "world" {
+		t.Errorf("read hard link after remove = %q", got)
+	}
+}
+
+func TestMemBackend_CreateThroughDanglingLink(t *testing.T) {
+	b := NewMemBackend(0)
+	if err := b.Mkdir("/dir", 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Symlink("target", "/dir/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Symlink("dir/link", "/outer"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.OpenFile("/outer", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660); !os.IsExist(err) {
+		t.Errorf("OpenFile(O_EXCL) error = %v, want exist", err)
+	}
+	writeMemFile(t, b, "/outer", "hello")
+	if got := readMemFile(t, b, "/dir/target"); got != "hello" {
+		t.Errorf("read target = %q, want %q", got, "hello")
+	}
+	for _, p := range []string{"/outer", "/dir/link"} {
+		if info, err := b.Lstat(p); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("Lstat(%s) = %v, %v, want the symlink kept", p, info, err)
+		}
+	}
+}
+
+func TestMemBackend_Limit(t *testing.T) {
+	b := NewMemBackend(8)
+	writeMemFile(t, b, "/a", "12345")
+
+	f, err := b.OpenFile("/b", os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("12345"), 0); err == nil {
+		t.Errorf("WriteAt() over limit succeeded")
+	}
+	f.Close()
+
+	if err := b.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, b, "/b", "12345678")
+}
+
+func TestMemBackend_LimitUnlinkedOpen(t *testing.T) {
+	b := NewMemBackend(8)
+	f, err := b.OpenFile("/a", os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("12345"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("12345"), 5); err == nil {
+		t.Error("WriteAt() to an unlinked file over limit succeeded")
+	}
+	writeMemFile(t, b, "/b", "123")
+	c, err := b.OpenFile("/c", os.O_WRONLY|os.O_CREATE, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.WriteAt([]byte("1"), 0); err == nil {
+		t.Error("WriteAt() with the space held by an unlinked open file succeeded")
+	}
+	c.Close()
+
+	f.Close()
+	writeMemFile(t, b, "/c", "12345")
+}
+
+func TestMemBackend_Concurrent(t *testing.T) {
+	b := NewMemBackend(0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("/file%d", i)
+			f, err := b.OpenFile(name, os.O_RDWR|os.O_CREATE, 0660)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer f.Close()
+			for off := int64(0); off < 64; off++ {
+				if _, err := f.WriteAt([]byte{byte(i)}, off); err != nil {
+					t.Error(err)
+					return
+				}
+				_, _ = b.Readdir("/")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	infos, err := b.Readdir("/")
+	if err != nil || len(infos) != 8 {
+		t.Fatalf("Readdir() = %d entries, %v", len(infos), err)
+	}
+	for _, info := range infos {
+		if info.Size() != 64 {
+			t.Errorf("%s size = %d, want 64", info.Name(), info.Size())
+		}
+	}
+}
+
+func TestUserRootHandler_Filecmd(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, b Backend)
+		req     *sftp.Request
+		wantErr bool
+		check   func(t *testing.T, b Backend)
+	}{
+		{
+			name: "mkdir",
+			req:  sftp.NewRequest("Mkdir", "/dir"),
+			check: func(t *testing.T, b Backend) {
+				if info, err := b.Stat("/dir"); err != nil || !info.IsDir() {
+					t.Errorf("Stat(/dir) = %v, %v", info, err)
+				}
+			},
+		},
+		{
+			name: "rename",
+			setup: func(t *testing.T, b Backend) {
+				writeMemFile(t, b, "/from", "data")
+			},
+			req: &sftp.Request{Method: "Rename", Filepath: "/from", Target: "/to"},
+			check: func(t *testing.T, b Backend) {
+				if got := readMemFile(t, b, "/to"); got != "data" {
+					t.Errorf("renamed content = %q", got)
+				}
+			},
+		},
+		{
+			name: "rename onto existing",
+			setup: func(t *testing.T, b Backend) {
+				writeMemFile(t, b, "/from", "data")
+				writeMemFile(t, b, "/to", "other")
+			},
+			req:     &sftp.Request{Method: "Rename", Filepath: "/from", Target: "/to"},
+			wantErr: true,
+		},
+		{
+			name: "remove",
+			setup: func(t *testing.T, b Backend) {
+				writeMemFile(t, b, "/file", "data")
+			},
+			req: sftp.NewRequest("Remove", "/file"),
+			check: func(t *testing.T, b Backend) {
+				if _, err := b.Stat("/file"); !os.IsNotExist(err) {
+					t.Errorf("Stat() after remove error = %v", err)
+				}
+			},
+		},
+		{
+			name: "rmdir file",
+			setup: func(t *testing.T, b Backend) {
+				writeMemFile(t, b, "/file", "data")
+			},
+			req:     sftp.NewRequest("Rmdir", "/file"),
+			wantErr: true,
+		},
+		{
+			name: "symlink",
+			setup: func(t *testing.T, b Backend) {
+				writeMemFile(t, b, "/file", "data")
+			},
+			req: &sftp.Request{Method: "Symlink", Filepath: "/file", Target: "/link"},
+			check: func(t *testing.T, b Backend) {
+				if got := readMemFile(t, b, "/link"); got != "data" {
+					t.Errorf("read through symlink = %q", got)
+				}
+			},
+		},
+		{
+			name: "escape root",
+			req:  sftp.NewRequest("Mkdir", "/../../dir"),
+			check: func(t *testing.T, b Backend) {
+				if _, err := b.Stat("/dir"); err != nil {
+					t.Errorf("Stat(/dir) error = %v", err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemBackend(0)
+			if tt.setup != nil {
+				tt.setup(t, b)
+			}
+			ur := newUserHandler(b, nil)
+			ur.logger = nil
+			if err := ur.Filecmd(tt.req); (err != nil) != tt.wantErr {
+				t.Errorf("Filecmd() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, b)
+			}
+		})
+	}
+}
+
+func TestUserRootHandler_Transfer(t *testing.T) {
+	b := NewMemBackend(0)
+	ur := newUserHandler(b, nil)
+	ur.logger = nil
+
+	put := sftp.NewRequest("Put", "/upload")
+	put.Flags = fxfWrite | fxfCreat | fxfTrunc
+	w, err := ur.Filewrite(put)
+	if err != nil {
+		t.Fatalf("Filewrite() error = %v", err)
+	}
+	if _, err := w.WriteAt([]byte("world"), 6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAt([]byte("hello "), 0); err != nil {
+		t.Fatal(err)
+	}
+	w.(io.Closer).Close()
+
+	get := sftp.NewRequest("Get", "/upload")
+	get.Flags = fxfRead
+	r, err := ur.Fileread(get)
+	if err != nil {
+		t.Fatalf("Fileread() error = %v", err)
+	}
+	buf := make([]byte, 5)
+	if n, err := r.ReadAt(buf, 6); n != 5 || string(buf) != "world" {
+		t.Errorf("ReadAt() = %d, %q, %v", n, buf, err)
+	}
+	r.(io.Closer).Close()
+
+	lister, err := ur.Filelist(sftp.NewRequest("List", "/"))
+	if err != nil {
+		t.Fatalf("Filelist() error = %v", err)
+	}
+	infos := make([]os.FileInfo, 4)
+	n, _ := lister.ListAt(infos, 0)
+	if n != 1 || infos[0].Name() != "upload" || infos[0].Size() != 11 {
+		t.Errorf("List = %d entries, first %v", n, infos[0])
+	}
+
+	excl := sftp.NewRequest("Put", "/upload")
+	excl.Flags = fxfWrite | fxfCreat | fxfExcl
+	if _, err := ur.Filewrite(excl); !os.IsExist(err) {
+		t.Errorf("Filewrite(O_EXCL) error = %v, want exists", err)
+	}
+}
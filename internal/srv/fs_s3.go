@@ -0,0 +1,683 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	// s3MinPartSize is the smallest part S3 accepts in a multipart upload (except for the last one).
+	s3MinPartSize = 5 << 20
+	// s3DefaultBufferSize bounds the data buffered locally per upload.
+	s3DefaultBufferSize = 64 << 20
+)
+
+// S3Config configures a Backend storing files in an S3-compatible bucket.
+type S3Config struct {
+	// Endpoint is the base URL of the service, eg. https://s3.eu-north-1.amazonaws.com
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to the key of every object.
+	Prefix string
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// PartSize is the size of each part of multipart uploads.
+	PartSize int64
+	// BufferSize bounds the local temp file buffering written data that cannot yet be
+	// uploaded, as it's out of order. Writes further ahead than this fail.
+	BufferSize int64
+
+	// Client is the HTTP client to use, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// s3Backend is a Backend mapping virtual paths to object keys.
+// Directories are emulated with key prefixes, and an empty marker object
+// with a trailing slash for directories created explicitly.
+type s3Backend struct {
+	client     *s3Client
+	prefix     string
+	partSize   int64
+	bufferSize int64
+}
+
+var _ Backend = &s3Backend{}
+
+// NewS3Backend returns a Backend storing files in an S3-compatible bucket.
+func NewS3Backend(conf S3Config) (Backend, error) {
+	if conf.Bucket == "" {
+		return nil, fmt.Errorf("no bucket specified")
+	}
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", conf.Endpoint)
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	if conf.PartSize == 0 {
+		conf.PartSize = s3MinPartSize
+	}
+	if conf.BufferSize == 0 {
+		conf.BufferSize = s3DefaultBufferSize
+	}
+	if conf.BufferSize < conf.PartSize {
+		return nil, fmt.Errorf("buffer size %d smaller than part size %d", conf.BufferSize, conf.PartSize)
+	}
+	if conf.Client == nil {
+		conf.Client = http.DefaultClient
+	}
+	prefix := strings.Trim(conf.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &s3Backend{
+		client: &s3Client{
+			endpoint:     endpoint,
+			region:       conf.Region,
+			bucket:       conf.Bucket,
+			accessKey:    conf.AccessKey,
+			secretKey:    conf.SecretKey,
+			sessionToken: conf.SessionToken,
+			http:         conf.Client,
+		},
+		prefix:     prefix,
+		partSize:   conf.PartSize,
+		bufferSize: conf.BufferSize,
+	}, nil
+}
+
+// parseS3Spec parses s3://bucket/prefix?endpoint=...&region=...&partsize=...&buffer=...
+// Credentials are taken from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+func parseS3Spec(spec string) (S3Config, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return S3Config{}, fmt.Errorf("invalid s3 backend %q: %w", spec, err)
+	}
+	query := u.Query()
+	conf := S3Config{
+		Endpoint:     query.Get("endpoint"),
+		Region:       query.Get("region"),
+		Bucket:       u.Host,
+		Prefix:       u.Path,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if conf.Endpoint == "" {
+		region := conf.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		conf.Endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	if v := query.Get("partsize"); v != "" {
+		if conf.PartSize, err = ParseSize(v); err != nil {
+			return S3Config{}, err
+		}
+	}
+	if v := query.Get("buffer"); v != "" {
+		if conf.BufferSize, err = ParseSize(v); err != nil {
+			return S3Config{}, err
+		}
+	}
+	return conf, nil
+}
+
+// key returns the object key of virtual path p, "" being the root.
+func (b *s3Backend) key(p string) string {
+	return b.prefix + strings.TrimPrefix(cleanPath(p), "/")
+}
+
+func (b *s3Backend) dirKey(p string) string {
+	key := b.key(p)
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+func s3Err(op, p string, errno syscall.Errno) error {
+	return &os.PathError{Op: op, Path: p, Err: errno}
+}
+
+// isDir reports whether p is a directory; the root, or a prefix of any key.
+func (b *s3Backend) isDir(p string) (bool, error) {
+	if cleanPath(p) == "/" {
+		return true, nil
+	}
+	objects, prefixes, err := b.client.listObjects(b.dirKey(p), "/", 1)
+	if err != nil {
+		return false, s3PathError(err)
+	}
+	return len(objects)+len(prefixes) > 0, nil
+}
+
+func (b *s3Backend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	key := b.key(p)
+	writable := flags&(os.O_WRONLY|os.O_RDWR) != 0
+
+	obj, err := b.client.headObject(key)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, s3PathError(err)
+	}
+	if !exists {
+		isDir, err := b.isDir(p)
+		if err != nil {
+			return nil, err
+		}
+		if isDir {
+			if writable {
+				return nil, s3Err("open", p, syscall.EISDIR)
+			}
+			return &s3File{b: b, key: key, name: p}, nil
+		}
+	}
+
+	switch {
+	case exists && flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0:
+		return nil, s3Err("open", p, syscall.EEXIST)
+	case !exists && flags&os.O_CREATE == 0:
+		return nil, s3Err("open", p, syscall.ENOENT)
+	case !writable:
+		return &s3File{b: b, key: key, name: p, size: obj.Size}, nil
+	case exists && obj.Size > 0 && flags&os.O_TRUNC == 0:
+		// objects can only be replaced as a whole
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+
+	if dir := path.Dir(cleanPath(p)); dir != "/" {
+		isDir, err := b.isDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		if !isDir {
+			return nil, s3Err("open", p, syscall.ENOENT)
+		}
+	}
+
+	buffer, err := ioutil.TempFile("", "sftp-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{
+		b:      b,
+		key:    key,
+		name:   p,
+		write:  true,
+		buffer: buffer,
+	}, nil
+}
+
+func (b *s3Backend) Stat(p string) (os.FileInfo, error) {
+	name := path.Base(cleanPath(p))
+	if cleanPath(p) != "/" {
+		obj, err := b.client.headObject(b.key(p))
+		if err == nil {
+			return &memFileInfo{name: name, size: obj.Size, mode: 0660, modTime: obj.LastModified}, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, s3PathError(err)
+		}
+	}
+	isDir, err := b.isDir(p)
+	if err != nil {
+		return nil, err
+	}
+	if !isDir {
+		return nil, s3Err("stat", p, syscall.ENOENT)
+	}
+	return &memFileInfo{name: name, mode: os.ModeDir | 0770}, nil
+}
+
+func (b *s3Backend) Lstat(p string) (os.FileInfo, error) {
+	return b.Stat(p)
+}
+
+func (b *s3Backend) Readdir(p string) ([]os.FileInfo, error) {
+	dirKey := b.dirKey(p)
+	objects, prefixes, err := b.client.listObjects(dirKey, "/", 0)
+	if err != nil {
+		return nil, s3PathError(err)
+	}
+	if len(objects) == 0 && len(prefixes) == 0 && cleanPath(p) != "/" {
+		if _, err := b.Stat(p); err != nil {
+			return nil, err
+		}
+		return nil, s3Err("readdir", p, syscall.ENOTDIR)
+	}
+
+	infos := make([]os.FileInfo, 0, len(objects)+len(prefixes))
+	for _, obj := range objects {
+		if obj.Key == dirKey {
+			continue // directory marker
+		}
+		infos = append(infos, &memFileInfo{
+			name:    strings.TrimPrefix(obj.Key, dirKey),
+			size:    obj.Size,
+			mode:    0660,
+			modTime: obj.LastModified,
+		})
+	}
+	for _, prefix := range prefixes {
+		infos = append(infos, &memFileInfo{
+			name: strings.TrimSuffix(strings.TrimPrefix(prefix, dirKey), "/"),
+			mode: os.ModeDir | 0770,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (b *s3Backend) Rename(from, to string) error {
+	if cleanPath(from) == cleanPath(to) {
+		return nil
+	}
+	info, err := b.Stat(from)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := b.client.copyObject(b.key(from), b.key(to)); err != nil {
+			return s3PathError(err)
+		}
+		return s3PathError(b.client.deleteObject(b.key(from)))
+	}
+
+	if strings.HasPrefix(cleanPath(to)+"/", cleanPath(from)+"/") {
+		return s3Err("rename", to, syscall.EINVAL)
+	}
+	fromKey, toKey := b.dirKey(from), b.dirKey(to)
+	objects, _, err := b.client.listObjects(fromKey, "", 0)
+	if err != nil {
+		return s3PathError(err)
+	}
+	for _, obj := range objects {
+		if err := b.client.copyObject(obj.Key, toKey+strings.TrimPrefix(obj.Key, fromKey)); err != nil {
+			return s3PathError(err)
+		}
+	}
+	for _, obj := range objects {
+		if err := b.client.deleteObject(obj.Key); err != nil {
+			return s3PathError(err)
+		}
+	}
+	return nil
+}
+
+func (b *s3Backend) Remove(p string) error {
+	if cleanPath(p) == "/" {
+		return s3Err("remove", p, syscall.EPERM)
+	}
+	if _, err := b.client.headObject(b.key(p)); err == nil {
+		return s3PathError(b.client.deleteObject(b.key(p)))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return s3PathError(err)
+	}
+
+	dirKey := b.dirKey(p)
+	objects, prefixes, err := b.client.listObjects(dirKey, "/", 2)
+	if err != nil {
+		return s3PathError(err)
+	}
+	switch {
+	case len(objects) == 0 && len(prefixes) == 0:
+		return s3Err("remove", p, syscall.ENOENT)
+	case len(prefixes) > 0, len(objects) > 1, objects[0].Key != dirKey:
+		return s3Err("remove", p, syscall.ENOTEMPTY)
+	}
+	return s3PathError(b.client.deleteObject(dirKey))
+}
+
+func (b *s3Backend) Mkdir(p string, perm os.FileMode) error {
+	if _, err := b.Stat(p); err == nil {
+		return s3Err("mkdir", p, syscall.EEXIST)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if parent := path.Dir(cleanPath(p)); parent != "/" {
+		isDir, err := b.isDir(parent)
+		if err != nil {
+			return err
+		}
+		if !isDir {
+			return s3Err("mkdir", p, syscall.ENOENT)
+		}
+	}
+	return s3PathError(b.client.putObject(b.dirKey(p), nil))
+}
+
+func (b *s3Backend) Link(oldname, newname string) error {
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (b *s3Backend) Symlink(oldname, newname string) error {
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (b *s3Backend) Readlink(p string) (string, error) {
+	return "", s3Err("readlink", p, syscall.EINVAL)
+}
+
+// Chmod is a no-op, objects have no permissions.
+func (b *s3Backend) Chmod(p string, mode os.FileMode) error {
+	_, err := b.Stat(p)
+	return err
+}
+
+// Chtimes is a no-op, modification times are set by the object store.
+func (b *s3Backend) Chtimes(p string, atime, mtime time.Time) error {
+	_, err := b.Stat(p)
+	return err
+}
+
+func (b *s3Backend) StatFS(p string) (*sftp.StatVFS, error) {
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// s3File is an open object. Readers fetch ranges on demand.
+// Writers stream the contiguously written data from offset 0 as parts of a multipart
+// upload, while data written out of order waits in a temp file used as a ring buffer.
+type s3File struct {
+	b    *s3Backend
+	key  string
+	name string
+	size int64
+
+	mu       sync.Mutex
+	write    bool
+	closed   bool
+	aborted  bool
+	failed   error // the error that aborted the upload
+	buffer   *os.File
+	written  []byteRange // written ranges not yet uploaded, sorted and merged
+	uploaded int64       // data before this offset has been uploaded as parts
+	uploadID string
+	parts    []s3CompletedPart
+}
+
+// byteRange is the half-open range [start, end)
+type byteRange struct {
+	start, end int64
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if f.write {
+		return 0, s3Err("read", f.name, syscall.EBADF)
+	}
+	if off < 0 {
+		return 0, s3Err("read", f.name, syscall.EINVAL)
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	want := p
+	if remaining := f.size - off; int64(len(want)) > remaining {
+		want = want[:remaining]
+	}
+	n, err := f.b.client.getObjectRange(f.key, want, off)
+	if err != nil {
+		return n, s3PathError(err)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *s3File) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.write || f.closed {
+		return 0, s3Err("write", f.name, syscall.EBADF)
+	}
+	if f.failed != nil {
+		return 0, f.failed
+	}
+	end := off + int64(len(p))
+	if off < f.uploaded {
+		return 0, fmt.Errorf("write at %d to %q: data before %d already uploaded", off, f.name, f.uploaded)
+	}
+	if end > f.uploaded+f.b.bufferSize {
+		return 0, fmt.Errorf("write at %d to %q: too far ahead of uploaded data at %d", off, f.name, f.uploaded)
+	}
+
+	// write to the ring buffer, wrapping at bufferSize
+	for written := 0; written < len(p); {
+		pos := (off + int64(written)) % f.b.bufferSize
+		chunk := p[written:]
+		if room := f.b.bufferSize - pos; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := f.buffer.WriteAt(chunk, pos)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	f.markWritten(byteRange{off, end})
+	if end > f.size {
+		f.size = end
+	}
+
+	for len(f.written) > 0 && f.written[0].start == f.uploaded && f.written[0].end-f.uploaded >= f.b.partSize {
+		if err := f.uploadPart(f.b.partSize); err != nil {
+			f.abort(err)
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+func (f *s3File) markWritten(r byteRange) {
+	ranges := append(f.written, r)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next.start <= last.end {
+			if next.end > last.end {
+				last.end = next.end
+			}
+			continue
+		}
+		merged = append(merged, next)
+	}
+	f.written = merged
+}
+
+// readBuffer returns n bytes from the ring buffer at offset uploaded.
+func (f *s3File) readBuffer(n int64) ([]byte, error) {
+	data := make([]byte, n)
+	for read := int64(0); read < n; {
+		pos := (f.uploaded + read) % f.b.bufferSize
+		chunk := data[read:]
+		if room := f.b.bufferSize - pos; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		m, err := f.buffer.ReadAt(chunk, pos)
+		// holes that were never written read as zeroes
+		if err == io.EOF {
+			err = nil
+			for i := m; i < len(chunk); i++ {
+				chunk[i] = 0
+			}
+			m = len(chunk)
+		}
+		if err != nil {
+			return nil, err
+		}
+		read += int64(m)
+	}
+	// zero any holes, the buffer may hold stale data from earlier laps
+	for pos := f.uploaded; pos < f.uploaded+n; {
+		var next byteRange
+		found := false
+		for _, r := range f.written {
+			if r.end > pos {
+				next = r
+				found = true
+				break
+			}
+		}
+		holeEnd := f.uploaded + n
+		if found && next.start < holeEnd {
+			holeEnd = next.start
+		}
+		for i := pos; i < holeEnd; i++ {
+			data[i-f.uploaded] = 0
+		}
+		if !found {
+			break
+		}
+		pos = next.end
+	}
+	return data, nil
+}
+
+// uploadPart uploads n bytes from offset uploaded as the next part.
+func (f *s3File) uploadPart(n int64) error {
+	data, err := f.readBuffer(n)
+	if err != nil {
+		return err
+	}
+	if f.uploadID == "" {
+		f.uploadID, err = f.b.client.createMultipartUpload(f.key)
+		if err != nil {
+			return s3PathError(err)
+		}
+	}
+	partNumber := len(f.parts) + 1
+	etag, err := f.b.client.uploadPart(f.key, f.uploadID, partNumber, data)
+	if err != nil {
+		return s3PathError(err)
+	}
+	f.parts = append(f.parts, s3CompletedPart{PartNumber: partNumber, ETag: etag})
+	f.uploaded += n
+
+	// forget about uploaded ranges
+	remaining := f.written[:0]
+	for _, r := range f.written {
+		if r.end <= f.uploaded {
+			continue
+		}
+		if r.start < f.uploaded {
+			r.start = f.uploaded
+		}
+		remaining = append(remaining, r)
+	}
+	f.written = remaining
+	return nil
+}
+
+func (f *s3File) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.write || f.closed {
+		return s3Err("truncate", f.name, syscall.EBADF)
+	}
+	if size < f.uploaded || size > f.uploaded+f.b.bufferSize {
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	trimmed := f.written[:0]
+	for _, r := range f.written {
+		if r.start >= size {
+			continue
+		}
+		if r.end > size {
+			r.end = size
+		}
+		trimmed = append(trimmed, r)
+	}
+	f.written = trimmed
+	f.size = size
+	return nil
+}
+
+// Close completes the upload, the object does not exist before that.
+func (f *s3File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	if !f.write {
+		return nil
+	}
+	defer func() {
+		f.buffer.Close()
+		os.Remove(f.buffer.Name())
+	}()
+	if f.failed != nil {
+		return f.failed
+	}
+	if f.aborted {
+		return nil
+	}
+
+	if f.uploadID == "" {
+		data, err := f.readBuffer(f.size)
+		if err != nil {
+			return err
+		}
+		return s3PathError(f.b.client.putObject(f.key, data))
+	}
+
+	for f.uploaded < f.size {
+		n := f.size - f.uploaded
+		if n > f.b.partSize {
+			n = f.b.partSize
+		}
+		if err := f.uploadPart(n); err != nil {
+			_ = f.b.client.abortMultipartUpload(f.key, f.uploadID)
+			return err
+		}
+	}
+	if err := f.b.client.completeMultipartUpload(f.key, f.uploadID, f.parts); err != nil {
+		_ = f.b.client.abortMultipartUpload(f.key, f.uploadID)
+		return s3PathError(err)
+	}
+	return nil
+}
+
+// abort discards the multipart upload after err, failing further writes and Close.
+func (f *s3File) abort(err error) {
+	f.failed = err
+	if f.uploadID != "" {
+		_ = f.b.client.abortMultipartUpload(f.key, f.uploadID)
+	}
+}
+
+// TransferError discards an incomplete upload when the client goes away.
+func (f *s3File) TransferError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.write || f.closed {
+		return
+	}
+	f.aborted = true
+	if f.uploadID != "" && f.failed == nil {
+		_ = f.b.client.abortMultipartUpload(f.key, f.uploadID)
+	}
+}
@@ -0,0 +1,393 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// fakeS3 is an in-process stand-in for an S3 service, storing objects of a single bucket.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+
+	failParts bool // fail uploading parts
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		s.fail(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	bucketPrefix := "/" + s.bucket
+	if !strings.HasPrefix(r.URL.Path, bucketPrefix) {
+		s.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucketPrefix), "/")
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, query.Get("prefix"), query.Get("delimiter"))
+
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if s.failParts {
+			s.fail(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, n))
+
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		complete := struct {
+			Parts []s3CompletedPart `xml:"Part"`
+		}{}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			s.fail(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		data := []byte{}
+		for i, part := range complete.Parts {
+			if i < len(complete.Parts)-1 && len(parts[part.PartNumber]) < s3MinPartSize/1024 {
+				s.fail(w, http.StatusBadRequest, "EntityTooSmall")
+				return
+			}
+			data = append(data, parts[part.PartNumber]...)
+		}
+		s.objects[key] = data
+		delete(s.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("x-amz-copy-source") != "":
+		source := strings.TrimPrefix(r.Header.Get("x-amz-copy-source"), bucketPrefix+"/")
+		data, ok := s.objects[source]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		s.objects[key] = append([]byte{}, data...)
+		fmt.Fprint(w, "<CopyObjectResult></CopyObjectResult>")
+
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+			if start >= len(data) {
+				s.fail(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			data = data[start : end+1]
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+
+	default:
+		s.fail(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, prefix, delimiter string) {
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("<ListBucketResult>")
+	seen := map[string]bool{}
+	for _, key := range keys {
+		rest := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			common := prefix + rest[:i+1]
+			if !seen[common] {
+				seen[common] = true
+				fmt.Fprintf(buf, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", common)
+			}
+			continue
+		}
+		fmt.Fprintf(buf, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+			key, len(s.objects[key]), time.Now().UTC().Format(time.RFC3339))
+	}
+	buf.WriteString("<IsTruncated>false</IsTruncated></ListBucketResult>")
+	_, _ = w.Write(buf.Bytes())
+}
+
+func (s *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func newTestS3Backend(t *testing.T) (Backend, *fakeS3, func()) {
+	t.Helper()
+	fake := newFakeS3("bucket")
+	server := httptest.NewServer(fake)
+
+	b, err := NewS3Backend(S3Config{
+		Endpoint:   server.URL,
+		Bucket:     "bucket",
+		Prefix:     "/data/",
+		AccessKey:  "access",
+		SecretKey:  "secret",
+		PartSize:   s3MinPartSize / 1024,
+		BufferSize: 4 * s3MinPartSize / 1024,
+	})
+	if err != nil {
+		server.Close()
+		t.Fatalf("NewS3Backend() error = %v", err)
+	}
+	return b, fake, server.Close
+}
+
+func TestS3Backend_Upload(t *testing.T) {
+	const partSize = s3MinPartSize / 1024
+	tests := []struct {
+		name    string
+		size    int
+		order   func(n int) []int // order of the chunks written
+		wantErr bool
+	}{
+		{
+			name:  "small",
+			size:  100,
+			order: func(n int) []int { return []int{0} },
+		},
+		{
+			name: "sequential multipart",
+			size: 3*partSize + 17,
+			order: func(n int) []int {
+				order := make([]int, n)
+				for i := range order {
+					order[i] = i
+				}
+				return order
+			},
+		},
+		{
+			name: "out of order",
+			size: 3*partSize + 17,
+			order: func(n int) []int {
+				order := make([]int, n)
+				for i := range order {
+					order[i] = n - 1 - i
+				}
+				return order
+			},
+		},
+		{
+			name: "beyond buffer",
+			size: 6 * partSize,
+			order: func(n int) []int {
+				return []int{n - 1}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, fake, done := newTestS3Backend(t)
+			defer done()
+			content := make([]byte, tt.size)
+			for i := range content {
+				content[i] = byte(i % 251)
+			}
+
+			f, err := b.OpenFile("/upload", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+			if err != nil {
+				t.Fatalf("OpenFile() error = %v", err)
+			}
+			const chunk = 1000
+			chunks := (tt.size + chunk - 1) / chunk
+			var writeErr error
+			for _, i := range tt.order(chunks) {
+				end := (i + 1) * chunk
+				if end > tt.size {
+					end = tt.size
+				}
+				if _, err := f.WriteAt(content[i*chunk:end], int64(i*chunk)); err != nil {
+					writeErr = err
+					break
+				}
+			}
+			if (writeErr != nil) != tt.wantErr {
+				t.Fatalf("WriteAt() error = %v, wantErr %v", writeErr, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if !bytes.Equal(fake.objects["data/upload"], content) {
+				t.Errorf("stored object differs, got %d bytes want %d", len(fake.objects["data/upload"]), len(content))
+			}
+
+			r, err := b.OpenFile("/upload", os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatalf("OpenFile() error = %v", err)
+			}
+			buf := make([]byte, 10)
+			off := int64(tt.size - 5)
+			if n, _ := r.ReadAt(buf, off); n != 5 || !bytes.Equal(buf[:n], content[off:]) {
+				t.Errorf("ReadAt(%d) = %d bytes", off, n)
+			}
+		})
+	}
+}
+
+func TestS3Backend_PartFailure(t *testing.T) {
+	const partSize = s3MinPartSize / 1024
+	b, fake, done := newTestS3Backend(t)
+	defer done()
+
+	f, err := b.OpenFile("/upload", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	if _, err := f.WriteAt(make([]byte, partSize), 0); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	fake.mu.Lock()
+	fake.failParts = true
+	fake.mu.Unlock()
+	if _, err := f.WriteAt(make([]byte, partSize), partSize); err == nil {
+		t.Fatal("WriteAt() with a failing part succeeded")
+	}
+	if len(fake.uploads) != 0 {
+		t.Errorf("%d multipart uploads left open", len(fake.uploads))
+	}
+	if _, err := f.WriteAt([]byte("x"), 2*partSize); err == nil {
+		t.Error("WriteAt() after a failed part succeeded")
+	}
+	if err := f.Close(); err == nil {
+		t.Error("Close() after a failed part succeeded")
+	}
+	if _, ok := fake.objects["data/upload"]; ok {
+		t.Error("object stored after a failed part")
+	}
+}
+
+func TestS3Backend_Unsupported(t *testing.T) {
+	b, _, done := newTestS3Backend(t)
+	defer done()
+	writeMemFile(t, b, "/file", "data")
+
+	if err := b.Link("/file", "/link"); err != sftp.ErrSSHFxOpUnsupported {
+		t.Errorf("Link() error = %v, want %v", err, sftp.ErrSSHFxOpUnsupported)
+	}
+	if err := b.Symlink("/file", "/link"); err != sftp.ErrSSHFxOpUnsupported {
+		t.Errorf("Symlink() error = %v, want %v", err, sftp.ErrSSHFxOpUnsupported)
+	}
+	if _, err := b.OpenFile("/file", os.O_WRONLY, 0); err != sftp.ErrSSHFxOpUnsupported {
+		t.Errorf("OpenFile(existing, O_WRONLY) error = %v, want %v", err, sftp.ErrSSHFxOpUnsupported)
+	}
+}
+
+func TestS3Backend_Directories(t *testing.T) {
+	b, fake, done := newTestS3Backend(t)
+	defer done()
+
+	if err := b.Mkdir("/dir", 0770); err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	if err := b.Mkdir("/missing/dir", 0770); !os.IsNotExist(err) {
+		t.Errorf("Mkdir() without parent error = %v", err)
+	}
+	writeMemFile(t, b, "/dir/file", "content")
+	if err := b.Remove("/dir"); err == nil {
+		t.Errorf("Remove() of non-empty dir succeeded")
+	}
+
+	if err := b.Rename("/dir", "/moved"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	infos, err := b.Readdir("/")
+	if err != nil || len(infos) != 1 || !infos[0].IsDir() || infos[0].Name() != "moved" {
+		t.Fatalf("Readdir(/) = %v, %v", infos, err)
+	}
+	if got := readMemFile(t, b, "/moved/file"); got != "content" {
+		t.Errorf("read moved file = %q", got)
+	}
+
+	if err := b.Remove("/moved/file"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if err := b.Remove("/moved"); err != nil {
+		t.Fatalf("Remove() of empty dir error = %v", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Errorf("objects left behind: %v", fake.objects)
+	}
+}
@@ -144,18 +144,14 @@ func (fs *fsSession) Symlink(target, file string) error {
 	if !(fs.isOwned(file) && fs.mayClaim(target)) {
 		return os.ErrPermission
 	}
-	return fs.impl.Symlink(file, target)
+	return fs.impl.Symlink(target, file)
 }
 
 func (fs *fsSession) Readdir(dirPath string) ([]os.FileInfo, error) {
 	if !(fs.isOwned(dirPath)) {
 		return nil, os.ErrPermission
 	}
-	file, err := fs.impl.OpenFile(dirPath, os.O_RDONLY, 0400)
-	if err != nil {
-		return nil, err
-	}
-	dirinfo, err := file.Readdir(0)
+	dirinfo, err := fs.impl.Readdir(dirPath)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,130 @@
+package srv
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// subBackend serves the directory dir of the wrapped Backend as its root.
+type subBackend struct {
+	backend Backend
+	dir     string
+}
+
+var _ Backend = &subBackend{}
+
+// NewSubBackend returns a Backend serving the directory dir of backend, created
+// if missing. Links created through it stay within it.
+func NewSubBackend(backend Backend, dir string) (Backend, error) {
+	dir = cleanPath(dir)
+	if dir == "/" {
+		return backend, nil
+	}
+	if err := mkdirAll(backend, dir); err != nil {
+		return nil, err
+	}
+	return &subBackend{backend: backend, dir: dir}, nil
+}
+
+// rebase returns p, if within dir, as the same path below the directory to.
+func rebase(p, dir, to string) (string, bool) {
+	if !within(p, dir) {
+		return p, false
+	}
+	return path.Join(to, strings.TrimPrefix(p, dir)), true
+}
+
+// rebaseErr returns err with the path of a PathError within dir rebased to the directory to.
+func rebaseErr(err error, dir, to string) error {
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) {
+		return err
+	}
+	if p, ok := rebase(pathErr.Path, dir, to); ok {
+		return &os.PathError{Op: pathErr.Op, Path: p, Err: pathErr.Err}
+	}
+	return err
+}
+
+// path returns the path of p in the wrapped backend.
+func (b *subBackend) path(p string) string {
+	p, _ = rebase(cleanPath(p), "/", b.dir)
+	return p
+}
+
+// err hides the directory from the paths of errors.
+func (b *subBackend) err(err error) error {
+	return rebaseErr(err, b.dir, "/")
+}
+
+func (b *subBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	f, err := b.backend.OpenFile(b.path(p), flags, perm)
+	return f, b.err(err)
+}
+
+func (b *subBackend) Stat(p string) (os.FileInfo, error) {
+	info, err := b.backend.Stat(b.path(p))
+	return info, b.err(err)
+}
+
+func (b *subBackend) Lstat(p string) (os.FileInfo, error) {
+	info, err := b.backend.Lstat(b.path(p))
+	return info, b.err(err)
+}
+
+func (b *subBackend) Readdir(p string) ([]os.FileInfo, error) {
+	infos, err := b.backend.Readdir(b.path(p))
+	return infos, b.err(err)
+}
+
+func (b *subBackend) Rename(from, to string) error {
+	return b.err(b.backend.Rename(b.path(from), b.path(to)))
+}
+
+func (b *subBackend) Remove(p string) error {
+	return b.err(b.backend.Remove(b.path(p)))
+}
+
+func (b *subBackend) Mkdir(p string, perm os.FileMode) error {
+	return b.err(b.backend.Mkdir(b.path(p), perm))
+}
+
+func (b *subBackend) Link(oldname, newname string) error {
+	return b.err(b.backend.Link(b.path(oldname), b.path(newname)))
+}
+
+// Symlink creates newname as a link to the absolute path of oldname in the
+// wrapped backend, relative targets being resolved from the directory of newname.
+func (b *subBackend) Symlink(oldname, newname string) error {
+	if !path.IsAbs(oldname) {
+		oldname = path.Join(path.Dir(cleanPath(newname)), oldname)
+	}
+	return b.err(b.backend.Symlink(b.path(oldname), b.path(newname)))
+}
+
+func (b *subBackend) Readlink(p string) (string, error) {
+	target, err := b.backend.Readlink(b.path(p))
+	if err != nil {
+		return "", b.err(err)
+	}
+	target, _ = rebase(target, b.dir, "/")
+	return target, nil
+}
+
+func (b *subBackend) Chmod(p string, mode os.FileMode) error {
+	return b.err(b.backend.Chmod(b.path(p), mode))
+}
+
+func (b *subBackend) Chtimes(p string, atime, mtime time.Time) error {
+	return b.err(b.backend.Chtimes(b.path(p), atime, mtime))
+}
+
+func (b *subBackend) StatFS(p string) (*sftp.StatVFS, error) {
+	stat, err := b.backend.StatFS(b.path(p))
+	return stat, b.err(err)
+}
@@ -0,0 +1,54 @@
+package srv
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSubBackend(t *testing.T) {
+	inner := NewMemBackend(0)
+	writeMemFile(t, inner, "/secret", "outside")
+	b, err := NewSubBackend(inner, "/home/alice")
+	if err != nil {
+		t.Fatalf("NewSubBackend() error = %v", err)
+	}
+	writeMemFile(t, b, "/notes", "inside")
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr string // path of the not exist error, if any
+	}{
+		{name: "file", path: "/notes", want: "inside"},
+		{name: "relative", path: "notes", want: "inside"},
+		{name: "parent of the root", path: "/../../notes", want: "inside"},
+		{name: "outside", path: "/../secret", wantErr: "/secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := b.OpenFile(tt.path, os.O_RDONLY, 0)
+			if tt.wantErr != "" {
+				pathErr, ok := err.(*os.PathError)
+				if !ok || !os.IsNotExist(err) || pathErr.Path != tt.wantErr {
+					t.Errorf("OpenFile(%s) error = %v, want not exist at %s", tt.path, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenFile(%s) error = %v", tt.path, err)
+			}
+			f.Close()
+			if got := readMemFile(t, b, tt.path); got != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := readMemFile(t, inner, "/home/alice/notes"); got != "inside" {
+		t.Errorf("stored %q in the directory, want inside", got)
+	}
+	if root, err := NewSubBackend(inner, "/"); err != nil || root != inner {
+		t.Errorf("NewSubBackend(/) = %v, %v, want the backend", root, err)
+	}
+}
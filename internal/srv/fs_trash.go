@@ -0,0 +1,459 @@
+package srv
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Deleted and replaced files are moved to the trash of the user deleting them,
+// keeping their original path:
+//
+//	/.trash/<user>/<deletion time>/<original path>
+//
+// Removing only ever removes files and empty directories, so every deletion
+// holds exactly one entry.
+const (
+	trashDirName  = ".trash"
+	trashDir      = "/" + trashDirName
+	trashIDFormat = "20060102T150405.000000000Z"
+)
+
+// Trash holds deleted files for a retention period, during which they can be restored.
+type Trash struct {
+	backend   Backend
+	retention time.Duration
+}
+
+// TrashItem is a deleted file or directory.
+type TrashItem struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"` // original path
+	Deleted time.Time `json:"deleted"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"` // as stored
+}
+
+// NewTrash returns a Trash kept in backend, keeping deleted files for retention.
+func NewTrash(backend Backend, retention time.Duration) *Trash {
+	return &Trash{backend: backend, retention: retention}
+}
+
+// Backend returns backend with files deleted or replaced by user moved to the trash.
+func (t *Trash) Backend(user string) Backend {
+	return &trashBackend{Backend: t.backend, dir: trashDir + "/" + user}
+}
+
+// List returns the deleted files of user, oldest first.
+func (t *Trash) List(user string) ([]TrashItem, error) {
+	dir := trashDir + "/" + user
+	infos, err := t.backend.Readdir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing trash: %w", err)
+	}
+	items := []TrashItem{}
+	for _, info := range infos {
+		deleted, err := time.Parse(trashIDFormat, info.Name())
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		item, err := t.item(dir+"/"+info.Name(), "/")
+		if err != nil {
+			return nil, fmt.Errorf("error reading trash item %q: %w", info.Name(), err)
+		}
+		item.ID, item.Deleted = info.Name(), deleted
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items, nil
+}
+
+// item returns the single entry found below dir, which is at p in the original tree.
+func (t *Trash) item(dir, p string) (TrashItem, error) {
+	infos, err := t.backend.Readdir(dir)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if len(infos) != 1 {
+		return TrashItem{}, fmt.Errorf("expected 1 entry in %q, got %d", dir, len(infos))
+	}
+	info := infos[0]
+	p = path.Join(p, info.Name())
+	if info.IsDir() {
+		if children, err := t.backend.Readdir(dir + "/" + info.Name()); err == nil && len(children) > 0 {
+			return t.item(dir+"/"+info.Name(), p)
+		}
+	}
+	return TrashItem{Path: p, IsDir: info.IsDir(), Size: info.Size()}, nil
+}
+
+// Restore moves the deleted item id of user back to its original path, which must not exist.
+func (t *Trash) Restore(user, id string) error {
+	items, err := t.List(user)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.ID != id {
+			continue
+		}
+		if _, err := t.backend.Lstat(item.Path); err == nil {
+			return &os.PathError{Op: "restore", Path: item.Path, Err: syscall.EEXIST}
+		}
+		if err := mkdirAll(t.backend, path.Dir(item.Path)); err != nil {
+			return fmt.Errorf("error creating parent directory: %w", err)
+		}
+		itemDir := trashDir + "/" + user + "/" + id
+		if err := t.backend.Rename(itemDir+item.Path, item.Path); err != nil {
+			return fmt.Errorf("error restoring %q: %w", item.Path, err)
+		}
+		return removeAll(t.backend, itemDir)
+	}
+	return fmt.Errorf("no trash item %q for user %q: %w", id, user, os.ErrNotExist)
+}
+
+// Purge removes items of all users deleted longer than the retention period before now.
+// It returns the number of removed items.
+func (t *Trash) Purge(now time.Time) (int, error) {
+	users, err := t.backend.Readdir(trashDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error listing trash: %w", err)
+	}
+	purged := 0
+	for _, user := range users {
+		dir := trashDir + "/" + user.Name()
+		infos, err := t.backend.Readdir(dir)
+		if err != nil {
+			return purged, fmt.Errorf("error listing trash: %w", err)
+		}
+		for _, info := range infos {
+			deleted, err := time.Parse(trashIDFormat, info.Name())
+			if err != nil || now.Sub(deleted) < t.retention {
+				continue
+			}
+			if err := removeAll(t.backend, dir+"/"+info.Name()); err != nil {
+				return purged, fmt.Errorf("error purging %q: %w", info.Name(), err)
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// mkdirAll creates directory p along with any missing parents.
+func mkdirAll(b Backend, p string) error {
+	p = cleanPath(p)
+	if info, err := b.Stat(p); err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if p != "/" {
+		if err := mkdirAll(b, path.Dir(p)); err != nil {
+			return err
+		}
+	}
+	if err := b.Mkdir(p, 0770); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeAll removes p and, if a directory, everything in it.
+func removeAll(b Backend, p string) error {
+	info, err := b.Lstat(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		infos, err := b.Readdir(p)
+		if err != nil {
+			return err
+		}
+		for _, child := range infos {
+			if err := removeAll(b, path.Join(p, child.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return b.Remove(p)
+}
+
+// copyFile copies the contents of the regular file from to the new file to.
+func copyFile(b Backend, from, to string) error {
+	info, err := b.Stat(from)
+	if err != nil {
+		return err
+	}
+	src, err := b.OpenFile(from, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := b.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(&offsetWriter{w: dst}, io.NewSectionReader(src, 0, info.Size()))
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		b.Remove(to)
+	}
+	return err
+}
+
+// trashBackend moves files deleted or replaced to dir, otherwise delegating to the wrapped Backend.
+type trashBackend struct {
+	Backend
+	dir string
+}
+
+// newItem returns the path in the trash to keep p at, with its parent directories created.
+func (b *trashBackend) newItem(p string) (string, error) {
+	if err := mkdirAll(b.Backend, b.dir); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	for {
+		itemDir := b.dir + "/" + now.Format(trashIDFormat)
+		err := b.Backend.Mkdir(itemDir, 0700)
+		if os.IsExist(err) {
+			now = now.Add(time.Nanosecond)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		item := itemDir + cleanPath(p)
+		return item, mkdirAll(b.Backend, path.Dir(item))
+	}
+}
+
+// trash moves p to the trash.
+func (b *trashBackend) trash(p string) error {
+	item, err := b.newItem(p)
+	if err != nil {
+		return &os.PathError{Op: "trash", Path: p, Err: err}
+	}
+	return b.Backend.Rename(p, item)
+}
+
+// isTrashPath reports whether p refers to the trash, hidden from clients.
+func isTrashPath(p string) bool {
+	return hasPathComponent(p, trashDirName)
+}
+
+func trashHidden(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: syscall.ENOENT}
+}
+
+func (b *trashBackend) Remove(p string) error {
+	if isTrashPath(p) {
+		return trashHidden("remove", p)
+	}
+	if p := cleanPath(p); p == versionsDir || strings.HasPrefix(p, versionsDir+"/") {
+		return b.Backend.Remove(p) // versions pruned, already a copy
+	}
+	info, err := b.Backend.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		infos, err := b.Backend.Readdir(p)
+		if err != nil {
+			return err
+		}
+		if len(infos) > 0 {
+			return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+		}
+	}
+	return b.trash(p)
+}
+
+func (b *trashBackend) Rename(from, to string) error {
+	if isTrashPath(from) {
+		return trashHidden("rename", from)
+	}
+	if isTrashPath(to) {
+		return trashHidden("rename", to)
+	}
+	if _, err := b.Backend.Lstat(from); err != nil {
+		return err
+	}
+	info, err := b.Backend.Lstat(to)
+	if err != nil || info.IsDir() || cleanPath(from) == cleanPath(to) {
+		return b.Backend.Rename(from, to)
+	}
+
+	// the replaced file is trashed, and put back if the rename fails
+	item, err := b.newItem(to)
+	if err != nil {
+		return &os.PathError{Op: "trash", Path: to, Err: err}
+	}
+	if err := b.Backend.Rename(to, item); err != nil {
+		return err
+	}
+	if err := b.Backend.Rename(from, to); err != nil {
+		_ = b.Backend.Rename(item, to)
+		return err
+	}
+	return nil
+}
+
+func (b *trashBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	if isTrashPath(p) {
+		return nil, trashHidden("open", p)
+	}
+	writable := flags&(os.O_WRONLY|os.O_RDWR) != 0
+	if !writable {
+		return b.Backend.OpenFile(p, flags, perm)
+	}
+	info, err := b.Backend.Stat(p)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 || flags&os.O_EXCL != 0 {
+		f, err := b.Backend.OpenFile(p, flags, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &trashFile{File: f, b: b, name: p}, nil
+	}
+
+	if flags&os.O_TRUNC != 0 {
+		// the previous content is trashed, and replaced by a new file
+		if err := b.trash(p); err != nil {
+			return nil, err
+		}
+		f, err := b.Backend.OpenFile(p, flags|os.O_CREATE, info.Mode().Perm())
+		if err != nil {
+			return nil, err
+		}
+		return &trashFile{File: f, b: b, name: p, trashed: true}, nil
+	}
+	f, err := b.Backend.OpenFile(p, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &trashFile{File: f, b: b, name: p}, nil
+}
+
+func (b *trashBackend) Stat(p string) (os.FileInfo, error) {
+	if isTrashPath(p) {
+		return nil, trashHidden("stat", p)
+	}
+	return b.Backend.Stat(p)
+}
+
+func (b *trashBackend) Lstat(p string) (os.FileInfo, error) {
+	if isTrashPath(p) {
+		return nil, trashHidden("lstat", p)
+	}
+	return b.Backend.Lstat(p)
+}
+
+func (b *trashBackend) Readdir(dirPath string) ([]os.FileInfo, error) {
+	if isTrashPath(dirPath) {
+		return nil, trashHidden("readdir", dirPath)
+	}
+	infos, err := b.Backend.Readdir(dirPath)
+	visible := infos[:0]
+	for _, info := range infos {
+		if info.Name() != trashDirName {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+func (b *trashBackend) Mkdir(p string, perm os.FileMode) error {
+	if isTrashPath(p) {
+		return &os.PathError{Op: "mkdir", Path: p, Err: syscall.EPERM}
+	}
+	return b.Backend.Mkdir(p, perm)
+}
+
+func (b *trashBackend) Link(oldname, newname string) error {
+	if isTrashPath(oldname) {
+		return trashHidden("link", oldname)
+	}
+	if isTrashPath(newname) {
+		return trashHidden("link", newname)
+	}
+	return b.Backend.Link(oldname, newname)
+}
+
+func (b *trashBackend) Symlink(oldname, newname string) error {
+	if isTrashPath(oldname) {
+		return &os.PathError{Op: "symlink", Path: oldname, Err: syscall.EPERM}
+	}
+	if isTrashPath(newname) {
+		return trashHidden("symlink", newname)
+	}
+	return b.Backend.Symlink(oldname, newname)
+}
+
+func (b *trashBackend) Readlink(p string) (string, error) {
+	if isTrashPath(p) {
+		return "", trashHidden("readlink", p)
+	}
+	return b.Backend.Readlink(p)
+}
+
+func (b *trashBackend) Chmod(p string, mode os.FileMode) error {
+	if isTrashPath(p) {
+		return trashHidden("chmod", p)
+	}
+	return b.Backend.Chmod(p, mode)
+}
+
+func (b *trashBackend) Chtimes(p string, atime, mtime time.Time) error {
+	if isTrashPath(p) {
+		return trashHidden("chtimes", p)
+	}
+	return b.Backend.Chtimes(p, atime, mtime)
+}
+
+// trashFile is a file open for writing, which copies its previous content to
+// the trash before being truncated.
+type trashFile struct {
+	File
+	b       *trashBackend
+	name    string
+	trashed bool
+}
+
+func (f *trashFile) TransferError(err error) {
+	transferError(f.File, err)
+}
+
+func (f *trashFile) Truncate(size int64) error {
+	if !f.trashed {
+		info, err := f.b.Backend.Stat(f.name)
+		if err == nil && size < info.Size() {
+			item, err := f.b.newItem(f.name)
+			if err == nil {
+				err = copyFile(f.b.Backend, f.name, item)
+			}
+			if err != nil {
+				return &os.PathError{Op: "trash", Path: f.name, Err: err}
+			}
+			f.trashed = true
+		}
+	}
+	return f.File.Truncate(size)
+}
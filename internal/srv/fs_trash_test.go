@@ -0,0 +1,154 @@
+package srv
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    []string // files created with their path as content
+		delete   func(b Backend) error
+		wantPath string // of the trashed item
+		wantDir  bool
+	}{
+		{
+			name:     "remove",
+			setup:    []string{"/dir/file"},
+			delete:   func(b Backend) error { return b.Remove("/dir/file") },
+			wantPath: "/dir/file",
+		},
+		{
+			name:     "remove empty dir",
+			setup:    []string{"/dir/file"},
+			delete:   func(b Backend) error { return (&fsAdapter{impl: b}).Rmdir("/dir/sub") },
+			wantPath: "/dir/sub",
+			wantDir:  true,
+		},
+		{
+			name:     "rename over",
+			setup:    []string{"/dir/file", "/new"},
+			delete:   func(b Backend) error { return b.Rename("/new", "/dir/file") },
+			wantPath: "/dir/file",
+		},
+		{
+			name:  "upload over",
+			setup: []string{"/dir/file"},
+			delete: func(b Backend) error {
+				writeMemFile(t, b, "/dir/file", "replaced")
+				return nil
+			},
+			wantPath: "/dir/file",
+		},
+		{
+			name:     "truncate",
+			setup:    []string{"/dir/file"},
+			delete:   func(b Backend) error { return (&fsAdapter{impl: b}).Truncate("/dir/file", 0) },
+			wantPath: "/dir/file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := NewMemBackend(0)
+			trash := NewTrash(inner, time.Hour)
+			b := trash.Backend("alice")
+			if err := mkdirAll(b, "/dir/sub"); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range tt.setup {
+				writeMemFile(t, b, p, p)
+			}
+
+			if err := tt.delete(b); err != nil {
+				t.Fatalf("delete error = %v", err)
+			}
+			items, err := trash.List("alice")
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			if len(items) != 1 || items[0].Path != tt.wantPath || items[0].IsDir != tt.wantDir {
+				t.Fatalf("List() = %+v, want %s", items, tt.wantPath)
+			}
+			infos, err := b.Readdir("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, info := range infos {
+				if info.Name() == trashDirName {
+					t.Errorf("Readdir(/) lists the trash")
+				}
+			}
+			if n, err := trash.Purge(time.Now()); n != 0 || err != nil {
+				t.Errorf("Purge() within retention = %d, %v", n, err)
+			}
+
+			if err := inner.Remove(tt.wantPath); err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if err := trash.Restore("alice", items[0].ID); err != nil {
+				t.Fatalf("Restore() error = %v", err)
+			}
+			if !tt.wantDir {
+				if got := readMemFile(t, b, tt.wantPath); got != tt.wantPath {
+					t.Errorf("restored content = %q, want %q", got, tt.wantPath)
+				}
+			}
+
+			if err := b.Remove(tt.wantPath); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := trash.Purge(time.Now().Add(2 * time.Hour)); n != 1 || err != nil {
+				t.Errorf("Purge() after retention = %d, %v, want 1", n, err)
+			}
+			if items, _ := trash.List("alice"); len(items) != 0 {
+				t.Errorf("List() after purge = %+v", items)
+			}
+		})
+	}
+}
+
+func TestTrash_RemoveNotEmpty(t *testing.T) {
+	b := NewTrash(NewMemBackend(0), time.Hour).Backend("alice")
+	writeMemFile(t, b, "/file", "data")
+	if err := b.Mkdir("/dir", 0770); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, b, "/dir/file", "data")
+	if err := b.Remove("/dir"); err == nil {
+		t.Errorf("Remove() of non-empty directory succeeded")
+	}
+	if _, err := b.OpenFile("/.trash/alice", os.O_RDONLY, 0); !os.IsNotExist(err) {
+		t.Errorf("OpenFile() in trash error = %v, want not exist", err)
+	}
+}
+
+func TestTrash_TransferError(t *testing.T) {
+	inner := &transferErrorBackend{Backend: NewMemBackend(0)}
+	b := NewTrash(inner, time.Hour).Backend("alice")
+	writeMemFile(t, b, "/report.csv", "hello")
+	// replacing the file trashes the previous content
+	inner.files = nil
+	f, err := b.OpenFile("/report.csv", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	checkTransferError(t, f, inner)
+}
+
+func TestTrash_Versions(t *testing.T) {
+	trash := NewTrash(NewMemBackend(0), time.Hour)
+	b := NewVersionBackend(trash.Backend("alice"), 1, 0)
+	for i := 1; i <= 3; i++ {
+		writeMemFile(t, b, "/report.csv", fmt.Sprintf("v%d", i))
+	}
+	if infos, err := b.Readdir("/.versions/report.csv"); err != nil || len(infos) != 1 {
+		t.Errorf("Readdir() = %d versions, %v, want 1", len(infos), err)
+	}
+	if items, err := trash.List("alice"); err != nil || len(items) != 0 {
+		t.Errorf("List() = %v, %v, want the pruned versions not trashed", items, err)
+	}
+}
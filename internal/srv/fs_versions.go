@@ -0,0 +1,305 @@
+package srv
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Before a file is truncated by opening it with O_TRUNC, its previous content is
+// kept as a version, named by the time it was replaced, in the version store:
+//
+//	/.versions/<directory>/<name>/<time>
+//
+// Clients see the versions of the files of every directory, read-only, in its
+// .versions directory:
+//
+//	<directory>/.versions/<name>/<time>
+//
+// (so for the root directory the virtual and stored paths are the same).
+const (
+	versionsDirName   = ".versions"
+	versionsDir       = "/" + versionsDirName
+	versionNameFormat = "20060102T150405.000000000Z"
+)
+
+// versionBackend keeps previous versions of overwritten files, otherwise delegating to the wrapped Backend.
+type versionBackend struct {
+	Backend
+	keep   int
+	maxAge time.Duration
+}
+
+// NewVersionBackend returns a Backend keeping the previous contents of files overwritten in backend.
+// Only the last keep versions of a file are kept unless keep is 0, and only versions
+// younger than maxAge unless maxAge is 0.
+func NewVersionBackend(backend Backend, keep int, maxAge time.Duration) Backend {
+	return &versionBackend{Backend: backend, keep: keep, maxAge: maxAge}
+}
+
+// versionPath maps p, if within a .versions directory, to its path in the version store.
+// depth is the number of elements following .versions: 0 for the list of
+// versioned files, 1 for the versions of a file and 2 for a version.
+func versionPath(p string) (store string, depth int, ok bool) {
+	elems := strings.Split(cleanPath(p), "/")[1:]
+	for i, elem := range elems {
+		if elem == versionsDirName {
+			rest := elems[i+1:]
+			return path.Join(versionsDir, strings.Join(elems[:i], "/"), strings.Join(rest, "/")), len(rest), true
+		}
+	}
+	return "", 0, false
+}
+
+func versionsReadOnly(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: syscall.EPERM}
+}
+
+// expired reports whether the version named name has expired.
+func (b *versionBackend) expired(name string, now time.Time) bool {
+	t, err := time.Parse(versionNameFormat, name)
+	return err != nil || (b.maxAge > 0 && now.Sub(t) > b.maxAge)
+}
+
+// versions returns the versions kept in the store directory dir, oldest first.
+func (b *versionBackend) versions(dir string) ([]os.FileInfo, error) {
+	infos, err := b.Backend.Readdir(dir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	versions := infos[:0]
+	for _, info := range infos {
+		if info.Mode().IsRegular() && !b.expired(info.Name(), now) {
+			versions = append(versions, &memFileInfo{name: info.Name(), size: info.Size(), mode: 0444, modTime: info.ModTime()})
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Name() < versions[j].Name() })
+	return versions, nil
+}
+
+// versionedFiles returns the files with versions kept in the store directory dir.
+func (b *versionBackend) versionedFiles(dir string) ([]os.FileInfo, error) {
+	infos, err := b.Backend.Readdir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := infos[:0]
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		if versions, err := b.versions(dir + "/" + info.Name()); err == nil && len(versions) > 0 {
+			files = append(files, &memFileInfo{name: info.Name(), mode: os.ModeDir | 0555, modTime: versions[len(versions)-1].ModTime()})
+		}
+	}
+	return files, nil
+}
+
+// snapshot moves p to the version store, dropping versions no longer kept.
+func (b *versionBackend) snapshot(p string) error {
+	dir, name := path.Split(cleanPath(p))
+	store := path.Join(versionsDir, dir, name)
+	if err := mkdirAll(b.Backend, store); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	version := store + "/" + now.Format(versionNameFormat)
+	for {
+		if _, err := b.Backend.Lstat(version); os.IsNotExist(err) {
+			break
+		}
+		now = now.Add(time.Nanosecond)
+		version = store + "/" + now.Format(versionNameFormat)
+	}
+	if err := b.Backend.Rename(p, version); err != nil {
+		return err
+	}
+
+	infos, err := b.Backend.Readdir(store)
+	if err != nil {
+		return err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() > infos[j].Name() })
+	kept := 0
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if b.expired(info.Name(), now) || (b.keep > 0 && kept >= b.keep) {
+			if err := b.Backend.Remove(store + "/" + info.Name()); err != nil {
+				return err
+			}
+			continue
+		}
+		kept++
+	}
+	return nil
+}
+
+func (b *versionBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	writable := flags&(os.O_WRONLY|os.O_RDWR) != 0
+	if store, depth, ok := versionPath(p); ok {
+		switch {
+		case writable || flags&os.O_CREATE != 0:
+			return nil, versionsReadOnly("open", p)
+		case depth < 2:
+			return nil, &os.PathError{Op: "open", Path: p, Err: syscall.EISDIR}
+		case depth > 2 || b.expired(path.Base(store), time.Now()):
+			return nil, &os.PathError{Op: "open", Path: p, Err: syscall.ENOENT}
+		}
+		return b.Backend.OpenFile(store, os.O_RDONLY, 0)
+	}
+	if !writable || flags&os.O_TRUNC == 0 || flags&os.O_EXCL != 0 {
+		return b.Backend.OpenFile(p, flags, perm)
+	}
+
+	info, err := b.Backend.Stat(p)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return b.Backend.OpenFile(p, flags, perm)
+	}
+	if err := b.snapshot(p); err != nil {
+		return nil, &os.PathError{Op: "snapshot", Path: p, Err: err}
+	}
+	return b.Backend.OpenFile(p, flags|os.O_CREATE, info.Mode().Perm())
+}
+
+func (b *versionBackend) stat(op, p, store string, depth int) (os.FileInfo, error) {
+	var infos []os.FileInfo
+	var err error
+	switch depth {
+	case 0:
+		infos, err = b.versionedFiles(store)
+	case 1:
+		infos, err = b.versions(store)
+	case 2:
+		if b.expired(path.Base(store), time.Now()) {
+			break
+		}
+		info, err := b.Backend.Stat(store)
+		if err != nil || !info.Mode().IsRegular() {
+			break
+		}
+		return &memFileInfo{name: info.Name(), size: info.Size(), mode: 0444, modTime: info.ModTime()}, nil
+	}
+	if err != nil || len(infos) == 0 {
+		return nil, &os.PathError{Op: op, Path: p, Err: syscall.ENOENT}
+	}
+	return &memFileInfo{name: path.Base(p), mode: os.ModeDir | 0555, modTime: infos[len(infos)-1].ModTime()}, nil
+}
+
+func (b *versionBackend) Stat(p string) (os.FileInfo, error) {
+	if store, depth, ok := versionPath(p); ok {
+		return b.stat("stat", p, store, depth)
+	}
+	return b.Backend.Stat(p)
+}
+
+func (b *versionBackend) Lstat(p string) (os.FileInfo, error) {
+	if store, depth, ok := versionPath(p); ok {
+		return b.stat("lstat", p, store, depth)
+	}
+	return b.Backend.Lstat(p)
+}
+
+func (b *versionBackend) Readdir(dirPath string) ([]os.FileInfo, error) {
+	if store, depth, ok := versionPath(dirPath); ok {
+		var infos []os.FileInfo
+		var err error
+		switch depth {
+		case 0:
+			infos, err = b.versionedFiles(store)
+		case 1:
+			infos, err = b.versions(store)
+		}
+		if err != nil || len(infos) == 0 {
+			return nil, &os.PathError{Op: "readdir", Path: dirPath, Err: syscall.ENOENT}
+		}
+		return infos, nil
+	}
+
+	infos, err := b.Backend.Readdir(dirPath)
+	if err != nil {
+		return infos, err
+	}
+	visible := infos[:0]
+	for _, info := range infos {
+		if info.Name() != versionsDirName {
+			visible = append(visible, info)
+		}
+	}
+	store, _, _ := versionPath(path.Join(dirPath, versionsDirName))
+	if info, err := b.stat("readdir", dirPath, store, 0); err == nil {
+		visible = append(visible, &memFileInfo{name: versionsDirName, mode: info.Mode(), modTime: info.ModTime()})
+	}
+	return visible, nil
+}
+
+func (b *versionBackend) Rename(from, to string) error {
+	if _, _, ok := versionPath(from); ok {
+		return versionsReadOnly("rename", from)
+	}
+	if _, _, ok := versionPath(to); ok {
+		return versionsReadOnly("rename", to)
+	}
+	return b.Backend.Rename(from, to)
+}
+
+func (b *versionBackend) Remove(p string) error {
+	if _, _, ok := versionPath(p); ok {
+		return versionsReadOnly("remove", p)
+	}
+	return b.Backend.Remove(p)
+}
+
+func (b *versionBackend) Mkdir(p string, perm os.FileMode) error {
+	if _, _, ok := versionPath(p); ok {
+		return versionsReadOnly("mkdir", p)
+	}
+	return b.Backend.Mkdir(p, perm)
+}
+
+func (b *versionBackend) Link(oldname, newname string) error {
+	if _, _, ok := versionPath(oldname); ok {
+		return versionsReadOnly("link", oldname)
+	}
+	if _, _, ok := versionPath(newname); ok {
+		return versionsReadOnly("link", newname)
+	}
+	return b.Backend.Link(oldname, newname)
+}
+
+// Symlink refuses links into the version store, which would make versions writable.
+func (b *versionBackend) Symlink(oldname, newname string) error {
+	if hasPathComponent(oldname, versionsDirName) {
+		return versionsReadOnly("symlink", oldname)
+	}
+	if _, _, ok := versionPath(newname); ok {
+		return versionsReadOnly("symlink", newname)
+	}
+	return b.Backend.Symlink(oldname, newname)
+}
+
+func (b *versionBackend) Readlink(p string) (string, error) {
+	if _, _, ok := versionPath(p); ok {
+		return "", &os.PathError{Op: "readlink", Path: p, Err: syscall.EINVAL}
+	}
+	return b.Backend.Readlink(p)
+}
+
+func (b *versionBackend) Chmod(p string, mode os.FileMode) error {
+	if _, _, ok := versionPath(p); ok {
+		return versionsReadOnly("chmod", p)
+	}
+	return b.Backend.Chmod(p, mode)
+}
+
+func (b *versionBackend) Chtimes(p string, atime, mtime time.Time) error {
+	if _, _, ok := versionPath(p); ok {
+		return versionsReadOnly("chtimes", p)
+	}
+	return b.Backend.Chtimes(p, atime, mtime)
+}
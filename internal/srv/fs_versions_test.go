@@ -0,0 +1,71 @@
+package srv
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVersionBackend(t *testing.T) {
+	tests := []struct {
+		name   string
+		keep   int
+		maxAge time.Duration
+		want   []string // contents of the kept versions, oldest first
+	}{
+		{name: "unlimited", want: []string{"v1", "v2", "v3"}},
+		{name: "keep 2", keep: 2, want: []string{"v2", "v3"}},
+		{name: "expired", maxAge: time.Nanosecond, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewVersionBackend(NewMemBackend(0), tt.keep, tt.maxAge)
+			if err := b.Mkdir("/dir", 0770); err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= 4; i++ {
+				writeMemFile(t, b, "/dir/report.csv", fmt.Sprintf("v%d", i))
+			}
+			if got := readMemFile(t, b, "/dir/report.csv"); got != "v4" {
+				t.Errorf("current content = %q, want v4", got)
+			}
+
+			infos, err := b.Readdir("/dir/.versions/report.csv")
+			if len(tt.want) == 0 {
+				if !os.IsNotExist(err) {
+					t.Errorf("Readdir() of expired versions = %v, %v", infos, err)
+				}
+				return
+			}
+			if err != nil || len(infos) != len(tt.want) {
+				t.Fatalf("Readdir() = %d versions, %v, want %d", len(infos), err, len(tt.want))
+			}
+			for i, info := range infos {
+				p := "/dir/.versions/report.csv/" + info.Name()
+				if got := readMemFile(t, b, p); got != tt.want[i] {
+					t.Errorf("version %s = %q, want %q", info.Name(), got, tt.want[i])
+				}
+			}
+
+			dirInfos, err := b.Readdir("/dir")
+			if err != nil || len(dirInfos) != 2 || dirInfos[1].Name() != ".versions" || !dirInfos[1].IsDir() {
+				t.Errorf("Readdir(/dir) = %v, %v, want report.csv and .versions", dirInfos, err)
+			}
+			if rootInfos, err := b.Readdir("/"); err != nil || len(rootInfos) != 1 {
+				t.Errorf("Readdir(/) = %v, %v, want only dir", rootInfos, err)
+			}
+
+			version := "/dir/.versions/report.csv/" + infos[0].Name()
+			if _, err := b.OpenFile(version, os.O_WRONLY, 0); !os.IsPermission(err) {
+				t.Errorf("OpenFile(O_WRONLY) error = %v, want permission error", err)
+			}
+			if err := b.Remove(version); !os.IsPermission(err) {
+				t.Errorf("Remove() error = %v, want permission error", err)
+			}
+			if err := b.Symlink("/.versions/dir", "/link"); !os.IsPermission(err) {
+				t.Errorf("Symlink() into store error = %v, want permission error", err)
+			}
+		})
+	}
+}
@@ -5,37 +5,41 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"path"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/sftp"
 )
 
-func newUserHandler(root string) *userRootHandler {
+func newUserHandler(backend Backend, policy *FilePolicy) *userRootHandler {
 	ur := &userRootHandler{
 		// fs:
-		dperm:    0770,
-		fperm:    0660,
-		logger:   func(f string, a ...interface{}) { fmt.Printf("sftp: "+f+"\n", a...) },
-		rootPath: root,
+		dperm:  0770,
+		fperm:  0660,
+		policy: policy,
 	}
 	fs := fsAdapter{
-		impl: fsImpl{
-			sanitizer: ur.pathSanitizer,
-			logger:    func(f string, a ...interface{}) { fmt.Printf("fs: "+f+"\n", a...) },
-		},
+		impl: backend,
 	}
 	ur.fs = fs
 	return ur
 }
 
 type userRootHandler struct {
-	fs     fsAdapter
-	fperm  os.FileMode
-	dperm  os.FileMode
-	logger func(format string, args ...interface{})
-
-	rootPath string
+	fs       fsAdapter
+	fperm    os.FileMode
+	dperm    os.FileMode
+	policy   *FilePolicy
+	readOnly bool
+	limiter  *transferLimiter
+	audit    *sessionAudit
+	logger   *Logger
+
+	session     *session
+	metrics     *Metrics
+	transferred *userMetrics // bytes transferred by the user
 }
 
 func (ur *userRootHandler) SftpHandler() sftp.Handlers {
@@ -47,42 +51,70 @@ func (ur *userRootHandler) SftpHandler() sftp.Handlers {
 	}
 }
 
-func (ur userRootHandler) pathSanitizer(path string) (string, error) {
-	orgPath := path
-	if !filepath.IsAbs(path) {
-		path = filepath.Join(ur.rootPath, path)
-	}
-	if filepath.IsAbs(path) {
-		path = filepath.Join(ur.rootPath, path)
-	}
-	path = filepath.Clean(path)
-	if !strings.HasPrefix(path, filepath.Clean(ur.rootPath)) {
-		return ur.rootPath, fmt.Errorf("invalid file path %q", orgPath)
-	}
-	return path, nil
-}
-
-func (ur userRootHandler) log(format string, args ...interface{}) {
-	if ur.logger == nil {
-		return
-	}
-	ur.logger(format, args...)
+func (ur *userRootHandler) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	start := time.Now()
+	file, err := ur.fileread(req)
+	ur.metrics.operation("get", start, err)
+	return ur.audited(req.Filepath, file, start, err)
 }
 
-func (ur *userRootHandler) Fileread(req *sftp.Request) (io.ReaderAt, error) {
-	ur.log("Fileread request %q", req.Filepath)
+func (ur *userRootHandler) fileread(req *sftp.Request) (File, error) {
+	ur.logger.Debug("fileread request", "path", req.Filepath)
 
 	flags := req.Pflags()
 	if !flags.Read {
 		// sanity check
 		return nil, os.ErrInvalid
 	}
+	if ur.readOnly && (flags.Write || flags.Append || flags.Creat || flags.Trunc) {
+		return nil, readOnlyDenied(req.Filepath)
+	}
+
+	file, err := ur.fs.OpenFile(req.Filepath, req.Pflags(), ur.fperm)
+	if err != nil {
+		return nil, err
+	}
+	if ur.limiter == nil || flags.Write {
+		return ur.limit(file, req.Filepath), nil
+	}
+	// reads are counted up to the size of the file
+	lf := &limitFile{File: file, limiter: ur.limiter, name: req.Filepath}
+	if info, err := ur.fs.Stat(req.Filepath); err == nil && info.Mode().IsRegular() {
+		lf.size, lf.sized = info.Size(), true
+	}
+	return lf, nil
+}
 
-	return ur.fs.OpenFile(req.Filepath, req.Pflags(), ur.fperm)
+// limit returns file with transfers limited by the limits of the session, if any.
+func (ur *userRootHandler) limit(file File, path string) File {
+	if ur.limiter == nil {
+		return file
+	}
+	return &limitFile{File: file, limiter: ur.limiter, name: path}
 }
 
 func (ur *userRootHandler) Filewrite(req *sftp.Request) (io.WriterAt, error) {
-	ur.log("Filewrite request %q", req.Filepath)
+	start := time.Now()
+	file, err := ur.filewrite(req)
+	ur.metrics.operation("put", start, err)
+	return ur.audited(req.Filepath, file, start, err)
+}
+
+// audited records the opening of the file p, returning it wrapped to record its transfers.
+func (ur *userRootHandler) audited(p string, file File, start time.Time, err error) (File, error) {
+	if ur.audit == nil && ur.metrics == nil && ur.session == nil {
+		return file, err
+	}
+	ur.audit.record(AuditOpen, p, "", 0, start, err)
+	if err != nil {
+		return nil, err
+	}
+	ur.session.opened()
+	return &auditFile{File: file, audit: ur.audit, metrics: ur.metrics, transferred: ur.transferred, session: ur.session, name: p, opened: start}, nil
+}
+
+func (ur *userRootHandler) filewrite(req *sftp.Request) (File, error) {
+	ur.logger.Debug("filewrite request", "path", req.Filepath)
 
 	flags := req.Pflags()
 	if !flags.Write {
@@ -90,25 +122,92 @@ func (ur *userRootHandler) Filewrite(req *sftp.Request) (io.WriterAt, error) {
 		return nil, os.ErrInvalid
 	}
 
+	if ur.readOnly {
+		return nil, readOnlyDenied(req.Filepath)
+	}
+
 	// FIXME: handle newFileAttrFlags() args?
 	requestPerm := req.Attributes().FileMode().Perm()
-	ur.log("Filewrite parm = %v", requestPerm)
+	ur.logger.Debug("filewrite permissions", "path", req.Filepath, "perm", requestPerm)
 
-	return ur.fs.OpenFile(req.Filepath, req.Pflags(), ur.fperm)
+	if err := ur.policy.checkName(req.Filepath, false); err != nil {
+		return nil, err
+	}
+	if ur.policy.sniffs() {
+		return ur.sniffed(req)
+	}
+	file, err := ur.fs.OpenFile(req.Filepath, req.Pflags(), ur.fperm)
+	if err != nil {
+		return nil, err
+	}
+	return ur.limit(file, req.Filepath), nil
+}
+
+// sniffed opens the file of req to write contents checked by the policy. The
+// file replaced when truncated is kept until the new contents are accepted, and
+// the contents of a file written to without truncating are sniffed with the writes.
+func (ur *userRootHandler) sniffed(req *sftp.Request) (File, error) {
+	flags := req.Pflags()
+	info, statErr := ur.fs.Stat(req.Filepath)
+	existing := statErr == nil && info.Mode().IsRegular()
+	if existing && flags.Trunc && !flags.Excl {
+		dir, name := path.Split(req.Filepath)
+		stage := fmt.Sprintf("%s%s%d-%s", dir, sniffStageName, time.Now().UnixNano(), name)
+		flags.Trunc, flags.Creat, flags.Excl = false, true, true
+		file, err := ur.fs.OpenFile(stage, flags, info.Mode().Perm())
+		if err != nil {
+			return nil, err
+		}
+		return ur.limit(newSniffFile(file, ur.fs, ur.policy, req.Filepath, stage), req.Filepath), nil
+	}
+	file, err := ur.fs.OpenFile(req.Filepath, flags, ur.fperm)
+	if err != nil {
+		return nil, err
+	}
+	f := newSniffFile(file, ur.fs, ur.policy, req.Filepath, "")
+	if existing {
+		if err := f.readHead(info.Size()); err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else {
+		f.created = os.IsNotExist(statErr)
+	}
+	return ur.limit(f, req.Filepath), nil
+}
+
+// readOnlyDenied returns the error of modifying p as a read-only user.
+func readOnlyDenied(p string) error {
+	return &os.PathError{Op: "denied (read-only user)", Path: p, Err: syscall.EPERM}
 }
 
 func (ur *userRootHandler) Filecmd(req *sftp.Request) error {
-	ur.log("Filecmd request %s %q", req.Method, req.Filepath)
+	start := time.Now()
+	err := ur.filecmd(req)
+	ur.audit.record(strings.ToLower(req.Method), req.Filepath, req.Target, 0, start, err)
+	ur.metrics.operation(strings.ToLower(req.Method), start, err)
+	return err
+}
 
+func (ur *userRootHandler) filecmd(req *sftp.Request) error {
+	ur.logger.Debug("filecmd request", "method", req.Method, "path", req.Filepath)
+
+	if ur.readOnly {
+		return readOnlyDenied(req.Filepath)
+	}
 	switch req.Method {
 	case "Setstat":
-		file, err := ur.fs.OpenFile(req.Filepath, sftp.FileOpenFlags{Write: true}, ur.fperm)
-		if err != nil {
-			return err
-		}
-
-		if req.AttrFlags().Size {
-			return file.Truncate(int64(req.Attributes().Size))
+		flags := req.AttrFlags()
+		attrs := req.Attributes()
+		if flags.Size {
+			if ur.limiter != nil {
+				if max := ur.limiter.limits.MaxFileSize; max > 0 && int64(attrs.Size) > max {
+					return limitExceeded(req.Filepath, "file size limit of %d bytes reached", max)
+				}
+			}
+			if err := ur.fs.Truncate(req.Filepath, int64(attrs.Size)); err != nil {
+				return err
+			}
 		}
 
 		return nil
@@ -123,6 +222,13 @@ func (ur *userRootHandler) Filecmd(req *sftp.Request) error {
 		if exists {
 			return os.ErrExist
 		}
+		info, err := ur.fs.Lstat(req.Filepath)
+		if err != nil {
+			return err
+		}
+		if err := ur.policy.checkName(req.Target, info.IsDir()); err != nil {
+			return err
+		}
 
 		return ur.fs.Rename(req.Filepath, req.Target)
 
@@ -135,13 +241,22 @@ func (ur *userRootHandler) Filecmd(req *sftp.Request) error {
 		return ur.fs.Unlink(req.Filepath)
 
 	case "Mkdir":
+		if err := ur.policy.checkName(req.Filepath, true); err != nil {
+			return err
+		}
 		return ur.fs.Mkdir(req.Filepath, ur.dperm)
 
 	case "Link":
+		if err := ur.policy.checkName(req.Target, false); err != nil {
+			return err
+		}
 		return ur.fs.Link(req.Filepath, req.Target)
 
 	case "Symlink":
 		// NOTE: r.Filepath is the target, and r.Target is the linkpath.
+		if err := ur.policy.checkName(req.Target, false); err != nil {
+			return err
+		}
 		return ur.fs.Symlink(req.Filepath, req.Target)
 	}
 
@@ -149,7 +264,17 @@ func (ur *userRootHandler) Filecmd(req *sftp.Request) error {
 }
 
 func (ur *userRootHandler) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
-	ur.log("Filelist request %s %q", req.Method, req.Filepath)
+	start := time.Now()
+	lister, err := ur.filelist(req)
+	if req.Method == "List" {
+		ur.audit.record(AuditList, req.Filepath, "", 0, start, err)
+	}
+	ur.metrics.operation(strings.ToLower(req.Method), start, err)
+	return lister, err
+}
+
+func (ur *userRootHandler) filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	ur.logger.Debug("filelist request", "method", req.Method, "path", req.Filepath)
 
 	switch req.Method {
 	case "List":
@@ -0,0 +1,172 @@
+package srv
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// recordingBackend records the calls made to the Backend it wraps.
+type recordingBackend struct {
+	Backend
+	calls []string
+}
+
+func (b *recordingBackend) record(call string, args ...interface{}) {
+	for _, arg := range args {
+		call += " " + strings.TrimSpace(strings.Replace(fmtArg(arg), "\n", " ", -1))
+	}
+	b.calls = append(b.calls, call)
+}
+
+func fmtArg(arg interface{}) string {
+	switch a := arg.(type) {
+	case string:
+		return a
+	case os.FileMode:
+		return a.String()
+	case int:
+		return flagsString(a)
+	}
+	return "?"
+}
+
+// flagsString names the access and creation flags of os.OpenFile.
+func flagsString(flags int) string {
+	var names []string
+	for _, f := range []struct {
+		flag int
+		name string
+	}{{os.O_WRONLY, "WRONLY"}, {os.O_RDWR, "RDWR"}, {os.O_APPEND, "APPEND"}, {os.O_CREATE, "CREATE"}, {os.O_EXCL, "EXCL"}, {os.O_TRUNC, "TRUNC"}} {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "RDONLY"
+	}
+	return strings.Join(names, "|")
+}
+
+func (b *recordingBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	b.record("OpenFile", p, flags, perm)
+	return b.Backend.OpenFile(p, flags, perm)
+}
+
+func (b *recordingBackend) Rename(from, to string) error {
+	b.record("Rename", from, to)
+	return b.Backend.Rename(from, to)
+}
+
+func (b *recordingBackend) Remove(p string) error {
+	b.record("Remove", p)
+	return b.Backend.Remove(p)
+}
+
+func TestUserRootHandler_BackendCalls(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(ur *userRootHandler) error
+		want []string
+	}{
+		{
+			name: "upload",
+			call: func(ur *userRootHandler) error {
+				req := sftp.NewRequest("Put", "/new")
+				req.Flags = fxfWrite | fxfCreat | fxfTrunc
+				_, err := ur.Filewrite(req)
+				return err
+			},
+			want: []string{"OpenFile /new WRONLY|CREATE|TRUNC -rw-rw----"},
+		},
+		{
+			name: "download",
+			call: func(ur *userRootHandler) error {
+				req := sftp.NewRequest("Get", "/file")
+				req.Flags = fxfRead
+				_, err := ur.Fileread(req)
+				return err
+			},
+			want: []string{"OpenFile /file RDONLY -rw-rw----"},
+		},
+		{
+			name: "rename onto existing is refused before reaching the backend",
+			call: func(ur *userRootHandler) error {
+				return ur.Filecmd(&sftp.Request{Method: "Rename", Filepath: "/file", Target: "/other"})
+			},
+			want: nil,
+		},
+		{
+			name: "remove",
+			call: func(ur *userRootHandler) error {
+				return ur.Filecmd(sftp.NewRequest("Remove", "/other"))
+			},
+			want: []string{"Remove /other"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := NewMemBackend(0)
+			writeMemFile(t, mem, "/file", "data")
+			writeMemFile(t, mem, "/other", "data")
+			b := &recordingBackend{Backend: mem}
+			ur := newUserHandler(b, nil)
+			ur.logger = nil
+			err := tt.call(ur)
+			if len(tt.want) > 0 && err != nil {
+				t.Errorf("error = %v", err)
+			}
+			if strings.Join(b.calls, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("backend calls = %q, want %q", b.calls, tt.want)
+			}
+		})
+	}
+}
+
+// transferErrorFile records the error reported by TransferError.
+type transferErrorFile struct {
+	File
+	err error
+}
+
+func (f *transferErrorFile) TransferError(err error) {
+	f.err = err
+}
+
+// transferErrorBackend returns files recording the errors reported by TransferError,
+// as the files of the S3 backend need them.
+type transferErrorBackend struct {
+	Backend
+	files []*transferErrorFile
+}
+
+func (b *transferErrorBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	f, err := b.Backend.OpenFile(p, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	tf := &transferErrorFile{File: f}
+	b.files = append(b.files, tf)
+	return tf, nil
+}
+
+// checkTransferError checks the error reported to f by TransferError reaches
+// a file opened on b.
+func checkTransferError(t *testing.T, f interface{}, b *transferErrorBackend) {
+	t.Helper()
+	te, ok := f.(sftp.TransferError)
+	if !ok {
+		t.Fatalf("%T doesn't implement sftp.TransferError", f)
+	}
+	errLost := errors.New("connection lost")
+	te.TransferError(errLost)
+	for _, tf := range b.files {
+		if tf.err == errLost {
+			return
+		}
+	}
+	t.Errorf("TransferError() of %T not reported to the stored file", f)
+}
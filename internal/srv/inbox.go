@@ -0,0 +1,426 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Each user is served their own inbox directory, kept in a directory named
+// after them below the inbox:
+//
+//	<inbox>/<user>/<path below inbox>
+//
+// Files uploaded to it are processed by marking them with Inbox.Process, which
+// moves them out of sight of the user, keeping their path below the inbox:
+//
+//	/.processed/<user>/<processing time>/<path below inbox>
+//
+// Users see the state of their files in the read-only status file of the inbox.
+const (
+	processedDirName = ".processed"
+	processedDir     = "/" + processedDirName
+	inboxStatusName  = ".status"
+)
+
+// Inbox is a directory files are uploaded to, to be processed.
+type Inbox struct {
+	backend Backend
+	dir     string
+}
+
+// InboxItem is a file of an inbox.
+type InboxItem struct {
+	Path      string    `json:"path"` // below the inbox
+	Processed bool      `json:"processed"`
+	Time      time.Time `json:"time"` // of the upload, or the processing if processed
+	Size      int64     `json:"size"`
+}
+
+// State returns the processing state of the item, "pending" or "processed".
+func (item InboxItem) State() string {
+	if item.Processed {
+		return "processed"
+	}
+	return "pending"
+}
+
+// NewInbox returns the Inbox dir kept in backend.
+func NewInbox(backend Backend, dir string) *Inbox {
+	return &Inbox{backend: backend, dir: cleanPath(dir)}
+}
+
+// userDir returns the directory keeping the inbox of user.
+func (in *Inbox) userDir(user string) string {
+	return path.Join(in.dir, user)
+}
+
+// Backend returns backend serving user their own inbox, with the status file
+// in it and the files of user processed hidden.
+func (in *Inbox) Backend(user string) (Backend, error) {
+	dir := in.userDir(user)
+	if err := mkdirAll(in.backend, dir); err != nil {
+		return nil, fmt.Errorf("error creating inbox: %w", err)
+	}
+	return &inboxBackend{Backend: in.backend, in: in, user: user, dir: dir}, nil
+}
+
+// List returns the files of user in the inbox, pending first and then processed, in order of time.
+func (in *Inbox) List(user string) ([]InboxItem, error) {
+	var items []InboxItem
+	userDir := in.userDir(user)
+	err := in.walk(userDir, func(p string, info os.FileInfo) {
+		items = append(items, InboxItem{Path: strings.TrimPrefix(p, userDir+"/"), Time: info.ModTime(), Size: info.Size()})
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing inbox: %w", err)
+	}
+
+	dir := processedDir + "/" + user
+	infos, err := in.backend.Readdir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error listing processed files: %w", err)
+	}
+	for _, info := range infos {
+		processed, err := time.Parse(trashIDFormat, info.Name())
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		itemDir := dir + "/" + info.Name()
+		err = in.walk(itemDir, func(p string, info os.FileInfo) {
+			items = append(items, InboxItem{Path: strings.TrimPrefix(p, itemDir+"/"), Processed: true, Time: processed, Size: info.Size()})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing processed files: %w", err)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].Processed != items[j].Processed {
+			return !items[i].Processed
+		}
+		return items[i].Time.Before(items[j].Time)
+	})
+	return items, nil
+}
+
+// walk calls fn with the regular files below dir.
+func (in *Inbox) walk(dir string, fn func(p string, info os.FileInfo)) error {
+	infos, err := in.backend.Readdir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		p := path.Join(dir, info.Name())
+		switch {
+		case info.IsDir() && isStoreName(info.Name()):
+			continue
+		case info.IsDir():
+			if err := in.walk(p, fn); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			fn(p, info)
+		}
+	}
+	return nil
+}
+
+// isStoreName reports whether name is that of the hidden store of a backend.
+func isStoreName(name string) bool {
+	switch name {
+	case dedupDirName, trashDirName, versionsDirName, scanDirName, processedDirName, retentionDirName:
+		return true
+	}
+	return false
+}
+
+// Process marks the file p of user (below the inbox, or absolute) processed.
+func (in *Inbox) Process(user, p string) error {
+	if !strings.HasPrefix(p, "/") {
+		p = in.dir + "/" + p
+	}
+	p = cleanPath(p)
+	if p == in.dir || !within(p, in.dir) {
+		return fmt.Errorf("%s is not in inbox %s: %w", p, in.dir, os.ErrInvalid)
+	}
+	userDir := in.userDir(user)
+	stored, _ := rebase(p, in.dir, userDir)
+	info, err := in.backend.Stat(stored)
+	if err != nil {
+		return rebaseErr(err, userDir, in.dir)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file: %w", p, os.ErrInvalid)
+	}
+
+	dir := processedDir + "/" + user
+	if err := mkdirAll(in.backend, dir); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for {
+		itemDir := dir + "/" + now.Format(trashIDFormat)
+		err := in.backend.Mkdir(itemDir, 0700)
+		if os.IsExist(err) {
+			now = now.Add(time.Nanosecond)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		item := itemDir + strings.TrimPrefix(stored, userDir)
+		if err := mkdirAll(in.backend, path.Dir(item)); err != nil {
+			return err
+		}
+		return in.backend.Rename(stored, item)
+	}
+}
+
+// status returns the content of the status file: a line per file, of its
+// state, the time of its upload or processing and its path below the inbox.
+func (in *Inbox) status(user string) ([]byte, error) {
+	items, err := in.List(user)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, item := range items {
+		fmt.Fprintf(&buf, "%s\t%s\t%s\n", item.State(), item.Time.UTC().Format(time.RFC3339), item.Path)
+	}
+	return buf.Bytes(), nil
+}
+
+// inboxBackend serves the inbox of user from dir, hides processed files and
+// serves the status file of the inbox, otherwise delegating to the wrapped Backend.
+type inboxBackend struct {
+	Backend
+	in   *Inbox
+	user string
+	dir  string // keeping the inbox of user
+}
+
+func isProcessedPath(p string) bool {
+	return hasPathComponent(p, processedDirName)
+}
+
+func processedHidden(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: syscall.ENOENT}
+}
+
+func (b *inboxBackend) isStatus(p string) bool {
+	return cleanPath(p) == b.in.dir+"/"+inboxStatusName
+}
+
+func statusReadOnly(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: syscall.EPERM}
+}
+
+// path returns the path of p in the wrapped backend, in the directory of the
+// user if in the inbox.
+func (b *inboxBackend) path(p string) string {
+	p, _ = rebase(cleanPath(p), b.in.dir, b.dir)
+	return p
+}
+
+// err returns err with the directory of the user shown as the inbox.
+func (b *inboxBackend) err(err error) error {
+	return rebaseErr(err, b.dir, b.in.dir)
+}
+
+// denied returns the error for op on p if refused.
+func (b *inboxBackend) denied(op, p string) error {
+	if isProcessedPath(p) {
+		return processedHidden(op, p)
+	}
+	if b.isStatus(p) {
+		return statusReadOnly(op, p)
+	}
+	if cleanPath(p) == b.in.dir {
+		return &os.PathError{Op: op, Path: p, Err: syscall.EPERM}
+	}
+	return nil
+}
+
+func (b *inboxBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	if isProcessedPath(p) {
+		return nil, processedHidden("open", p)
+	}
+	if !b.isStatus(p) {
+		f, err := b.Backend.OpenFile(b.path(p), flags, perm)
+		return f, b.err(err)
+	}
+	if flags&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, statusReadOnly("open", p)
+	}
+	data, err := b.in.status(b.user)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return &staticFile{Reader: bytes.NewReader(data), name: p}, nil
+}
+
+func (b *inboxBackend) statusInfo() (os.FileInfo, error) {
+	data, err := b.in.status(b.user)
+	if err != nil {
+		return nil, err
+	}
+	return &memFileInfo{name: inboxStatusName, size: int64(len(data)), mode: 0444, modTime: time.Now()}, nil
+}
+
+func (b *inboxBackend) Stat(p string) (os.FileInfo, error) {
+	if isProcessedPath(p) {
+		return nil, processedHidden("stat", p)
+	}
+	if b.isStatus(p) {
+		return b.statusInfo()
+	}
+	info, err := b.Backend.Stat(b.path(p))
+	return info, b.err(err)
+}
+
+func (b *inboxBackend) Lstat(p string) (os.FileInfo, error) {
+	if isProcessedPath(p) {
+		return nil, processedHidden("lstat", p)
+	}
+	if b.isStatus(p) {
+		return b.statusInfo()
+	}
+	info, err := b.Backend.Lstat(b.path(p))
+	return info, b.err(err)
+}
+
+func (b *inboxBackend) Readdir(dirPath string) ([]os.FileInfo, error) {
+	if isProcessedPath(dirPath) {
+		return nil, processedHidden("readdir", dirPath)
+	}
+	infos, err := b.Backend.Readdir(b.path(dirPath))
+	if err != nil {
+		return infos, b.err(err)
+	}
+	visible := infos[:0]
+	for _, info := range infos {
+		if info.Name() != processedDirName {
+			visible = append(visible, info)
+		}
+	}
+	if cleanPath(dirPath) == b.in.dir {
+		if info, err := b.statusInfo(); err == nil {
+			visible = append(visible, info)
+		}
+	}
+	return visible, nil
+}
+
+func (b *inboxBackend) Rename(from, to string) error {
+	if err := b.denied("rename", from); err != nil {
+		return err
+	}
+	if err := b.denied("rename", to); err != nil {
+		return err
+	}
+	return b.err(b.Backend.Rename(b.path(from), b.path(to)))
+}
+
+func (b *inboxBackend) Remove(p string) error {
+	if err := b.denied("remove", p); err != nil {
+		return err
+	}
+	return b.err(b.Backend.Remove(b.path(p)))
+}
+
+func (b *inboxBackend) Mkdir(p string, perm os.FileMode) error {
+	if isProcessedPath(p) {
+		return &os.PathError{Op: "mkdir", Path: p, Err: syscall.EPERM}
+	}
+	if b.isStatus(p) {
+		return statusReadOnly("mkdir", p)
+	}
+	return b.err(b.Backend.Mkdir(b.path(p), perm))
+}
+
+func (b *inboxBackend) Link(oldname, newname string) error {
+	if err := b.denied("link", oldname); err != nil {
+		return err
+	}
+	if err := b.denied("link", newname); err != nil {
+		return err
+	}
+	return b.err(b.Backend.Link(b.path(oldname), b.path(newname)))
+}
+
+// Symlink creates newname as a link to oldname, relative targets being made
+// absolute so that they resolve the same in the directory of the user.
+func (b *inboxBackend) Symlink(oldname, newname string) error {
+	if isProcessedPath(oldname) {
+		return &os.PathError{Op: "symlink", Path: oldname, Err: syscall.EPERM}
+	}
+	if err := b.denied("symlink", newname); err != nil {
+		return err
+	}
+	if !path.IsAbs(oldname) {
+		oldname = path.Join(path.Dir(cleanPath(newname)), oldname)
+	}
+	return b.err(b.Backend.Symlink(b.path(oldname), b.path(newname)))
+}
+
+func (b *inboxBackend) Readlink(p string) (string, error) {
+	if isProcessedPath(p) {
+		return "", processedHidden("readlink", p)
+	}
+	if b.isStatus(p) {
+		return "", &os.PathError{Op: "readlink", Path: p, Err: syscall.EINVAL}
+	}
+	target, err := b.Backend.Readlink(b.path(p))
+	if err != nil {
+		return "", b.err(err)
+	}
+	target, _ = rebase(target, b.dir, b.in.dir)
+	return target, nil
+}
+
+func (b *inboxBackend) Chmod(p string, mode os.FileMode) error {
+	if err := b.denied("chmod", p); err != nil {
+		return err
+	}
+	return b.err(b.Backend.Chmod(b.path(p), mode))
+}
+
+func (b *inboxBackend) Chtimes(p string, atime, mtime time.Time) error {
+	if err := b.denied("chtimes", p); err != nil {
+		return err
+	}
+	return b.err(b.Backend.Chtimes(b.path(p), atime, mtime))
+}
+
+func (b *inboxBackend) StatFS(p string) (*sftp.StatVFS, error) {
+	stat, err := b.Backend.StatFS(b.path(p))
+	return stat, b.err(err)
+}
+
+// staticFile is a read-only file of generated content.
+type staticFile struct {
+	*bytes.Reader
+	name string
+}
+
+func (f *staticFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, statusReadOnly("write", f.name)
+}
+
+func (f *staticFile) Truncate(size int64) error {
+	return statusReadOnly("truncate", f.name)
+}
+
+func (f *staticFile) Close() error {
+	return nil
+}
@@ -0,0 +1,74 @@
+package srv
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInbox(t *testing.T) {
+	inner := NewMemBackend(0)
+	inbox := NewInbox(inner, "/incoming")
+	b, err := inbox.Backend("u")
+	if err != nil {
+		t.Fatalf("Backend() error = %v", err)
+	}
+	if err := b.Mkdir("/incoming/2020", 0770); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, b, "/incoming/2020/orders.csv", "1")
+	writeMemFile(t, b, "/incoming/stock.csv", "2")
+
+	if err := inbox.Process("u", "2020/orders.csv"); err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if err := inbox.Process("u", "/outgoing/stock.csv"); err == nil {
+		t.Errorf("Process() of file outside inbox succeeded")
+	}
+	if _, err := b.Stat("/incoming/2020/orders.csv"); !os.IsNotExist(err) {
+		t.Errorf("Stat() of processed file error = %v, want not exist", err)
+	}
+	if infos, err := b.Readdir("/"); err != nil || len(infos) != 1 {
+		t.Errorf("Readdir(/) = %v, %v, want only the inbox", infos, err)
+	}
+
+	status := readMemFile(t, b, "/incoming/.status")
+	lines := strings.Split(strings.TrimSpace(status), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "pending\t") || !strings.HasSuffix(lines[0], "\tstock.csv") ||
+		!strings.HasPrefix(lines[1], "processed\t") || !strings.HasSuffix(lines[1], "\t2020/orders.csv") {
+		t.Errorf("status = %q, want stock.csv pending and 2020/orders.csv processed", status)
+	}
+	if info, err := b.Stat("/incoming/.status"); err != nil || info.Size() != int64(len(status)) {
+		t.Errorf("Stat() of status = %v, %v, want size %d", info, err, len(status))
+	}
+	if _, err := b.OpenFile("/incoming/.status", os.O_WRONLY|os.O_TRUNC, 0); !os.IsPermission(err) {
+		t.Errorf("OpenFile() of status for writing error = %v, want permission error", err)
+	}
+
+	items, err := inbox.List("u")
+	if err != nil || len(items) != 2 || items[1].State() != "processed" {
+		t.Errorf("List() = %+v, %v", items, err)
+	}
+	if got := readMemFile(t, inner, "/incoming/u/stock.csv"); got != "2" {
+		t.Errorf("stored %q in the inbox of the user, want 2", got)
+	}
+
+	// other users only see their own files
+	other, err := inbox.Backend("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Stat("/incoming/stock.csv"); !os.IsNotExist(err) {
+		t.Errorf("Stat() of file of another user error = %v, want not exist", err)
+	}
+	writeMemFile(t, other, "/incoming/stock.csv", "3")
+	if status := readMemFile(t, other, "/incoming/.status"); strings.Count(status, "\n") != 1 {
+		t.Errorf("status of other user = %q, want only their file", status)
+	}
+	if err := inbox.Process("bob", "2020/orders.csv"); !os.IsNotExist(err) {
+		t.Errorf("Process() of file of another user error = %v, want not exist", err)
+	}
+	if err := other.Remove("/incoming"); !os.IsPermission(err) {
+		t.Errorf("Remove() of inbox error = %v, want permission error", err)
+	}
+}
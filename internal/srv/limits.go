@@ -0,0 +1,172 @@
+package srv
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// TransferLimits limit the bytes a user may transfer, uploads and downloads
+// alike. Limits of 0 don't apply.
+type TransferLimits struct {
+	MaxFileSize     int64 // size a file may be written up to
+	MaxSessionBytes int64 // transferred in a session
+	MaxDailyBytes   int64 // transferred by all sessions of the user in a day (local time)
+}
+
+func (l TransferLimits) enabled() bool {
+	return l.MaxFileSize > 0 || l.MaxSessionBytes > 0 || l.MaxDailyBytes > 0
+}
+
+// limitExceeded returns the error for a transfer of p refused by a limit for reason.
+// It's reported to clients as SSH_FX_PERMISSION_DENIED with reason in the message.
+func limitExceeded(p, format string, a ...interface{}) error {
+	return &os.PathError{Op: "limit exceeded (" + fmt.Sprintf(format, a...) + ")", Path: p, Err: syscall.EPERM}
+}
+
+// dailyCounter counts the bytes transferred by a user today.
+type dailyCounter struct {
+	mu    sync.Mutex
+	day   string
+	bytes int64
+}
+
+// dayOf returns the day bytes transferred at t count for.
+func dayOf(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// add adds n bytes to today's count unless exceeding max.
+func (c *dailyCounter) add(n, max int64, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if day := dayOf(now); day != c.day {
+		c.day, c.bytes = day, 0
+	}
+	if max > 0 && c.bytes+n > max {
+		return false
+	}
+	c.bytes += n
+	return true
+}
+
+// sub uncounts n bytes added on day, unless counting another day since.
+func (c *dailyCounter) sub(n int64, day string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if day == c.day {
+		c.bytes -= n
+	}
+}
+
+// transferLimiter enforces the TransferLimits of a session.
+type transferLimiter struct {
+	session int64 // first for alignment of atomic operations
+	limits  TransferLimits
+	user    string
+	home    string
+	daily   *dailyCounter // shared by the sessions of the user
+	onEvent func(Event)
+}
+
+// take counts n bytes transferred to or from p, unless exceeding a limit.
+// It returns the day the bytes count for.
+func (l *transferLimiter) take(p string, n int64) (string, error) {
+	now := time.Now()
+	if n <= 0 {
+		return dayOf(now), nil
+	}
+	if total := atomic.AddInt64(&l.session, n); l.limits.MaxSessionBytes > 0 && total > l.limits.MaxSessionBytes {
+		atomic.AddInt64(&l.session, -n)
+		return "", limitExceeded(p, "session transfer limit of %d bytes reached", l.limits.MaxSessionBytes)
+	}
+	if !l.daily.add(n, l.limits.MaxDailyBytes, now) {
+		atomic.AddInt64(&l.session, -n)
+		return "", limitExceeded(p, "daily transfer limit of %d bytes reached", l.limits.MaxDailyBytes)
+	}
+	return dayOf(now), nil
+}
+
+// giveBack uncounts n bytes taken on day but not transferred.
+func (l *transferLimiter) giveBack(n int64, day string) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&l.session, -n)
+	l.daily.sub(n, day)
+}
+
+func (l *transferLimiter) report(p string, err error) {
+	if l.onEvent != nil {
+		l.onEvent(Event{Time: time.Now(), Type: EventLimit, User: l.user, Path: p, Home: l.home, Err: err})
+	}
+}
+
+// limitFile is an open file transfers of which are limited.
+type limitFile struct {
+	File
+	limiter  *transferLimiter
+	name     string
+	size     int64 // if sized
+	sized    bool  // opened for reading only, of size
+	reported int32
+}
+
+func (f *limitFile) TransferError(err error) {
+	transferError(f.File, err)
+}
+
+// fail reports err, once per file.
+func (f *limitFile) fail(err error) error {
+	if atomic.CompareAndSwapInt32(&f.reported, 0, 1) {
+		f.limiter.report(f.name, err)
+	}
+	return err
+}
+
+func (f *limitFile) ReadAt(p []byte, off int64) (int, error) {
+	// only the bytes left before the end are counted, so reads reaching past it fit the limits
+	reserved := int64(len(p))
+	if f.sized && f.size-off < reserved {
+		reserved = f.size - off
+		if reserved < 0 {
+			reserved = 0
+		}
+	}
+	day, err := f.limiter.take(f.name, reserved)
+	if err != nil {
+		return 0, f.fail(err)
+	}
+	n, err := f.File.ReadAt(p, off)
+	if int64(n) > reserved {
+		// grown since opened
+		if _, err := f.limiter.take(f.name, int64(n)-reserved); err != nil {
+			return 0, f.fail(err)
+		}
+	}
+	f.limiter.giveBack(reserved-int64(n), day)
+	return n, err
+}
+
+func (f *limitFile) WriteAt(p []byte, off int64) (int, error) {
+	if max := f.limiter.limits.MaxFileSize; max > 0 && off+int64(len(p)) > max {
+		return 0, f.fail(limitExceeded(f.name, "file size limit of %d bytes reached", max))
+	}
+	day, err := f.limiter.take(f.name, int64(len(p)))
+	if err != nil {
+		return 0, f.fail(err)
+	}
+	n, err := f.File.WriteAt(p, off)
+	f.limiter.giveBack(int64(len(p)-n), day)
+	return n, err
+}
+
+func (f *limitFile) Truncate(size int64) error {
+	if max := f.limiter.limits.MaxFileSize; max > 0 && size > max {
+		return f.fail(limitExceeded(f.name, "file size limit of %d bytes reached", max))
+	}
+	return f.File.Truncate(size)
+}
@@ -0,0 +1,131 @@
+package srv
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+func TestLimitFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  TransferLimits
+		writes  []int // sizes written one after the other
+		wantErr bool
+	}{
+		{name: "within limits", limits: TransferLimits{MaxFileSize: 10, MaxSessionBytes: 10}, writes: []int{5, 5}},
+		{name: "file size", limits: TransferLimits{MaxFileSize: 10}, writes: []int{5, 6}, wantErr: true},
+		{name: "session", limits: TransferLimits{MaxSessionBytes: 8}, writes: []int{5, 5}, wantErr: true},
+		{name: "daily", limits: TransferLimits{MaxDailyBytes: 8}, writes: []int{4, 4, 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemBackend(0)
+			var events []Event
+			limiter := &transferLimiter{limits: tt.limits, user: "u", daily: &dailyCounter{}, onEvent: func(e Event) { events = append(events, e) }}
+			f, err := b.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0660)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lf := &limitFile{File: f, limiter: limiter, name: "/file"}
+			var off int64
+			var writeErr error
+			for _, n := range tt.writes {
+				if _, writeErr = lf.WriteAt(make([]byte, n), off); writeErr != nil {
+					break
+				}
+				off += int64(n)
+			}
+			lf.Close()
+			if (writeErr != nil) != tt.wantErr {
+				t.Errorf("WriteAt() error = %v, wantErr %v", writeErr, tt.wantErr)
+			}
+			if writeErr != nil && !os.IsPermission(writeErr) {
+				t.Errorf("WriteAt() error = %v, want permission error", writeErr)
+			}
+			if tt.wantErr && (len(events) != 1 || events[0].Type != EventLimit) {
+				t.Errorf("events = %v, want one limit event", events)
+			}
+		})
+	}
+}
+
+func TestServer_newTransferLimiter(t *testing.T) {
+	s := &Server{}
+	u := User{Name: "u", Limits: TransferLimits{MaxDailyBytes: 10}}
+	if _, err := s.newTransferLimiter(u).take("/a", 6); err != nil {
+		t.Fatalf("take() error = %v", err)
+	}
+	// the daily limit is shared by the sessions of the user
+	if _, err := s.newTransferLimiter(u).take("/b", 6); !os.IsPermission(err) {
+		t.Errorf("take() in second session error = %v, want permission error", err)
+	}
+	if l := s.newTransferLimiter(User{Name: "u"}); l != nil {
+		t.Errorf("newTransferLimiter() without limits = %v, want nil", l)
+	}
+
+	// counts restart the next day
+	c := &dailyCounter{}
+	now := time.Now()
+	if !c.add(10, 10, now) || c.add(1, 10, now) {
+		t.Errorf("add() over the daily limit succeeded")
+	}
+	if !c.add(10, 10, now.Add(24*time.Hour)) {
+		t.Errorf("add() on the next day failed")
+	}
+	// bytes given back the next day aren't credited to it
+	c.sub(5, dayOf(now))
+	if c.add(1, 10, now.Add(24*time.Hour)) {
+		t.Errorf("add() after giving back bytes of the day before succeeded")
+	}
+}
+
+func TestLimitFile_ReadAt(t *testing.T) {
+	b := NewMemBackend(0)
+	writeMemFile(t, b, "/file", "0123456789")
+	f, err := b.OpenFile("/file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	limiter := &transferLimiter{limits: TransferLimits{MaxSessionBytes: 15}, user: "u", daily: &dailyCounter{}}
+	lf := &limitFile{File: f, limiter: limiter, name: "/file", size: 10, sized: true}
+
+	tests := []struct {
+		off     int64
+		want    int
+		wantErr bool
+	}{
+		{off: 0, want: 10},
+		{off: 10, want: 0},
+		{off: 5, want: 5},
+		{off: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		n, err := lf.ReadAt(make([]byte, 32<<10), tt.off)
+		if n != tt.want || os.IsPermission(err) != tt.wantErr {
+			t.Errorf("ReadAt(%d) = %d, %v, want %d bytes, wantErr %v", tt.off, n, err, tt.want, tt.wantErr)
+		}
+	}
+	if limiter.session != 15 {
+		t.Errorf("counted %d bytes, want 15", limiter.session)
+	}
+}
+
+func TestLimitFile_TransferError(t *testing.T) {
+	inner := &transferErrorBackend{Backend: NewMemBackend(0)}
+	ur := newUserHandler(inner, nil)
+	ur.logger = nil
+	ur.limiter = &transferLimiter{limits: TransferLimits{MaxSessionBytes: 15}, user: "u", daily: &dailyCounter{}}
+	put := sftp.NewRequest("Put", "/upload")
+	put.Flags = fxfWrite | fxfCreat | fxfTrunc
+	w, err := ur.Filewrite(put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.(io.Closer).Close()
+	checkTransferError(t, w, inner)
+}
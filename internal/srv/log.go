@@ -0,0 +1,167 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// Log levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level: debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) || (name == "warn" && strings.EqualFold(s, "warning")) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q", s)
+}
+
+// Logger writes messages with key/value fields, as text (logfmt) or JSON lines.
+// A nil *Logger discards all messages.
+type Logger struct {
+	sink   *logSink
+	fields []interface{} // key/value pairs added to every message
+}
+
+// logSink is where the Loggers derived from one another write to.
+type logSink struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+}
+
+// NewLogger returns a Logger writing messages of level or above to w,
+// encoded as JSON if asJSON, otherwise as text.
+func NewLogger(w io.Writer, level Level, asJSON bool) *Logger {
+	return &Logger{sink: &logSink{w: w, level: level, json: asJSON}}
+}
+
+// With returns a Logger adding the key/value pairs kv to every message.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+// Enabled reports whether messages of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.sink.level
+}
+
+// Debug logs msg with the key/value pairs kv at LevelDebug.
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+
+// Info logs msg with the key/value pairs kv at LevelInfo.
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+
+// Warn logs msg with the key/value pairs kv at LevelWarn.
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(LevelWarn, msg, kv) }
+
+// Error logs msg with the key/value pairs kv at LevelError.
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	var buf bytes.Buffer
+	now := time.Now().Format(time.RFC3339Nano)
+	if l.sink.json {
+		buf.WriteString(`{"time":`)
+		writeJSONValue(&buf, now)
+		buf.WriteString(`,"level":`)
+		writeJSONValue(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+		for i := 0; i < len(fields); i += 2 {
+			buf.WriteByte(',')
+			writeJSONValue(&buf, fmt.Sprint(fields[i]))
+			buf.WriteByte(':')
+			writeJSONValue(&buf, fields[i+1])
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "time=%s level=%s msg=%s", now, level, logfmtValue(msg))
+		for i := 0; i < len(fields); i += 2 {
+			fmt.Fprintf(&buf, " %s=%s", fields[i], logfmtValue(fields[i+1]))
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	_, _ = l.sink.w.Write(buf.Bytes())
+}
+
+// plainValue returns v as logged: errors and Stringers by their text.
+func plainValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(plainValue(v))
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// logfmtValue returns v formatted for text logs, quoted if needed.
+func logfmtValue(v interface{}) string {
+	var s string
+	switch v := plainValue(v).(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		s = v
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
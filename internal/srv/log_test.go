@@ -0,0 +1,108 @@
+package srv
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	tests := []struct {
+		name   string
+		asJSON bool
+		log    func(l *Logger)
+		want   string // matched against the message logged, without its time
+	}{
+		{
+			name: "text",
+			log: func(l *Logger) {
+				l.With("user", "bob").Info("client disconnected", "path", "/a b", "err", errors.New("EOF"))
+			},
+			want: `^level=info msg="client disconnected" user=bob path="/a b" err=EOF\n$`,
+		},
+		{
+			name:   "json",
+			asJSON: true,
+			log:    func(l *Logger) { l.With("user", "bob").Warn("rejected", "bytes", 5, "err", errors.New("denied")) },
+			want:   `^"level":"warn","msg":"rejected","user":"bob","bytes":5,"err":"denied"}\n$`,
+		},
+		{
+			name: "below level",
+			log:  func(l *Logger) { l.Debug("sanitize", "path", "/a") },
+			want: `^$`,
+		},
+		{
+			name: "nil logger",
+			log:  func(l *Logger) { (*Logger)(nil).With("a", 1).Error("error") },
+			want: `^$`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.log(NewLogger(&buf, LevelInfo, tt.asJSON))
+			got := regexp.MustCompile(`^(time=\S+ |\{"time":"[^"]+",)`).ReplaceAllString(buf.String(), "")
+			if !regexp.MustCompile(tt.want).MatchString(got) {
+				t.Errorf("logged %q, want %s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestLogBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	osBackend, err := NewOSBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		backend Backend
+		path    string
+		want    string // matched against the message logged, without its time
+	}{
+		{
+			name:    "mem",
+			backend: NewMemBackend(0),
+			path:    "/missing",
+			want:    `^level=debug msg=stat session=0123 component=fs path=/missing err="stat /missing: no such file or directory"\n$`,
+		},
+		{
+			name:    "outside of root",
+			backend: osBackend,
+			path:    "../etc",
+			want:    `^level=warn msg=stat session=0123 component=fs path=../etc err="invalid file path \\"../etc\\""\n$`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			b := NewLogBackend(tt.backend, NewLogger(&buf, LevelDebug, false).With("session", "0123"))
+			if _, err := b.Stat(tt.path); err == nil {
+				t.Fatalf("Stat(%s) succeeded", tt.path)
+			}
+			got := regexp.MustCompile(`^time=\S+ `).ReplaceAllString(buf.String(), "")
+			if !regexp.MustCompile(tt.want).MatchString(got) {
+				t.Errorf("logged %q, want %s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "warning": LevelWarn, "error": LevelError} {
+		if got, err := ParseLevel(s); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("ParseLevel(verbose) succeeded")
+	}
+}
@@ -0,0 +1,313 @@
+package srv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the buckets of operation latencies.
+var durationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics counts the activity of a Server, exposed in the Prometheus text format.
+// A nil *Metrics counts nothing.
+type Metrics struct {
+	connections       int64 // first for alignment of atomic operations
+	handshakeFailures int64
+	sessions          int64
+	activeSessions    int64
+	server            *Server
+
+	mu         sync.Mutex
+	auth       map[[2]string]int64 // method and result -> attempts
+	users      map[string]*userMetrics
+	operations map[string]*histogram // by SFTP method
+	errors     map[string]int64      // by result code
+	rejections map[string]int64      // by reason
+}
+
+// userMetrics are the bytes transferred by a user.
+type userMetrics struct {
+	read    int64
+	written int64
+}
+
+// histogram counts observations in durationBuckets.
+type histogram struct {
+	buckets []int64 // cumulative counts are computed when written
+	count   int64
+	sum     float64
+}
+
+// NewMetrics returns empty Metrics, to be passed to Server.SetMetrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		auth:       map[[2]string]int64{},
+		users:      map[string]*userMetrics{},
+		operations: map[string]*histogram{},
+		errors:     map[string]int64{},
+		rejections: map[string]int64{},
+	}
+}
+
+// user returns the counters of user, or nil if m is nil.
+func (m *Metrics) user(name string) *userMetrics {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.users[name]
+	if u == nil {
+		u = &userMetrics{}
+		m.users[name] = u
+	}
+	return u
+}
+
+func (u *userMetrics) add(read, written int64) {
+	if u == nil {
+		return
+	}
+	if read > 0 {
+		atomic.AddInt64(&u.read, read)
+	}
+	if written > 0 {
+		atomic.AddInt64(&u.written, written)
+	}
+}
+
+func (m *Metrics) connected() {
+	if m != nil {
+		atomic.AddInt64(&m.connections, 1)
+	}
+}
+
+func (m *Metrics) handshakeFailed() {
+	if m != nil {
+		atomic.AddInt64(&m.handshakeFailures, 1)
+	}
+}
+
+// session counts a session opened, returning the function to call when closed.
+func (m *Metrics) session() func() {
+	if m == nil {
+		return func() {}
+	}
+	atomic.AddInt64(&m.sessions, 1)
+	atomic.AddInt64(&m.activeSessions, 1)
+	return func() { atomic.AddInt64(&m.activeSessions, -1) }
+}
+
+func (m *Metrics) authenticated(method string, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.mu.Lock()
+	m.auth[[2]string{method, result}]++
+	m.mu.Unlock()
+}
+
+// operation counts an operation of the SFTP method which took since start.
+func (m *Metrics) operation(method string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	seconds := time.Since(start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.operations[method]
+	if h == nil {
+		h = &histogram{buckets: make([]int64, len(durationBuckets))}
+		m.operations[method] = h
+	}
+	if i := sort.SearchFloat64s(durationBuckets, seconds); i < len(durationBuckets) {
+		h.buckets[i]++
+	}
+	h.count++
+	h.sum += seconds
+	m.failed(err)
+}
+
+// failed counts err by its result code, if an error. m.mu must be held.
+func (m *Metrics) failed(err error) {
+	if result := auditResult(err); result != "ok" {
+		m.errors[result]++
+	}
+}
+
+// rejected counts a connection or session rejected by the ConnectionLimits.
+func (m *Metrics) rejected(err error) {
+	rejected, ok := err.(connRejected)
+	if m == nil || !ok {
+		return
+	}
+	m.mu.Lock()
+	m.rejections[rejected.reason]++
+	m.mu.Unlock()
+}
+
+// transferFailed counts an error reading or writing an open file.
+func (m *Metrics) transferFailed(err error) {
+	if m == nil || err == nil {
+		return
+	}
+	m.mu.Lock()
+	m.failed(err)
+	m.mu.Unlock()
+}
+
+// ServeHTTP serves the metrics to Prometheus.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	var conns int64
+	var quotas []UserQuota
+	if m.server != nil {
+		conns = m.server.NumConns()
+		quotas = m.server.QuotaUsage()
+	}
+	writeMetric(bw, "sftp_connections_active", "gauge", "Connections open.", nil, conns)
+	writeMetric(bw, "sftp_connections_total", "counter", "Connections accepted.", nil, atomic.LoadInt64(&m.connections))
+	writeMetric(bw, "sftp_handshake_failures_total", "counter", "Connections failing the SSH handshake, including authentication.", nil, atomic.LoadInt64(&m.handshakeFailures))
+	writeMetric(bw, "sftp_sessions_active", "gauge", "SSH sessions open.", nil, atomic.LoadInt64(&m.activeSessions))
+	writeMetric(bw, "sftp_sessions_total", "counter", "SSH sessions opened.", nil, atomic.LoadInt64(&m.sessions))
+
+	m.mu.Lock()
+	var auth []sample
+	for k, n := range m.auth {
+		auth = append(auth, sample{labels{"method", k[0], "result", k[1]}, n})
+	}
+	var read, written []sample
+	for name, u := range m.users {
+		read = append(read, sample{labels{"user", name}, atomic.LoadInt64(&u.read)})
+		written = append(written, sample{labels{"user", name}, atomic.LoadInt64(&u.written)})
+	}
+	var errs []sample
+	for result, n := range m.errors {
+		errs = append(errs, sample{labels{"type", result}, n})
+	}
+	var rejections []sample
+	for reason, n := range m.rejections {
+		rejections = append(rejections, sample{labels{"reason", reason}, n})
+	}
+	methods := make([]string, 0, len(m.operations))
+	for method := range m.operations {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	ops := make([]histogram, len(methods))
+	for i, method := range methods {
+		h := m.operations[method]
+		ops[i] = histogram{buckets: append([]int64{}, h.buckets...), count: h.count, sum: h.sum}
+	}
+	m.mu.Unlock()
+
+	writeMetrics(bw, "sftp_connections_rejected_total", "counter", "Connections and sessions rejected by the connection limits, by reason.", rejections)
+	writeMetrics(bw, "sftp_auth_attempts_total", "counter", "Authentication attempts by method and result.", auth)
+	writeMetrics(bw, "sftp_read_bytes_total", "counter", "Bytes read from files by user.", read)
+	writeMetrics(bw, "sftp_written_bytes_total", "counter", "Bytes written to files by user.", written)
+	writeMetrics(bw, "sftp_errors_total", "counter", "Failed operations by type of error.", errs)
+
+	const opName = "sftp_operation_duration_seconds"
+	fmt.Fprintf(bw, "# HELP %s Duration of operations by SFTP method.\n# TYPE %s histogram\n", opName, opName)
+	for i, method := range methods {
+		var cumulative int64
+		for j, bound := range durationBuckets {
+			cumulative += ops[i].buckets[j]
+			writeSample(bw, opName+"_bucket", labels{"method", method, "le", formatFloat(bound)}, strconv.FormatInt(cumulative, 10))
+		}
+		writeSample(bw, opName+"_bucket", labels{"method", method, "le", "+Inf"}, strconv.FormatInt(ops[i].count, 10))
+		writeSample(bw, opName+"_sum", labels{"method", method}, formatFloat(ops[i].sum))
+		writeSample(bw, opName+"_count", labels{"method", method}, strconv.FormatInt(ops[i].count, 10))
+	}
+
+	if len(quotas) > 0 {
+		var used, limits []sample
+		for _, q := range quotas {
+			used = append(used, sample{labels{"user", q.User}, q.Used})
+			if q.Limit > 0 {
+				limits = append(limits, sample{labels{"user", q.User}, q.Limit})
+			}
+		}
+		writeMetrics(bw, "sftp_quota_used_bytes", "gauge", "Bytes stored by user, counted against the quota.", used)
+		writeMetrics(bw, "sftp_quota_limit_bytes", "gauge", "Quota of user in bytes, if limited.", limits)
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// labels are the names and values of the labels of a sample.
+type labels []string
+
+type sample struct {
+	labels labels
+	value  int64
+}
+
+func writeMetric(w io.Writer, name, typ, help string, l labels, value int64) {
+	writeMetrics(w, name, typ, help, []sample{{l, value}})
+}
+
+// writeMetrics writes the samples of a metric in the order of their labels.
+func writeMetrics(w io.Writer, name, typ, help string, samples []sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\x00") < strings.Join(samples[j].labels, "\x00")
+	})
+	for _, s := range samples {
+		writeSample(w, name, s.labels, strconv.FormatInt(s.value, 10))
+	}
+}
+
+func writeSample(w io.Writer, name string, l labels, value string) {
+	fmt.Fprint(w, name)
+	if len(l) > 0 {
+		fmt.Fprint(w, "{")
+		for i := 0; i+1 < len(l); i += 2 {
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l[i], labelEscaper.Replace(l[i+1]))
+		}
+		fmt.Fprint(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
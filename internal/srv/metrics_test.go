@@ -0,0 +1,95 @@
+package srv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+func TestMetrics_WriteTo(t *testing.T) {
+	dedup, err := NewDedup(NewMemBackend(0), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := dedup.Backend("u")
+	s := &Server{conf: config{Owner: "u", Users: map[string]User{"u": {Name: "u"}}}}
+	metrics := NewMetrics()
+	s.SetMetrics(metrics)
+	s.SetQuota(dedup)
+
+	s.connect()
+	s.connect()
+	s.disconnect()
+	metrics.handshakeFailed()
+	metrics.authenticated("password", nil)
+	metrics.authenticated("password", errors.New("rejected"))
+	metrics.authenticated("password", errors.New("rejected"))
+	closeSession := metrics.session()
+
+	ur := newUserHandler(backend, nil)
+	ur.logger = nil
+	ur.metrics = metrics
+	ur.transferred = metrics.user("u")
+	put := sftp.NewRequest("Put", "/report.csv")
+	put.Flags = fxfWrite | fxfCreat | fxfTrunc
+	w, err := ur.Filewrite(put)
+	if err != nil {
+		t.Fatalf("Filewrite() error = %v", err)
+	}
+	if _, err := w.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	w.(io.Closer).Close()
+	ur.Filecmd(sftp.NewRequest("Remove", "/missing"))
+	ur.Filelist(sftp.NewRequest("Stat", "/report.csv"))
+	metrics.operation("get", time.Now().Add(-time.Second), nil)
+
+	var buf bytes.Buffer
+	if _, err := metrics.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE sftp_connections_active gauge\nsftp_connections_active 1\n",
+		"sftp_connections_total 2\n",
+		"sftp_handshake_failures_total 1\n",
+		"sftp_sessions_active 1\n",
+		`sftp_auth_attempts_total{method="password",result="failure"} 2` + "\n",
+		`sftp_auth_attempts_total{method="password",result="success"} 1` + "\n",
+		`sftp_written_bytes_total{user="u"} 5` + "\n",
+		`sftp_read_bytes_total{user="u"} 0` + "\n",
+		`sftp_errors_total{type="no_such_file"} 1` + "\n",
+		"# TYPE sftp_operation_duration_seconds histogram\n",
+		`sftp_operation_duration_seconds_count{method="put"} 1` + "\n",
+		`sftp_operation_duration_seconds_count{method="remove"} 1` + "\n",
+		`sftp_operation_duration_seconds_count{method="stat"} 1` + "\n",
+		`sftp_operation_duration_seconds_bucket{method="get",le="0.5"} 0` + "\n",
+		`sftp_operation_duration_seconds_bucket{method="get",le="2.5"} 1` + "\n",
+		`sftp_operation_duration_seconds_bucket{method="get",le="+Inf"} 1` + "\n",
+		`sftp_quota_used_bytes{user="u"} 5` + "\n",
+		`sftp_quota_limit_bytes{user="u"} 1000` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, buf.String())
+		}
+	}
+
+	closeSession()
+	buf.Reset()
+	metrics.WriteTo(&buf)
+	if !strings.Contains(buf.String(), "sftp_sessions_active 0\n") {
+		t.Errorf("metrics after closing session:\n%s", buf.String())
+	}
+}
+
+func TestWriteSample_EscapesLabels(t *testing.T) {
+	var buf bytes.Buffer
+	writeSample(&buf, "m", labels{"user", "a\"b\\c\nd"}, "1")
+	if want := `m{user="a\"b\\c\nd"} 1` + "\n"; buf.String() != want {
+		t.Errorf("writeSample() = %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,294 @@
+package srv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FilePolicy restricts the names and types of files a user may create.
+// Names with control characters, reserved on Windows (eg. "CON" or "nul.txt")
+// or ending with a dot or space are always refused.
+type FilePolicy struct {
+	MaxNameLength   int      // of a file name in bytes, 255 if 0
+	MaxPathLength   int      // in bytes, 4096 if 0
+	AllowExtensions []string // only files with these extensions (eg. ".csv") are allowed, unless empty
+	DenyExtensions  []string
+	AllowTypes      []string // only contents of these types (see sniffType) are allowed, unless empty
+	DenyTypes       []string
+}
+
+// policyDenied returns the error for p refused by a policy for reason.
+// It's reported to clients as SSH_FX_PERMISSION_DENIED with reason in the message.
+func policyDenied(p, format string, a ...interface{}) error {
+	return &os.PathError{Op: "denied by policy (" + fmt.Sprintf(format, a...) + ")", Path: p, Err: syscall.EPERM}
+}
+
+// windowsReserved are the names of devices on Windows, with or without an extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+func containsExt(exts []string, ext string) bool {
+	for _, e := range exts {
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkName returns an error if the policy refuses creating a file (or directory) at p.
+func (policy *FilePolicy) checkName(p string, isDir bool) error {
+	if policy == nil {
+		return nil
+	}
+	p = cleanPath(p)
+	name := path.Base(p)
+	maxName, maxPath := policy.MaxNameLength, policy.MaxPathLength
+	if maxName == 0 {
+		maxName = 255
+	}
+	if maxPath == 0 {
+		maxPath = 4096
+	}
+
+	switch {
+	case len(p) > maxPath:
+		return policyDenied(p, "path longer than %d bytes", maxPath)
+	case len(name) > maxName:
+		return policyDenied(p, "name longer than %d bytes", maxName)
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return policyDenied(p, "name contains control characters")
+	case strings.HasSuffix(name, ".") || strings.HasSuffix(name, " "):
+		return policyDenied(p, "name ends with a dot or space")
+	case windowsReserved[strings.ToUpper(strings.SplitN(name, ".", 2)[0])]:
+		return policyDenied(p, "name is reserved on Windows")
+	}
+	if isDir {
+		return nil
+	}
+
+	ext := path.Ext(name)
+	if len(policy.AllowExtensions) > 0 && !containsExt(policy.AllowExtensions, ext) {
+		return policyDenied(p, "extension %q not allowed", ext)
+	}
+	if containsExt(policy.DenyExtensions, ext) {
+		return policyDenied(p, "extension %q denied", ext)
+	}
+	return nil
+}
+
+// sniffs reports whether the policy restricts file contents.
+func (policy *FilePolicy) sniffs() bool {
+	return policy != nil && (len(policy.AllowTypes) > 0 || len(policy.DenyTypes) > 0)
+}
+
+// checkType returns an error if the policy refuses the file p starting with data.
+func (policy *FilePolicy) checkType(p string, data []byte) error {
+	if !policy.sniffs() {
+		return nil
+	}
+	typ := sniffType(data)
+	if len(policy.AllowTypes) > 0 && !containsString(policy.AllowTypes, typ) {
+		return policyDenied(p, "content of type %s not allowed", typ)
+	}
+	if containsString(policy.DenyTypes, typ) {
+		return policyDenied(p, "content of type %s denied", typ)
+	}
+	return nil
+}
+
+// magicTypes are the types of contents recognized by their first bytes.
+var magicTypes = []struct {
+	typ   string
+	magic string
+}{
+	{"exe", "MZ"},
+	{"elf", "\x7fELF"},
+	{"macho", "\xfe\xed\xfa\xce"},
+	{"macho", "\xfe\xed\xfa\xcf"},
+	{"macho", "\xce\xfa\xed\xfe"},
+	{"macho", "\xcf\xfa\xed\xfe"},
+	{"script", "#!"},
+	{"zip", "PK\x03\x04"},
+	{"gzip", "\x1f\x8b"},
+	{"bzip2", "BZh"},
+	{"xz", "\xfd7zXZ\x00"},
+	{"7z", "7z\xbc\xaf\x27\x1c"},
+	{"rar", "Rar!\x1a\x07"},
+	{"pdf", "%PDF-"},
+	{"png", "\x89PNG\r\n\x1a\n"},
+	{"jpeg", "\xff\xd8\xff"},
+	{"gif", "GIF8"},
+}
+
+// sniffType returns the type of contents starting with data: one of magicTypes,
+// otherwise "text" for UTF-8 without control characters (but whitespace), or "binary".
+func sniffType(data []byte) string {
+	for _, t := range magicTypes {
+		if bytes.HasPrefix(data, []byte(t.magic)) {
+			return t.typ
+		}
+	}
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			// cut off at the end of data
+			break
+		}
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			return "binary"
+		}
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return "binary"
+		}
+		data = data[size:]
+	}
+	return "text"
+}
+
+const (
+	sniffLen       = 512 // bytes the type of contents is told by
+	sniffMagicLen  = 8   // of the longest of magicTypes
+	sniffStageName = ".sftp-upload-"
+)
+
+// sniffFile checks the type of the contents written to a file by a policy,
+// whatever the order of the writes. Once refused, writes fail and the file is
+// removed when closed if created by the open. A file replacing another is
+// written to stage, renamed over it once accepted.
+type sniffFile struct {
+	File
+	fs      fsAdapter
+	policy  *FilePolicy
+	name    string
+	stage   string // written instead of name, if set
+	created bool   // name didn't exist before the open
+
+	mu      sync.Mutex
+	head    []byte     // the first sniffLen bytes
+	written byteRanges // of head
+	size    int64      // end of the last byte written
+	checked bool
+	err     error
+}
+
+func (f *sniffFile) TransferError(err error) {
+	transferError(f.File, err)
+}
+
+// newSniffFile returns file, opened at stage if set, checked by policy as the file name.
+func newSniffFile(file File, fs fsAdapter, policy *FilePolicy, name, stage string) *sniffFile {
+	return &sniffFile{File: file, fs: fs, policy: policy, name: name, stage: stage, head: make([]byte, sniffLen)}
+}
+
+// readHead reads the head of the contents of the file, of size bytes, kept
+// when opened. It must be called before writing.
+func (f *sniffFile) readHead(size int64) error {
+	if size > sniffLen {
+		size = sniffLen
+	}
+	r, err := f.fs.impl.OpenFile(f.name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	n, err := r.ReadAt(f.head[:size], 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	f.written = f.written.add(0, int64(n))
+	f.size = int64(n)
+	return nil
+}
+
+// check checks the type of the head once it can't change, or when final. f.mu must be held.
+func (f *sniffFile) check(final bool) {
+	var n int64
+	if final {
+		n = f.size
+	} else if len(f.written) > 0 && f.written[0][0] == 0 {
+		n = f.written[0][1]
+	}
+	if n > sniffLen {
+		n = sniffLen
+	}
+	if n == 0 {
+		return
+	}
+	typ := sniffType(f.head[:n])
+	// more bytes may make text binary, and binary one of magicTypes
+	if !final && n < sniffLen && (typ == "text" || typ == "binary" && n < sniffMagicLen) {
+		return
+	}
+	f.checked = true
+	f.err = f.policy.checkType(f.name, f.head[:n])
+}
+
+func (f *sniffFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	if f.err == nil && !f.checked && len(p) > 0 {
+		if off < sniffLen {
+			n := copy(f.head[off:], p)
+			f.written = f.written.add(off, off+int64(n))
+		}
+		if end := off + int64(len(p)); end > f.size {
+			f.size = end
+		}
+		f.check(false)
+	}
+	err := f.err
+	f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *sniffFile) Close() error {
+	err := f.File.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil && !f.checked {
+		f.check(true)
+	}
+	if f.err != nil {
+		var rerr error
+		switch {
+		case f.stage != "":
+			rerr = f.fs.Unlink(f.stage)
+		case f.created:
+			rerr = f.fs.Unlink(f.name)
+		}
+		if rerr != nil {
+			return rerr
+		}
+		return f.err
+	}
+	if err == nil && f.stage != "" {
+		err = f.fs.Rename(f.stage, f.name)
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+package srv
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestFilePolicy_checkName(t *testing.T) {
+	policy := &FilePolicy{
+		MaxNameLength:  12,
+		DenyExtensions: []string{".exe", "bat"},
+	}
+	tests := []struct {
+		path    string
+		isDir   bool
+		wantErr bool
+	}{
+		{path: "/in/data.csv"},
+		{path: "/in/tab\tname.csv", wantErr: true},
+		{path: "/in/CON", wantErr: true},
+		{path: "/in/nul.txt", wantErr: true},
+		{path: "/in/console.txt"},
+		{path: "/in/data.csv.", wantErr: true},
+		{path: "/in/data ", wantErr: true},
+		{path: "/in/averylongname.csv", wantErr: true},
+		{path: "/in/setup.EXE", wantErr: true},
+		{path: "/in/run.bat", wantErr: true},
+		{path: "/in/dir.exe", isDir: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			err := policy.checkName(tt.path, tt.isDir)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !os.IsPermission(err) {
+				t.Errorf("checkName() error = %v, want permission error", err)
+			}
+		})
+	}
+
+	allow := &FilePolicy{AllowExtensions: []string{".csv"}}
+	if err := allow.checkName("/data.CSV", false); err != nil {
+		t.Errorf("checkName() of allowed extension error = %v", err)
+	}
+	if err := allow.checkName("/data.xlsx", false); err == nil {
+		t.Errorf("checkName() of extension not allowed succeeded")
+	}
+}
+
+func TestSniffType(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{data: "MZ\x90\x00\x03", want: "exe"},
+		{data: "\x7fELF\x02\x01", want: "elf"},
+		{data: "#!/bin/sh\n", want: "script"},
+		{data: "PK\x03\x04\x14\x00", want: "zip"},
+		{data: "id,name\n1,Zoë\n", want: "text"},
+		{data: "id,name\n1,Zo\xc3", want: "text"},
+		{data: "id\x00\x01\x02", want: "binary"},
+	}
+	for _, tt := range tests {
+		if got := sniffType([]byte(tt.data)); got != tt.want {
+			t.Errorf("sniffType(%q) = %s, want %s", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestUserRootHandler_Policy(t *testing.T) {
+	b := NewMemBackend(0)
+	ur := newUserHandler(b, &FilePolicy{DenyTypes: []string{"exe", "elf"}})
+	ur.logger = nil
+
+	put := sftp.NewRequest("Put", "/report.csv")
+	put.Flags = fxfWrite | fxfCreat | fxfTrunc
+	w, err := ur.Filewrite(put)
+	if err != nil {
+		t.Fatalf("Filewrite() error = %v", err)
+	}
+	if _, err := w.WriteAt([]byte("MZ\x90\x00"), 0); !os.IsPermission(err) {
+		t.Errorf("WriteAt() of executable error = %v, want permission error", err)
+	}
+	w.(io.Closer).Close()
+	if _, err := b.Stat("/report.csv"); !os.IsNotExist(err) {
+		t.Errorf("Stat() of refused upload error = %v, want removed", err)
+	}
+
+	if err := ur.Filecmd(sftp.NewRequest("Mkdir", "/aux")); !os.IsPermission(err) {
+		t.Errorf("Mkdir() of reserved name error = %v, want permission error", err)
+	}
+	writeMemFile(t, b, "/upload", "data")
+	rename := &sftp.Request{Method: "Rename", Filepath: "/upload", Target: "/upload."}
+	if err := ur.Filecmd(rename); !os.IsPermission(err) {
+		t.Errorf("Rename() to trailing dot error = %v, want permission error", err)
+	}
+}
+
+func TestSniffFile(t *testing.T) {
+	type write struct {
+		off  int64
+		data string
+	}
+	elf := "\x7fELF" + strings.Repeat("\x00", 600)
+	tests := []struct {
+		name     string
+		existing bool // replacing a file
+		writes   []write
+		wantErr  bool
+	}{
+		{name: "text", writes: []write{{0, "id,amount\n"}, {10, "1,2\n"}}},
+		{name: "executable", writes: []write{{0, elf}}, wantErr: true},
+		{name: "one byte first", writes: []write{{0, elf[:1]}, {1, elf[1:]}}, wantErr: true},
+		{name: "out of order", writes: []write{{300, elf[300:]}, {2, elf[2:300]}, {0, elf[:2]}}, wantErr: true},
+		{name: "short file", writes: []write{{2, "LF"}, {0, "\x7fE"}}, wantErr: true},
+		{name: "replacing", existing: true, writes: []write{{0, "new"}}},
+		{name: "refused replacing", existing: true, writes: []write{{0, elf}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemBackend(0)
+			ur := newUserHandler(b, &FilePolicy{DenyTypes: []string{"elf"}})
+			ur.logger = nil
+			if tt.existing {
+				writeMemFile(t, b, "/upload", "old")
+			}
+			put := sftp.NewRequest("Put", "/upload")
+			put.Flags = fxfWrite | fxfCreat | fxfTrunc
+			w, err := ur.Filewrite(put)
+			if err != nil {
+				t.Fatalf("Filewrite() error = %v", err)
+			}
+			want := []byte{}
+			for _, wr := range tt.writes {
+				if _, err = w.WriteAt([]byte(wr.data), wr.off); err != nil {
+					break
+				}
+				if end := int(wr.off) + len(wr.data); end > len(want) {
+					want = append(want, make([]byte, end-len(want))...)
+				}
+				copy(want[wr.off:], wr.data)
+			}
+			if cerr := w.(io.Closer).Close(); err == nil {
+				err = cerr
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("upload error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			infos, _ := b.Readdir("/")
+			switch {
+			case tt.wantErr && tt.existing:
+				if got := readMemFile(t, b, "/upload"); got != "old" || len(infos) != 1 {
+					t.Errorf("refused upload left %q and %d files, want the replaced file only", got, len(infos))
+				}
+			case tt.wantErr:
+				if len(infos) != 0 {
+					t.Errorf("refused upload left %d files", len(infos))
+				}
+			default:
+				if got := readMemFile(t, b, "/upload"); got != string(want) || len(infos) != 1 {
+					t.Errorf("uploaded %q and %d files, want %q only", got, len(infos), want)
+				}
+			}
+		})
+	}
+}
+
+func TestSniffFile_TransferError(t *testing.T) {
+	inner := &transferErrorBackend{Backend: NewMemBackend(0)}
+	ur := newUserHandler(inner, &FilePolicy{DenyTypes: []string{"elf"}})
+	ur.logger = nil
+	put := sftp.NewRequest("Put", "/upload")
+	put.Flags = fxfWrite | fxfCreat | fxfTrunc
+	w, err := ur.Filewrite(put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.(io.Closer).Close()
+	checkTransferError(t, w, inner)
+}
+
+func TestSniffFile_Existing(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string // written at the end of the file
+		want    string
+		wantErr bool
+	}{
+		{name: "appended text", data: "bye\n", want: "hello world\nbye\n"},
+		{name: "refused append", data: "\x00\x01\x02\x03\x04\x05\x06\x07", want: "hello world\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewMemBackend(0)
+			ur := newUserHandler(b, &FilePolicy{AllowTypes: []string{"text"}})
+			ur.logger = nil
+			writeMemFile(t, b, "/a.txt", "hello world\n")
+			put := sftp.NewRequest("Put", "/a.txt")
+			put.Flags = fxfWrite
+			w, err := ur.Filewrite(put)
+			if err != nil {
+				t.Fatalf("Filewrite() error = %v", err)
+			}
+			_, err = w.WriteAt([]byte(tt.data), 12)
+			if cerr := w.(io.Closer).Close(); err == nil {
+				err = cerr
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("append error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := readMemFile(t, b, "/a.txt"); got != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
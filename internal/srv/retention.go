@@ -0,0 +1,517 @@
+package srv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The files downloaded by a user are kept in the store of the sweeper as a
+// JSON list of their paths, in:
+//
+//	/.retention/<user>
+const (
+	retentionDirName = ".retention"
+	retentionDir     = "/" + retentionDirName
+)
+
+// RetentionRule expires the files below a directory.
+type RetentionRule struct {
+	User          string        // user the rule applies to, all users if empty
+	Path          string        // directory the rule applies to
+	MaxAge        time.Duration // expire files not modified for this long, unless 0
+	AfterDownload bool          // expire files once downloaded in full
+	ArchiveDir    string        // move expired files here, keeping their path, instead of removing them
+}
+
+// ParseRetentionRule parses a rule given as comma separated key=value pairs, eg.
+// "path=/incoming,age=30d,archive=/archive". The keys are user, path, age (a
+// duration or a number of days followed by d), after (only "download") and archive.
+func ParseRetentionRule(s string) (RetentionRule, error) {
+	rule := RetentionRule{Path: "/"}
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return rule, fmt.Errorf("invalid retention rule %q: expected key=value, got %q", s, field)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "user":
+			rule.User = value
+		case "path":
+			rule.Path = cleanPath(value)
+		case "age":
+			age, err := parseAge(value)
+			if err != nil {
+				return rule, fmt.Errorf("invalid retention rule %q: %w", s, err)
+			}
+			rule.MaxAge = age
+		case "after":
+			if value != "download" {
+				return rule, fmt.Errorf("invalid retention rule %q: after must be download, got %q", s, value)
+			}
+			rule.AfterDownload = true
+		case "archive":
+			rule.ArchiveDir = cleanPath(value)
+		default:
+			return rule, fmt.Errorf("invalid retention rule %q: unknown key %q", s, key)
+		}
+	}
+	if rule.MaxAge == 0 && !rule.AfterDownload {
+		return rule, fmt.Errorf("invalid retention rule %q: neither age nor after given", s)
+	}
+	return rule, nil
+}
+
+// parseAge parses a duration, also accepting a number of days such as "30d".
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(s)
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return age, nil
+}
+
+// within reports whether p is dir or below it.
+func within(p, dir string) bool {
+	return dir == "/" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// byteRanges is a set of byte ranges, as sorted disjoint [start, end) pairs.
+type byteRanges [][2]int64
+
+// add returns the set with [start, end) added.
+func (r byteRanges) add(start, end int64) byteRanges {
+	merged := byteRanges{}
+	for _, rg := range r {
+		if rg[1] < start || rg[0] > end {
+			merged = append(merged, rg)
+			continue
+		}
+		if rg[0] < start {
+			start = rg[0]
+		}
+		if rg[1] > end {
+			end = rg[1]
+		}
+	}
+	merged = append(merged, [2]int64{start, end})
+	sort.Slice(merged, func(i, j int) bool { return merged[i][0] < merged[j][0] })
+	return merged
+}
+
+// covers reports whether the set holds every byte of [0, size).
+func (r byteRanges) covers(size int64) bool {
+	return len(r) == 1 && r[0][0] <= 0 && r[0][1] >= size
+}
+
+// RetentionSweeper expires the files of a user according to retention rules.
+// Downloads are tracked in memory, so unless kept in a store set with SetStore
+// only files downloaded since the sweeper was created expire after download.
+type RetentionSweeper struct {
+	backend Backend
+	user    string
+	rules   []RetentionRule
+	dryRun  bool
+	onEvent func(Event)
+
+	mu         sync.Mutex
+	downloaded map[string]bool
+	reads      map[string]byteRanges // read of files not downloaded in full yet
+	store      Backend               // keeping downloaded, if set
+	unsaved    bool                  // downloaded changed since last saved
+}
+
+// NewRetentionSweeper returns a sweeper expiring files of user in backend by the rules
+// applying to user. With dryRun expired files are only reported to onEvent.
+func NewRetentionSweeper(backend Backend, user string, rules []RetentionRule, dryRun bool, onEvent func(Event)) *RetentionSweeper {
+	s := &RetentionSweeper{
+		backend:    backend,
+		user:       user,
+		dryRun:     dryRun,
+		onEvent:    onEvent,
+		downloaded: map[string]bool{},
+		reads:      map[string]byteRanges{},
+	}
+	for _, rule := range rules {
+		if rule.User == "" || rule.User == user {
+			s.rules = append(s.rules, rule)
+		}
+	}
+	return s
+}
+
+// Backend returns the backend of the sweeper, tracking files downloaded through it.
+func (s *RetentionSweeper) Backend() Backend {
+	return &downloadBackend{Backend: s.backend, s: s}
+}
+
+// rule returns the rule for p, the one for the closest directory.
+func (s *RetentionSweeper) rule(p string) (rule RetentionRule, ok bool) {
+	for _, r := range s.rules {
+		if within(p, r.Path) && (!ok || len(r.Path) > len(rule.Path)) {
+			rule, ok = r, true
+		}
+	}
+	return rule, ok
+}
+
+// SetStore keeps the files downloaded in store, the backend below that of the
+// sweeper, loading those kept already. Downloads are then remembered when restarted.
+func (s *RetentionSweeper) SetStore(store Backend) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store = store
+	f, err := store.OpenFile(s.storePath(), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error loading downloads: %w", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 1<<62))
+	if err != nil {
+		return fmt.Errorf("error loading downloads: %w", err)
+	}
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return fmt.Errorf("error loading downloads: %w", err)
+	}
+	for _, p := range paths {
+		s.downloaded[cleanPath(p)] = true
+	}
+	return nil
+}
+
+func (s *RetentionSweeper) storePath() string {
+	return retentionDir + "/" + s.user
+}
+
+// save writes the files downloaded to the store, if set. s.mu must be held.
+func (s *RetentionSweeper) save() error {
+	if s.store == nil {
+		return nil
+	}
+	s.unsaved = true
+	paths := make([]string, 0, len(s.downloaded))
+	for p := range s.downloaded {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	data, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+	if err := mkdirAll(s.store, retentionDir); err != nil {
+		return err
+	}
+	tmp := s.storePath() + ".tmp"
+	f, err := s.store.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, 0)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = s.store.Rename(tmp, s.storePath())
+	}
+	if err != nil {
+		s.store.Remove(tmp)
+		return err
+	}
+	s.unsaved = false
+	return nil
+}
+
+func (s *RetentionSweeper) setDownloaded(p string, downloaded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p = cleanPath(p)
+	delete(s.reads, p)
+	if s.downloaded[p] == downloaded {
+		return
+	}
+	if downloaded {
+		s.downloaded[p] = true
+	} else {
+		delete(s.downloaded, p)
+	}
+	// retried when sweeping if failing
+	_ = s.save()
+}
+
+// read records the bytes [start, end) of p, of size bytes, read. p is
+// downloaded once every byte was read, in any order and by any number of reads.
+func (s *RetentionSweeper) read(p string, start, end, size int64) {
+	s.mu.Lock()
+	p = cleanPath(p)
+	if s.downloaded[p] {
+		s.mu.Unlock()
+		return
+	}
+	reads := s.reads[p].add(start, end)
+	s.reads[p] = reads
+	s.mu.Unlock()
+	if reads.covers(size) {
+		s.setDownloaded(p, true)
+	}
+}
+
+func (s *RetentionSweeper) isDownloaded(p string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloaded[p]
+}
+
+// Sweep expires the files due at now, and saves the files downloaded if
+// failed before. Failures to expire single files are reported with their events.
+func (s *RetentionSweeper) Sweep(now time.Time) error {
+	s.mu.Lock()
+	var err error
+	if s.unsaved {
+		err = s.save()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error saving downloads: %w", err)
+	}
+	if len(s.rules) == 0 {
+		return nil
+	}
+	return s.sweep("/", now)
+}
+
+func (s *RetentionSweeper) sweep(dir string, now time.Time) error {
+	infos, err := s.backend.Readdir(dir)
+	if err != nil {
+		return fmt.Errorf("error listing %q: %w", dir, err)
+	}
+	for _, info := range infos {
+		p := path.Join(dir, info.Name())
+		if info.IsDir() {
+			// versions expire by their own policy
+			if info.Name() == versionsDirName || info.Name() == retentionDirName {
+				continue
+			}
+			if err := s.sweep(p, now); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		rule, ok := s.rule(p)
+		if !ok || (rule.ArchiveDir != "" && within(p, rule.ArchiveDir)) {
+			continue
+		}
+		expired := rule.MaxAge > 0 && now.Sub(info.ModTime()) >= rule.MaxAge
+		if rule.AfterDownload && s.isDownloaded(p) {
+			expired = true
+		}
+		if expired {
+			s.expire(p, rule, now)
+		}
+	}
+	return nil
+}
+
+// expire removes or archives p.
+func (s *RetentionSweeper) expire(p string, rule RetentionRule, now time.Time) {
+	event := Event{Time: now, Type: EventExpired, User: s.user, Path: p, DryRun: s.dryRun}
+	if rule.ArchiveDir != "" {
+		event.Target = path.Join(rule.ArchiveDir, p)
+	}
+	if !s.dryRun {
+		if event.Target != "" {
+			event.Err = mkdirAll(s.backend, path.Dir(event.Target))
+			if event.Err == nil {
+				event.Err = s.backend.Rename(p, event.Target)
+			}
+		} else {
+			event.Err = s.backend.Remove(p)
+		}
+		if event.Err == nil {
+			s.setDownloaded(p, false)
+		}
+	}
+	if s.onEvent != nil {
+		s.onEvent(event)
+	}
+}
+
+// downloadBackend tracks files downloaded in full and hides the store of
+// downloads, otherwise delegating to the wrapped Backend.
+type downloadBackend struct {
+	Backend
+	s *RetentionSweeper
+}
+
+func isRetentionPath(p string) bool {
+	return hasPathComponent(p, retentionDirName)
+}
+
+func retentionHidden(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: syscall.ENOENT}
+}
+
+func (b *downloadBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	if isRetentionPath(p) {
+		return nil, retentionHidden("open", p)
+	}
+	f, err := b.Backend.OpenFile(p, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+		// changed, so not downloaded (yet)
+		b.s.setDownloaded(p, false)
+		return f, nil
+	}
+	info, err := b.Backend.Stat(p)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return f, nil
+	}
+	return &downloadFile{File: f, s: b.s, name: p, size: info.Size()}, nil
+}
+
+func (b *downloadBackend) Stat(p string) (os.FileInfo, error) {
+	if isRetentionPath(p) {
+		return nil, retentionHidden("stat", p)
+	}
+	return b.Backend.Stat(p)
+}
+
+func (b *downloadBackend) Lstat(p string) (os.FileInfo, error) {
+	if isRetentionPath(p) {
+		return nil, retentionHidden("lstat", p)
+	}
+	return b.Backend.Lstat(p)
+}
+
+func (b *downloadBackend) Readdir(dirPath string) ([]os.FileInfo, error) {
+	if isRetentionPath(dirPath) {
+		return nil, retentionHidden("readdir", dirPath)
+	}
+	infos, err := b.Backend.Readdir(dirPath)
+	if err != nil {
+		return infos, err
+	}
+	visible := infos[:0]
+	for _, info := range infos {
+		if info.Name() != retentionDirName {
+			visible = append(visible, info)
+		}
+	}
+	return visible, nil
+}
+
+func (b *downloadBackend) Rename(from, to string) error {
+	if isRetentionPath(from) {
+		return retentionHidden("rename", from)
+	}
+	if isRetentionPath(to) {
+		return retentionHidden("rename", to)
+	}
+	err := b.Backend.Rename(from, to)
+	if err == nil {
+		b.s.setDownloaded(from, false)
+		b.s.setDownloaded(to, false)
+	}
+	return err
+}
+
+func (b *downloadBackend) Remove(p string) error {
+	if isRetentionPath(p) {
+		return retentionHidden("remove", p)
+	}
+	err := b.Backend.Remove(p)
+	if err == nil {
+		b.s.setDownloaded(p, false)
+	}
+	return err
+}
+
+func (b *downloadBackend) Mkdir(p string, perm os.FileMode) error {
+	if isRetentionPath(p) {
+		return &os.PathError{Op: "mkdir", Path: p, Err: syscall.EPERM}
+	}
+	return b.Backend.Mkdir(p, perm)
+}
+
+func (b *downloadBackend) Link(oldname, newname string) error {
+	if isRetentionPath(oldname) {
+		return retentionHidden("link", oldname)
+	}
+	if isRetentionPath(newname) {
+		return &os.PathError{Op: "link", Path: newname, Err: syscall.EPERM}
+	}
+	return b.Backend.Link(oldname, newname)
+}
+
+func (b *downloadBackend) Symlink(oldname, newname string) error {
+	if isRetentionPath(oldname) || isRetentionPath(newname) {
+		return &os.PathError{Op: "symlink", Path: newname, Err: syscall.EPERM}
+	}
+	return b.Backend.Symlink(oldname, newname)
+}
+
+func (b *downloadBackend) Readlink(p string) (string, error) {
+	if isRetentionPath(p) {
+		return "", retentionHidden("readlink", p)
+	}
+	return b.Backend.Readlink(p)
+}
+
+func (b *downloadBackend) Chmod(p string, mode os.FileMode) error {
+	if isRetentionPath(p) {
+		return retentionHidden("chmod", p)
+	}
+	return b.Backend.Chmod(p, mode)
+}
+
+func (b *downloadBackend) Chtimes(p string, atime, mtime time.Time) error {
+	if isRetentionPath(p) {
+		return retentionHidden("chtimes", p)
+	}
+	return b.Backend.Chtimes(p, atime, mtime)
+}
+
+// downloadFile is a file open for reading, recording the bytes read.
+type downloadFile struct {
+	File
+	s    *RetentionSweeper
+	name string
+	size int64
+}
+
+func (f *downloadFile) TransferError(err error) {
+	transferError(f.File, err)
+}
+
+func (f *downloadFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	if n > 0 {
+		f.s.read(f.name, off, off+int64(n), f.size)
+	}
+	return n, err
+}
@@ -0,0 +1,181 @@
+package srv
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionRule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    RetentionRule
+		wantErr bool
+	}{
+		{spec: "path=/incoming,age=30d,archive=/archive/", want: RetentionRule{Path: "/incoming", MaxAge: 30 * 24 * time.Hour, ArchiveDir: "/archive"}},
+		{spec: "user=alice,after=download", want: RetentionRule{User: "alice", Path: "/", AfterDownload: true}},
+		{spec: "age=36h", want: RetentionRule{Path: "/", MaxAge: 36 * time.Hour}},
+		{spec: "path=/incoming", wantErr: true},
+		{spec: "age=-1d", wantErr: true},
+		{spec: "after=upload", wantErr: true},
+		{spec: "age=1d,color=red", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseRetentionRule(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRetentionRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRetentionRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetentionSweeper(t *testing.T) {
+	rules := []RetentionRule{
+		{Path: "/incoming", MaxAge: 24 * time.Hour, ArchiveDir: "/archive"},
+		{Path: "/outgoing", AfterDownload: true},
+		{User: "bob", Path: "/", MaxAge: time.Hour},
+	}
+	tests := []struct {
+		name       string
+		dryRun     bool
+		wantEvents []string
+		wantFiles  []string
+	}{
+		{
+			name:       "expire",
+			wantEvents: []string{"/incoming/old.csv", "/outgoing/report.csv"},
+			wantFiles:  []string{"/archive/incoming/old.csv", "/incoming/new.csv", "/outgoing/pending.csv"},
+		},
+		{
+			name:       "dry run",
+			dryRun:     true,
+			wantEvents: []string{"/incoming/old.csv", "/outgoing/report.csv"},
+			wantFiles:  []string{"/incoming/new.csv", "/incoming/old.csv", "/outgoing/pending.csv", "/outgoing/report.csv"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := NewMemBackend(0)
+			events := []string{}
+			s := NewRetentionSweeper(inner, "alice", rules, tt.dryRun, func(e Event) {
+				if e.Err != nil || e.DryRun != tt.dryRun {
+					t.Errorf("unexpected event %+v", e)
+				}
+				events = append(events, e.Path)
+			})
+			b := s.Backend()
+			for _, p := range []string{"/incoming/old.csv", "/incoming/new.csv", "/outgoing/report.csv", "/outgoing/pending.csv"} {
+				if err := mkdirAll(b, p[:len("/incoming")]); err != nil {
+					t.Fatal(err)
+				}
+				writeMemFile(t, b, p, "data")
+			}
+			old := time.Now().Add(-48 * time.Hour)
+			if err := b.Chtimes("/incoming/old.csv", old, old); err != nil {
+				t.Fatal(err)
+			}
+			readMemFile(t, b, "/outgoing/report.csv")
+			f, err := b.OpenFile("/outgoing/pending.csv", os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.ReadAt(make([]byte, 2), 0)
+			f.Close()
+
+			if err := s.Sweep(time.Now()); err != nil {
+				t.Fatalf("Sweep() error = %v", err)
+			}
+			if !reflect.DeepEqual(events, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", events, tt.wantEvents)
+			}
+			files := []string{}
+			for _, dir := range []string{"/archive/incoming", "/incoming", "/outgoing"} {
+				infos, _ := inner.Readdir(dir)
+				for _, info := range infos {
+					files = append(files, dir+"/"+info.Name())
+				}
+			}
+			sort.Strings(files)
+			if !reflect.DeepEqual(files, tt.wantFiles) {
+				t.Errorf("files = %v, want %v", files, tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestRetentionSweeper_Downloads(t *testing.T) {
+	type read struct{ off, n int64 }
+	tests := []struct {
+		name  string
+		reads []read
+		want  bool
+	}{
+		{name: "in order", reads: []read{{0, 4}, {4, 4}, {8, 2}}, want: true},
+		{name: "out of order", reads: []read{{8, 2}, {0, 4}, {4, 4}}, want: true},
+		{name: "same range twice", reads: []read{{0, 5}, {0, 5}}},
+		{name: "gap", reads: []read{{0, 4}, {5, 5}}},
+		{name: "resumed", reads: []read{{0, 3}, {3, 7}}, want: true},
+	}
+	rules := []RetentionRule{{Path: "/", AfterDownload: true}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := NewMemBackend(0)
+			s := NewRetentionSweeper(inner, "alice", rules, false, nil)
+			if err := s.SetStore(inner); err != nil {
+				t.Fatal(err)
+			}
+			b := s.Backend()
+			writeMemFile(t, b, "/report.csv", "0123456789")
+			for _, r := range tt.reads {
+				// each read by its own handle, as when resumed
+				f, err := b.OpenFile("/report.csv", os.O_RDONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.ReadAt(make([]byte, r.n), r.off)
+				f.Close()
+			}
+
+			// downloads are remembered when restarted
+			s = NewRetentionSweeper(inner, "alice", rules, false, nil)
+			if err := s.SetStore(inner); err != nil {
+				t.Fatalf("SetStore() error = %v", err)
+			}
+			if err := s.Sweep(time.Now()); err != nil {
+				t.Fatalf("Sweep() error = %v", err)
+			}
+			if _, err := inner.Stat("/report.csv"); os.IsNotExist(err) != tt.want {
+				t.Errorf("Stat() after sweep error = %v, want expired %v", err, tt.want)
+			}
+			infos, err := s.Backend().Readdir("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, info := range infos {
+				if info.Name() == retentionDirName {
+					t.Errorf("Readdir() lists the store of downloads")
+				}
+			}
+		})
+	}
+}
+
+func TestRetentionSweeper_TransferError(t *testing.T) {
+	inner := &transferErrorBackend{Backend: NewMemBackend(0)}
+	s := NewRetentionSweeper(inner, "alice", []RetentionRule{{Path: "/", AfterDownload: true}}, false, nil)
+	b := s.Backend()
+	writeMemFile(t, b, "/report.csv", "hello")
+	inner.files = nil
+	f, err := b.OpenFile("/report.csv", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	checkTransferError(t, f, inner)
+}
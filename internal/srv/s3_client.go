@@ -0,0 +1,375 @@
+package srv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// s3Client is a minimal client for S3-compatible object storage, using path-style
+// requests signed with AWS Signature Version 4.
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	http         *http.Client
+}
+
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type s3ListResult struct {
+	Contents              []s3Object
+	CommonPrefixes        []struct{ Prefix string }
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+type s3ErrorResponse struct {
+	Code    string
+	Message string
+}
+
+// s3Error is returned for failed requests. It unwraps to a syscall.Errno where
+// the status code has an equivalent, so os.IsNotExist etc. work.
+type s3Error struct {
+	Op         string
+	Key        string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 %s %q: %d %s: %s", e.Op, e.Key, e.StatusCode, e.Code, e.Message)
+}
+
+func (e *s3Error) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return syscall.ENOENT
+	case http.StatusForbidden:
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// pathError converts an s3Error into the *os.PathError the sftp package knows how to report.
+func s3PathError(err error) error {
+	if e, ok := err.(*s3Error); ok {
+		if errno, ok := e.Unwrap().(syscall.Errno); ok {
+			return &os.PathError{Op: e.Op, Path: e.Key, Err: errno}
+		}
+	}
+	return err
+}
+
+// awsEscape URI encodes s as required by Signature Version 4.
+func awsEscape(s string, encodeSlash bool) string {
+	buf := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+	u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + "/" + awsEscape(c.bucket, true)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + awsEscape(key, false)
+	}
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// sign adds the Signature Version 4 headers to req. The payload is left unsigned.
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.sessionToken)
+	}
+	if c.accessKey == "" {
+		return // anonymous access
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-type" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// do performs a request and returns the response if it has a 2xx status.
+func (c *s3Client) do(op, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := c.objectURL(key, query)
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = u
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+	}
+	c.sign(req, time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s %q: %w", op, key, err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	s3err := &s3Error{Op: op, Key: key, StatusCode: resp.StatusCode, Code: resp.Status}
+	errResp := s3ErrorResponse{}
+	if data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10)); err == nil && len(data) > 0 {
+		if xml.Unmarshal(data, &errResp) == nil {
+			s3err.Code = errResp.Code
+			s3err.Message = errResp.Message
+		}
+	}
+	return nil, s3err
+}
+
+// doXML performs a request and decodes the XML response into v.
+func (c *s3Client) doXML(op, method, key string, query url.Values, body []byte, v interface{}) error {
+	resp, err := c.do(op, method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("s3 %s %q: error decoding response: %w", op, key, err)
+	}
+	return nil
+}
+
+func (c *s3Client) headObject(key string) (s3Object, error) {
+	resp, err := c.do("head", http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return s3Object{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return s3Object{Key: key, Size: resp.ContentLength, LastModified: modTime}, nil
+}
+
+// getObjectRange reads len(p) bytes at off.
+func (c *s3Client) getObjectRange(key string, p []byte, off int64) (int, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := c.do("get", http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.ReadFull(resp.Body, p)
+}
+
+func (c *s3Client) putObject(key string, body []byte) error {
+	if body == nil {
+		body = []byte{}
+	}
+	resp, err := c.do("put", http.MethodPut, key, nil, nil, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *s3Client) copyObject(from, to string) error {
+	header := http.Header{}
+	header.Set("x-amz-copy-source", "/"+awsEscape(c.bucket, true)+"/"+awsEscape(from, false))
+	resp, err := c.do("copy", http.MethodPut, to, nil, header, []byte{})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *s3Client) deleteObject(key string) error {
+	resp, err := c.do("delete", http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// listObjects lists keys under prefix. With a delimiter keys are grouped into common prefixes.
+// At most max entries are returned unless max is 0.
+func (c *s3Client) listObjects(prefix, delimiter string, max int) ([]s3Object, []string, error) {
+	var objects []s3Object
+	var prefixes []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if max > 0 {
+		query.Set("max-keys", fmt.Sprint(max))
+	}
+	for {
+		result := s3ListResult{}
+		if err := c.doXML("list", http.MethodGet, "", query, nil, &result); err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, result.Contents...)
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" || (max > 0 && len(objects)+len(prefixes) >= max) {
+			return objects, prefixes, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (c *s3Client) createMultipartUpload(key string) (string, error) {
+	result := struct{ UploadId string }{}
+	if err := c.doXML("create upload", http.MethodPost, key, url.Values{"uploads": {""}}, []byte{}, &result); err != nil {
+		return "", err
+	}
+	return result.UploadId, nil
+}
+
+func (c *s3Client) uploadPart(key, uploadID string, partNumber int, body []byte) (string, error) {
+	query := url.Values{"partNumber": {fmt.Sprint(partNumber)}, "uploadId": {uploadID}}
+	resp, err := c.do("upload part", http.MethodPut, key, query, nil, body)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (c *s3Client) completeMultipartUpload(key, uploadID string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do("complete upload", http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 may report failure with a 200 status once the body is sent.
+	result := s3ErrorResponse{}
+	if data, err := ioutil.ReadAll(resp.Body); err == nil && xml.Unmarshal(data, &result) == nil && result.Code != "" {
+		return &s3Error{Op: "complete upload", Key: key, StatusCode: resp.StatusCode, Code: result.Code, Message: result.Message}
+	}
+	return nil
+}
+
+func (c *s3Client) abortMultipartUpload(key, uploadID string) error {
+	resp, err := c.do("abort upload", http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
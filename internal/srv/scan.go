@@ -0,0 +1,446 @@
+package srv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Files written are staged until scanned, and only then moved to their path:
+//
+//	/.scan/<seq>
+//
+// Staged files left over when the server stopped were never scanned, and are removed.
+// Files which couldn't be moved to the quarantine are held instead, and kept:
+//
+//	/.scan/held/<time>-<seq>-<name>
+const (
+	scanDirName  = ".scan"
+	scanDir      = "/" + scanDirName
+	scanHeldName = "held"
+	scanHeldDir  = scanDir + "/" + scanHeldName
+)
+
+// Scanner scans file contents for malware.
+type Scanner interface {
+	// Scan returns the name of the malware found in r, or "" if r is clean.
+	Scan(r io.Reader) (string, error)
+}
+
+// ClamdScanner scans with a clamd daemon using its INSTREAM command.
+type ClamdScanner struct {
+	Network string // "unix" or "tcp"
+	Address string
+	Timeout time.Duration // of a scan, unless 0
+}
+
+// clamdChunkSize is the size of the chunks streamed, below clamd's default StreamMaxLength.
+const clamdChunkSize = 64 << 10
+
+// ParseClamdAddress parses the address of clamd given as unix:/path, tcp:host:port,
+// a socket path or host:port.
+func ParseClamdAddress(s string) (*ClamdScanner, error) {
+	switch {
+	case strings.HasPrefix(s, "unix:"):
+		return &ClamdScanner{Network: "unix", Address: strings.TrimPrefix(s, "unix:")}, nil
+	case strings.HasPrefix(s, "tcp:"):
+		return &ClamdScanner{Network: "tcp", Address: strings.TrimPrefix(s, "tcp:")}, nil
+	case strings.HasPrefix(s, "/"):
+		return &ClamdScanner{Network: "unix", Address: s}, nil
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return nil, fmt.Errorf("invalid clamd address %q: %w", s, err)
+	}
+	return &ClamdScanner{Network: "tcp", Address: s}, nil
+}
+
+// Scan streams r to clamd.
+func (c *ClamdScanner) Scan(r io.Reader) (string, error) {
+	conn, err := net.Dial(c.Network, c.Address)
+	if err != nil {
+		return "", fmt.Errorf("error connecting to clamd: %w", err)
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return "", fmt.Errorf("error sending to clamd: %w", err)
+	}
+	buf := make([]byte, clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			var size [4]byte
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			w.Write(size[:])
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return "", fmt.Errorf("error sending to clamd: %w", werr)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("error reading file to scan: %w", err)
+		}
+	}
+	w.Write([]byte{0, 0, 0, 0})
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("error sending to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", fmt.Errorf("error reading clamd reply: %w", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply parses a reply such as "stream: OK" or "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd error: %s", strings.TrimSuffix(result, " ERROR"))
+}
+
+// scanBackend stages files written until scanned clean, otherwise delegating to the wrapped Backend.
+// Files which aren't clean, or couldn't be scanned, are moved to the quarantine directory.
+type scanBackend struct {
+	Backend
+	scanner    Scanner
+	quarantine string // local directory
+	user       string
+	onEvent    func(Event)
+	seq        uint64
+
+	mu     sync.Mutex
+	staged map[string]string // staging path of files being written
+}
+
+// NewScanBackend returns a Backend scanning files written to backend by user with scanner.
+// Infected files are moved to the local directory quarantine, and every verdict is
+// reported to onEvent.
+func NewScanBackend(backend Backend, scanner Scanner, quarantine, user string, onEvent func(Event)) (Backend, error) {
+	if err := os.MkdirAll(quarantine, 0700); err != nil {
+		return nil, fmt.Errorf("error creating quarantine directory: %w", err)
+	}
+	if err := mkdirAll(backend, scanHeldDir); err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %w", err)
+	}
+	infos, err := backend.Readdir(scanDir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing unscanned files: %w", err)
+	}
+	for _, info := range infos {
+		if info.Name() == scanHeldName {
+			continue
+		}
+		if err := removeAll(backend, scanDir+"/"+info.Name()); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error removing unscanned files: %w", err)
+		}
+	}
+	return &scanBackend{
+		Backend:    backend,
+		scanner:    scanner,
+		quarantine: quarantine,
+		user:       user,
+		onEvent:    onEvent,
+		staged:     map[string]string{},
+	}, nil
+}
+
+// scanned reports whether files written to p are scanned: those in the
+// hidden stores of other backends are not.
+func scanned(p string) bool {
+	return !hasPathComponent(p, trashDirName) && !hasPathComponent(p, versionsDirName) && !hasPathComponent(p, dedupDirName)
+}
+
+func isScanPath(p string) bool {
+	return hasPathComponent(p, scanDirName)
+}
+
+func scanHidden(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: syscall.ENOENT}
+}
+
+// stagedPath returns the staging path of p if being written, otherwise p.
+func (b *scanBackend) stagedPath(p string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if staged, ok := b.staged[cleanPath(p)]; ok {
+		return staged
+	}
+	return p
+}
+
+func (b *scanBackend) OpenFile(p string, flags int, perm os.FileMode) (File, error) {
+	if isScanPath(p) {
+		return nil, scanHidden("open", p)
+	}
+	if flags&(os.O_WRONLY|os.O_RDWR) == 0 || !scanned(p) {
+		return b.Backend.OpenFile(p, flags, perm)
+	}
+
+	info, err := b.Backend.Stat(p)
+	switch {
+	case os.IsNotExist(err) && flags&os.O_CREATE == 0:
+		return nil, err
+	case err == nil && flags&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: p, Err: syscall.EEXIST}
+	case err == nil && !info.Mode().IsRegular():
+		return b.Backend.OpenFile(p, flags, perm)
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+	// the parent directory must exist, as for writing p directly
+	if dir, err := b.Backend.Stat(path.Dir(cleanPath(p))); err != nil {
+		return nil, err
+	} else if !dir.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: p, Err: syscall.ENOTDIR}
+	}
+
+	staged := fmt.Sprintf("%s/%d", scanDir, atomic.AddUint64(&b.seq, 1))
+	if err == nil && flags&os.O_TRUNC == 0 {
+		// modified in place, so the rest of the file is scanned as well
+		if err := copyFile(b.Backend, p, staged); err != nil {
+			return nil, &os.PathError{Op: "stage", Path: p, Err: err}
+		}
+	}
+	if err == nil {
+		perm = info.Mode().Perm()
+	}
+	f, err := b.Backend.OpenFile(staged, os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "stage", Path: p, Err: err}
+	}
+	b.mu.Lock()
+	b.staged[cleanPath(p)] = staged
+	b.mu.Unlock()
+	return &scanFile{File: f, b: b, name: cleanPath(p), staged: staged}, nil
+}
+
+// scan scans the staged file of p, and moves it to p if clean or to the quarantine otherwise.
+func (b *scanBackend) scan(p, staged string) error {
+	event := Event{Time: time.Now(), Type: EventScanned, User: b.user, Path: p}
+	virus, err := b.scanStaged(staged)
+	if err == nil && virus == "" {
+		event.Err = b.Backend.Rename(staged, p)
+		b.report(event)
+		if event.Err != nil {
+			b.Backend.Remove(staged)
+		}
+		return event.Err
+	}
+
+	if err != nil {
+		event.Err = fmt.Errorf("error scanning: %w", err)
+	} else {
+		event.Type, event.Detail = EventInfected, virus
+	}
+	// the sequence number of the staged file keeps names of the same time apart
+	name := event.Time.UTC().Format(trashIDFormat) + "-" + path.Base(staged) + "-" + path.Base(p)
+	event.Target = filepath.Join(b.quarantine, name)
+	if qerr := b.quarantineFile(staged, event.Target); qerr != nil {
+		event.Err = fmt.Errorf("error quarantining: %w", qerr)
+		event.Target = scanHeldDir + "/" + name
+		if herr := b.Backend.Rename(staged, event.Target); herr != nil {
+			event.Target = staged
+		}
+	} else {
+		b.Backend.Remove(staged)
+	}
+	b.report(event)
+	if event.Type == EventInfected {
+		return &os.PathError{Op: "infected (" + virus + ")", Path: p, Err: syscall.EPERM}
+	}
+	return &os.PathError{Op: "scan", Path: p, Err: syscall.EIO}
+}
+
+func (b *scanBackend) scanStaged(staged string) (string, error) {
+	info, err := b.Backend.Stat(staged)
+	if err != nil {
+		return "", err
+	}
+	f, err := b.Backend.OpenFile(staged, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return b.scanner.Scan(io.NewSectionReader(f, 0, info.Size()))
+}
+
+// quarantineFile copies the staged file to the local file target.
+func (b *scanBackend) quarantineFile(staged, target string) error {
+	info, err := b.Backend.Stat(staged)
+	if err != nil {
+		return err
+	}
+	src, err := b.Backend.OpenFile(staged, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(src, 0, info.Size()))
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(target)
+	}
+	return err
+}
+
+func (b *scanBackend) report(event Event) {
+	if b.onEvent != nil {
+		b.onEvent(event)
+	}
+}
+
+func (b *scanBackend) Stat(p string) (os.FileInfo, error) {
+	if isScanPath(p) {
+		return nil, scanHidden("stat", p)
+	}
+	return b.Backend.Stat(p)
+}
+
+func (b *scanBackend) Lstat(p string) (os.FileInfo, error) {
+	if isScanPath(p) {
+		return nil, scanHidden("lstat", p)
+	}
+	return b.Backend.Lstat(p)
+}
+
+func (b *scanBackend) Readdir(dirPath string) ([]os.FileInfo, error) {
+	if isScanPath(dirPath) {
+		return nil, scanHidden("readdir", dirPath)
+	}
+	infos, err := b.Backend.Readdir(dirPath)
+	visible := infos[:0]
+	for _, info := range infos {
+		if info.Name() != scanDirName {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+func (b *scanBackend) Rename(from, to string) error {
+	if isScanPath(from) {
+		return scanHidden("rename", from)
+	}
+	if isScanPath(to) {
+		return scanHidden("rename", to)
+	}
+	return b.Backend.Rename(from, to)
+}
+
+func (b *scanBackend) Remove(p string) error {
+	if isScanPath(p) {
+		return scanHidden("remove", p)
+	}
+	return b.Backend.Remove(p)
+}
+
+func (b *scanBackend) Mkdir(p string, perm os.FileMode) error {
+	if isScanPath(p) {
+		return &os.PathError{Op: "mkdir", Path: p, Err: syscall.EPERM}
+	}
+	return b.Backend.Mkdir(p, perm)
+}
+
+func (b *scanBackend) Link(oldname, newname string) error {
+	if isScanPath(oldname) {
+		return scanHidden("link", oldname)
+	}
+	if isScanPath(newname) {
+		return scanHidden("link", newname)
+	}
+	return b.Backend.Link(oldname, newname)
+}
+
+func (b *scanBackend) Symlink(oldname, newname string) error {
+	if isScanPath(oldname) {
+		return &os.PathError{Op: "symlink", Path: oldname, Err: syscall.EPERM}
+	}
+	if isScanPath(newname) {
+		return scanHidden("symlink", newname)
+	}
+	return b.Backend.Symlink(oldname, newname)
+}
+
+func (b *scanBackend) Readlink(p string) (string, error) {
+	if isScanPath(p) {
+		return "", scanHidden("readlink", p)
+	}
+	return b.Backend.Readlink(p)
+}
+
+// Chmod applies to the staged file of p while being written, as clients may
+// set the permissions of a file before closing it.
+func (b *scanBackend) Chmod(p string, mode os.FileMode) error {
+	if isScanPath(p) {
+		return scanHidden("chmod", p)
+	}
+	return b.Backend.Chmod(b.stagedPath(p), mode)
+}
+
+// Chtimes applies to the staged file of p while being written, as clients may
+// set the times of a file before closing it.
+func (b *scanBackend) Chtimes(p string, atime, mtime time.Time) error {
+	if isScanPath(p) {
+		return scanHidden("chtimes", p)
+	}
+	return b.Backend.Chtimes(b.stagedPath(p), atime, mtime)
+}
+
+// scanFile is a staged file, scanned when closed.
+type scanFile struct {
+	File
+	b      *scanBackend
+	name   string
+	staged string
+	closed int32
+}
+
+func (f *scanFile) TransferError(err error) {
+	transferError(f.File, err)
+}
+
+func (f *scanFile) Close() error {
+	if !atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		return os.ErrClosed
+	}
+	f.b.mu.Lock()
+	if f.b.staged[f.name] == f.staged {
+		delete(f.b.staged, f.name)
+	}
+	f.b.mu.Unlock()
+
+	if err := f.File.Close(); err != nil {
+		f.b.Backend.Remove(f.staged)
+		return err
+	}
+	return f.b.scan(f.name, f.staged)
+}
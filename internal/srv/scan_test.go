@@ -0,0 +1,229 @@
+package srv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeClamd serves the INSTREAM command on l, finding "EICAR" in streams.
+func fakeClamd(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+				conn.Write([]byte("UNKNOWN COMMAND\x00"))
+				return
+			}
+			var data []byte
+			for {
+				var size uint32
+				if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+					return
+				}
+				if size == 0 {
+					break
+				}
+				chunk := make([]byte, size)
+				if _, err := io.ReadFull(r, chunk); err != nil {
+					return
+				}
+				data = append(data, chunk...)
+			}
+			if bytes.Contains(data, []byte("EICAR")) {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+		}()
+	}
+}
+
+func TestScanBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("unix", filepath.Join(dir, "clamd.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeClamd(l)
+
+	scanner, err := ParseClamdAddress("unix:" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarantine := filepath.Join(dir, "quarantine")
+	var events []Event
+	b, err := NewScanBackend(NewMemBackend(0), scanner, quarantine, "u", func(e Event) { events = append(events, e) })
+	if err != nil {
+		t.Fatalf("NewScanBackend() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		content   string
+		scanner   Scanner
+		wantEvent string
+		wantErr   bool
+	}{
+		{name: "clean", content: "hello", wantEvent: EventScanned},
+		{name: "infected", content: "X5O!P%@AP EICAR", wantEvent: EventInfected, wantErr: true},
+		{name: "scanner down", content: "hello", scanner: &ClamdScanner{Network: "unix", Address: filepath.Join(dir, "none")}, wantEvent: EventScanned, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events = nil
+			b.(*scanBackend).scanner = scanner
+			if tt.scanner != nil {
+				b.(*scanBackend).scanner = tt.scanner
+			}
+			f, err := b.OpenFile("/upload", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt([]byte(tt.content), 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.Stat("/upload"); !os.IsNotExist(err) {
+				t.Errorf("Stat() before scan error = %v, want not exist", err)
+			}
+			if infos, _ := b.Readdir("/"); len(infos) != 0 {
+				t.Errorf("Readdir() before scan = %v, want empty", infos)
+			}
+			err = f.Close()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Close() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(events) != 1 || events[0].Type != tt.wantEvent {
+				t.Fatalf("events = %+v, want one %s event", events, tt.wantEvent)
+			}
+			if tt.wantErr {
+				if _, err := b.Stat("/upload"); !os.IsNotExist(err) {
+					t.Errorf("Stat() of refused upload error = %v, want not exist", err)
+				}
+				if data, err := ioutil.ReadFile(events[0].Target); err != nil || string(data) != tt.content {
+					t.Errorf("quarantined %q, %v, want %q", data, err, tt.content)
+				}
+				return
+			}
+			if got := readMemFile(t, b, "/upload"); got != tt.content {
+				t.Errorf("read %q, want %q", got, tt.content)
+			}
+			if err := b.Remove("/upload"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// infectedScanner finds malware in every file.
+type infectedScanner struct{}
+
+func (infectedScanner) Scan(r io.Reader) (string, error) {
+	return "Eicar-Test-Signature", nil
+}
+
+func TestScanBackend_Quarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inner := NewMemBackend(0)
+	var events []Event
+	b, err := NewScanBackend(inner, infectedScanner{}, dir, "u", func(e Event) { events = append(events, e) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(content string) {
+		t.Helper()
+		f, err := b.OpenFile("/upload", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err == nil {
+			t.Fatal("Close() of infected upload succeeded")
+		}
+	}
+
+	// uploads of the same name at the same time are both kept
+	upload("first")
+	upload("second")
+	if len(events) != 2 || events[0].Target == events[1].Target {
+		t.Fatalf("events = %+v, want two distinct targets", events)
+	}
+	for i, want := range []string{"first", "second"} {
+		if data, err := ioutil.ReadFile(events[i].Target); err != nil || string(data) != want {
+			t.Errorf("quarantined %q, %v, want %q", data, err, want)
+		}
+	}
+
+	// when the quarantine can't be written to, the file is held in the backend
+	events = nil
+	b.(*scanBackend).quarantine = filepath.Join(dir, "missing")
+	upload("third")
+	if len(events) != 1 || events[0].Err == nil {
+		t.Fatalf("events = %+v, want one event with an error", events)
+	}
+	if _, err := NewScanBackend(inner, infectedScanner{}, dir, "u", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, inner, events[0].Target); got != "third" {
+		t.Errorf("held %q after restart, want %q", got, "third")
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply     string
+		wantVirus string
+		wantErr   bool
+	}{
+		{reply: "stream: OK"},
+		{reply: "stream: Win.Test.EICAR_HDB-1 FOUND", wantVirus: "Win.Test.EICAR_HDB-1"},
+		{reply: "INSTREAM size limit exceeded. ERROR", wantErr: true},
+	}
+	for _, tt := range tests {
+		virus, err := parseClamdReply(tt.reply)
+		if virus != tt.wantVirus || (err != nil) != tt.wantErr {
+			t.Errorf("parseClamdReply(%q) = %q, %v, want %q, error %v", tt.reply, virus, err, tt.wantVirus, tt.wantErr)
+		}
+	}
+}
+
+func TestScanBackend_TransferError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inner := &transferErrorBackend{Backend: NewMemBackend(0)}
+	b, err := NewScanBackend(inner, infectedScanner{}, dir, "u", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := b.OpenFile("/upload", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	checkTransferError(t, f, inner)
+}
@@ -0,0 +1,183 @@
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// session is the SSH connection of an authenticated user.
+type session struct {
+	bytes      int64 // transferred, first for alignment of atomic operations
+	files      int64 // open
+	active     int64 // unix nanoseconds of the last packet from the client
+	id         string
+	user       string
+	remoteAddr string
+	start      time.Time
+	conn       ssh.Conn
+
+	mu  sync.Mutex // guards cut
+	cut error      // reason the server closed the session
+}
+
+// SessionInfo describes an active session.
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	Start      time.Time `json:"start"`
+	Bytes      int64     `json:"bytes"` // read and written
+}
+
+// add counts n bytes transferred in the session.
+func (s *session) add(n int64) {
+	if s != nil && n > 0 {
+		atomic.AddInt64(&s.bytes, n)
+	}
+}
+
+// opened counts a file opened in the session until closed.
+func (s *session) opened() {
+	if s != nil {
+		atomic.AddInt64(&s.files, 1)
+	}
+}
+
+func (s *session) closed() {
+	if s != nil {
+		atomic.AddInt64(&s.files, -1)
+	}
+}
+
+// busy reports whether files are open in the session, being transferred.
+func (s *session) busy() bool {
+	return s != nil && atomic.LoadInt64(&s.files) > 0
+}
+
+func (s *session) info() SessionInfo {
+	return SessionInfo{ID: s.id, User: s.user, RemoteAddr: s.remoteAddr, Start: s.start, Bytes: atomic.LoadInt64(&s.bytes)}
+}
+
+// openSession tracks the session of conn until closeSession, unless the user
+// has the maximum number of sessions open.
+func (s *Server) openSession(conn ssh.Conn) (*session, error) {
+	sess := &session{
+		id:         sessionID(conn.SessionID()),
+		user:       conn.User(),
+		remoteAddr: conn.RemoteAddr().String(),
+		start:      time.Now(),
+		conn:       conn,
+	}
+	sess.touch()
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if err := s.sessionsLimited(sess.user); err != nil {
+		return nil, err
+	}
+	if s.sessions == nil {
+		s.sessions = map[string]*session{}
+	}
+	s.sessions[sess.id] = sess
+	return sess, nil
+}
+
+// admitSession returns the error rejecting a new session of user by the
+// ConnectionLimits, if any.
+func (s *Server) admitSession(user string) error {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	return s.sessionsLimited(user)
+}
+
+// sessionsLimited returns the error rejecting a new session of user, if any.
+// s.sessionsMu must be held.
+func (s *Server) sessionsLimited(user string) error {
+	max := s.connLimits.MaxSessionsPerUser
+	if max <= 0 {
+		return nil
+	}
+	open := 0
+	for _, sess := range s.sessions {
+		if sess.user == user {
+			open++
+		}
+	}
+	if open >= max {
+		return connRejected{rejectMaxSessionsPerUser, max}
+	}
+	return nil
+}
+
+func (s *Server) closeSession(sess *session) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	delete(s.sessions, sess.id)
+}
+
+// Sessions returns the active sessions in the order they were opened.
+func (s *Server) Sessions() []SessionInfo {
+	s.sessionsMu.Lock()
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		infos = append(infos, sess.info())
+	}
+	s.sessionsMu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+	return infos
+}
+
+// close closes the connection of the session, cut for the reason err.
+func (s *session) close(err error) error {
+	s.mu.Lock()
+	if s.cut == nil {
+		s.cut = err
+	}
+	s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// cutBy returns the reason the session was closed by close, if it was.
+func (s *session) cutBy() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cut
+}
+
+// CloseSession terminates the active session with the ID id.
+func (s *Server) CloseSession(id string) error {
+	return s.cutSession(id, errors.New("closed by admin"))
+}
+
+// cutSession terminates the active session with the ID id, cut for the
+// reason err.
+func (s *Server) cutSession(id string, err error) error {
+	s.sessionsMu.Lock()
+	sess := s.sessions[id]
+	s.sessionsMu.Unlock()
+	if sess == nil {
+		return fmt.Errorf("no session %q", id)
+	}
+	s.logger.Info("closing session", "user", sess.user, "session", sess.id, "remote_addr", sess.remoteAddr, "reason", err)
+	return sess.close(err)
+}
+
+// CloseRemovedSessions terminates the sessions of users no longer allowed
+// to log in, returning the number of sessions closed.
+func (s *Server) CloseRemovedSessions() int {
+	closed := 0
+	for _, sess := range s.Sessions() {
+		if _, ok := s.user(sess.User); ok {
+			continue
+		}
+		if err := s.cutSession(sess.ID, errors.New("user removed")); err == nil {
+			closed++
+		}
+	}
+	return closed
+}
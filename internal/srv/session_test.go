@@ -0,0 +1,78 @@
+package srv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestServer_CloseRemovedSessions(t *testing.T) {
+	s := &Server{}
+	s.SetUsers([]User{{Name: "alice"}, {Name: "bobby"}})
+	alice := &fakeSSHConn{user: "alice", id: []byte{1}}
+	bobby := &fakeSSHConn{user: "bobby", id: []byte{2}}
+	s.openSession(alice)
+	removed, err := s.openSession(bobby)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetUsers([]User{{Name: "alice", ReadOnly: true}})
+	if u, ok := s.user("alice"); !ok || !u.ReadOnly {
+		t.Errorf("user(alice) = %+v, %v, want the new settings", u, ok)
+	}
+	if _, ok := s.user("bobby"); ok {
+		t.Error("user(bobby) found after removal")
+	}
+	if n := s.CloseRemovedSessions(); n != 1 {
+		t.Errorf("CloseRemovedSessions() = %d, want 1", n)
+	}
+	if alice.closed || !bobby.closed {
+		t.Errorf("closed alice = %v, bobby = %v, want only bobby", alice.closed, bobby.closed)
+	}
+	if err := removed.cutBy(); err == nil || err.Error() != "user removed" {
+		t.Errorf("cutBy() = %v, want user removed", err)
+	}
+}
+
+func TestServer_openSession_MaxSessionsPerUser(t *testing.T) {
+	s := &Server{}
+	s.SetConnectionLimits(ConnectionLimits{MaxSessionsPerUser: 2})
+	for i, want := range []bool{true, true, false} {
+		_, err := s.openSession(&fakeSSHConn{user: "alice", id: []byte{byte(i)}})
+		if (err == nil) != want {
+			t.Errorf("openSession() %d error = %v, want allowed %v", i, err, want)
+		}
+	}
+	if _, err := s.openSession(&fakeSSHConn{user: "bobby", id: []byte{9}}); err != nil {
+		t.Errorf("openSession() of another user error = %v", err)
+	}
+	if err := s.admitSession("alice"); err == nil || err.Error() != "connection rejected (max_sessions_per_user 2)" {
+		t.Errorf("admitSession() error = %v, want max_sessions_per_user", err)
+	}
+}
+
+func TestServer_passwordCallback_MaxSessionsPerUser(t *testing.T) {
+	sum := sha256.Sum256([]byte("alice" + "secret"))
+	s := &Server{}
+	s.SetUsers([]User{{Name: "alice", Password: string(sum[:])}})
+	s.SetConnectionLimits(ConnectionLimits{MaxSessionsPerUser: 1})
+	metrics := NewMetrics()
+	s.SetMetrics(metrics)
+	if _, err := s.openSession(&fakeSSHConn{user: "alice", id: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.passwordCallback(&fakeSSHConn{user: "alice", id: []byte{2}}, []byte("secret")); err == nil {
+		t.Fatal("passwordCallback() over the sessions of the user succeeded")
+	}
+
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	if !strings.Contains(buf.String(), `sftp_connections_rejected_total{reason="max_sessions_per_user"} 1`) {
+		t.Errorf("metrics missing the rejection:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), `sftp_auth_attempts_total{method="password"`) {
+		t.Errorf("metrics count the rejection as an authentication attempt:\n%s", buf.String())
+	}
+}
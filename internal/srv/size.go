@@ -0,0 +1,38 @@
+package srv
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses a byte size such as "512", "64K", "10M" or "2G".
+// Suffixes are binary multiples and may be followed by "iB" or "B".
+func ParseSize(s string) (int64, error) {
+	str := strings.TrimSpace(s)
+	str = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(str), "B"), "I")
+
+	multiplier := int64(1)
+	if len(str) > 0 {
+		switch str[len(str)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			str = str[:len(str)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,27 @@
+package srv
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "512", want: 512},
+		{in: "64K", want: 64 << 10},
+		{in: "10MiB", want: 10 << 20},
+		{in: " 2gb ", want: 2 << 30},
+		{in: "8388607T", want: 8388607 << 40},
+		{in: "8388608T", wantErr: true},
+		{in: "9000000T", wantErr: true},
+		{in: "-1K", wantErr: true},
+		{in: "K", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -3,16 +3,20 @@ package srv
 import (
 	"bufio"
 	"bytes"
+	"container/list"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -23,29 +27,75 @@ import (
 )
 
 type Server struct {
-	debug          io.Writer
+	logger         *Logger
 	conf           config
-	serveChan      chan<- struct{}
 	activeConns    int64
 	onIdleCallback func(*Server)
+	onEvent        func(Event)
+	audit          *AuditLogger
+	metrics        *Metrics
+	quota          Quota
+	userStorage    func(User) (*UserStorage, error)
+
+	dailyMu sync.Mutex
+	daily   map[string]*dailyCounter // bytes transferred today by user
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*session // by ID
+
+	usersMu sync.RWMutex // guards conf.Users, replaced when reloaded
+
+	mu       sync.Mutex // guards the serving state below
+	listener net.Listener
+	closed   bool                  // by Close or Shutdown
+	conns    map[net.Conn]*session // nil session until authenticated
+	connsWg  sync.WaitGroup        // handling conns
+
+	handshakeTimeout time.Duration // 0 for none
+	connLimits       ConnectionLimits
+	ipConns          map[string]int           // open by remote IP
+	ipRates          map[string]*list.Element // of *rateBucket, by remote IP
+	ipRateOrder      *list.List               // of ipRates, most recently refilled first
+
+	idleTimeout time.Duration // 0 to serve until closed
+	idleTimer   *time.Timer   // closing when idle, while serving
+	lastActive  time.Time     // when last connected or disconnected
+}
+
+// ErrServerClosed is returned by ServeSocket after Close or Shutdown.
+var ErrServerClosed = errors.New("sftp: server closed")
+
+// shutdownPollInterval is how often Shutdown checks for finished transfers.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Quota reports the bytes stored by a user and the limit, 0 if unlimited.
+type Quota interface {
+	Usage(user string) (used, limit int64)
 }
 
 type config struct {
-	User    user
+	Users   map[string]User // by name
+	Owner   string          // name of the user the server was created with
 	KeysPEM []byte
-	DataDir string
+	Backend Backend
 
 	MaxDataBytes int64
 }
 
-type user struct {
+// User is a user allowed to log in.
+type User struct {
 	Name string
 	// Password is salted + hashed with sha256
 	Password   string
 	QuotaBytes int64
+	Home       string // directory of the backend the user is confined to, the root if empty
+	ReadOnly   bool
+	Policy     *FilePolicy
+	Limits     TransferLimits
+	Timeouts   SessionTimeouts
 }
 
-func (u user) credentialMatch(userName string, userPass []byte) bool {
+func (u User) credentialMatch(userName string, userPass []byte) bool {
 	if userName != u.Name {
 		return false
 	}
@@ -56,35 +106,37 @@ func (u user) credentialMatch(userName string, userPass []byte) bool {
 	return bytes.Equal(h.Sum(nil), []byte(u.Password))
 }
 
+// NewServer returns a Server serving the backend described by rootDirPath (see OpenBackend).
 func NewServer(rootDirPath, hostKeyPath, userName, userNameAndPasswordSha256 string, idleCb func(*Server)) (*Server, error) {
-
-	//
-	info, err := os.Stat(rootDirPath)
-	if err != nil && !os.IsNotExist(err) {
-		return nil, fmt.Errorf("error opening root dir %q: %w", rootDirPath, err)
-	}
-	if os.IsNotExist(err) {
-		return nil, fmt.Errorf("root %q does not exist", rootDirPath)
-	}
-	if !info.IsDir() {
-		return nil, fmt.Errorf("root path %q is not a directory", rootDirPath)
+	backend, err := OpenBackend(rootDirPath)
+	if err != nil {
+		return nil, err
 	}
 
+	return NewServerWithBackend(backend, hostKeyPath, userName, userNameAndPasswordSha256, idleCb)
+}
+
+// NewServerWithBackend returns a Server serving the storage backend.
+func NewServerWithBackend(backend Backend, hostKeyPath, userName, userNameAndPasswordSha256 string, idleCb func(*Server)) (*Server, error) {
+
 	keysPEM, err := readOrCreateSSHKeys(hostKeyPath)
 	if err != nil {
 		return nil, fmt.Errorf("error getting SSH keys: %w", err)
 	}
 
 	return &Server{
-		debug:          os.Stdout,
+		logger:         NewLogger(os.Stderr, LevelInfo, false),
 		onIdleCallback: idleCb,
 		conf: config{
-			User: user{
-				Name:       userName,
-				Password:   userNameAndPasswordSha256,
-				QuotaBytes: 0,
+			Users: map[string]User{
+				userName: {
+					Name:       userName,
+					Password:   userNameAndPasswordSha256,
+					QuotaBytes: 0,
+				},
 			},
-			DataDir:      rootDirPath,
+			Owner:        userName,
+			Backend:      backend,
 			KeysPEM:      keysPEM,
 			MaxDataBytes: 0,
 		},
@@ -246,12 +298,10 @@ func scanPemRSABlock(data []byte, atEOF bool) (advance int, token []byte, err er
 	return 0, nil, nil
 }
 
-func (s *Server) log(format string, a ...interface{}) {
-	if s.debug == nil {
-		return
-	}
-	_, _ = fmt.Fprintf(s.debug, format, a...)
-	_, _ = fmt.Fprintf(s.debug, "\n")
+// SetLogger sets the logger of the server, nil to discard messages.
+// It must be called before serving.
+func (s *Server) SetLogger(logger *Logger) {
+	s.logger = logger
 }
 
 func (s *Server) passwordCallback(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
@@ -260,16 +310,278 @@ func (s *Server) passwordCallback(c ssh.ConnMetadata, pass []byte) (*ssh.Permiss
 	var perm *ssh.Permissions
 	err := fmt.Errorf("password rejected for %q", c.User())
 
-	if s.conf.User.credentialMatch(c.User(), pass) {
+	var rejected error // by the connection limits
+	if u, ok := s.user(c.User()); ok && u.credentialMatch(c.User(), pass) {
 		perm = nil
 		err = nil
+		rejected = s.admitSession(u.Name)
 	}
 
 	<-constTime
-	s.log("user %q password check, err = %v\n", c.User(), err)
+	logger := s.logger.With("user", c.User(), "session", sessionID(c.SessionID()), "remote_addr", c.RemoteAddr())
+	switch {
+	case rejected != nil:
+		err = rejected
+		s.metrics.rejected(rejected)
+		logger.Warn("login rejected", "err", rejected)
+	case err != nil:
+		logger.Warn("password rejected")
+	default:
+		logger.Debug("password accepted")
+	}
+	if rejected == nil {
+		// logins rejected by the connection limits are counted as rejections only
+		s.metrics.authenticated("password", err)
+	}
+	if s.audit != nil {
+		result := "ok"
+		if err != nil {
+			result = "permission_denied"
+		}
+		s.audit.Log(AuditRecord{Type: AuditAuth, User: c.User(), Session: sessionID(c.SessionID()), RemoteAddr: c.RemoteAddr().String(), Result: result, Error: errorString(rejected)})
+	}
 	return perm, err
 }
 
+// user returns the user named name, if allowed to log in.
+func (s *Server) user(name string) (User, bool) {
+	s.usersMu.RLock()
+	defer s.usersMu.RUnlock()
+	u, ok := s.conf.Users[name]
+	return u, ok
+}
+
+// SetUsers replaces the users allowed to log in. It may be called while
+// serving: new sessions use the new users, while open sessions keep theirs.
+func (s *Server) SetUsers(users []User) {
+	byName := map[string]User{}
+	for _, u := range users {
+		byName[u.Name] = u
+	}
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	s.conf.Users = byName
+}
+
+// updateUsers replaces the users by the ones returned by update for each of them.
+func (s *Server) updateUsers(update func(User) User) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	byName := map[string]User{}
+	for name, u := range s.conf.Users {
+		byName[name] = update(u)
+	}
+	s.conf.Users = byName
+}
+
+// SetFilePolicy restricts the names and types of files the users may create.
+func (s *Server) SetFilePolicy(policy *FilePolicy) {
+	s.updateUsers(func(u User) User {
+		u.Policy = policy
+		return u
+	})
+}
+
+// SetTransferLimits limits the bytes the users may transfer.
+func (s *Server) SetTransferLimits(limits TransferLimits) {
+	s.updateUsers(func(u User) User {
+		u.Limits = limits
+		return u
+	})
+}
+
+// SetSessionTimeouts cuts the sessions of the users exceeding timeouts.
+func (s *Server) SetSessionTimeouts(timeouts SessionTimeouts) {
+	s.updateUsers(func(u User) User {
+		u.Timeouts = timeouts
+		return u
+	})
+}
+
+// SetHandshakeTimeout closes connections not authenticated within timeout.
+// It must be called before serving.
+func (s *Server) SetHandshakeTimeout(timeout time.Duration) {
+	s.handshakeTimeout = timeout
+}
+
+// SetEventHandler sets the function called with the events of the server.
+// It must be called before serving.
+func (s *Server) SetEventHandler(onEvent func(Event)) {
+	s.onEvent = onEvent
+}
+
+// SetAuditLog records the sessions and operations of clients to audit.
+// It must be called before serving.
+func (s *Server) SetAuditLog(audit *AuditLogger) {
+	s.audit = audit
+}
+
+// SetMetrics counts the activity of the server in metrics.
+// It must be called before serving.
+func (s *Server) SetMetrics(metrics *Metrics) {
+	s.metrics = metrics
+	if metrics != nil {
+		metrics.server = s
+	}
+}
+
+// SetQuota sets the quota of the users reported in metrics and the admin API.
+// It must be called before serving.
+func (s *Server) SetQuota(quota Quota) {
+	s.quota = quota
+}
+
+// UserStorage is the storage serving a user.
+type UserStorage struct {
+	Backend Backend
+	Trash   *Trash // nil if deleted files aren't kept
+	Inbox   *Inbox // nil if none is served
+}
+
+// SetUserStorage sets the function returning the storage of a user, called for
+// each session. By default users are served the directory of the backend of the
+// server named by their home.
+// It must be called before serving.
+func (s *Server) SetUserStorage(storage func(u User) (*UserStorage, error)) {
+	s.userStorage = storage
+}
+
+// storage returns the storage serving u.
+func (s *Server) storage(u User) (*UserStorage, error) {
+	if s.userStorage != nil {
+		return s.userStorage(u)
+	}
+	backend, err := NewSubBackend(s.conf.Backend, u.Home)
+	if err != nil {
+		return nil, fmt.Errorf("error opening home of %s: %w", u.Name, err)
+	}
+	return &UserStorage{Backend: backend}, nil
+}
+
+// storageOf returns the storage of the user named name.
+func (s *Server) storageOf(name string) (*UserStorage, error) {
+	u, ok := s.user(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown user %q: %w", name, os.ErrNotExist)
+	}
+	return s.storage(u)
+}
+
+// trash returns the trash of the user named name.
+func (s *Server) trash(name string) (*Trash, error) {
+	storage, err := s.storageOf(name)
+	if err != nil {
+		return nil, err
+	}
+	if storage.Trash == nil {
+		return nil, fmt.Errorf("no trash kept for %s: %w", name, os.ErrNotExist)
+	}
+	return storage.Trash, nil
+}
+
+// TrashItems returns the files deleted by the user named name, oldest first.
+func (s *Server) TrashItems(name string) ([]TrashItem, error) {
+	trash, err := s.trash(name)
+	if err != nil {
+		return nil, err
+	}
+	items, err := trash.List(name)
+	if items == nil && err == nil {
+		items = []TrashItem{}
+	}
+	return items, err
+}
+
+// RestoreTrash restores the item id deleted by the user named name.
+func (s *Server) RestoreTrash(name, id string) error {
+	trash, err := s.trash(name)
+	if err != nil {
+		return err
+	}
+	if err := trash.Restore(name, id); err != nil {
+		return err
+	}
+	s.logger.Info("restored trash item", "user", name, "id", id)
+	return nil
+}
+
+// inbox returns the inbox of the user named name.
+func (s *Server) inbox(name string) (*Inbox, error) {
+	storage, err := s.storageOf(name)
+	if err != nil {
+		return nil, err
+	}
+	if storage.Inbox == nil {
+		return nil, fmt.Errorf("no inbox served to %s: %w", name, os.ErrNotExist)
+	}
+	return storage.Inbox, nil
+}
+
+// InboxItems returns the files of the inbox of the user named name, pending first.
+func (s *Server) InboxItems(name string) ([]InboxItem, error) {
+	inbox, err := s.inbox(name)
+	if err != nil {
+		return nil, err
+	}
+	items, err := inbox.List(name)
+	if items == nil && err == nil {
+		items = []InboxItem{}
+	}
+	return items, err
+}
+
+// ProcessInbox marks the file p of the inbox of the user named name processed.
+func (s *Server) ProcessInbox(name, p string) error {
+	inbox, err := s.inbox(name)
+	if err != nil {
+		return err
+	}
+	if err := inbox.Process(name, p); err != nil {
+		return err
+	}
+	s.logger.Info("processed inbox file", "user", name, "path", p)
+	return nil
+}
+
+// UserQuota is the storage used by a user.
+type UserQuota struct {
+	User  string `json:"user"`
+	Used  int64  `json:"used_bytes"`
+	Limit int64  `json:"limit_bytes"` // 0 if unlimited
+}
+
+// QuotaUsage returns the storage used by the users, by name, none if not set with SetQuota.
+func (s *Server) QuotaUsage() []UserQuota {
+	quotas := []UserQuota{}
+	if s.quota == nil {
+		return quotas
+	}
+	s.usersMu.RLock()
+	for name := range s.conf.Users {
+		used, limit := s.quota.Usage(name)
+		quotas = append(quotas, UserQuota{User: name, Used: used, Limit: limit})
+	}
+	s.usersMu.RUnlock()
+	sort.Slice(quotas, func(i, j int) bool { return quotas[i].User < quotas[j].User })
+	return quotas
+}
+
+// newTransferLimiter returns the limiter of a new session of user, or nil if unlimited.
+func (s *Server) newTransferLimiter(u User) *transferLimiter {
+	if !u.Limits.enabled() {
+		return nil
+	}
+	s.dailyMu.Lock()
+	defer s.dailyMu.Unlock()
+	if s.daily == nil {
+		s.daily = map[string]*dailyCounter{}
+	}
+	if s.daily[u.Name] == nil {
+		s.daily[u.Name] = &dailyCounter{}
+	}
+	return &transferLimiter{limits: u.Limits, user: u.Name, home: u.Home, daily: s.daily[u.Name], onEvent: s.onEvent}
+}
+
 // NumConns returns the number of active connections
 func (s *Server) NumConns() int64 {
 	return atomic.LoadInt64(&s.activeConns)
@@ -277,6 +589,7 @@ func (s *Server) NumConns() int64 {
 
 func (s *Server) connect() {
 	_ = atomic.AddInt64(&s.activeConns, 1)
+	s.metrics.connected()
 }
 
 func (s *Server) disconnect() {
@@ -286,17 +599,128 @@ func (s *Server) disconnect() {
 	}
 }
 
-// Close stops serving
+// SetIdleTimeout closes the server when it has had no connection for timeout,
+// including since it started serving, eg. to exit when socket activated.
+// It must be called before serving.
+func (s *Server) SetIdleTimeout(timeout time.Duration) {
+	s.idleTimeout = timeout
+}
+
+// closeIfIdle closes the server if it has been idle for the idle timeout.
+// Connecting stops the timer calling it and disconnecting resets it, but it
+// may already be running.
+func (s *Server) closeIfIdle() {
+	s.mu.Lock()
+	idle := len(s.conns) == 0 && time.Since(s.lastActive) >= s.idleTimeout
+	s.mu.Unlock()
+	if idle {
+		s.logger.Info("closing when idle", "timeout", s.idleTimeout)
+		s.Close()
+	}
+}
+
+// Close stops serving, closing the listener and all connections immediately.
+// Use Shutdown to let the transfers in progress finish.
 func (s *Server) Close() error {
-	// FIXME make thread safe
-	if s.serveChan == nil {
-		return nil // not serving
+	err := s.stopListening()
+	s.closeConns(func(*session) bool { return true })
+	return err
+}
+
+// Shutdown stops serving gracefully: it closes the listener and the
+// connections without transfers in progress, then waits for the transfers of
+// the others to finish before closing them. If ctx is done first, the
+// remaining connections are closed and the error of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.stopListening()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.closeConns(func(sess *session) bool { return !sess.busy() }) > 0 {
+		select {
+		case <-ctx.Done():
+			s.closeConns(func(*session) bool { return true })
+			s.connsWg.Wait()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	s.connsWg.Wait()
+	return err
+}
+
+// stopListening closes the listener, if serving, and prevents serving again.
+func (s *Server) stopListening() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// closeConns closes the connections for which match returns true, given their
+// session or nil if not authenticated yet. It returns the number of remaining
+// connections, including the ones closed until their handling ends.
+func (s *Server) closeConns(match func(*session) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, sess := range s.conns {
+		if match(sess) {
+			conn.Close()
+		}
+	}
+	return len(s.conns)
+}
+
+// track registers conn until untracked, unless the server is closed or the
+// connection limits reject it.
+func (s *Server) track(conn net.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	if err := s.admit(remoteIP(conn.RemoteAddr()), time.Now()); err != nil {
+		return err
+	}
+	if s.conns == nil {
+		s.conns = map[net.Conn]*session{}
+	}
+	s.conns[conn] = nil
+	s.connsWg.Add(1)
+	s.lastActive = time.Now()
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
 	}
-	close(s.serveChan)
-	s.serveChan = nil
 	return nil
 }
 
+// authenticated sets the session of the tracked conn.
+func (s *Server) authenticated(conn net.Conn, sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = sess
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.release(remoteIP(conn.RemoteAddr()))
+	s.lastActive = time.Now()
+	if len(s.conns) == 0 && s.idleTimer != nil && !s.closed {
+		s.idleTimer.Reset(s.idleTimeout)
+	}
+	s.mu.Unlock()
+	s.connsWg.Done()
+}
+
 // ServeSystemdSocket serves socket from systemd (for socket activated services)
 func (s *Server) ServeSystemdSocket() error {
 	listeners, err := activation.Listeners()
@@ -310,17 +734,24 @@ func (s *Server) ServeSystemdSocket() error {
 	return s.ServeSocket(listeners[0])
 }
 
-// ServeSocket serves a listener
+// ServeSocket serves a listener until Close or Shutdown, returning
+// ErrServerClosed if called after them.
 func (s *Server) ServeSocket(listener net.Listener) error {
-
-	if s.serveChan != nil {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	if s.listener != nil {
+		s.mu.Unlock()
 		return fmt.Errorf("already serving")
 	}
-	stopChan := make(chan struct{})
-	s.serveChan = stopChan
-	defer func() {
-		stopChan = nil
-	}()
+	s.listener = listener
+	if s.idleTimeout > 0 {
+		s.lastActive = time.Now()
+		s.idleTimer = time.AfterFunc(s.idleTimeout, s.closeIfIdle)
+	}
+	s.mu.Unlock()
 
 	// wsftp for "write sftp" as in write only, i guess. I should rename this.
 	sshConfig := &ssh.ServerConfig{
@@ -329,70 +760,116 @@ func (s *Server) ServeSocket(listener net.Listener) error {
 	}
 	private, err := ssh.ParsePrivateKey([]byte(s.conf.KeysPEM))
 	if err != nil {
-		s.log("error parsing private key: %v", err)
+		s.logger.Error("error parsing private key", "err", err)
 		return err
 	}
 	sshConfig.AddHostKey(private)
 
-	go func() {
-		<-stopChan
-		listener.Close()
-	}()
-
-	serversWg := sync.WaitGroup{}
-serveLoop:
 	for {
 		nConn, err := listener.Accept()
-		select {
-		case <-stopChan:
-			break serveLoop
-		default:
-		}
 		if err != nil {
-			s.log("error accepting connection: %v", err)
+			if s.isClosed() {
+				break
+			}
+			s.logger.Error("error accepting connection", "err", err)
 			time.Sleep(time.Second)
 			continue
 		}
+		if err := s.track(nConn); err == ErrServerClosed {
+			nConn.Close()
+			break
+		} else if err != nil {
+			s.logger.Warn("rejecting connection", "remote_addr", nConn.RemoteAddr(), "err", err)
+			s.metrics.rejected(err)
+			nConn.Close()
+			continue
+		}
 
 		s.connect()
-		serversWg.Add(1)
 		go func() {
-			err = s.handleSSHConnection(nConn, sshConfig, stopChan)
+			defer s.untrack(nConn)
+			err := s.handleSSHConnection(nConn, sshConfig)
 			if err != nil {
-				s.log("error listening: %v", err)
+				s.logger.Warn("connection ended with error", "remote_addr", nConn.RemoteAddr(), "err", err)
 			}
 			s.disconnect()
-			serversWg.Done()
 		}()
 	}
 
-	serversWg.Wait()
+	s.connsWg.Wait()
 
 	return nil
 }
 
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
 // Serve endpoint (interface ip and port string)
 func (s *Server) Serve(endpoint string) error {
 
 	listener, err := net.Listen("tcp", endpoint)
 	if err != nil {
-		s.log("error listening on %q: %v", endpoint, err)
+		s.logger.Error("error listening", "endpoint", endpoint, "err", err)
 		return err
 	}
-	s.log("Listening on %v", listener.Addr())
+	s.logger.Info("listening", "addr", listener.Addr())
 
 	return s.ServeSocket(listener)
 }
 
-func (s *Server) handleSSHConnection(nConn net.Conn, sshConfig *ssh.ServerConfig, stopChan <-chan struct{}) error {
+func (s *Server) handleSSHConnection(nConn net.Conn, sshConfig *ssh.ServerConfig) error {
 
 	// Before use, a handshake must be performed on the incoming net.Conn.
+	if s.handshakeTimeout > 0 {
+		nConn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	}
 	sconn, chans, reqs, err := ssh.NewServerConn(nConn, sshConfig)
 	if err != nil {
-		s.log("error performing SSH handshake with %q: %v", nConn.RemoteAddr().String(), err)
+		s.logger.Warn("error performing SSH handshake", "remote_addr", nConn.RemoteAddr(), "err", err)
+		s.metrics.handshakeFailed()
 		return err
 	}
-	s.log("login from %q", sconn.User())
+	nConn.SetDeadline(time.Time{})
+	sess, err := s.openSession(sconn)
+	if err != nil {
+		s.logger.Warn("rejecting session", "user", sconn.User(), "remote_addr", nConn.RemoteAddr(), "err", err)
+		s.metrics.rejected(err)
+		sconn.Close()
+		return err
+	}
+	defer s.closeSession(sess)
+	defer s.metrics.session()()
+	s.authenticated(nConn, sess)
+	logger := s.logger.With("user", sess.user, "session", sess.id, "remote_addr", sess.remoteAddr)
+	logger.Info("login")
+
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	user, known := s.user(sess.user)
+	if known {
+		go sess.watch(user.Timeouts, stopWatch, func(reason error) {
+			logger.Info("cutting session", "reason", reason)
+			sess.close(reason)
+		})
+	}
+	var audit *sessionAudit
+	if s.audit != nil {
+		audit = &sessionAudit{
+			log:        s.audit,
+			user:       sess.user,
+			home:       user.Home,
+			session:    sess.id,
+			remoteAddr: sess.remoteAddr,
+			start:      sess.start,
+		}
+		audit.record(AuditSessionOpen, "", "", 0, time.Time{}, nil)
+		defer func() {
+			audit.record(AuditSessionClose, "", "", atomic.LoadInt64(&sess.bytes), audit.start, sess.cutBy())
+		}()
+	}
 
 	// The incoming Request channel must be serviced.
 	go ssh.DiscardRequests(reqs)
@@ -402,78 +879,89 @@ func (s *Server) handleSSHConnection(nConn net.Conn, sshConfig *ssh.ServerConfig
 		// Channels have a type, depending on the application level
 		// protocol intended. In the case of an SFTP session, this is "subsystem"
 		// with a payload string of "<length=4>sftp"
-		s.log("incoming channel: %s", newChannel.ChannelType())
+		logger.Debug("incoming channel", "type", newChannel.ChannelType())
 		if newChannel.ChannelType() != "session" {
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-			s.log("rejecting unknown channel type %s", newChannel.ChannelType())
+			logger.Warn("rejecting unknown channel type", "type", newChannel.ChannelType())
 			continue
 		}
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
-			s.log("error accepting channel: %v", err)
+			logger.Error("error accepting channel", "err", err)
 			return err
 		}
-		s.log("accepted channel")
+		logger.Debug("accepted channel")
 
 		// Sessions have out-of-band requests such as "shell",
 		// "pty-req" and "env".  Here we handle only the
 		// "subsystem" request.
 		go func(in <-chan *ssh.Request) {
 			for req := range in {
-				s.log("Request type: %s", req.Type)
+				logger.Debug("channel request", "type", req.Type)
 				ok := false
 				switch req.Type {
 				case "subsystem":
-					s.log("Subsystem: %s", req.Payload[4:])
+					logger.Debug("subsystem requested", "subsystem", string(req.Payload[4:]))
 					if string(req.Payload[4:]) == "sftp" {
 						ok = true
 					}
 				}
-				s.log("Rejected request of type %s", req.Type)
+				if !ok {
+					logger.Debug("rejected channel request", "type", req.Type)
+				}
 				req.Reply(ok, nil)
 			}
 		}(requests)
 
-		handler, err := s.getHandlerForUser(sconn.User())
+		handler, err := s.getHandlerForUser(sess, audit, logger)
 		if err != nil {
-			s.log("error getting handler for user %s. Terminating connection.", sconn.User())
+			logger.Error("error getting handler for user, terminating connection", "err", err)
 			break
 		}
-		server := sftp.NewRequestServer(channel, handler)
-		go func() {
-			<-stopChan
-			server.Close()
-		}()
+		server := sftp.NewRequestServer(&activityChannel{Channel: channel, session: sess}, handler)
 		if err := server.Serve(); err == io.EOF {
 			err := server.Close()
 			if err != nil {
-				s.log("error closing server on client disconnect: %v", err)
+				logger.Warn("error closing server on client disconnect", "err", err)
 			}
-			s.log("client %q disconnected", nConn.RemoteAddr())
+			logger.Info("client disconnected")
 			break
 		} else if err != nil {
-			err := server.Close()
-			if err != nil {
-				s.log("error closing server post error: %v", err)
+			if err := server.Close(); err != nil {
+				logger.Warn("error closing server post error", "err", err)
 			}
-			s.log("sftp server ended with error: %v", err)
+			logger.Warn("sftp server ended with error", "err", err)
 			break
 		}
 		break
 	}
 	err = sconn.Close()
 	if err != nil {
-		s.log("error closing SSH connection: %v", err)
+		logger.Debug("error closing SSH connection", "err", err)
 	}
 
 	return err
 }
 
-func (s *Server) getHandlerForUser(userName string) (sftp.Handlers, error) {
-	user := s.conf.User
-	s.log("Returning handler for user %s", user.Name)
+func (s *Server) getHandlerForUser(sess *session, audit *sessionAudit, logger *Logger) (sftp.Handlers, error) {
+	user, ok := s.user(sess.user)
+	if !ok {
+		return sftp.Handlers{}, fmt.Errorf("no user %q", sess.user)
+	}
+	logger.Debug("returning handler for user", "handler_user", user.Name)
 
-	handler := newUserHandler(s.conf.DataDir)
+	storage, err := s.storage(user)
+	if err != nil {
+		return sftp.Handlers{}, err
+	}
+	handler := newUserHandler(NewLogBackend(storage.Backend, logger), user.Policy)
+	handler.readOnly = user.ReadOnly
+	handler.limiter = s.newTransferLimiter(user)
+	handler.audit = audit
+	handler.logger = logger
+	handler.metrics = s.metrics
+	handler.transferred = s.metrics.user(sess.user)
+	handler.session = sess
 
 	return handler.SftpHandler(), nil
 }
@@ -1,17 +1,30 @@
 package srv
 
 import (
-	"io"
-	"io/ioutil"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"net"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
 )
 
 type FakeListener chan interface{}
 
 // Accept waits for and returns the next connection to the listener.
 func (l FakeListener) Accept() (net.Conn, error) {
-	conn := <-l
+	conn, open := <-l
+	if !open {
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Err: errors.New("use of closed network connection")}
+	}
 	if err, ok := conn.(error); ok {
 		return nil, err
 	}
@@ -54,29 +67,110 @@ func (l FakeListener) Connect(err error) net.Conn {
 		l <- err
 		return nil
 	}
-	alice, bob := net.Pipe()
+	alice, bob, err := connPair()
+	if err != nil {
+		panic(err)
+	}
 	l <- alice
 	return bob
 }
 
+// connPair returns the ends of a loopback TCP connection, buffered unlike
+// net.Pipe so that both SSH peers may send their version first.
+func connPair() (net.Conn, net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+	bob, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	alice, err := l.Accept()
+	if err != nil {
+		bob.Close()
+		return nil, nil, err
+	}
+	return alice, bob, nil
+}
+
 var _ net.Listener = make(FakeListener, 0)
 
+// testKeysPEM returns a host key, quicker to generate than by GenerateSSHKeysAsPEM.
+func testKeysPEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// newTestServer returns a server of backend with the user tester, password secret.
+func newTestServer(t *testing.T, backend Backend) *Server {
+	t.Helper()
+	password, _ := UserConfig{Name: "tester", Password: "secret"}.hash()
+	return &Server{conf: config{
+		Users:   map[string]User{"tester": {Name: "tester", Password: password}},
+		Owner:   "tester",
+		KeysPEM: testKeysPEM(t),
+		Backend: backend,
+	}}
+}
+
+// dialSSH logs in as tester on a connection to l.
+func dialSSH(t *testing.T, l FakeListener) *ssh.Client {
+	t.Helper()
+	conn, chans, reqs, err := ssh.NewClientConn(l.Connect(nil), "127.0.0.1:22", &ssh.ClientConfig{
+		User:            "tester",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("ssh.NewClientConn() error = %v", err)
+	}
+	return ssh.NewClient(conn, chans, reqs)
+}
+
+// dialSFTP starts an SFTP session as tester on a connection to l.
+func dialSFTP(t *testing.T, l FakeListener) (*ssh.Client, *sftp.Client) {
+	t.Helper()
+	conn := dialSSH(t, l)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("sftp.NewClient() error = %v", err)
+	}
+	return conn, client
+}
+
+// serve serves l with s until the returned channel receives the result.
+func serve(s *Server, l net.Listener) <-chan error {
+	served := make(chan error, 1)
+	go func() { served <- s.ServeSocket(l) }()
+	return served
+}
+
 func TestServer_ServeSocket(t *testing.T) {
 	type fields struct {
-		debug          io.Writer
+		logger         *Logger
 		conf           config
-		serveChan      chan<- struct{}
 		activeConns    int64
 		onIdleCallback func(*Server)
 	}
 	type args struct {
-		listener net.Listener
+		listener FakeListener
 	}
 	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		wantErr bool
+		name        string
+		fields      fields
+		args        args
+		connections int // made and closed, calling onIdleCallback
+		wantErr     bool
 	}{
 		{
 			name: "simple",
@@ -84,26 +178,218 @@ func TestServer_ServeSocket(t *testing.T) {
 				listener: make(FakeListener, 1),
 			},
 			fields: fields{
-				debug: ioutil.Discard,
 				onIdleCallback: func(s *Server) {
 					s.Close()
 				},
+				conf: newTestServer(t, NewMemBackend(0)).conf,
+			},
+			connections: 1,
+		},
+		{
+			name: "invalid host key",
+			args: args{
+				listener: make(FakeListener, 1),
+			},
+			fields: fields{
 				conf: config{},
 			},
+			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &Server{
-				debug:          tt.fields.debug,
+				logger:         tt.fields.logger,
 				conf:           tt.fields.conf,
-				serveChan:      tt.fields.serveChan,
 				activeConns:    tt.fields.activeConns,
 				onIdleCallback: tt.fields.onIdleCallback,
 			}
-			if err := s.ServeSocket(tt.args.listener); (err != nil) != tt.wantErr {
-				t.Errorf("Server.ServeSocket() error = %v, wantErr %v", err, tt.wantErr)
+			served := serve(s, tt.args.listener)
+			for i := 0; i < tt.connections; i++ {
+				dialSSH(t, tt.args.listener).Close()
+			}
+			select {
+			case err := <-served:
+				if (err != nil) != tt.wantErr {
+					t.Errorf("Server.ServeSocket() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Server.ServeSocket() did not return")
 			}
 		})
 	}
 }
+
+func TestServer_Shutdown(t *testing.T) {
+	backend := NewMemBackend(0)
+	s := newTestServer(t, backend)
+	l := make(FakeListener, 1)
+	served := serve(s, l)
+
+	idle := dialSSH(t, l)
+	busyConn, busy := dialSFTP(t, l)
+	f, err := busy.Create("/upload")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	idle.Wait() // closed without transfers
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() during shutdown error = %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown() = %v during transfer", err)
+	case <-time.After(2 * shutdownPollInterval):
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() during shutdown error = %v", err)
+	}
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown() did not return after the transfer")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("ServeSocket() error = %v", err)
+	}
+	busyConn.Wait()
+	if got := readMemFile(t, backend, "/upload"); got != "hello" {
+		t.Errorf("uploaded %q, want hello", got)
+	}
+	if err := s.ServeSocket(make(FakeListener)); err != ErrServerClosed {
+		t.Errorf("ServeSocket() after Shutdown error = %v, want ErrServerClosed", err)
+	}
+}
+
+func TestServer_Shutdown_Deadline(t *testing.T) {
+	s := newTestServer(t, NewMemBackend(0))
+	l := make(FakeListener, 1)
+	served := serve(s, l)
+
+	conn, client := dialSFTP(t, l)
+	if _, err := client.Create("/upload"); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*shutdownPollInterval)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() error = %v, want DeadlineExceeded", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("ServeSocket() error = %v", err)
+	}
+	conn.Wait()
+	if n := s.NumConns(); n != 0 {
+		t.Errorf("NumConns() after Shutdown = %d", n)
+	}
+}
+
+func TestServer_Close_Concurrent(t *testing.T) {
+	s := newTestServer(t, NewMemBackend(0))
+	l := make(FakeListener, 1)
+	served := serve(s, l)
+	conn := dialSSH(t, l)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Close()
+		}()
+	}
+	wg.Wait()
+	if err := <-served; err != nil {
+		t.Errorf("ServeSocket() error = %v", err)
+	}
+	conn.Wait()
+}
+
+func TestServer_SetIdleTimeout(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	tests := []struct {
+		name    string
+		hold    time.Duration // connected for, 0 not to connect
+		wantMin time.Duration // serving for
+	}{
+		{"no connection since start", 0, timeout},
+		{"reset on disconnect", 2 * timeout, 3 * timeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, NewMemBackend(0))
+			s.SetIdleTimeout(timeout)
+			l := make(FakeListener, 1)
+			start := time.Now()
+			served := serve(s, l)
+			if tt.hold > 0 {
+				conn := dialSSH(t, l)
+				time.Sleep(tt.hold)
+				select {
+				case <-served:
+					t.Fatal("ServeSocket() returned while connected")
+				default:
+				}
+				conn.Close()
+			}
+			select {
+			case err := <-served:
+				if err != nil {
+					t.Errorf("ServeSocket() error = %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("ServeSocket() did not return when idle")
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantMin {
+				t.Errorf("served for %v, want at least %v", elapsed, tt.wantMin)
+			}
+		})
+	}
+}
+
+func TestServer_Home(t *testing.T) {
+	backend := NewMemBackend(0)
+	s := newTestServer(t, backend)
+	tester := s.conf.Users["tester"]
+	tester.Home = "/home/tester"
+	s.conf.Users["tester"] = tester
+	l := make(FakeListener, 1)
+	served := serve(s, l)
+
+	conn, client := dialSFTP(t, l)
+	f, err := client.Create("/../upload")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Symlink("upload", "/link"); err != nil {
+		t.Fatalf("Symlink() error = %v", err)
+	}
+	if target, err := client.ReadLink("/link"); err != nil || target != "upload" {
+		t.Errorf("ReadLink() = %q, %v, want upload", target, err)
+	}
+	conn.Close()
+	s.Close()
+	<-served
+
+	if got := readMemFile(t, backend, "/home/tester/upload"); got != "hello" {
+		t.Errorf("uploaded %q to the home, want hello", got)
+	}
+	if target, err := backend.Readlink("/home/tester/link"); err != nil || target != "/home/tester/upload" {
+		t.Errorf("Readlink() = %q, %v, want the link within the home", target, err)
+	}
+}
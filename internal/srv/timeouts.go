@@ -0,0 +1,82 @@
+package srv
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SessionTimeouts cut the sessions of a user. Timeouts of 0 don't apply.
+type SessionTimeouts struct {
+	MaxDuration time.Duration // of a session
+	Idle        time.Duration // without SFTP packets from the client
+}
+
+func (t SessionTimeouts) enabled() bool {
+	return t.MaxDuration > 0 || t.Idle > 0
+}
+
+// sessionTimeout is the reason a session was cut, recorded in the audit log
+// with the result "timeout".
+type sessionTimeout string
+
+func (e sessionTimeout) Error() string { return string(e) }
+func (e sessionTimeout) Timeout() bool { return true }
+
+// activityChannel is the channel of an SFTP session, recording in the session
+// when the client last sent packets.
+type activityChannel struct {
+	ssh.Channel
+	session *session
+}
+
+func (c *activityChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		c.session.touch()
+	}
+	return n, err
+}
+
+// touch records activity in the session.
+func (s *session) touch() {
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+}
+
+// watch calls cut once the session exceeds the timeouts, unless stop is
+// closed first.
+func (s *session) watch(timeouts SessionTimeouts, stop <-chan struct{}, cut func(error)) {
+	if !timeouts.enabled() {
+		return
+	}
+	for {
+		var wait time.Duration
+		now := time.Now()
+		if timeouts.MaxDuration > 0 {
+			wait = s.start.Add(timeouts.MaxDuration).Sub(now)
+			if wait <= 0 {
+				cut(sessionTimeout(fmt.Sprintf("session exceeded the maximum duration of %v", timeouts.MaxDuration)))
+				return
+			}
+		}
+		if timeouts.Idle > 0 {
+			left := time.Unix(0, atomic.LoadInt64(&s.active)).Add(timeouts.Idle).Sub(now)
+			if left <= 0 {
+				cut(sessionTimeout(fmt.Sprintf("session idle for %v", timeouts.Idle)))
+				return
+			}
+			if wait == 0 || left < wait {
+				wait = left
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package srv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSession_watch(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts SessionTimeouts
+		stop     bool
+		wantCut  string
+	}{
+		{"no timeouts", SessionTimeouts{}, false, ""},
+		{"max duration", SessionTimeouts{MaxDuration: 50 * time.Millisecond, Idle: time.Hour}, false, "maximum duration of 50ms"},
+		{"idle", SessionTimeouts{MaxDuration: time.Hour, Idle: 50 * time.Millisecond}, false, "idle for 50ms"},
+		{"stopped", SessionTimeouts{MaxDuration: time.Hour}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := &session{start: time.Now()}
+			sess.touch()
+			stop := make(chan struct{})
+			if tt.stop {
+				close(stop)
+			}
+			var cut error
+			done := make(chan struct{})
+			go func() {
+				sess.watch(tt.timeouts, stop, func(err error) { cut = err })
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("watch() did not return")
+			}
+			if tt.wantCut == "" && cut != nil || tt.wantCut != "" && (cut == nil || !strings.Contains(cut.Error(), tt.wantCut)) {
+				t.Errorf("cut = %v, want %q", cut, tt.wantCut)
+			}
+			if cut != nil && auditResult(cut) != "timeout" {
+				t.Errorf("auditResult(%v) = %q, want timeout", cut, auditResult(cut))
+			}
+		})
+	}
+}
+
+func TestServer_SessionTimeouts(t *testing.T) {
+	const idle = 300 * time.Millisecond
+	s := newTestServer(t, NewMemBackend(0))
+	s.SetSessionTimeouts(SessionTimeouts{Idle: idle})
+	var audit bytes.Buffer
+	s.SetAuditLog(NewAuditLogger(&audit, ""))
+	l := make(FakeListener, 1)
+	served := serve(s, l)
+
+	conn, client := dialSFTP(t, l)
+	for i := 0; i < 6; i++ { // active for longer than idle
+		time.Sleep(idle / 3)
+		if _, err := client.Getwd(); err != nil {
+			t.Fatalf("Getwd() error = %v while active", err)
+		}
+	}
+	cut := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(cut)
+	}()
+	select {
+	case <-cut:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session not closed")
+	}
+
+	s.Close()
+	<-served
+	var closed AuditRecord
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var rec AuditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Type == AuditSessionClose {
+			closed = rec
+		}
+	}
+	if closed.Result != "timeout" || !strings.Contains(closed.Error, "idle") {
+		t.Errorf("session_close = %+v, want idle timeout", closed)
+	}
+}
+
+func TestServer_SetHandshakeTimeout(t *testing.T) {
+	s := newTestServer(t, NewMemBackend(0))
+	s.SetHandshakeTimeout(200 * time.Millisecond)
+	l := make(FakeListener, 1)
+	served := serve(s, l)
+	defer func() {
+		s.Close()
+		<-served
+	}()
+
+	conn := l.Connect(nil) // never sending the client version
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := ioutil.ReadAll(conn)
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		t.Fatal("connection not closed by the handshake timeout")
+	}
+}
@@ -2,6 +2,18 @@
 with lib;
 let
   cfg = config.services.sftp-server;
+
+  # JSON is valid YAML, so settings need no escaping
+  configFile = pkgs.writeText "sftp-server.yaml" (builtins.toJSON (recursiveUpdate {
+    listen = if cfg.socketActivate then null else "${cfg.interface}:${toString cfg.port}";
+    systemd_socket = cfg.socketActivate;
+    exit_when_idle = cfg.socketActivate;
+    host_key = cfg.hostKey;
+    root = "${cfg.dataDir}/root";
+    users = [ ({ name = cfg.user; }
+      // optionalAttrs (cfg.password != "") { password = cfg.password; }
+      // optionalAttrs (cfg.passwordHashed != "") { password_hash = cfg.passwordHashed; }) ];
+  } cfg.settings));
 in {
   options.services.sftp-server = {
     enable = mkEnableOption "sftp server";
@@ -42,6 +54,15 @@ in {
         Path to be served over sftp
       '';
     };
+    settings = mkOption {
+      description = ''
+        Further settings of the configuration file (see the README), eg.
+        `{ storage.dedup = true; limits.max_file_size = "100M"; }`.
+        Users given here replace the one of the options above.
+      '';
+      type = types.attrs;
+      default = { };
+    };
     hostKey = mkOption {
       type = types.path;
       default = "/tmp";
@@ -103,16 +124,7 @@ in {
         PrivateNetwork = optional (!cfg.socketActivate) "true";
       };
       serviceConfig.ExecStartPre = ''${pkgs.runtimeShell} -c 'mkdir ${escapeShellArg cfg.dataDir}/root' '';
-      serviceConfig.ExecStart = ''
-        ${pkgs.custompkgs.sftp-server}/bin/server \
-          ${ if cfg.socketActivate then "-socket" else "-endpoint ${escapeShellArg cfg.interface}:${toString cfg.port}" } \
-          ${ optionalString cfg.socketActivate "-exit" } \
-          -user ${escapeShellArg cfg.user} \
-          ${ optionalString (cfg.password != "") "-plaintextPassword ${escapeShellArg cfg.password}" } \
-          ${ optionalString (cfg.passwordHashed != "") "-passwordHash ${escapeShellArg cfg.passwordHashed}" } \
-          -hostkey ${escapeShellArg cfg.hostKey} \
-          -root ${escapeShellArg cfg.dataDir}/root
-      '';
+      serviceConfig.ExecStart = "${pkgs.custompkgs.sftp-server}/bin/server -config ${configFile}";
       serviceConfig.ExecStopPost = ''${pkgs.runtimeShell} -c 'mv ${escapeShellArg cfg.dataDir}/root ${escapeShellArg cfg.dataDir}/root-$RANDOM' '';
     };
   };
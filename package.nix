@@ -13,7 +13,7 @@ buildGoModule rec {
   src = ./.;
 
   # The hash of the output of the intermediate fetcher derivation
-  vendorSha256 = "0gdfamxg4b6xb2b3d9ri48d1iskj7zfiwsipbmf954mdcqdiqnqb";
+  vendorSha256 = "0lb53hcj0b3cdjrsilg6n6jcxr9810w2xzkyjrngxrh2cnx2l0nh";
 
   # runVend runs the vend command to generate the vendor directory. This is useful if your code depends on c code and go mod tidy does not include the needed sources to build. 
   runVend = false;